@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"github.com/joho/godotenv"
+	"github.com/klauspost/compress/zstd"
+)
+
+func main() {
+	inFile := flag.String("file", "", "path to an encrypted .enc file (required)")
+	outFile := flag.String("out", "", "where to write the decrypted content, - for stdout (default the file name without .enc)")
+	keyFile := flag.String("key-file", "", "file holding the key (default ENCRYPTION_KEY or ENCRYPTION_KEY_FILE)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -file <path> [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Decrypts a file stored with ENCRYPT_AT_REST. Files that were also stored compressed")
+		fmt.Fprintln(flag.CommandLine.Output(), "(.zst.enc) are decompressed as well.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *inFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The key comes from the same settings as the service, without needing the rest of its configuration
+	godotenv.Load()
+	cfg := &config.Config{
+		EncryptionKey:     os.Getenv("ENCRYPTION_KEY"),
+		EncryptionKeyFile: os.Getenv("ENCRYPTION_KEY_FILE"),
+	}
+	if *keyFile != "" {
+		cfg.EncryptionKey = ""
+		cfg.EncryptionKeyFile = *keyFile
+	}
+	key, err := cfg.LoadEncryptionKey()
+	if err != nil {
+		log.Fatalf("Unable to load the encryption key: %v", err)
+	}
+
+	in, err := os.Open(*inFile)
+	if err != nil {
+		log.Fatalf("Unable to open encrypted file: %v", err)
+	}
+	defer in.Close()
+
+	var reader io.Reader
+	reader, err = media.NewDecryptReader(in, key)
+	if err != nil {
+		log.Fatalf("Unable to decrypt %s: %v", *inFile, err)
+	}
+
+	// Undo compression that was applied before encryption
+	name := strings.TrimSuffix(*inFile, media.EncryptedExtension)
+	if media.IsCompressed(name) {
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			log.Fatalf("Unable to create decompressor: %v", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+		name = strings.TrimSuffix(name, media.CompressedExtension)
+	}
+
+	if *outFile == "" {
+		*outFile = name
+	}
+	if *outFile == *inFile {
+		log.Fatalf("Refusing to overwrite %s; pass -out", *inFile)
+	}
+
+	var out io.Writer = os.Stdout
+	if *outFile != "-" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("Unable to create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	written, err := io.Copy(out, reader)
+	if err != nil {
+		if *outFile != "-" {
+			os.Remove(*outFile)
+		}
+		log.Fatalf("Unable to decrypt %s: %v", *inFile, err)
+	}
+
+	if *outFile != "-" {
+		fmt.Printf("Decrypted %d bytes to %s\n", written, *outFile)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"code.olipicus.com/line_file_catcher/internal/cloud/drive"
+	"code.olipicus.com/line_file_catcher/internal/cloud/webdav"
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// report collects the results of each check
+type report struct {
+	failed bool
+}
+
+// pass prints a passing check
+func (r *report) pass(name, detail string) {
+	fmt.Printf("[PASS] %s: %s\n", name, detail)
+}
+
+// fail prints a failing check and marks the report as failed
+func (r *report) fail(name string, err error) {
+	fmt.Printf("[FAIL] %s: %v\n", name, err)
+	r.failed = true
+}
+
+// skip prints a check that was not run
+func (r *report) skip(name, reason string) {
+	fmt.Printf("[SKIP] %s: %s\n", name, reason)
+}
+
+func main() {
+	fmt.Println("LineFileCatcher doctor")
+	fmt.Println()
+
+	// Load configuration; exits listing the problems if it is invalid
+	cfg := config.Load()
+
+	r := &report{}
+	r.pass("Configuration", "loaded")
+
+	checkLine(r, cfg)
+	checkStorage(r, cfg)
+	checkDrive(r, cfg)
+	checkWebDAV(r, cfg)
+
+	fmt.Println()
+	if r.failed {
+		fmt.Println("Some checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All checks passed")
+}
+
+// checkLine verifies the LINE channel token by fetching the bot info
+func checkLine(r *report, cfg *config.Config) {
+	const name = "LINE channel token"
+
+	client, err := lineapi.NewClient(cfg.ChannelSecret, cfg.ChannelToken)
+	if err != nil {
+		r.fail(name, err)
+		return
+	}
+
+	info, err := client.GetBot().GetBotInfo().Do()
+	if err != nil {
+		r.fail(name, fmt.Errorf("unable to get bot info: %v", err))
+		return
+	}
+
+	r.pass(name, fmt.Sprintf("bot %q (%s)", info.DisplayName, info.BasicID))
+}
+
+// checkStorage verifies the storage directory is writable
+func checkStorage(r *report, cfg *config.Config) {
+	name := fmt.Sprintf("Storage directory %s", cfg.StorageDir)
+
+	if err := utils.CheckWritable(cfg.StorageDir); err != nil {
+		r.fail(name, err)
+		return
+	}
+
+	r.pass(name, "writable")
+}
+
+// checkDrive verifies Google Drive authentication when enabled
+func checkDrive(r *report, cfg *config.Config) {
+	const name = "Google Drive"
+
+	if !cfg.DriveEnabled {
+		r.skip(name, "disabled")
+		return
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		r.fail(name, err)
+		return
+	}
+	defer logger.Close()
+
+	// Initialize authenticates and looks up the root folder
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		r.fail(name, err)
+		return
+	}
+
+	if err := driveService.Ping(); err != nil {
+		r.fail(name, err)
+		return
+	}
+
+	r.pass(name, fmt.Sprintf("authenticated, folder %q available", cfg.DriveFolder))
+}
+
+// checkWebDAV verifies the WebDAV server and credentials when enabled
+func checkWebDAV(r *report, cfg *config.Config) {
+	const name = "WebDAV"
+
+	if !cfg.WebDAVEnabled {
+		r.skip(name, "disabled")
+		return
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		r.fail(name, err)
+		return
+	}
+	defer logger.Close()
+
+	// Initialize checks the server is reachable and creates the root folder
+	webdavService := webdav.NewWebDAVService(cfg, logger)
+	if err := webdavService.Initialize(); err != nil {
+		r.fail(name, err)
+		return
+	}
+
+	r.pass(name, fmt.Sprintf("authenticated, folder %q available", cfg.WebDAVFolder))
+}
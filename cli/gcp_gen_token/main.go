@@ -1,22 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 )
 
 func main() {
+	credentialsPath := flag.String("credentials", "./credentials.json", "path to the OAuth client credentials file")
+	tokenPath := flag.String("token", "./token.json", "path of the token file to write, or to check with -validate")
+	authCode := flag.String("code", "", "authorization code to exchange instead of prompting for it; also read from stdin when piped")
+	validate := flag.Bool("validate", false, "check that the existing token still works with Drive; exits non-zero if it needs re-authorization")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Generates the Google Drive token, prompting for the authorization code unless it is")
+		fmt.Fprintln(flag.CommandLine.Output(), "given with -code or piped to stdin, or checks an existing token with -validate.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// Read credentials from file
-	credentialsPath := "./credentials.json" // Update this path if needed
-	b, err := os.ReadFile(credentialsPath)
+	b, err := os.ReadFile(*credentialsPath)
 	if err != nil {
 		log.Fatalf("Unable to read client secret file: %v", err)
 	}
@@ -27,44 +42,110 @@ func main() {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
 
-	// Generate an authentication URL
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser:\n%v\n\n", authURL)
+	if *validate {
+		if err := validateToken(config, *tokenPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Token %s needs re-authorization: %v\n", *tokenPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Token %s is valid\n", *tokenPath)
+		return
+	}
 
-	// Get the authorization code from user input
-	var authCode string
-	fmt.Print("Enter the authorization code: ")
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	code := *authCode
+	if code == "" {
+		code, err = readAuthCode(config)
+		if err != nil {
+			log.Fatalf("Unable to read authorization code: %v", err)
+		}
 	}
 
 	// Exchange auth code for token
-	tok, err := config.Exchange(context.Background(), authCode)
+	tok, err := config.Exchange(context.Background(), code)
 	if err != nil {
 		log.Fatalf("Unable to retrieve token from web: %v", err)
 	}
 
 	// Save the token
-	tokenPath := "./token.json" // Update this path if needed
-	fmt.Printf("Saving token to: %s\n", tokenPath)
+	fmt.Printf("Saving token to: %s\n", *tokenPath)
+	if err := saveToken(*tokenPath, tok); err != nil {
+		log.Fatalf("Unable to cache oauth token: %v", err)
+	}
+
+	fmt.Println("Token successfully generated and saved!")
+}
+
+// readAuthCode reads the authorization code from stdin
+// When stdin is a terminal the user is shown the authentication URL and prompted; a piped code is read silently
+func readAuthCode(config *oauth2.Config) (string, error) {
+	info, err := os.Stdin.Stat()
+	interactive := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	if interactive {
+		// Generate an authentication URL
+		authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+		fmt.Printf("Go to the following link in your browser:\n%v\n\n", authURL)
+		fmt.Print("Enter the authorization code: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	code := strings.TrimSpace(line)
+	if code == "" {
+		if err == nil {
+			err = fmt.Errorf("empty authorization code")
+		}
+		return "", err
+	}
+	return code, nil
+}
+
+// validateToken checks that the token at tokenPath can still access Drive, refreshing it if it has expired
+// A refreshed token is saved back so the next run starts from it
+func validateToken(config *oauth2.Config, tokenPath string) error {
+	f, err := os.Open(tokenPath)
+	if err != nil {
+		return err
+	}
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("invalid token file: %v", err)
+	}
+
+	ctx := context.Background()
+	source := config.TokenSource(ctx, tok)
+	service, err := drive.NewService(ctx, option.WithTokenSource(source))
+	if err != nil {
+		return fmt.Errorf("unable to create Drive client: %v", err)
+	}
+
+	// A cheap call that needs a working token
+	if _, err := service.About.Get().Fields("user").Do(); err != nil {
+		return fmt.Errorf("drive request failed: %v", err)
+	}
 
+	if current, err := source.Token(); err == nil && current.AccessToken != tok.AccessToken {
+		if err := saveToken(tokenPath, current); err != nil {
+			return fmt.Errorf("unable to save refreshed token: %v", err)
+		}
+		fmt.Printf("Saved refreshed token to: %s\n", tokenPath)
+	}
+
+	return nil
+}
+
+// saveToken writes the token as JSON, readable only by the owner
+func saveToken(tokenPath string, tok *oauth2.Token) error {
 	// Ensure directory exists
-	tokenDir := filepath.Dir(tokenPath)
-	if err := os.MkdirAll(tokenDir, 0700); err != nil {
-		log.Fatalf("Unable to create token directory: %v", err)
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0700); err != nil {
+		return fmt.Errorf("unable to create token directory: %v", err)
 	}
 
-	// Write token to file
 	f, err := os.OpenFile(tokenPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
 	defer f.Close()
 
-	// Encode token to JSON
-	if err := json.NewEncoder(f).Encode(tok); err != nil {
-		log.Fatalf("Unable to encode token to JSON: %v", err)
-	}
-
-	fmt.Println("Token successfully generated and saved!")
+	return json.NewEncoder(f).Encode(tok)
 }
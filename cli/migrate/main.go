@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// progressBarWidth is the number of characters in the progress bar
+const progressBarWidth = 40
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Uploads stored files that are not yet in the configured cloud storage.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Files keep their folder relative to STORAGE_DIR. Completed uploads are recorded")
+		fmt.Fprintln(flag.CommandLine.Output(), "in the upload index, so an interrupted migration resumes when run again.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	workers := flag.Int("workers", 0, "number of files to upload at once (default SYNC_WORKERS)")
+	flag.Parse()
+
+	// Load configuration for the storage directory and the cloud backend
+	cfg := config.Load()
+	if !cfg.DriveEnabled && !cfg.WebDAVEnabled {
+		log.Fatal("No cloud storage is enabled; set DRIVE_ENABLED or WEBDAV_ENABLED")
+	}
+	if *workers > 0 {
+		cfg.SyncWorkers = *workers
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+	defer logger.Close()
+
+	// Initializes the cloud backend and starts the upload workers
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// Stop starting uploads on Ctrl+C; uploads already started still finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	progress, err := mediaStore.MigrateBackups(ctx, printProgress)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		logger.Close()
+		log.Fatalf("Migration failed after %d of %d files: %v", progress.Uploaded, progress.Total, err)
+	}
+
+	fmt.Printf("Migrated %d of %d files in %s (%.1f files/s, %.2f MB/s)", progress.Uploaded, progress.Total,
+		progress.Elapsed.Round(time.Second), progress.FilesPerSecond(), progress.MBPerSecond())
+	if progress.Failed > 0 {
+		fmt.Printf(", %d failed; run again to retry them\n", progress.Failed)
+		os.Exit(1)
+	}
+	fmt.Println()
+}
+
+// printProgress redraws the progress bar on stderr
+func printProgress(p media.MigrationProgress) {
+	finished := p.Uploaded + p.Failed
+
+	filled := progressBarWidth
+	if p.Total > 0 {
+		filled = finished * progressBarWidth / p.Total
+	}
+
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d files",
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), finished, p.Total)
+	if p.Failed > 0 {
+		fmt.Fprintf(os.Stderr, " (%d failed)", p.Failed)
+	}
+	fmt.Fprintf(os.Stderr, " %.1f files/s %.2f MB/s ", p.FilesPerSecond(), p.MBPerSecond())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+)
+
+func main() {
+	eventFile := flag.String("file", "", "path to a saved event file (required)")
+	webhookURL := flag.String("url", "", "webhook URL of the running service (default http://localhost:$PORT/webhook)")
+	flag.Parse()
+
+	if *eventFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration for the channel secret and port
+	cfg := config.Load()
+	if *webhookURL == "" {
+		*webhookURL = fmt.Sprintf("http://localhost:%s/webhook", cfg.Port)
+	}
+
+	// Read the saved event
+	data, err := os.ReadFile(*eventFile)
+	if err != nil {
+		log.Fatalf("Unable to read event file: %v", err)
+	}
+
+	var event handler.PersistedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Fatalf("Unable to parse event file: %v", err)
+	}
+
+	// Sign the body with the channel secret, as LINE would
+	body, signature, err := event.Resign(cfg.ChannelSecret)
+	if err != nil {
+		log.Fatalf("Unable to sign event: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, *webhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("Unable to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Line-Signature", signature)
+
+	// The service acknowledges skipped events too, so point out the settings that would skip this one
+	age := time.Since(event.ReceivedAt)
+	if cfg.MaxEventAge > 0 && age > time.Duration(cfg.MaxEventAge)*time.Second {
+		fmt.Printf("Warning: the event is %v old and MAX_EVENT_AGE is %ds, so the service will skip it\n", age.Round(time.Second), cfg.MaxEventAge)
+	}
+	if cfg.DedupWindowSeconds > 0 && age < time.Duration(cfg.DedupWindowSeconds)*time.Second {
+		fmt.Printf("Warning: the event was received within DEDUP_WINDOW_SECONDS (%ds), so its messages will be skipped as duplicates\n", cfg.DedupWindowSeconds)
+	}
+
+	fmt.Printf("Replaying event received at %s to %s\n", event.ReceivedAt.Format("2006-01-02 15:04:05"), *webhookURL)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Unable to send event: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("Response: %s %s\n", resp.Status, bytes.TrimSpace(respBody))
+
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
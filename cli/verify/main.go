@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	dir := flag.String("dir", "", "storage directory to verify (default STORAGE_DIR)")
+	verbose := flag.Bool("v", false, "print each file as it is checked")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Re-hashes the files recorded with WRITE_CHECKSUMS and reports any whose content changed.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Files that no longer exist, such as ones evicted by the storage quota, are listed separately.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Only the storage directory is needed, not the rest of the service's configuration
+	if *dir == "" {
+		godotenv.Load()
+		*dir = os.Getenv("STORAGE_DIR")
+	}
+	if *dir == "" {
+		*dir = "./storage"
+	}
+
+	var onFile func(string)
+	if *verbose {
+		onFile = func(filePath string) { fmt.Println("Checking", filePath) }
+	}
+
+	report, err := media.VerifyChecksums(*dir, onFile)
+	if err != nil {
+		log.Fatalf("Verification failed after %d files: %v", report.Verified, err)
+	}
+
+	for _, filePath := range report.Missing {
+		fmt.Println("MISSING ", filePath)
+	}
+	for _, filePath := range report.Mismatched {
+		fmt.Println("MISMATCH", filePath)
+	}
+
+	fmt.Printf("Verified %d files, %d mismatched, %d missing\n", report.Verified, len(report.Mismatched), len(report.Missing))
+	if len(report.Mismatched) > 0 {
+		os.Exit(1)
+	}
+}
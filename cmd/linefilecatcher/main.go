@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// pendingWorkTimeout bounds how long shutdown waits for pending downloads and uploads
+const pendingWorkTimeout = 2 * time.Minute
+
+func main() {
+	// Load configuration
+	cfg := config.Load()
+
+	// Set up logging
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		log.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	logger.Info("Starting LineFileCatcher service")
+	logger.Info("Channel Secret: %s", maskSecret(cfg.ChannelSecret))
+	logger.Info("Storage Directory: %s", cfg.StorageDir) // Absolute, resolved by config.Load
+	logger.Info("Debug Mode: %v", cfg.Debug)
+
+	// Create the LINE API client
+	logger.Info("Initializing LINE API client")
+	lineClient, err := lineapi.NewClient(cfg.ChannelSecret, cfg.ChannelToken)
+	if err != nil {
+		logger.Error("Failed to create LINE client: %v", err)
+		os.Exit(1)
+	}
+
+	// Create the media store
+	logger.Info("Initializing media store")
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// Create handlers
+	webhookHandler := handler.NewWebhookHandler(cfg, lineClient, mediaStore, logger)
+	healthHandler := handler.NewHealthCheckHandler(logger, mediaStore)
+	readinessHandler := handler.NewReadinessHandler(cfg, logger)
+	statsHandler := handler.NewStatsHandler(cfg, logger, mediaStore, lineClient)
+	statsHandler.TrackFollowers(webhookHandler.FollowerStats)
+	statsHandler.TrackWebhook(webhookHandler.WebhookStats)
+	backupHandler := handler.NewBackupHandler(cfg, logger, mediaStore)
+	errorsHandler := handler.NewErrorsHandler(cfg, logger, mediaStore)
+	pauseHandler := handler.NewPauseHandler(cfg, logger, mediaStore)
+	archiveHandler := handler.NewArchiveHandler(cfg, logger)
+
+	// Register routes
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", webhookHandler.HandleWebhook)
+	var health http.Handler = http.HandlerFunc(healthHandler.HandleHealthCheck)
+	if cfg.StatsAuthHealth {
+		health = handler.WithStatsAuth(cfg, logger, health)
+	}
+	mux.Handle("/health", health)
+	mux.HandleFunc("/ready", readinessHandler.HandleReady)
+	mux.Handle("/stats", handler.WithStatsAuth(cfg, logger, http.HandlerFunc(statsHandler.HandleStats)))
+	mux.HandleFunc("/stats/reset", statsHandler.HandleStatsReset)
+	mux.HandleFunc("/stats/sources", statsHandler.HandleSourceStats)
+	mux.HandleFunc("/backup/sync", backupHandler.HandleSync)
+	mux.HandleFunc("/errors", errorsHandler.HandleErrors)
+	mux.HandleFunc("/pause", pauseHandler.HandlePause)
+	mux.HandleFunc("/resume", pauseHandler.HandleResume)
+	mux.HandleFunc("/archive/", archiveHandler.HandleArchive)
+
+	// Client IPs are read from forwarding headers only when they come from a trusted proxy
+	trustedProxies, err := utils.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error("Invalid TRUSTED_PROXIES: %v", err)
+		os.Exit(1)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler.WithClientIP(trustedProxies, handler.WithLogging(logger, mux)),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(cfg.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(cfg.IdleTimeout) * time.Second,
+	}
+
+	// Start the server, over HTTPS when a certificate is configured
+	go func() {
+		var err error
+		if cfg.TLSCert != "" {
+			logger.Info("Starting HTTPS server on %s", server.Addr)
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			logger.Info("Starting server on %s", server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Server error: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Reload the hot-reloadable settings on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(cfg, logger, webhookHandler)
+		}
+	}()
+
+	// Wait for an interrupt signal
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("Shutting down, waiting for pending downloads to complete...")
+
+	// Stop accepting new requests
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Server shutdown error: %v", err)
+	}
+
+	// Let pending downloads and uploads finish, even if processing was paused
+	// Backup syncs stop at the file they are on; the files they didn't reach stay pending for the next sync
+	if mediaStore.Resume() {
+		logger.Info("Resumed paused processing to finish pending work")
+	}
+	mediaStore.StopSweeps()
+
+	done := make(chan struct{})
+	go func() {
+		mediaStore.WaitForAll()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("Server shutdown complete")
+	case <-time.After(pendingWorkTimeout):
+		logger.Warning("Gave up waiting for pending downloads and uploads after %s", pendingWorkTimeout)
+	}
+}
+
+// reloadConfig re-reads the configuration and applies the settings that can change at runtime
+// Settings that only take effect at startup are reported as needing a restart
+func reloadConfig(cfg *config.Config, logger *utils.Logger, webhookHandler *handler.WebhookHandler) {
+	logger.Info("Received SIGHUP, reloading configuration")
+
+	newCfg, err := config.Reload()
+	if err != nil {
+		logger.Error("Failed to reload configuration, keeping current settings: %v", err)
+		return
+	}
+
+	// Compare against the startup configuration, which is what is still in effect
+	// Every setting that the reload doesn't apply needs a restart
+	applied := handler.WithReloadableSettings(cfg, newCfg)
+	applied.Debug = newCfg.Debug
+	for _, name := range config.ChangedSettings(&applied, newCfg) {
+		logger.Warning("%s changed; a restart is required to apply it", name)
+	}
+
+	logger.SetDebug(newCfg.Debug)
+	webhookHandler.ApplyConfig(newCfg)
+
+	logger.Info("Configuration reloaded (debug: %v, webhook rate limit: %d/min)", newCfg.Debug, newCfg.WebhookRateLimit)
+}
+
+// maskSecret hides all but the first few characters of a secret for logging
+func maskSecret(secret string) string {
+	if len(secret) <= 3 {
+		return "***"
+	}
+	return secret[:3] + "***"
+}
@@ -6,9 +6,12 @@ toolchain go1.24.2
 
 require (
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.18.0
 	github.com/line/line-bot-sdk-go/v7 v7.21.0
 	golang.org/x/oauth2 v0.29.0
+	golang.org/x/sync v0.13.0
 	google.golang.org/api v0.230.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
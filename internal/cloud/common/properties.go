@@ -0,0 +1,27 @@
+package common
+
+import "context"
+
+// Keys of the properties attached to uploaded files
+const (
+	PropertyMessageID  = "lineMessageId"
+	PropertyUserID     = "lineUserId"
+	PropertySourceType = "lineSourceType"
+	PropertySourceID   = "lineSourceId"
+)
+
+// propertiesKey is the context key for the properties of an uploaded file
+type propertiesKey struct{}
+
+// WithFileProperties returns a context carrying properties to attach to the files uploaded with it,
+// such as the ID of the message a file came from, so they can be searched for later
+// Providers that can't store custom properties ignore them
+func WithFileProperties(ctx context.Context, properties map[string]string) context.Context {
+	return context.WithValue(ctx, propertiesKey{}, properties)
+}
+
+// FilePropertiesFromContext returns the properties set with WithFileProperties, or nil if there are none
+func FilePropertiesFromContext(ctx context.Context) map[string]string {
+	properties, _ := ctx.Value(propertiesKey{}).(map[string]string)
+	return properties
+}
@@ -0,0 +1,70 @@
+package common
+
+import "time"
+
+// BackupStats holds the statistics of a cloud storage provider
+// Durations are whole milliseconds so they can be graphed without parsing
+type BackupStats struct {
+	TotalUploaded      int64      `json:"totalUploaded"`
+	UploadCount        int        `json:"uploadCount"`
+	FailedUploads      int        `json:"failedUploads"`
+	RetryCount         int        `json:"retryCount"`
+	FirstTrySuccess    int        `json:"firstTrySuccess"` // Successful uploads that needed no retry
+	RetriedSuccess     int        `json:"retriedSuccess"`  // Successful uploads that needed at least one retry
+	FolderCreatedCount int        `json:"folderCreatedCount"`
+	AverageUploadMs    int64      `json:"averageUploadMs"`
+	LastUploadTime     *time.Time `json:"lastUploadTime,omitempty"`
+	ActiveUploads      *int64     `json:"activeUploads,omitempty"` // Only reported by providers that limit concurrent uploads
+	MaxConcurrent      *int       `json:"maxConcurrent,omitempty"`
+	SkippedDuplicates  *int       `json:"skippedDuplicates,omitempty"` // Only reported by providers that skip identical uploads
+}
+
+// NewBackupStats fills the fields every provider tracks
+func NewBackupStats(totalUploaded int64, uploadCount, failedUploads, retryCount, folderCreatedCount int,
+	averageUploadTime time.Duration, lastUploadTime time.Time) BackupStats {
+	stats := BackupStats{
+		TotalUploaded:      totalUploaded,
+		UploadCount:        uploadCount,
+		FailedUploads:      failedUploads,
+		RetryCount:         retryCount,
+		FolderCreatedCount: folderCreatedCount,
+		AverageUploadMs:    averageUploadTime.Milliseconds(),
+	}
+
+	if !lastUploadTime.IsZero() {
+		stats.LastUploadTime = &lastUploadTime
+	}
+
+	return stats
+}
+
+// Map returns the statistics in the original map layout, for existing consumers
+// It keeps averageUploadTime as a duration string next to the numeric averageUploadMs
+func (s BackupStats) Map() map[string]interface{} {
+	stats := map[string]interface{}{
+		"totalUploaded":      s.TotalUploaded,
+		"uploadCount":        s.UploadCount,
+		"failedUploads":      s.FailedUploads,
+		"retryCount":         s.RetryCount,
+		"firstTrySuccess":    s.FirstTrySuccess,
+		"retriedSuccess":     s.RetriedSuccess,
+		"folderCreatedCount": s.FolderCreatedCount,
+		"averageUploadMs":    s.AverageUploadMs,
+		"averageUploadTime":  (time.Duration(s.AverageUploadMs) * time.Millisecond).String(),
+	}
+
+	if s.LastUploadTime != nil {
+		stats["lastUploadTime"] = s.LastUploadTime.Format(time.RFC3339)
+	}
+	if s.ActiveUploads != nil {
+		stats["activeUploads"] = *s.ActiveUploads
+	}
+	if s.MaxConcurrent != nil {
+		stats["maxConcurrent"] = *s.MaxConcurrent
+	}
+	if s.SkippedDuplicates != nil {
+		stats["skippedDuplicates"] = *s.SkippedDuplicates
+	}
+
+	return stats
+}
@@ -1,20 +1,38 @@
 package common
 
+import (
+	"context"
+	"io"
+)
+
 // CloudStorage defines the interface for cloud storage providers
 type CloudStorage interface {
 	// Initialize sets up the cloud storage service
 	Initialize() error
 
 	// UploadFile uploads a local file to cloud storage
+	// Properties set on the context with WithFileProperties are attached to the file if the provider supports it
+	// Returns the file ID and error
+	UploadFile(ctx context.Context, localPath, remoteFolder string) (string, error)
+
+	// UploadStream uploads content as it is read from r, for files that aren't on local disk yet
+	// The content can only be read once, so a failed upload is not retried
+	// size is the length of the content, or -1 if unknown
 	// Returns the file ID and error
-	UploadFile(localPath, remoteFolder string) (string, error)
+	UploadStream(ctx context.Context, r io.Reader, name, remoteFolder string, size int64) (string, error)
 
 	// CreateFolder creates a folder in cloud storage if it doesn't exist
-	CreateFolder(folderPath string) (string, error)
+	CreateFolder(ctx context.Context, folderPath string) (string, error)
 
 	// GetBackupStats returns statistics about the cloud storage usage
-	GetBackupStats() map[string]interface{}
+	GetBackupStats() BackupStats
+
+	// ResetStats clears the backup statistics
+	ResetStats()
 
 	// GetFileLink returns a shareable link for a file based on its ID
 	GetFileLink(fileID string) (string, error)
+
+	// Ping checks that the cloud storage backend is reachable and authorized
+	Ping() error
 }
@@ -2,18 +2,24 @@ package drive
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"code.olipicus.com/line_file_catcher/internal/cloud/common"
 	"code.olipicus.com/line_file_catcher/internal/config"
 	"code.olipicus.com/line_file_catcher/internal/utils"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 )
@@ -23,11 +29,20 @@ type DriveService struct {
 	config      *config.Config
 	logger      *utils.Logger
 	service     *drive.Service
-	folderCache map[string]string // Cache folder ID by path
+	folderCache *folderCache            // Recently used folder IDs by path, guarded by mu
+	folderGroup singleflight.Group      // Deduplicates concurrent lookups of the same folder path
+	linkCache   *linkCache              // Recently created shareable links by file ID, nil if disabled
+	uploadSlots chan struct{}           // Semaphore limiting concurrent uploads to Drive
+	bandwidth   *utils.BandwidthLimiter // Shared by all uploads, nil when UPLOAD_MAX_BYTES_PER_SEC is unset
+	active      atomic.Int64            // Uploads currently sending data to Drive
+	mu          sync.Mutex              // Guards the folder cache
 	stats       DriveStats
-	mu          sync.Mutex
+	statsMu     sync.Mutex // Guards stats; held only to update or copy them, never during an upload
 }
 
+// defaultMaxConcurrentUploads is used when DRIVE_MAX_CONCURRENT is not configured
+const defaultMaxConcurrentUploads = 3
+
 // DriveStats stores statistics about Google Drive operations
 type DriveStats struct {
 	TotalUploaded      int64
@@ -38,14 +53,25 @@ type DriveStats struct {
 	TotalUploadTime    time.Duration
 	AverageUploadTime  time.Duration
 	FolderCreatedCount int
+	FirstTrySuccess    int // Uploads that succeeded on the first attempt
+	RetriedSuccess     int // Uploads that succeeded only after retrying
+	SkippedDuplicates  int // Uploads skipped because the folder already had an identical file
 }
 
 // NewDriveService creates a new Google Drive service
 func NewDriveService(cfg *config.Config, logger *utils.Logger) *DriveService {
+	maxConcurrent := cfg.DriveMaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentUploads
+	}
+
 	return &DriveService{
 		config:      cfg,
 		logger:      logger,
-		folderCache: make(map[string]string),
+		folderCache: newFolderCache(cfg.DriveFolderCacheSize),
+		linkCache:   newLinkCache(cfg.DriveLinkCacheSize, time.Duration(cfg.DriveLinkCacheSeconds)*time.Second),
+		uploadSlots: make(chan struct{}, maxConcurrent),
+		bandwidth:   utils.NewBandwidthLimiter(int64(cfg.UploadMaxBytesPerSec)),
 		stats:       DriveStats{},
 	}
 }
@@ -75,7 +101,15 @@ func (d *DriveService) Initialize() error {
 	// Create the Drive client
 	ctx := context.Background()
 	client := config.Client(ctx, token)
-	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+
+	// Allow overriding the API endpoint for testing
+	if apiEndpoint := d.config.DriveAPIEndpoint; apiEndpoint != "" {
+		d.logger.Info("Using custom Google Drive API endpoint: %s", apiEndpoint)
+		opts = append(opts, option.WithEndpoint(apiEndpoint))
+	}
+
+	srv, err := drive.NewService(ctx, opts...)
 	if err != nil {
 		return fmt.Errorf("unable to create Drive service: %v", err)
 	}
@@ -84,7 +118,7 @@ func (d *DriveService) Initialize() error {
 	d.logger.Info("Google Drive service initialized successfully")
 
 	// Create the root folder if needed
-	_, err = d.CreateFolder(d.config.DriveFolder)
+	_, err = d.CreateFolder(ctx, d.config.DriveFolder)
 	if err != nil {
 		return fmt.Errorf("unable to create root folder: %v", err)
 	}
@@ -121,12 +155,11 @@ func (d *DriveService) tokenFromFile(file string) (*oauth2.Token, error) {
 }
 
 // CreateFolder creates a folder in Google Drive if it doesn't exist
-func (d *DriveService) CreateFolder(folderPath string) (string, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
+// Concurrent calls for the same path share a single lookup and creation,
+// so each folder is created exactly once
+func (d *DriveService) CreateFolder(ctx context.Context, folderPath string) (string, error) {
 	// Check cache first
-	if id, ok := d.folderCache[folderPath]; ok {
+	if id, ok := d.cachedFolder(folderPath); ok {
 		return id, nil
 	}
 
@@ -149,55 +182,92 @@ func (d *DriveService) CreateFolder(folderPath string) (string, error) {
 			currentPath = currentPath + "/" + part
 		}
 
-		// Check if this folder exists in cache
-		if id, ok := d.folderCache[currentPath]; ok {
-			parentID = id
-			continue
-		}
-
-		// Search for the folder
-		query := fmt.Sprintf("name='%s' and mimeType='application/vnd.google-apps.folder' and '%s' in parents and trashed=false", part, parentID)
-		fileList, err := d.service.Files.List().Q(query).Fields("files(id, name)").Do()
+		// Look up or create the folder, sharing the work with concurrent callers for the same path
+		levelPath, levelParentID := currentPath, parentID
+		id, err, _ := d.folderGroup.Do(levelPath, func() (interface{}, error) {
+			return d.findOrCreateFolder(ctx, part, levelPath, levelParentID)
+		})
 		if err != nil {
-			return "", fmt.Errorf("unable to search for folder %s: %v", part, err)
+			return "", err
 		}
 
-		// Folder exists
-		if len(fileList.Files) > 0 {
-			folderID := fileList.Files[0].Id
-			d.folderCache[currentPath] = folderID
-			parentID = folderID
-			continue
-		}
+		parentID = id.(string)
+	}
 
-		// Folder doesn't exist, create it
-		folderMetadata := &drive.File{
-			Name:     part,
-			MimeType: "application/vnd.google-apps.folder",
-			Parents:  []string{parentID},
-		}
+	// Cache the full path as given so the next call for it returns immediately
+	d.mu.Lock()
+	d.folderCache.put(folderPath, parentID)
+	d.mu.Unlock()
 
-		folder, err := d.service.Files.Create(folderMetadata).Fields("id").Do()
-		if err != nil {
-			return "", fmt.Errorf("unable to create folder %s: %v", part, err)
-		}
+	return parentID, nil
+}
 
-		d.folderCache[currentPath] = folder.Id
-		parentID = folder.Id
-		d.stats.FolderCreatedCount++
-		d.logger.Debug("Created Google Drive folder: %s with ID: %s", part, folder.Id)
+// cachedFolder returns the cached folder ID for a path
+func (d *DriveService) cachedFolder(folderPath string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, ok := d.folderCache.get(folderPath)
+	return id, ok
+}
+
+// findOrCreateFolder returns the ID of a single folder, creating it if it doesn't exist
+// The result is cached before returning so later callers never repeat the lookup
+func (d *DriveService) findOrCreateFolder(ctx context.Context, name, folderPath, parentID string) (string, error) {
+	// Another caller may have finished creating the folder just before this one started
+	if id, ok := d.cachedFolder(folderPath); ok {
+		return id, nil
 	}
 
-	return parentID, nil
+	// Search for the folder
+	query := fmt.Sprintf("name='%s' and mimeType='application/vnd.google-apps.folder' and '%s' in parents and trashed=false", name, parentID)
+	fileList, err := d.service.Files.List().Q(query).Fields("files(id, name)").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to search for folder %s: %v", name, err)
+	}
+
+	// Folder exists
+	if len(fileList.Files) > 0 {
+		folderID := fileList.Files[0].Id
+		d.mu.Lock()
+		d.folderCache.put(folderPath, folderID)
+		d.mu.Unlock()
+		return folderID, nil
+	}
+
+	// Folder doesn't exist, create it
+	folderMetadata := &drive.File{
+		Name:     name,
+		MimeType: "application/vnd.google-apps.folder",
+		Parents:  []string{parentID},
+	}
+
+	folder, err := d.service.Files.Create(folderMetadata).Fields("id").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to create folder %s: %v", name, err)
+	}
+
+	d.mu.Lock()
+	d.folderCache.put(folderPath, folder.Id)
+	d.mu.Unlock()
+
+	d.statsMu.Lock()
+	d.stats.FolderCreatedCount++
+	d.statsMu.Unlock()
+
+	d.logger.Debug("Created Google Drive folder: %s with ID: %s", name, folder.Id)
+
+	return folder.Id, nil
 }
 
 // UploadFile uploads a file to Google Drive
-func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error) {
+// Cancelling the context aborts the upload, including any pending retries
+func (d *DriveService) UploadFile(ctx context.Context, localPath, remoteFolder string) (string, error) {
 	// Start timing the upload
 	startTime := time.Now()
 
 	// Get the folder ID
-	folderID, err := d.CreateFolder(remoteFolder)
+	folderID, err := d.CreateFolder(ctx, remoteFolder)
 	if err != nil {
 		return "", fmt.Errorf("failed to create folder for upload: %v", err)
 	}
@@ -205,10 +275,11 @@ func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error
 	// Get file metadata
 	filename := filepath.Base(localPath)
 
-	// Create file metadata
+	// Create file metadata, tagged with the message the file came from so it can be searched for
 	file := &drive.File{
-		Name:    filename,
-		Parents: []string{folderID},
+		Name:          filename,
+		Parents:       []string{folderID},
+		AppProperties: common.FilePropertiesFromContext(ctx),
 	}
 
 	// Open the local file
@@ -225,6 +296,21 @@ func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error
 	}
 	fileSize := fileInfo.Size()
 
+	// Reuse an identical file already in the folder, such as one uploaded before a re-sync or redelivery
+	if d.config.DriveSkipDuplicates {
+		existingID, err := d.findDuplicate(ctx, folderID, filename, localPath)
+		if err != nil {
+			d.logger.Warning("Unable to check Google Drive for a copy of %s, uploading anyway: %v", filename, err)
+		} else if existingID != "" {
+			d.statsMu.Lock()
+			d.stats.SkippedDuplicates++
+			d.statsMu.Unlock()
+
+			d.logger.Info("Skipped uploading %s to Google Drive, an identical file already exists (ID: %s)", filename, existingID)
+			return existingID, nil
+		}
+	}
+
 	// Upload with retry logic
 	var uploadedFile *drive.File
 	var retryCount int
@@ -232,7 +318,9 @@ func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error
 	for retryCount = 0; retryCount <= d.config.DriveRetryCount; retryCount++ {
 		if retryCount > 0 {
 			d.logger.Warning("Retrying upload for %s (attempt %d of %d)", filename, retryCount, d.config.DriveRetryCount)
+			d.statsMu.Lock()
 			d.stats.RetryCount++
+			d.statsMu.Unlock()
 
 			// Reopen file for retry
 			content.Close()
@@ -242,34 +330,47 @@ func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error
 			}
 
 			// Wait before retry with exponential backoff
-			time.Sleep(time.Duration(1<<retryCount) * time.Second)
+			select {
+			case <-time.After(time.Duration(1<<retryCount) * time.Second):
+			case <-ctx.Done():
+				return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+			}
 		}
 
 		// Create the file
-		uploadedFile, err = d.service.Files.Create(file).Media(content).Fields("id, name, size").Do()
+		uploadedFile, err = d.createFile(ctx, file, content)
 		if err == nil {
 			break
 		}
 
+		// Don't retry if the upload was cancelled
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+		}
+
 		// If we've reached the max retry count, fail
 		if retryCount == d.config.DriveRetryCount {
-			d.mu.Lock()
+			d.statsMu.Lock()
 			d.stats.FailedUploads++
-			d.mu.Unlock()
+			d.statsMu.Unlock()
 			return "", fmt.Errorf("failed to upload file after %d attempts: %v", retryCount+1, err)
 		}
 	}
 
-	// Update statistics
-	d.mu.Lock()
+	// Update statistics; the count and total time change together so the average stays consistent
+	uploadDuration := time.Since(startTime)
+	d.statsMu.Lock()
 	d.stats.UploadCount++
+	if retryCount == 0 {
+		d.stats.FirstTrySuccess++
+	} else {
+		d.stats.RetriedSuccess++
+	}
 	d.stats.TotalUploaded += fileSize
 	d.stats.LastUploadTime = time.Now()
-
-	uploadDuration := time.Since(startTime)
 	d.stats.TotalUploadTime += uploadDuration
 	d.stats.AverageUploadTime = d.stats.TotalUploadTime / time.Duration(d.stats.UploadCount)
-	d.mu.Unlock()
+	d.statsMu.Unlock()
 
 	d.logger.Info("Successfully uploaded %s to Google Drive (ID: %s, Size: %d bytes) in %v",
 		filename, uploadedFile.Id, fileSize, uploadDuration)
@@ -277,29 +378,161 @@ func (d *DriveService) UploadFile(localPath, remoteFolder string) (string, error
 	return uploadedFile.Id, nil
 }
 
-// GetBackupStats returns the current backup statistics
-func (d *DriveService) GetBackupStats() map[string]interface{} {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// UploadStream uploads content as it is read from r, without a local copy of the file
+// The content can only be read once, so a failed upload isn't retried and duplicates aren't checked for
+func (d *DriveService) UploadStream(ctx context.Context, r io.Reader, name, remoteFolder string, size int64) (string, error) {
+	// Start timing the upload
+	startTime := time.Now()
+
+	// Get the folder ID
+	folderID, err := d.CreateFolder(ctx, remoteFolder)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder for upload: %v", err)
+	}
+
+	// Create file metadata, tagged with the message the file came from so it can be searched for
+	file := &drive.File{
+		Name:          name,
+		Parents:       []string{folderID},
+		AppProperties: common.FilePropertiesFromContext(ctx),
+	}
+
+	// Count the content as it goes, since size may be unknown
+	content := &utils.CountingReader{R: r}
+	uploadedFile, err := d.createFile(ctx, file, content)
+	if err != nil {
+		d.statsMu.Lock()
+		d.stats.FailedUploads++
+		d.statsMu.Unlock()
+
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("failed to upload stream: %v", err)
+	}
+
+	// Update statistics; the count and total time change together so the average stays consistent
+	uploadDuration := time.Since(startTime)
+	d.statsMu.Lock()
+	d.stats.UploadCount++
+	d.stats.FirstTrySuccess++
+	d.stats.TotalUploaded += content.N
+	d.stats.LastUploadTime = time.Now()
+	d.stats.TotalUploadTime += uploadDuration
+	d.stats.AverageUploadTime = d.stats.TotalUploadTime / time.Duration(d.stats.UploadCount)
+	d.statsMu.Unlock()
+
+	d.logger.Info("Successfully streamed %s to Google Drive (ID: %s, Size: %d bytes) in %v",
+		name, uploadedFile.Id, content.N, uploadDuration)
+
+	return uploadedFile.Id, nil
+}
+
+// findDuplicate returns the ID of a file in a folder with the same name and MD5 checksum as a local file
+// Returns an empty ID if there is none
+func (d *DriveService) findDuplicate(ctx context.Context, folderID, filename, localPath string) (string, error) {
+	checksum, err := fileMD5(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	query := fmt.Sprintf("name='%s' and mimeType!='application/vnd.google-apps.folder' and '%s' in parents and trashed=false",
+		escapeQuery(filename), folderID)
+	fileList, err := d.service.Files.List().Q(query).Fields("files(id, name, md5Checksum)").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to search for file %s: %v", filename, err)
+	}
+
+	for _, file := range fileList.Files {
+		if file.Md5Checksum == checksum {
+			return file.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// fileMD5 returns the hex-encoded MD5 checksum of a file, as Drive reports it
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open file for checksum: %v", err)
+	}
+	defer file.Close()
 
-	stats := map[string]interface{}{
-		"totalUploaded":      d.stats.TotalUploaded,
-		"uploadCount":        d.stats.UploadCount,
-		"failedUploads":      d.stats.FailedUploads,
-		"retryCount":         d.stats.RetryCount,
-		"folderCreatedCount": d.stats.FolderCreatedCount,
-		"averageUploadTime":  d.stats.AverageUploadTime.String(),
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("unable to read file for checksum: %v", err)
 	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// escapeQuery escapes a value for use in a quoted string of a Drive search query
+func escapeQuery(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// createFile uploads a file's content once Drive has a free upload slot
+// The slot is held only while data is being sent, not while waiting to retry
+// The content is read no faster than UPLOAD_MAX_BYTES_PER_SEC allows across all uploads
+func (d *DriveService) createFile(ctx context.Context, file *drive.File, content io.Reader) (*drive.File, error) {
+	select {
+	case d.uploadSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	d.active.Add(1)
+	defer func() {
+		d.active.Add(-1)
+		<-d.uploadSlots
+	}()
+
+	return d.service.Files.Create(file).Media(d.bandwidth.Reader(ctx, content)).Fields("id, name, size").Context(ctx).Do()
+}
 
-	if !d.stats.LastUploadTime.IsZero() {
-		stats["lastUploadTime"] = d.stats.LastUploadTime.Format(time.RFC3339)
+// Stats returns a consistent copy of the backup statistics
+func (d *DriveService) Stats() DriveStats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+
+	return d.stats
+}
+
+// GetBackupStats returns the current backup statistics
+// It only waits for other statistics updates, not for uploads or folder lookups in progress
+func (d *DriveService) GetBackupStats() common.BackupStats {
+	snapshot := d.Stats()
+
+	stats := common.NewBackupStats(snapshot.TotalUploaded, snapshot.UploadCount, snapshot.FailedUploads,
+		snapshot.RetryCount, snapshot.FolderCreatedCount, snapshot.AverageUploadTime, snapshot.LastUploadTime)
+	stats.FirstTrySuccess = snapshot.FirstTrySuccess
+	stats.RetriedSuccess = snapshot.RetriedSuccess
+
+	active := d.active.Load()
+	maxConcurrent := cap(d.uploadSlots)
+	stats.ActiveUploads = &active
+	stats.MaxConcurrent = &maxConcurrent
+	if d.config.DriveSkipDuplicates {
+		stats.SkippedDuplicates = &snapshot.SkippedDuplicates
 	}
 
 	return stats
 }
 
+// ResetStats clears the backup statistics
+func (d *DriveService) ResetStats() {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+
+	d.stats = DriveStats{}
+}
+
 // GetFileLink returns a shareable link for a file based on its ID
+// Links created within DRIVE_LINK_CACHE_SECONDS are returned from the cache without calling the Drive API
 func (d *DriveService) GetFileLink(fileID string) (string, error) {
+	if link, ok := d.linkCache.get(fileID, utils.Now()); ok {
+		return link, nil
+	}
+
 	// Check if file exists and get permissions
 	file, err := d.service.Files.Get(fileID).Fields("id", "name").Do()
 	if err != nil {
@@ -322,5 +555,18 @@ func (d *DriveService) GetFileLink(fileID string) (string, error) {
 	link := fmt.Sprintf("https://drive.google.com/file/d/%s/view", fileID)
 
 	d.logger.Info("Created shareable link for %s: %s", file.Name, link)
+	d.linkCache.put(fileID, link, utils.Now())
 	return link, nil
 }
+
+// Ping checks that Google Drive is reachable and the token is still valid
+func (d *DriveService) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := d.service.About.Get().Fields("user").Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to reach Google Drive: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package drive
+
+import "container/list"
+
+// defaultFolderCacheSize is used when DRIVE_FOLDER_CACHE_SIZE is not configured
+const defaultFolderCacheSize = 1000
+
+// folderCache is a least-recently-used cache of folder IDs by path
+// Evicting a folder is safe since it still exists on Drive and is looked up again when needed
+// It is not safe for concurrent use; DriveService guards it with its mutex
+type folderCache struct {
+	maxEntries int
+	order      *list.List               // Most recently used at the front
+	entries    map[string]*list.Element // Elements hold a *folderCacheEntry
+}
+
+// folderCacheEntry is a cached folder path and its ID
+type folderCacheEntry struct {
+	path string
+	id   string
+}
+
+// newFolderCache creates a folder cache holding at most maxEntries folders
+func newFolderCache(maxEntries int) *folderCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultFolderCacheSize
+	}
+
+	return &folderCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached ID for a folder path, marking it as recently used
+func (c *folderCache) get(path string) (string, bool) {
+	elem, ok := c.entries[path]
+	if !ok {
+		return "", false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*folderCacheEntry).id, true
+}
+
+// put caches the ID for a folder path, evicting the least recently used folder if the cache is full
+func (c *folderCache) put(path, id string) {
+	if elem, ok := c.entries[path]; ok {
+		elem.Value.(*folderCacheEntry).id = id
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[path] = c.order.PushFront(&folderCacheEntry{path: path, id: id})
+
+	if c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*folderCacheEntry).path)
+	}
+}
@@ -0,0 +1,82 @@
+package drive
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestFolderCacheEvictsLeastRecentlyUsed tests that filling the cache past its size evicts the oldest folders first
+func TestFolderCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newFolderCache(3)
+
+	for _, path := range []string{"a", "b", "c", "d", "e"} {
+		cache.put(path, "id-"+path)
+	}
+
+	if cache.order.Len() != 3 || len(cache.entries) != 3 {
+		t.Fatalf("Expected 3 cached folders, got %d in the list and %d in the map", cache.order.Len(), len(cache.entries))
+	}
+	for _, path := range []string{"a", "b"} {
+		if _, ok := cache.get(path); ok {
+			t.Errorf("Expected %s to be evicted", path)
+		}
+	}
+	for _, path := range []string{"c", "d", "e"} {
+		if id, ok := cache.get(path); !ok || id != "id-"+path {
+			t.Errorf("Expected %s to be cached as id-%s, got %q, %v", path, path, id, ok)
+		}
+	}
+}
+
+// TestFolderCacheGetRefreshesRecency tests that a folder that was just looked up isn't the next one evicted
+func TestFolderCacheGetRefreshesRecency(t *testing.T) {
+	cache := newFolderCache(2)
+
+	cache.put("a", "id-a")
+	cache.put("b", "id-b")
+	if _, ok := cache.get("a"); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	cache.put("c", "id-c")
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("Expected b to be evicted as the least recently used folder")
+	}
+	if id, ok := cache.get("a"); !ok || id != "id-a" {
+		t.Errorf("Expected a to stay cached after being looked up, got %q, %v", id, ok)
+	}
+
+	// Updating a folder's ID refreshes it too
+	cache.put("c", "id-c2")
+	cache.put("d", "id-d")
+	if _, ok := cache.get("a"); ok {
+		t.Errorf("Expected a to be evicted after c was updated")
+	}
+	if id, ok := cache.get("c"); !ok || id != "id-c2" {
+		t.Errorf("Expected c to be cached with its new ID, got %q, %v", id, ok)
+	}
+}
+
+// TestFolderCacheDefaultSize tests that a size of zero or less falls back to the default
+func TestFolderCacheDefaultSize(t *testing.T) {
+	for _, maxEntries := range []int{0, -1} {
+		cache := newFolderCache(maxEntries)
+		if cache.maxEntries != defaultFolderCacheSize {
+			t.Errorf("Expected size %d for %d, got %d", defaultFolderCacheSize, maxEntries, cache.maxEntries)
+		}
+
+		// One more folder than the default size evicts only the first
+		for i := 0; i <= defaultFolderCacheSize; i++ {
+			cache.put(fmt.Sprintf("folder%d", i), "id")
+		}
+		if cache.order.Len() != defaultFolderCacheSize {
+			t.Errorf("Expected %d cached folders for %d, got %d", defaultFolderCacheSize, maxEntries, cache.order.Len())
+		}
+		if _, ok := cache.get("folder0"); ok {
+			t.Errorf("Expected the first folder to be evicted for %d", maxEntries)
+		}
+		if _, ok := cache.get("folder1"); !ok {
+			t.Errorf("Expected the second folder to stay cached for %d", maxEntries)
+		}
+	}
+}
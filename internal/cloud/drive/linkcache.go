@@ -0,0 +1,97 @@
+package drive
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultLinkCacheSize is used when DRIVE_LINK_CACHE_SIZE is not configured
+const defaultLinkCacheSize = 500
+
+// linkCache is a least-recently-used cache of shareable links by file ID, each kept for a limited time
+// A file shared once stays shared, so the cache only saves the Drive API calls of sharing it again
+// It is safe for concurrent use
+type linkCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List               // Most recently used at the front
+	entries    map[string]*list.Element // Elements hold a *linkCacheEntry
+}
+
+// linkCacheEntry is a cached file ID and its link
+type linkCacheEntry struct {
+	fileID  string
+	link    string
+	expires time.Time
+}
+
+// newLinkCache creates a link cache holding at most maxEntries links for ttl each
+// Returns nil, which caches nothing, if ttl is not positive
+func newLinkCache(maxEntries int, ttl time.Duration) *linkCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultLinkCacheSize
+	}
+
+	return &linkCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached link for a file if it hasn't expired, marking it as recently used
+func (c *linkCache) get(fileID string, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[fileID]
+	if !ok {
+		return "", false
+	}
+
+	entry := elem.Value.(*linkCacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, fileID)
+		return "", false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.link, true
+}
+
+// put caches the link for a file, evicting the least recently used link if the cache is full
+func (c *linkCache) put(fileID, link string, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := now.Add(c.ttl)
+	if elem, ok := c.entries[fileID]; ok {
+		entry := elem.Value.(*linkCacheEntry)
+		entry.link, entry.expires = link, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[fileID] = c.order.PushFront(&linkCacheEntry{fileID: fileID, link: link, expires: expires})
+
+	if c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*linkCacheEntry).fileID)
+	}
+}
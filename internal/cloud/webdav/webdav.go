@@ -0,0 +1,419 @@
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/cloud/common"
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// WebDAVService implements CloudStorage interface for WebDAV servers such as Nextcloud
+type WebDAVService struct {
+	config      *config.Config
+	logger      *utils.Logger
+	client      *http.Client
+	baseURL     *url.URL
+	folderCache map[string]bool         // Folders known to exist, by path
+	bandwidth   *utils.BandwidthLimiter // Shared by all uploads, nil when UPLOAD_MAX_BYTES_PER_SEC is unset
+	stats       WebDAVStats
+	mu          sync.Mutex
+}
+
+// WebDAVStats stores statistics about WebDAV operations
+type WebDAVStats struct {
+	TotalUploaded      int64
+	UploadCount        int
+	FailedUploads      int
+	RetryCount         int
+	LastUploadTime     time.Time
+	TotalUploadTime    time.Duration
+	AverageUploadTime  time.Duration
+	FolderCreatedCount int
+	FirstTrySuccess    int // Uploads that succeeded on the first attempt
+	RetriedSuccess     int // Uploads that succeeded only after retrying
+}
+
+// NewWebDAVService creates a new WebDAV service
+func NewWebDAVService(cfg *config.Config, logger *utils.Logger) *WebDAVService {
+	return &WebDAVService{
+		config:      cfg,
+		logger:      logger,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		folderCache: make(map[string]bool),
+		bandwidth:   utils.NewBandwidthLimiter(int64(cfg.UploadMaxBytesPerSec)),
+		stats:       WebDAVStats{},
+	}
+}
+
+// Initialize sets up the WebDAV service
+func (w *WebDAVService) Initialize() error {
+	w.logger.Info("Initializing WebDAV service")
+
+	if w.config.WebDAVURL == "" {
+		return fmt.Errorf("WEBDAV_URL must be set")
+	}
+
+	// Parse the base URL, making sure it ends with a slash so paths resolve beneath it
+	baseURL, err := url.Parse(strings.TrimSuffix(w.config.WebDAVURL, "/") + "/")
+	if err != nil {
+		return fmt.Errorf("invalid WebDAV URL: %v", err)
+	}
+	w.baseURL = baseURL
+
+	// Check that the server is reachable and the credentials are valid
+	if err := w.Ping(); err != nil {
+		return err
+	}
+
+	w.logger.Info("WebDAV service initialized successfully")
+
+	// Create the root folder if needed
+	if _, err := w.CreateFolder(context.Background(), w.config.WebDAVFolder); err != nil {
+		return fmt.Errorf("unable to create root folder: %v", err)
+	}
+
+	return nil
+}
+
+// resolve returns the full URL for a path relative to the WebDAV base URL
+func (w *WebDAVService) resolve(remotePath string) string {
+	// Escape each path segment individually so separators are preserved
+	parts := strings.Split(strings.Trim(remotePath, "/"), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return w.baseURL.ResolveReference(&url.URL{Path: strings.Join(parts, "/")}).String()
+}
+
+// newRequest creates an authenticated request against the WebDAV server
+func (w *WebDAVService) newRequest(ctx context.Context, method, rawURL string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.config.WebDAVUsername != "" {
+		req.SetBasicAuth(w.config.WebDAVUsername, w.config.WebDAVPassword)
+	}
+
+	return req, nil
+}
+
+// CreateFolder creates a folder on the WebDAV server if it doesn't exist
+// Returns the folder path, which serves as its ID
+func (w *WebDAVService) CreateFolder(ctx context.Context, folderPath string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	folderPath = strings.Trim(filepath.ToSlash(folderPath), "/")
+
+	// Check cache first
+	if w.folderCache[folderPath] {
+		return folderPath, nil
+	}
+
+	var currentPath string
+
+	// Create each folder in the path if it doesn't exist
+	for _, part := range strings.Split(folderPath, "/") {
+		if part == "" {
+			continue
+		}
+
+		currentPath = path.Join(currentPath, part)
+
+		// Check if this folder exists in cache
+		if w.folderCache[currentPath] {
+			continue
+		}
+
+		req, err := w.newRequest(ctx, "MKCOL", w.resolve(currentPath)+"/", nil)
+		if err != nil {
+			return "", fmt.Errorf("unable to create request for folder %s: %v", part, err)
+		}
+
+		resp, err := w.client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("unable to create folder %s: %v", part, err)
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusCreated:
+			w.stats.FolderCreatedCount++
+			w.logger.Debug("Created WebDAV folder: %s", currentPath)
+		case http.StatusMethodNotAllowed:
+			// The folder already exists
+		default:
+			return "", fmt.Errorf("unable to create folder %s, status code: %d", part, resp.StatusCode)
+		}
+
+		w.folderCache[currentPath] = true
+	}
+
+	return folderPath, nil
+}
+
+// UploadFile uploads a file to the WebDAV server
+// Returns the remote path of the file, which serves as its ID
+func (w *WebDAVService) UploadFile(ctx context.Context, localPath, remoteFolder string) (string, error) {
+	// Start timing the upload
+	startTime := time.Now()
+
+	// Make sure the folder exists
+	folderPath, err := w.CreateFolder(ctx, remoteFolder)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder for upload: %v", err)
+	}
+
+	filename := filepath.Base(localPath)
+	remotePath := path.Join(folderPath, filename)
+
+	// Get file size for statistics
+	fileInfo, err := os.Stat(localPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to get file info: %v", err)
+	}
+	fileSize := fileInfo.Size()
+
+	// Upload with retry logic
+	var retryCount int
+	for retryCount = 0; retryCount <= w.config.WebDAVRetryCount; retryCount++ {
+		if retryCount > 0 {
+			w.logger.Warning("Retrying upload for %s (attempt %d of %d)", filename, retryCount, w.config.WebDAVRetryCount)
+			w.mu.Lock()
+			w.stats.RetryCount++
+			w.mu.Unlock()
+
+			// Wait before retry with exponential backoff
+			select {
+			case <-time.After(time.Duration(1<<retryCount) * time.Second):
+			case <-ctx.Done():
+				return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+			}
+		}
+
+		err = w.put(ctx, localPath, remotePath, fileSize)
+		if err == nil {
+			break
+		}
+
+		// Don't retry if the upload was cancelled
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+		}
+
+		// If we've reached the max retry count, fail
+		if retryCount == w.config.WebDAVRetryCount {
+			w.mu.Lock()
+			w.stats.FailedUploads++
+			w.mu.Unlock()
+			return "", fmt.Errorf("failed to upload file after %d attempts: %v", retryCount+1, err)
+		}
+	}
+
+	// Update statistics
+	w.mu.Lock()
+	w.stats.UploadCount++
+	if retryCount == 0 {
+		w.stats.FirstTrySuccess++
+	} else {
+		w.stats.RetriedSuccess++
+	}
+	w.stats.TotalUploaded += fileSize
+	w.stats.LastUploadTime = time.Now()
+
+	uploadDuration := time.Since(startTime)
+	w.stats.TotalUploadTime += uploadDuration
+	w.stats.AverageUploadTime = w.stats.TotalUploadTime / time.Duration(w.stats.UploadCount)
+	w.mu.Unlock()
+
+	w.logger.Info("Successfully uploaded %s to WebDAV (Path: %s, Size: %d bytes) in %v",
+		filename, remotePath, fileSize, uploadDuration)
+
+	return remotePath, nil
+}
+
+// UploadStream uploads content as it is read from r, without a local copy of the file
+// The content can only be read once, so a failed upload isn't retried
+// Returns the remote path of the file, which serves as its ID
+func (w *WebDAVService) UploadStream(ctx context.Context, r io.Reader, name, remoteFolder string, size int64) (string, error) {
+	// Start timing the upload
+	startTime := time.Now()
+
+	// Make sure the folder exists
+	folderPath, err := w.CreateFolder(ctx, remoteFolder)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder for upload: %v", err)
+	}
+	remotePath := path.Join(folderPath, name)
+
+	// Count the content as it goes, since size may be unknown
+	content := &utils.CountingReader{R: r}
+	if err := w.putContent(ctx, content, remotePath, size); err != nil {
+		w.mu.Lock()
+		w.stats.FailedUploads++
+		w.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("upload cancelled: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("failed to upload stream: %v", err)
+	}
+
+	// Update statistics
+	w.mu.Lock()
+	w.stats.UploadCount++
+	w.stats.FirstTrySuccess++
+	w.stats.TotalUploaded += content.N
+	w.stats.LastUploadTime = time.Now()
+
+	uploadDuration := time.Since(startTime)
+	w.stats.TotalUploadTime += uploadDuration
+	w.stats.AverageUploadTime = w.stats.TotalUploadTime / time.Duration(w.stats.UploadCount)
+	w.mu.Unlock()
+
+	w.logger.Info("Successfully streamed %s to WebDAV (Path: %s, Size: %d bytes) in %v",
+		name, remotePath, content.N, uploadDuration)
+
+	return remotePath, nil
+}
+
+// put uploads the content of a local file to a remote path
+func (w *WebDAVService) put(ctx context.Context, localPath, remotePath string, size int64) error {
+	content, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to open file for upload: %v", err)
+	}
+	defer content.Close()
+
+	return w.putContent(ctx, content, remotePath, size)
+}
+
+// putContent uploads content to a remote path
+// A size of -1 sends the content chunked, for when its length isn't known
+func (w *WebDAVService) putContent(ctx context.Context, content io.Reader, remotePath string, size int64) error {
+	req, err := w.newRequest(ctx, http.MethodPut, w.resolve(remotePath), w.bandwidth.Reader(ctx, content))
+	if err != nil {
+		return fmt.Errorf("unable to create upload request: %v", err)
+	}
+	req.ContentLength = size
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload failed, status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// GetBackupStats returns the current backup statistics
+func (w *WebDAVService) GetBackupStats() common.BackupStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := common.NewBackupStats(w.stats.TotalUploaded, w.stats.UploadCount, w.stats.FailedUploads,
+		w.stats.RetryCount, w.stats.FolderCreatedCount, w.stats.AverageUploadTime, w.stats.LastUploadTime)
+	stats.FirstTrySuccess = w.stats.FirstTrySuccess
+	stats.RetriedSuccess = w.stats.RetriedSuccess
+	return stats
+}
+
+// ResetStats clears the backup statistics
+func (w *WebDAVService) ResetStats() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stats = WebDAVStats{}
+}
+
+// GetFileLink returns a link for a file based on its remote path
+// A public share link is created when the OCS share API is configured,
+// otherwise the direct WebDAV URL is returned
+func (w *WebDAVService) GetFileLink(fileID string) (string, error) {
+	if w.config.WebDAVShareAPIURL == "" {
+		return w.resolve(fileID), nil
+	}
+
+	// Create a public link share (shareType 3)
+	form := url.Values{}
+	form.Set("path", "/"+strings.TrimPrefix(fileID, "/"))
+	form.Set("shareType", "3")
+
+	req, err := w.newRequest(context.Background(), http.MethodPost, w.config.WebDAVShareAPIURL+"?format=json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("unable to create share request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("OCS-APIRequest", "true")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to share file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to share file, status code: %d", resp.StatusCode)
+	}
+
+	var shareResponse struct {
+		OCS struct {
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&shareResponse); err != nil {
+		return "", fmt.Errorf("unable to parse share response: %v", err)
+	}
+
+	if shareResponse.OCS.Data.URL == "" {
+		return "", fmt.Errorf("share response did not include a link")
+	}
+
+	w.logger.Info("Created shareable link for %s: %s", fileID, shareResponse.OCS.Data.URL)
+	return shareResponse.OCS.Data.URL, nil
+}
+
+// Ping checks that the WebDAV server is reachable and the credentials are valid
+func (w *WebDAVService) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := w.newRequest(ctx, "PROPFIND", w.baseURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %v", err)
+	}
+	req.Header.Set("Depth", "0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach WebDAV server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to reach WebDAV server, status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -1,72 +1,312 @@
 package config
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 
-	"github.com/joho/godotenv"
+	"code.olipicus.com/line_file_catcher/internal/utils"
 )
 
 // Config holds all configuration for the application
 type Config struct {
 	// LINE Bot API configuration
-	ChannelSecret string
-	ChannelToken  string
+	ChannelSecret string `yaml:"line_channel_secret" json:"line_channel_secret"`
+	ChannelToken  string `yaml:"line_channel_token" json:"line_channel_token"`
 
 	// Server configuration
-	Port string
+	Port                string `yaml:"port" json:"port"`
+	MaxWebhookBodyBytes int64  `yaml:"max_webhook_body_bytes" json:"max_webhook_body_bytes"`
+	AdminToken          string `yaml:"admin_token" json:"admin_token"`                     // Bearer token for admin endpoints, empty to disable them
+	StatsAuthToken      string `yaml:"stats_auth_token" json:"stats_auth_token"`           // Token required by the stats endpoint, empty to leave it open
+	StatsAuthHealth     bool   `yaml:"stats_auth_health" json:"stats_auth_health"`         // Also require StatsAuthToken on the health endpoint
+	WebhookRateLimit    int    `yaml:"webhook_rate_limit" json:"webhook_rate_limit"`       // Maximum webhook requests per minute
+	ErrorLogSize        int    `yaml:"error_log_size" json:"error_log_size"`               // Number of recent errors kept for the errors endpoint
+	SourceStatsLimit    int    `yaml:"source_stats_limit" json:"source_stats_limit"`       // Number of users, groups and rooms tracked in the per-source statistics
+	AlertWebhookURL     string `yaml:"alert_webhook_url" json:"alert_webhook_url"`         // Webhook (e.g. Slack) receiving operator alerts, empty to disable
+	AlertUploadFailures int    `yaml:"alert_upload_failures" json:"alert_upload_failures"` // Consecutive upload failures before alerting
+	AlertMinFreeMB      int    `yaml:"alert_min_free_mb" json:"alert_min_free_mb"`         // Alert when free disk space drops below this, 0 to disable
+	DedupWindowSeconds  int    `yaml:"dedup_window_seconds" json:"dedup_window_seconds"`   // Skip messages already processed within this many seconds, 0 to disable
+	MaxEventAge         int    `yaml:"max_event_age" json:"max_event_age"`                 // Skip events sent more than this many seconds ago, 0 to disable
+	ReadTimeout         int    `yaml:"read_timeout" json:"read_timeout"`                   // Seconds allowed to read a request, 0 for no timeout
+	WriteTimeout        int    `yaml:"write_timeout" json:"write_timeout"`                 // Seconds allowed to write a response, 0 for no timeout
+	IdleTimeout         int    `yaml:"idle_timeout" json:"idle_timeout"`                   // Seconds to keep idle keep-alive connections open
+	TLSCert             string `yaml:"tls_cert" json:"tls_cert"`                           // TLS certificate file; HTTPS is served when set with TLSKey
+	TLSKey              string `yaml:"tls_key" json:"tls_key"`                             // TLS private key file
+
+	// CIDR ranges or IPs of reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
 
 	// Storage configuration
-	StorageDir string
+	StorageDir         string            `yaml:"storage_dir" json:"storage_dir"`
+	FallbackStorageDir string            `yaml:"fallback_storage_dir" json:"fallback_storage_dir"`           // Used by saves that fail to write to StorageDir, disabled when empty
+	SpoolDir           string            `yaml:"spool_dir" json:"spool_dir"`                                 // Holds received content until it is written to storage, the system temp dir when empty
+	SubfolderByType    bool              `yaml:"subfolder_by_type" json:"subfolder_by_type"`                 // Store each media type in its own subfolder of the date folder
+	FlatStorage        bool              `yaml:"flat_storage" json:"flat_storage"`                           // Store every file directly in StorageDir, without date or type folders
+	FilenamePrefixes   map[string]string `yaml:"filename_prefixes" json:"filename_prefixes"`                 // Filename prefix per media type; the type name is used if missing
+	FilenameStrategy   string            `yaml:"filename_strategy" json:"filename_strategy"`                 // How saved files are named: random or hash
+	CaptureTypes       []string          `yaml:"capture_types" json:"capture_types"`                         // Media types to save: image, video, audio and file
+	AllowedMimeTypes   []string          `yaml:"allowed_mime_types" json:"allowed_mime_types"`               // Content types that may be saved, all when empty; "image/*" matches a family
+	BlockedMimeTypes   []string          `yaml:"blocked_mime_types" json:"blocked_mime_types"`               // Content types that are never saved
+	MaxFileSizeBytes   int64             `yaml:"max_file_size_bytes" json:"max_file_size_bytes"`             // Maximum size of a saved file, 0 for unlimited
+	MaxTotalStorageMB  int               `yaml:"max_total_storage_mb" json:"max_total_storage_mb"`           // Maximum total size of StorageDir, 0 for unlimited
+	StorageQuotaPolicy string            `yaml:"storage_quota_policy" json:"storage_quota_policy"`           // What to do when MaxTotalStorageMB would be exceeded: evict or reject
+	DownloadRetryCount int               `yaml:"download_retry_count" json:"download_retry_count"`           // Retries of a failed content download, resuming where it stopped
+	MaxDownloadTime    int               `yaml:"max_download_duration" json:"max_download_duration"`         // Seconds a whole download may take, including retries, 0 for unlimited
+	PersistDownloads   bool              `yaml:"persist_downloads" json:"persist_downloads"`                 // Keep queued downloads on disk so they are resumed after a restart
+	DispositionNames   bool              `yaml:"content_disposition_names" json:"content_disposition_names"` // Name downloads after the file name in their Content-Disposition header
+	TranscodeAudio     bool              `yaml:"transcode_audio" json:"transcode_audio"`                     // Convert received audio to mp3 with ffmpeg
+	CompressStorage    bool              `yaml:"compress_storage" json:"compress_storage"`                   // Store text-like files compressed with zstd
+	EncryptAtRest      bool              `yaml:"encrypt_at_rest" json:"encrypt_at_rest"`                     // Store files encrypted with AES-256-GCM, adding .enc to their names
+	EncryptionKey      string            `yaml:"encryption_key" json:"encryption_key"`                       // Base64 or hex encoded 32-byte key for EncryptAtRest
+	EncryptionKeyFile  string            `yaml:"encryption_key_file" json:"encryption_key_file"`             // File holding the key, used when EncryptionKey is empty
+	SavePreviews       bool              `yaml:"save_previews" json:"save_previews"`                         // Save video preview images and duration metadata
+	SaveImagePreview   bool              `yaml:"save_image_preview" json:"save_image_preview"`               // Also save LINE's lower resolution preview of each image
+	WriteMetadata      bool              `yaml:"write_metadata" json:"write_metadata"`                       // Write a JSON sidecar with the sender and message details for each file
+	WriteChecksums     bool              `yaml:"write_checksums" json:"write_checksums"`                     // Record the SHA-256 of each saved file in its folder's checksums file
+
+	// Download connection configuration
+	DownloadMaxIdleConns   int `yaml:"download_max_idle_conns" json:"download_max_idle_conns"`                   // Idle connections kept for reuse across all hosts
+	DownloadMaxIdlePerHost int `yaml:"download_max_idle_conns_per_host" json:"download_max_idle_conns_per_host"` // Idle connections kept for reuse per host
+	DownloadIdleTimeout    int `yaml:"download_idle_timeout" json:"download_idle_timeout"`                       // Seconds an idle connection is kept open
+	DownloadHeaderTimeout  int `yaml:"download_header_timeout" json:"download_header_timeout"`                   // Seconds to wait for a response to start, 0 for no timeout
+	DownloadMaxBytesPerSec int `yaml:"download_max_bytes_per_sec" json:"download_max_bytes_per_sec"`             // Combined download bandwidth cap in bytes per second, 0 for unlimited
+
+	// Reply message configuration
+	SendConfirmation        bool   `yaml:"send_confirmation" json:"send_confirmation"`                     // Send confirmation replies and Drive link messages
+	ReplyTokenMaxAgeSeconds int    `yaml:"reply_token_max_age_seconds" json:"reply_token_max_age_seconds"` // Push instead of replying once a reply token is older than this, 0 to always try replying
+	MessageRetryCount       int    `yaml:"message_retry_count" json:"message_retry_count"`                 // Retries of replies and pushes that failed with a transient error
+	ReplyTemplate           string `yaml:"reply_template" json:"reply_template"`                           // Supports {mediaType}
+	BatchReplyTemplate      string `yaml:"batch_reply_template" json:"batch_reply_template"`               // Supports {summary} and {count}
+	DriveLinkTemplate       string `yaml:"drive_link_template" json:"drive_link_template"`                 // Supports {filename} and {link}
+	DriveLinkFlex           bool   `yaml:"drive_link_flex" json:"drive_link_flex"`                         // Send the backup link as a Flex message card
+	DefaultLanguage         string `yaml:"default_language" json:"default_language"`                       // Language of messages to users whose profile language is unknown or unsupported
+	ProfileLanguage         bool   `yaml:"profile_language" json:"profile_language"`                       // Reply in the language of the user's LINE profile
+
+	// Non-media reply configuration
+	AutoReplyNonMedia         bool   `yaml:"auto_reply_non_media" json:"auto_reply_non_media"`                     // Reply to text messages that nothing was saved
+	AutoReplyNonMediaInGroups bool   `yaml:"auto_reply_non_media_in_groups" json:"auto_reply_non_media_in_groups"` // Also reply to text messages in groups and rooms
+	NonMediaReplyTemplate     string `yaml:"non_media_reply_template" json:"non_media_reply_template"`             // Used instead of the catalog's message for every language
+
+	// Welcome message configuration
+	SendWelcome    bool   `yaml:"send_welcome" json:"send_welcome"`       // Reply to follow events with a welcome message
+	WelcomeMessage string `yaml:"welcome_message" json:"welcome_message"` // Used instead of the catalog's message for every language
+
+	// Group greeting configuration
+	SendGroupGreeting bool   `yaml:"send_group_greeting" json:"send_group_greeting"` // Greet groups and rooms the bot is added to
+	GroupGreeting     string `yaml:"group_greeting" json:"group_greeting"`           // Used instead of the catalog's message for every language
 
 	// Logging configuration
-	LogDir string
-	Debug  bool
+	LogDir string `yaml:"log_dir" json:"log_dir"`
+	Debug  bool   `yaml:"debug" json:"debug"`
+
+	// Event persistence configuration
+	PersistEvents       bool   `yaml:"persist_events" json:"persist_events"`               // Save each verified webhook body for replay
+	EventsDir           string `yaml:"events_dir" json:"events_dir"`                       // Directory where webhook bodies are saved
+	EventsRetentionDays int    `yaml:"events_retention_days" json:"events_retention_days"` // Delete saved events older than this many days, 0 to keep them
 
 	// Google Drive configuration
-	DriveEnabled     bool
-	DriveCredentials string
-	DriveTokenFile   string
-	DriveFolder      string
-	DriveRetryCount  int
+	DriveEnabled          bool   `yaml:"drive_enabled" json:"drive_enabled"`
+	DriveCredentials      string `yaml:"drive_credentials" json:"drive_credentials"`
+	DriveTokenFile        string `yaml:"drive_token_file" json:"drive_token_file"`
+	DriveFolder           string `yaml:"drive_folder" json:"drive_folder"`
+	DriveRetryCount       int    `yaml:"drive_retry_count" json:"drive_retry_count"`
+	DriveAPIEndpoint      string `yaml:"drive_api_endpoint" json:"drive_api_endpoint"`             // Overrides the Drive API endpoint for testing
+	DriveFolderCacheSize  int    `yaml:"drive_folder_cache_size" json:"drive_folder_cache_size"`   // Maximum number of folder IDs kept in memory
+	DriveMaxConcurrent    int    `yaml:"drive_max_concurrent" json:"drive_max_concurrent"`         // Maximum number of uploads sent to Drive at once
+	DriveSkipDuplicates   bool   `yaml:"drive_skip_duplicates" json:"drive_skip_duplicates"`       // Skip uploads when the folder already has a file with the same name and MD5
+	DriveLinkCacheSize    int    `yaml:"drive_link_cache_size" json:"drive_link_cache_size"`       // Maximum number of shareable links kept in memory
+	DriveLinkCacheSeconds int    `yaml:"drive_link_cache_seconds" json:"drive_link_cache_seconds"` // How long a shareable link is reused, 0 to disable the cache
+
+	// WebDAV configuration (e.g. Nextcloud)
+	WebDAVEnabled     bool   `yaml:"webdav_enabled" json:"webdav_enabled"`
+	WebDAVURL         string `yaml:"webdav_url" json:"webdav_url"` // Base WebDAV URL, e.g. https://cloud.example.com/remote.php/dav/files/user/
+	WebDAVUsername    string `yaml:"webdav_username" json:"webdav_username"`
+	WebDAVPassword    string `yaml:"webdav_password" json:"webdav_password"` // Password or app token
+	WebDAVFolder      string `yaml:"webdav_folder" json:"webdav_folder"`
+	WebDAVRetryCount  int    `yaml:"webdav_retry_count" json:"webdav_retry_count"`
+	WebDAVShareAPIURL string `yaml:"webdav_share_api_url" json:"webdav_share_api_url"` // Optional OCS share API URL for public links
+
+	// Cloud upload queue configuration
+	UploadWorkers               int    `yaml:"upload_workers" json:"upload_workers"`                                 // Number of concurrent cloud uploads
+	SyncWorkers                 int    `yaml:"sync_workers" json:"sync_workers"`                                     // Number of concurrent uploads of a backup sync or migration
+	UploadMaxBytesPerSec        int    `yaml:"upload_max_bytes_per_sec" json:"upload_max_bytes_per_sec"`             // Combined upload bandwidth cap in bytes per second, 0 for unlimited
+	StreamUploads               bool   `yaml:"stream_uploads" json:"stream_uploads"`                                 // Upload received content to cloud storage while it is saved, rather than queueing it afterwards
+	UploadQueueSize             int    `yaml:"upload_queue_size" json:"upload_queue_size"`                           // Uploads waiting for a worker before the queue is full
+	UploadQueuePolicy           string `yaml:"upload_queue_policy" json:"upload_queue_policy"`                       // "block" or "drop" when the queue is full
+	UploadQueueBlockSeconds     int    `yaml:"upload_queue_block_seconds" json:"upload_queue_block_seconds"`         // How long to block for a free slot before dropping
+	UploadFailurePolicy         string `yaml:"upload_failure_policy" json:"upload_failure_policy"`                   // "keep_local", "queue_retry" or "alert" when an upload fails after its retries
+	UploadRetryDelaySeconds     int    `yaml:"upload_retry_delay_seconds" json:"upload_retry_delay_seconds"`         // How long queue_retry waits before retrying failed uploads
+	CloudFolderTemplate         string `yaml:"cloud_folder_template" json:"cloud_folder_template"`                   // Supports {year}, {month}, {day}, {type} and {user}
+	CloudBreakerThreshold       int    `yaml:"cloud_breaker_threshold" json:"cloud_breaker_threshold"`               // Consecutive upload failures before uploads are paused, 0 to never pause
+	CloudBreakerCooldownSeconds int    `yaml:"cloud_breaker_cooldown_seconds" json:"cloud_breaker_cooldown_seconds"` // How long uploads are paused before testing recovery
 }
 
 // Load returns a Config struct populated with values from environment variables
 func Load() *Config {
 	// Load .env file if it exists
-	godotenv.Load()
+	loadDotEnv()
 
-	config := &Config{
-		ChannelSecret:    getEnv("LINE_CHANNEL_SECRET", ""),
-		ChannelToken:     getEnv("LINE_CHANNEL_TOKEN", ""),
-		Port:             getEnv("PORT", "8080"),
-		StorageDir:       getEnv("STORAGE_DIR", "./storage"),
-		LogDir:           getEnv("LOG_DIR", "./logs"),
-		Debug:            getEnv("DEBUG", "false") == "true",
-		DriveEnabled:     getEnv("DRIVE_ENABLED", "false") == "true",
-		DriveCredentials: getEnv("DRIVE_CREDENTIALS", "./credentials.json"),
-		DriveTokenFile:   getEnv("DRIVE_TOKEN_FILE", "./token.json"),
-		DriveFolder:      getEnv("DRIVE_FOLDER", "LineFileCatcher"),
-		DriveRetryCount:  getIntEnv("DRIVE_RETRY_COUNT", 3),
+	// Settings from CONFIG_FILE fill in what the environment and .env leave unset
+	if err := loadConfigFile(); err != nil {
+		log.Fatal(err)
 	}
 
-	if config.ChannelSecret == "" || config.ChannelToken == "" {
-		log.Fatal("LINE_CHANNEL_SECRET and LINE_CHANNEL_TOKEN must be set")
+	config := fromEnv()
+
+	// Fail fast with every problem at once rather than part way through handling a request
+	if problems := config.Validate(); len(problems) > 0 {
+		log.Fatalf("Invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
 	}
 
-	// Create storage directory if it doesn't exist
-	if err := os.MkdirAll(config.StorageDir, 0755); err != nil {
-		log.Fatalf("Failed to create storage directory: %v", err)
+	return config
+}
+
+// Reload re-reads the .env file and CONFIG_FILE and returns the new configuration
+// Variables set in the real environment still take precedence over both files
+// Unlike Load it returns an error instead of exiting, so a bad edit doesn't take down a running service
+func Reload() (*Config, error) {
+	if err := loadDotEnv(); err != nil {
+		return nil, err
 	}
+	if err := loadConfigFile(); err != nil {
+		return nil, err
+	}
+
+	config := fromEnv()
 
-	// Create log directory if it doesn't exist
-	if err := os.MkdirAll(config.LogDir, 0755); err != nil {
-		log.Fatalf("Failed to create log directory: %v", err)
+	if problems := config.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
 	}
 
-	return config
+	return config, nil
+}
+
+// ChangedSettings returns the environment variable names of the settings that differ between two configurations
+func ChangedSettings(old, updated *Config) []string {
+	var changed []string
+	oldFields := reflect.ValueOf(*old)
+	updatedFields := reflect.ValueOf(*updated)
+	for i := 0; i < oldFields.NumField(); i++ {
+		if !reflect.DeepEqual(oldFields.Field(i).Interface(), updatedFields.Field(i).Interface()) {
+			changed = append(changed, strings.ToUpper(oldFields.Type().Field(i).Tag.Get("json")))
+		}
+	}
+	return changed
+}
+
+// fromEnv builds a Config from environment variables
+func fromEnv() *Config {
+	return &Config{
+		ChannelSecret:               getEnv("LINE_CHANNEL_SECRET", ""),
+		ChannelToken:                getEnv("LINE_CHANNEL_TOKEN", ""),
+		Port:                        getEnv("PORT", "8080"),
+		MaxWebhookBodyBytes:         int64(getIntEnv("MAX_WEBHOOK_BODY_BYTES", 1<<20)),
+		AdminToken:                  getEnv("ADMIN_TOKEN", ""),
+		StatsAuthToken:              getEnv("STATS_AUTH_TOKEN", ""),
+		StatsAuthHealth:             getEnv("STATS_AUTH_HEALTH", "false") == "true",
+		TrustedProxies:              getListEnv("TRUSTED_PROXIES", ""),
+		WebhookRateLimit:            getIntEnv("WEBHOOK_RATE_LIMIT", 60),
+		ErrorLogSize:                getIntEnv("ERROR_LOG_SIZE", 100),
+		SourceStatsLimit:            getIntEnv("SOURCE_STATS_LIMIT", 100),
+		AlertWebhookURL:             getEnv("ALERT_WEBHOOK_URL", ""),
+		AlertUploadFailures:         getIntEnv("ALERT_UPLOAD_FAILURES", 5),
+		AlertMinFreeMB:              getIntEnv("ALERT_MIN_FREE_MB", 1024),
+		DedupWindowSeconds:          getIntEnv("DEDUP_WINDOW_SECONDS", 300),
+		MaxEventAge:                 getIntEnv("MAX_EVENT_AGE", 0),
+		ReadTimeout:                 getIntEnv("READ_TIMEOUT", 15),
+		WriteTimeout:                getIntEnv("WRITE_TIMEOUT", 60),
+		IdleTimeout:                 getIntEnv("IDLE_TIMEOUT", 120),
+		TLSCert:                     getEnv("TLS_CERT", ""),
+		TLSKey:                      getEnv("TLS_KEY", ""),
+		StorageDir:                  getEnv("STORAGE_DIR", "./storage"),
+		FallbackStorageDir:          getEnv("FALLBACK_STORAGE_DIR", ""),
+		SpoolDir:                    getEnv("SPOOL_DIR", ""),
+		SubfolderByType:             getEnv("SUBFOLDER_BY_TYPE", "false") == "true",
+		FlatStorage:                 getEnv("FLAT_STORAGE", "false") == "true",
+		FilenamePrefixes:            getMapEnv("FILENAME_PREFIXES", ""),
+		FilenameStrategy:            strings.ToLower(getEnv("FILENAME_STRATEGY", "random")),
+		CaptureTypes:                getListEnv("CAPTURE_TYPES", "image,video,audio,file"),
+		AllowedMimeTypes:            getListEnv("ALLOWED_MIME_TYPES", ""),
+		BlockedMimeTypes:            getListEnv("BLOCKED_MIME_TYPES", ""),
+		MaxFileSizeBytes:            int64(getIntEnv("MAX_FILE_SIZE_BYTES", 0)),
+		MaxTotalStorageMB:           getIntEnv("MAX_TOTAL_STORAGE_MB", 0),
+		StorageQuotaPolicy:          strings.ToLower(getEnv("STORAGE_QUOTA_POLICY", "evict")),
+		DownloadRetryCount:          getIntEnv("DOWNLOAD_RETRY_COUNT", 3),
+		MaxDownloadTime:             getIntEnv("MAX_DOWNLOAD_DURATION", 0),
+		PersistDownloads:            getEnv("PERSIST_DOWNLOADS", "true") == "true",
+		DispositionNames:            getEnv("CONTENT_DISPOSITION_NAMES", "true") == "true",
+		DownloadMaxIdleConns:        getIntEnv("DOWNLOAD_MAX_IDLE_CONNS", 100),
+		DownloadMaxIdlePerHost:      getIntEnv("DOWNLOAD_MAX_IDLE_CONNS_PER_HOST", 10),
+		DownloadIdleTimeout:         getIntEnv("DOWNLOAD_IDLE_TIMEOUT", 90),
+		DownloadHeaderTimeout:       getIntEnv("DOWNLOAD_HEADER_TIMEOUT", 30),
+		DownloadMaxBytesPerSec:      getIntEnv("DOWNLOAD_MAX_BYTES_PER_SEC", 0),
+		TranscodeAudio:              getEnv("TRANSCODE_AUDIO", "false") == "true",
+		CompressStorage:             getEnv("COMPRESS_STORAGE", "false") == "true",
+		EncryptAtRest:               getEnv("ENCRYPT_AT_REST", "false") == "true",
+		EncryptionKey:               getEnv("ENCRYPTION_KEY", ""),
+		EncryptionKeyFile:           getEnv("ENCRYPTION_KEY_FILE", ""),
+		SavePreviews:                getEnv("SAVE_PREVIEWS", "false") == "true",
+		SaveImagePreview:            getEnv("SAVE_IMAGE_PREVIEW", "false") == "true",
+		WriteMetadata:               getEnv("WRITE_METADATA", "false") == "true",
+		WriteChecksums:              getEnv("WRITE_CHECKSUMS", "false") == "true",
+		SendConfirmation:            getEnv("SEND_CONFIRMATION", "true") == "true",
+		ReplyTokenMaxAgeSeconds:     getIntEnv("REPLY_TOKEN_MAX_AGE_SECONDS", 50),
+		MessageRetryCount:           getIntEnv("MESSAGE_RETRY_COUNT", 2),
+		ReplyTemplate:               getEnv("REPLY_TEMPLATE", ""),
+		BatchReplyTemplate:          getEnv("BATCH_REPLY_TEMPLATE", ""),
+		DriveLinkTemplate:           getEnv("DRIVE_LINK_TEMPLATE", ""),
+		DriveLinkFlex:               getEnv("DRIVE_LINK_FLEX", "false") == "true",
+		DefaultLanguage:             getEnv("DEFAULT_LANGUAGE", "en"),
+		ProfileLanguage:             getEnv("PROFILE_LANGUAGE", "true") == "true",
+		AutoReplyNonMedia:           getEnv("AUTO_REPLY_NON_MEDIA", "false") == "true",
+		AutoReplyNonMediaInGroups:   getEnv("AUTO_REPLY_NON_MEDIA_IN_GROUPS", "false") == "true",
+		NonMediaReplyTemplate:       getEnv("NON_MEDIA_REPLY_TEMPLATE", ""),
+		SendWelcome:                 getEnv("SEND_WELCOME", "true") == "true",
+		WelcomeMessage:              getEnv("WELCOME_MESSAGE", ""),
+		SendGroupGreeting:           getEnv("SEND_GROUP_GREETING", "true") == "true",
+		GroupGreeting:               getEnv("GROUP_GREETING", ""),
+		LogDir:                      getEnv("LOG_DIR", "./logs"),
+		Debug:                       getEnv("DEBUG", "false") == "true",
+		PersistEvents:               getEnv("PERSIST_EVENTS", "false") == "true",
+		EventsDir:                   getEnv("EVENTS_DIR", "./events"),
+		EventsRetentionDays:         getIntEnv("EVENTS_RETENTION_DAYS", 7),
+		DriveEnabled:                getEnv("DRIVE_ENABLED", "false") == "true",
+		DriveCredentials:            getEnv("DRIVE_CREDENTIALS", "./credentials.json"),
+		DriveTokenFile:              getEnv("DRIVE_TOKEN_FILE", "./token.json"),
+		DriveFolder:                 getEnv("DRIVE_FOLDER", "LineFileCatcher"),
+		DriveRetryCount:             getIntEnv("DRIVE_RETRY_COUNT", 3),
+		DriveAPIEndpoint:            getEnv("DRIVE_API_ENDPOINT", ""),
+		DriveFolderCacheSize:        getIntEnv("DRIVE_FOLDER_CACHE_SIZE", 1000),
+		DriveLinkCacheSize:          getIntEnv("DRIVE_LINK_CACHE_SIZE", 500),
+		DriveLinkCacheSeconds:       getIntEnv("DRIVE_LINK_CACHE_SECONDS", 3600),
+		DriveMaxConcurrent:          getIntEnv("DRIVE_MAX_CONCURRENT", 3),
+		DriveSkipDuplicates:         getEnv("DRIVE_SKIP_DUPLICATES", "true") == "true",
+		WebDAVEnabled:               getEnv("WEBDAV_ENABLED", "false") == "true",
+		WebDAVURL:                   getEnv("WEBDAV_URL", ""),
+		WebDAVUsername:              getEnv("WEBDAV_USERNAME", ""),
+		WebDAVPassword:              getEnv("WEBDAV_PASSWORD", ""),
+		WebDAVFolder:                getEnv("WEBDAV_FOLDER", "LineFileCatcher"),
+		WebDAVRetryCount:            getIntEnv("WEBDAV_RETRY_COUNT", 3),
+		WebDAVShareAPIURL:           getEnv("WEBDAV_SHARE_API_URL", ""),
+		UploadWorkers:               getIntEnv("UPLOAD_WORKERS", 4),
+		SyncWorkers:                 getIntEnv("SYNC_WORKERS", 2),
+		UploadMaxBytesPerSec:        getIntEnv("UPLOAD_MAX_BYTES_PER_SEC", 0),
+		StreamUploads:               getEnv("STREAM_UPLOADS", "false") == "true",
+		UploadQueueSize:             getIntEnv("UPLOAD_QUEUE_SIZE", 100),
+		UploadQueuePolicy:           getEnv("UPLOAD_QUEUE_POLICY", "block"),
+		UploadQueueBlockSeconds:     getIntEnv("UPLOAD_QUEUE_BLOCK_SECONDS", 5),
+		UploadFailurePolicy:         strings.ToLower(getEnv("UPLOAD_FAILURE_POLICY", "keep_local")),
+		UploadRetryDelaySeconds:     getIntEnv("UPLOAD_RETRY_DELAY_SECONDS", 300),
+		CloudFolderTemplate:         getEnv("CLOUD_FOLDER_TEMPLATE", "{year}-{month}-{day}"),
+		CloudBreakerThreshold:       getIntEnv("CLOUD_BREAKER_THRESHOLD", 5),
+		CloudBreakerCooldownSeconds: getIntEnv("CLOUD_BREAKER_COOLDOWN_SECONDS", 60),
+	}
 }
 
 // getEnv retrieves an environment variable or returns a default value
@@ -94,9 +334,172 @@ func getIntEnv(key string, defaultValue int) int {
 	return intValue
 }
 
-// GetMediaDir returns the path to the directory where media should be stored for a given date
-func (c *Config) GetMediaDir(dateStr string) (string, error) {
-	dir := filepath.Join(c.StorageDir, dateStr)
+// getListEnv retrieves a comma-separated environment variable as a lowercase list or returns a default value
+func getListEnv(key, defaultValue string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getMapEnv retrieves a comma-separated list of key=value pairs, such as "image=img,video=vid"
+// Keys are lowercased; values are kept as given and may be empty
+func getMapEnv(key, defaultValue string) map[string]string {
+	values := make(map[string]string)
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			if strings.TrimSpace(item) != "" {
+				log.Printf("Warning: Ignoring invalid entry %q in %s, expected key=value", item, key)
+			}
+			continue
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+// FilenamePrefix returns the prefix of saved filenames for a media type
+// It is the media type itself unless FILENAME_PREFIXES sets another, possibly empty, prefix
+func (c *Config) FilenamePrefix(mediaType string) string {
+	if prefix, ok := c.FilenamePrefixes[mediaType]; ok {
+		return prefix
+	}
+	return mediaType
+}
+
+// MimeTypeAllowed reports whether content of the given types may be saved, such as its declared and detected types
+// It is refused if any type is in BLOCKED_MIME_TYPES, or if ALLOWED_MIME_TYPES is set and none of the types is in it
+func (c *Config) MimeTypeAllowed(contentTypes ...string) bool {
+	allowed := len(c.AllowedMimeTypes) == 0
+	for _, contentType := range contentTypes {
+		if contentType == "" {
+			continue
+		}
+		if matchesMimeType(c.BlockedMimeTypes, contentType) {
+			return false
+		}
+		if matchesMimeType(c.AllowedMimeTypes, contentType) {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// matchesMimeType reports whether a content type is in a list of types, ignoring parameters such as charset
+// Entries ending in "/*" match every subtype
+func matchesMimeType(patterns []string, contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for _, pattern := range patterns {
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(contentType, family+"/") {
+				return true
+			}
+		} else if pattern == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// CapturesType reports whether media of the given type should be saved
+// All types are captured when no list is configured
+func (c *Config) CapturesType(mediaType string) bool {
+	if len(c.CaptureTypes) == 0 {
+		return true
+	}
+
+	for _, captured := range c.CaptureTypes {
+		if captured == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaTypeFolders names the subfolder for each media type when SubfolderByType is set
+var mediaTypeFolders = map[string]string{
+	"image": "images",
+	"video": "videos",
+	"audio": "audio",
+	"file":  "files",
+}
+
+// TypeSubfolder returns the subfolder for a media type within a date folder,
+// or an empty string when media types share the date folder
+func (c *Config) TypeSubfolder(mediaType string) string {
+	if !c.SubfolderByType {
+		return ""
+	}
+	if folder, ok := mediaTypeFolders[mediaType]; ok {
+		return folder
+	}
+	return mediaTypeFolders["file"]
+}
+
+// LoadEncryptionKey returns the key for ENCRYPT_AT_REST from ENCRYPTION_KEY or ENCRYPTION_KEY_FILE
+// The key must be 32 bytes, encoded as base64 or hex
+func (c *Config) LoadEncryptionKey() ([]byte, error) {
+	encoded := c.EncryptionKey
+	if encoded == "" && c.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY or ENCRYPTION_KEY_FILE must be set")
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key is neither hex nor base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, 32 are required", len(key))
+	}
+
+	return key, nil
+}
+
+// GetMediaDir returns the path to the directory where media of a type should be stored for a given date
+// The date is validated so it can't point outside the storage directory
+// With FLAT_STORAGE every file is stored directly in the storage directory, whatever its date and type
+func (c *Config) GetMediaDir(dateStr, mediaType string) (string, error) {
+	return c.mediaDirUnder(c.StorageDir, dateStr, mediaType)
+}
+
+// GetFallbackMediaDir is GetMediaDir for FALLBACK_STORAGE_DIR, with the same layout
+func (c *Config) GetFallbackMediaDir(dateStr, mediaType string) (string, error) {
+	if c.FallbackStorageDir == "" {
+		return "", fmt.Errorf("no fallback storage directory configured")
+	}
+	return c.mediaDirUnder(c.FallbackStorageDir, dateStr, mediaType)
+}
+
+// mediaDirUnder creates the date and type folders for media below root
+func (c *Config) mediaDirUnder(root, dateStr, mediaType string) (string, error) {
+	dateStr, err := utils.SanitizePathComponent(dateStr)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, dateStr, c.TypeSubfolder(mediaType))
+	if c.FlatStorage {
+		dir = root
+	}
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", err
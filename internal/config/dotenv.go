@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// dotEnv tracks the environment variables set from the .env file and their values, so a reload can pick up
+// edits to the file while variables set in the real environment keep precedence
+var dotEnv = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// loadDotEnv applies the settings in the .env file, if present, as environment variables
+// Variables already set in the environment are left alone unless they were set from .env by an earlier load
+func loadDotEnv() error {
+	values, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read .env file: %v", err)
+	}
+
+	dotEnv.Lock()
+	defer dotEnv.Unlock()
+
+	for key, value := range values {
+		if current, set := os.LookupEnv(key); set {
+			if previous, fromDotEnv := dotEnv.values[key]; !fromDotEnv || current != previous {
+				continue
+			}
+		}
+		os.Setenv(key, value)
+		dotEnv.values[key] = value
+	}
+
+	// Settings removed from the file since the last load go back to their defaults
+	for key, previous := range dotEnv.values {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if os.Getenv(key) == previous {
+			os.Unsetenv(key)
+		}
+		delete(dotEnv.values, key)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileEnv tracks the environment variables set from CONFIG_FILE and their values, so a reload can replace
+// them when the file changes without overriding variables that were set some other way
+var fileEnv = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// loadConfigFile applies the settings in CONFIG_FILE, if set, as environment variables
+// Keys are the lowercase names of the environment variables, e.g. storage_dir for STORAGE_DIR
+// Variables already set in the environment or .env are left alone, so the precedence is
+// environment, then .env, then CONFIG_FILE, then the built-in defaults
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	fileEnv.Lock()
+	defer fileEnv.Unlock()
+
+	for key, value := range values {
+		if current, set := os.LookupEnv(key); set {
+			if previous, fromFile := fileEnv.values[key]; !fromFile || current != previous {
+				continue
+			}
+		}
+		os.Setenv(key, value)
+		fileEnv.values[key] = value
+	}
+
+	// Settings removed from the file since the last load go back to their defaults
+	for key, previous := range fileEnv.values {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if os.Getenv(key) == previous {
+			os.Unsetenv(key)
+		}
+		delete(fileEnv.values, key)
+	}
+	return nil
+}
+
+// readConfigFile parses a YAML or JSON config file, chosen by its extension, into the Config fields
+// It returns the settings the file contains as environment variable values
+// Unknown keys and values of the wrong type are errors, so typos don't go unnoticed
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// Decoding into a Config checks the keys and types; decoding into a map tells which keys are present
+	var parsed Config
+	var present map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		if err := yaml.Unmarshal(data, &present); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, &present); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q, expected .yaml, .yml or .json", ext)
+	}
+
+	values := make(map[string]string)
+	fields := reflect.ValueOf(parsed)
+	for i := 0; i < fields.NumField(); i++ {
+		key := fields.Type().Field(i).Tag.Get("json")
+		if _, ok := present[key]; ok {
+			values[strings.ToUpper(key)] = envValue(fields.Field(i))
+		}
+	}
+	return values, nil
+}
+
+// envValue formats a Config field the way its environment variable is written
+func envValue(field reflect.Value) string {
+	switch field.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(field.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(field.Int(), 10)
+	case reflect.Slice:
+		return strings.Join(field.Interface().([]string), ",")
+	case reflect.Map:
+		var pairs []string
+		for key, value := range field.Interface().(map[string]string) {
+			pairs = append(pairs, key+"="+value)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return field.String()
+	}
+}
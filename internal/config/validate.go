@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// setting is a named configuration value, for reporting problems by environment variable
+type setting struct {
+	name  string
+	value string
+}
+
+// numericSetting is a named numeric configuration value
+type numericSetting struct {
+	name  string
+	value int64
+}
+
+// Validate checks the configuration for problems that would otherwise only show up once the service is running
+// It returns every problem found rather than stopping at the first, so they can all be fixed at once
+// Directories that will be written to are created if missing and checked by writing a file to them
+// StorageDir is replaced with its cleaned absolute path, with a leading ~ expanded to the home directory
+func (c *Config) Validate() []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	storageDir, err := resolveDir(c.StorageDir)
+	if err != nil {
+		addf("STORAGE_DIR: %v", err)
+	} else {
+		c.StorageDir = storageDir
+	}
+
+	if c.ChannelSecret == "" || c.ChannelToken == "" {
+		addf("LINE_CHANNEL_SECRET and LINE_CHANNEL_TOKEN must be set")
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		addf("PORT must be a number from 1 to 65535, got %q", c.Port)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		addf("TLS_CERT and TLS_KEY must be set together")
+	}
+	for _, file := range []setting{{"TLS_CERT", c.TLSCert}, {"TLS_KEY", c.TLSKey}} {
+		if file.value != "" {
+			if err := checkReadableFile(file.value); err != nil {
+				addf("%s: %v", file.name, err)
+			}
+		}
+	}
+
+	// Counts and durations that have no meaning when negative
+	nonNegative := []numericSetting{
+		{"MAX_WEBHOOK_BODY_BYTES", c.MaxWebhookBodyBytes},
+		{"WEBHOOK_RATE_LIMIT", int64(c.WebhookRateLimit)},
+		{"DEDUP_WINDOW_SECONDS", int64(c.DedupWindowSeconds)},
+		{"MAX_EVENT_AGE", int64(c.MaxEventAge)},
+		{"EVENTS_RETENTION_DAYS", int64(c.EventsRetentionDays)},
+		{"READ_TIMEOUT", int64(c.ReadTimeout)},
+		{"WRITE_TIMEOUT", int64(c.WriteTimeout)},
+		{"IDLE_TIMEOUT", int64(c.IdleTimeout)},
+		{"MAX_FILE_SIZE_BYTES", c.MaxFileSizeBytes},
+		{"MAX_TOTAL_STORAGE_MB", int64(c.MaxTotalStorageMB)},
+		{"DOWNLOAD_RETRY_COUNT", int64(c.DownloadRetryCount)},
+		{"MAX_DOWNLOAD_DURATION", int64(c.MaxDownloadTime)},
+		{"DOWNLOAD_IDLE_TIMEOUT", int64(c.DownloadIdleTimeout)},
+		{"DOWNLOAD_HEADER_TIMEOUT", int64(c.DownloadHeaderTimeout)},
+		{"DOWNLOAD_MAX_BYTES_PER_SEC", int64(c.DownloadMaxBytesPerSec)},
+		{"REPLY_TOKEN_MAX_AGE_SECONDS", int64(c.ReplyTokenMaxAgeSeconds)},
+		{"MESSAGE_RETRY_COUNT", int64(c.MessageRetryCount)},
+		{"DRIVE_RETRY_COUNT", int64(c.DriveRetryCount)},
+		{"DRIVE_LINK_CACHE_SIZE", int64(c.DriveLinkCacheSize)},
+		{"DRIVE_LINK_CACHE_SECONDS", int64(c.DriveLinkCacheSeconds)},
+		{"WEBDAV_RETRY_COUNT", int64(c.WebDAVRetryCount)},
+		{"UPLOAD_QUEUE_BLOCK_SECONDS", int64(c.UploadQueueBlockSeconds)},
+		{"UPLOAD_RETRY_DELAY_SECONDS", int64(c.UploadRetryDelaySeconds)},
+		{"CLOUD_BREAKER_THRESHOLD", int64(c.CloudBreakerThreshold)},
+		{"CLOUD_BREAKER_COOLDOWN_SECONDS", int64(c.CloudBreakerCooldownSeconds)},
+		{"UPLOAD_MAX_BYTES_PER_SEC", int64(c.UploadMaxBytesPerSec)},
+	}
+	for _, number := range nonNegative {
+		if number.value < 0 {
+			addf("%s must not be negative, got %d", number.name, number.value)
+		}
+	}
+
+	// An empty value selects the default, as it does at runtime
+	switch c.StorageQuotaPolicy {
+	case "", "evict", "reject":
+	default:
+		addf("STORAGE_QUOTA_POLICY must be evict or reject, got %q", c.StorageQuotaPolicy)
+	}
+	switch c.UploadQueuePolicy {
+	case "", "block", "drop":
+	default:
+		addf("UPLOAD_QUEUE_POLICY must be block or drop, got %q", c.UploadQueuePolicy)
+	}
+	switch c.UploadFailurePolicy {
+	case "", "keep_local", "queue_retry", "alert":
+	default:
+		addf("UPLOAD_FAILURE_POLICY must be keep_local, queue_retry or alert, got %q", c.UploadFailurePolicy)
+	}
+	switch c.FilenameStrategy {
+	case "", "random", "hash":
+	default:
+		addf("FILENAME_STRATEGY must be random or hash, got %q", c.FilenameStrategy)
+	}
+
+	// Never fall back to storing files unencrypted
+	if c.EncryptAtRest {
+		if _, err := c.LoadEncryptionKey(); err != nil {
+			addf("ENCRYPT_AT_REST is set but the key is unusable: %v", err)
+		}
+	}
+
+	if c.DriveEnabled {
+		if err := checkReadableFile(c.DriveCredentials); err != nil {
+			addf("DRIVE_CREDENTIALS: %v", err)
+		}
+	}
+	if c.WebDAVEnabled && c.WebDAVURL == "" {
+		addf("WEBDAV_URL must be set when WEBDAV_ENABLED is true")
+	}
+
+	// Directories the service writes to; a storage directory that couldn't be resolved was already reported
+	var dirs []setting
+	if storageDir != "" {
+		dirs = append(dirs, setting{"STORAGE_DIR", c.StorageDir})
+	}
+	dirs = append(dirs, []setting{
+		{"LOG_DIR", c.LogDir},
+		{"FALLBACK_STORAGE_DIR", c.FallbackStorageDir},
+		{"SPOOL_DIR", c.SpoolDir},
+	}...)
+	if c.PersistEvents {
+		dirs = append(dirs, setting{"EVENTS_DIR", c.EventsDir})
+	}
+	for _, dir := range dirs {
+		if dir.value == "" {
+			continue
+		}
+		if err := checkWritableDir(dir.value); err != nil {
+			addf("%s: %v", dir.name, err)
+		}
+	}
+
+	return problems
+}
+
+// resolveDir expands a leading ~ and returns the cleaned absolute path of a directory
+// The path may not exist yet, but if it does it must be a directory
+func resolveDir(dir string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("no directory is set")
+	}
+
+	if dir == "~" || strings.HasPrefix(dir, "~/") || strings.HasPrefix(dir, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to expand %s: %v", dir, err)
+		}
+		dir = filepath.Join(home, dir[1:])
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %s: %v", dir, err)
+	}
+
+	if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// checkReadableFile checks that a file exists and can be opened
+func checkReadableFile(path string) error {
+	if path == "" {
+		return fmt.Errorf("no file is set")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// checkWritableDir creates a directory if needed and checks that files can be created in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %v", dir, err)
+	}
+
+	file, err := os.CreateTemp(dir, ".write_check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
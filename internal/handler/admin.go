@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// authorizeAdmin checks that a request is a POST carrying the admin token as a bearer token
+// Writes the error response and returns false if it is not
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, cfg *config.Config, logger *utils.Logger) bool {
+	return authorizeAdminMethod(w, r, http.MethodPost, cfg, logger)
+}
+
+// authorizeAdminMethod checks that a request uses the given method and carries the admin token as a bearer token
+// Writes the error response and returns false if it does not
+func authorizeAdminMethod(w http.ResponseWriter, r *http.Request, method string, cfg *config.Config, logger *utils.Logger) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// Admin endpoints are disabled unless an admin token is configured
+	if cfg.AdminToken == "" {
+		logger.Warning("Rejected %s from %s: ADMIN_TOKEN is not configured", r.URL.Path, clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		logger.Warning("Rejected unauthenticated %s from %s", r.URL.Path, clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
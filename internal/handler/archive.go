@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// archivePathPrefix is the path of the archive endpoint, followed by the date and .zip
+const archivePathPrefix = "/archive/"
+
+// ArchiveHandler serves a day's stored media as a zip archive
+type ArchiveHandler struct {
+	config *config.Config
+	logger *utils.Logger
+}
+
+// NewArchiveHandler creates a new archive handler
+func NewArchiveHandler(cfg *config.Config, logger *utils.Logger) *ArchiveHandler {
+	return &ArchiveHandler{
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// HandleArchive streams the files stored for a date, such as /archive/2025-01-02.zip, as a zip archive
+// The archive is built while it is sent, so memory use doesn't grow with the size of the day
+// Requires a GET with the admin token as a bearer token
+func (h *ArchiveHandler) HandleArchive(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdminMethod(w, r, http.MethodGet, h.config, h.logger) {
+		return
+	}
+
+	date, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, archivePathPrefix), ".zip")
+	if !ok || !validDate(date) {
+		http.Error(w, "Bad Request: expected /archive/YYYY-MM-DD.zip", http.StatusBadRequest)
+		return
+	}
+
+	// With FLAT_STORAGE there are no date folders; the day's files are those modified on that date
+	dateDir := filepath.Join(h.config.StorageDir, date)
+	include := func(fs.FileInfo) bool { return true }
+	if h.config.FlatStorage {
+		dateDir = h.config.StorageDir
+		include = func(info fs.FileInfo) bool { return info.ModTime().Format("2006-01-02") == date }
+	}
+	if info, err := os.Stat(dateDir); err != nil || !info.IsDir() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	h.logger.Info("Sending archive of %s to %s", date, clientIP(r))
+
+	// A large day can take longer to send than WRITE_TIMEOUT allows for other requests
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Debug("Could not lift the write timeout for the archive of %s: %v", date, err)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, date))
+
+	// Once the archive has started, errors can only be logged; the client gets a truncated zip
+	files, err := writeArchive(w, dateDir, include)
+	if err != nil {
+		h.logger.Error("Failed to send archive of %s after %d files: %v", date, files, err)
+		return
+	}
+
+	h.logger.Info("Sent archive of %s with %d files", date, files)
+}
+
+// validDate reports whether a string is a date in the YYYY-MM-DD format of the storage folders
+func validDate(date string) bool {
+	parsed, err := time.Parse("2006-01-02", date)
+	return err == nil && parsed.Format("2006-01-02") == date
+}
+
+// writeArchive writes the files under a directory for which include returns true to w as a zip,
+// with paths relative to the directory
+// Hidden files and downloads or writes still in progress are left out; returns the number of files written
+func writeArchive(w io.Writer, dir string, include func(fs.FileInfo) bool) (int, error) {
+	archive := zip.NewWriter(w)
+
+	files := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || media.IsInProgress(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || !include(info) {
+			return nil
+		}
+
+		if err := addToArchive(archive, dir, path); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+
+	return files, archive.Close()
+}
+
+// addToArchive copies a file into the archive
+// Media is mostly compressed already, so files are stored rather than compressed again
+func addToArchive(archive *zip.Writer, dir, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+	header.Method = zip.Store
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(entry, file); err != nil {
+		return fmt.Errorf("failed to add %s: %v", rel, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// BackupHandler handles cloud backup administration requests
+type BackupHandler struct {
+	config     *config.Config
+	logger     *utils.Logger
+	mediaStore *media.MediaStore
+}
+
+// BackupSyncResponse represents the response for the backup sync endpoint
+type BackupSyncResponse struct {
+	Status   string `json:"status"`
+	Enqueued int    `json:"enqueued"`
+}
+
+// NewBackupHandler creates a new backup handler
+func NewBackupHandler(cfg *config.Config, logger *utils.Logger, mediaStore *media.MediaStore) *BackupHandler {
+	return &BackupHandler{
+		config:     cfg,
+		logger:     logger,
+		mediaStore: mediaStore,
+	}
+}
+
+// HandleSync re-queues stored files that never made it to cloud storage
+// Requires a POST with the admin token as a bearer token
+func (h *BackupHandler) HandleSync(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.config, h.logger) {
+		return
+	}
+
+	enqueued, err := h.mediaStore.SyncBackups(r.Context())
+	if errors.Is(err, media.ErrCloudDisabled) {
+		http.Error(w, "Cloud backup is not enabled", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, media.ErrSweepsStopped) {
+		http.Error(w, "Service is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Backup sync failed: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Backup sync requested by %s queued %d files", clientIP(r), enqueued)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BackupSyncResponse{Status: "ok", Enqueued: enqueued}); err != nil {
+		h.logger.Error("Failed to encode backup sync response: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// fallbackLanguage is used for languages without a catalog
+const fallbackLanguage = "en"
+
+// messageCatalog holds the messages sent to users in one language
+type messageCatalog struct {
+	reply          string            // Supports {mediaType}
+	batchReply     string            // Supports {summary} and {count}
+	batchItem      string            // One media type in a batch summary; supports {count} and {mediaType}
+	pluralSuffix   string            // Appended to a media type name counted more than once
+	and            string            // Joins the last two items of a batch summary
+	driveLink      string            // Supports {filename} and {link}
+	compressedNote string            // Appended to confirmations when a file was stored compressed
+	tooLarge       string            // Supports {mediaType}
+	diskFull       string            // Supports {mediaType}
+	saveFailed     string            // Supports {mediaType}
+	blockedType    string            // Supports {mediaType}
+	expired        string            // Supports {mediaType}
+	nonMedia       string            // Reply to text messages with AUTO_REPLY_NON_MEDIA
+	welcome        string            // Sent to users who add the bot as a friend
+	groupGreeting  string            // Sent to groups and rooms the bot is added to
+	help           string            // Reply to the help postback action
+	stats          string            // Reply to the stats postback action; supports {summary}, {size} and {since}
+	statsEmpty     string            // Reply to the stats postback action when nothing was saved; supports {since}
+	mediaTypes     map[string]string // Display names of media types; the type itself is used if missing
+}
+
+// catalogs are the message catalogs keyed by language code
+var catalogs = map[string]messageCatalog{
+	"en": {
+		reply:          "Thanks for sharing! Your {mediaType} file has been received and is being processed.",
+		batchReply:     "Thanks for sharing! Received {summary}. They are being processed.",
+		batchItem:      "{count} {mediaType}",
+		pluralSuffix:   "s",
+		and:            " and ",
+		driveLink:      "📁 Your file {filename} has been backed up to Google Drive and is available at: {link}",
+		compressedNote: "Text files are stored compressed to save space.",
+		tooLarge:       "Sorry, your {mediaType} file is too large to be saved.",
+		diskFull:       "Sorry, your {mediaType} file couldn't be saved because the server is out of storage space.",
+		saveFailed:     "Sorry, your {mediaType} file couldn't be saved. Please try sending it again.",
+		blockedType:    "Sorry, this kind of {mediaType} file isn't accepted, so it wasn't saved.",
+		expired:        "Sorry, your {mediaType} file is no longer available on LINE's servers, so it couldn't be saved.",
+		nonMedia:       "I only save images, videos, audio and files. Send one and I'll keep it for you.",
+		welcome:        "Thanks for adding me! Send me images, videos, audio or files and I'll save them for you.",
+		groupGreeting:  "Hello everyone! Images, videos, audio and files shared in this chat will be saved.",
+		help:           "Send me images, videos, audio or files and I'll save them for you. Tap Stats to see how many files have been saved.",
+		stats:          "Saved since {since}: {summary} ({size}).",
+		statsEmpty:     "No files have been saved since {since}.",
+	},
+	"th": {
+		reply:          "ขอบคุณที่แชร์! ได้รับ{mediaType}ของคุณแล้ว กำลังดำเนินการ",
+		batchReply:     "ขอบคุณที่แชร์! ได้รับ{summary}แล้ว กำลังดำเนินการ",
+		batchItem:      "{mediaType} {count} รายการ",
+		and:            " และ ",
+		driveLink:      "📁 สำรองไฟล์ {filename} ไปยัง Google Drive แล้ว เปิดดูได้ที่: {link}",
+		compressedNote: "ไฟล์ข้อความจะถูกบีบอัดเพื่อประหยัดพื้นที่",
+		tooLarge:       "ขออภัย {mediaType}ของคุณมีขนาดใหญ่เกินกว่าจะบันทึกได้",
+		diskFull:       "ขออภัย ไม่สามารถบันทึก{mediaType}ของคุณได้ เนื่องจากพื้นที่จัดเก็บของเซิร์ฟเวอร์เต็ม",
+		saveFailed:     "ขออภัย ไม่สามารถบันทึก{mediaType}ของคุณได้ กรุณาส่งใหม่อีกครั้ง",
+		blockedType:    "ขออภัย ระบบไม่รับ{mediaType}ประเภทนี้ จึงไม่ได้บันทึกไว้",
+		expired:        "ขออภัย {mediaType}นี้ไม่มีอยู่บนเซิร์ฟเวอร์ของ LINE แล้ว จึงไม่สามารถบันทึกได้",
+		nonMedia:       "บอทนี้บันทึกเฉพาะรูปภาพ วิดีโอ ไฟล์เสียง และไฟล์เท่านั้น",
+		welcome:        "ขอบคุณที่เพิ่มเป็นเพื่อน! ส่งรูปภาพ วิดีโอ ไฟล์เสียง หรือไฟล์มาได้เลย ระบบจะบันทึกไว้ให้",
+		groupGreeting:  "สวัสดีทุกคน! รูปภาพ วิดีโอ ไฟล์เสียง และไฟล์ที่แชร์ในแชทนี้จะถูกบันทึกไว้",
+		help:           "ส่งรูปภาพ วิดีโอ ไฟล์เสียง หรือไฟล์มาได้เลย ระบบจะบันทึกไว้ให้ แตะ Stats เพื่อดูจำนวนไฟล์ที่บันทึกแล้ว",
+		stats:          "บันทึกแล้วตั้งแต่ {since}: {summary} ({size})",
+		statsEmpty:     "ยังไม่มีไฟล์ที่บันทึกตั้งแต่ {since}",
+		mediaTypes: map[string]string{
+			"image": "รูปภาพ",
+			"video": "วิดีโอ",
+			"audio": "ไฟล์เสียง",
+			"file":  "ไฟล์",
+		},
+	},
+}
+
+// catalogLanguage returns the catalog language for a language code such as "th" or "en-US"
+// Returns an empty string if there is no catalog for the language
+func catalogLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+
+	if _, ok := catalogs[language]; ok {
+		return language
+	}
+	return ""
+}
+
+// catalogFor returns the catalog for a language, falling back to English
+func catalogFor(language string) messageCatalog {
+	if language = catalogLanguage(language); language != "" {
+		return catalogs[language]
+	}
+	return catalogs[fallbackLanguage]
+}
+
+// mediaTypeName returns the display name of a media type
+func (c messageCatalog) mediaTypeName(mediaType string) string {
+	if name, ok := c.mediaTypes[mediaType]; ok {
+		return name
+	}
+	return mediaType
+}
+
+// format fills in a message that takes a media type
+func (c messageCatalog) format(template, mediaType string) string {
+	return utils.FormatTemplate(template, map[string]string{"mediaType": c.mediaTypeName(mediaType)})
+}
+
+// summary describes the media counts of a batch, e.g. "3 images and 1 video"
+// typeOrder lists the media types in the order they were received
+func (c messageCatalog) summary(typeOrder []string, counts map[string]int) string {
+	parts := make([]string, 0, len(typeOrder))
+	for _, mediaType := range typeOrder {
+		name := c.mediaTypeName(mediaType)
+		if counts[mediaType] > 1 {
+			name += c.pluralSuffix
+		}
+		parts = append(parts, utils.FormatTemplate(c.batchItem, map[string]string{
+			"count":     fmt.Sprintf("%d", counts[mediaType]),
+			"mediaType": name,
+		}))
+	}
+
+	summary := parts[0]
+	if len(parts) > 1 {
+		summary = strings.Join(parts[:len(parts)-1], ", ") + c.and + parts[len(parts)-1]
+	}
+	return summary
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// messageDedup remembers recently processed message IDs so duplicate deliveries are skipped
+// Entries expire after the dedup window, which bounds memory
+type messageDedup struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // Message ID to when it was claimed
+	order []dedupEntry         // Claims in the order they were made, for expiry
+}
+
+// dedupEntry is a claimed message ID and when it was claimed
+type dedupEntry struct {
+	messageID string
+	claimedAt time.Time
+}
+
+// newMessageDedup creates an empty dedup cache
+func newMessageDedup() *messageDedup {
+	return &messageDedup{
+		seen: make(map[string]time.Time),
+	}
+}
+
+// claim records a message as being processed
+// Returns false if the message was already claimed within the window
+func (d *messageDedup) claim(messageID string, window time.Duration, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(window, now)
+
+	if _, ok := d.seen[messageID]; ok {
+		return false
+	}
+
+	d.seen[messageID] = now
+	d.order = append(d.order, dedupEntry{messageID: messageID, claimedAt: now})
+	return true
+}
+
+// forget removes a claim so a redelivery of the message is processed again, e.g. after it failed
+func (d *messageDedup) forget(messageID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seen, messageID)
+}
+
+// expire drops the claims made longer than the window ago
+// Must be called with mu held
+func (d *messageDedup) expire(window time.Duration, now time.Time) {
+	expired := 0
+	for _, entry := range d.order {
+		if now.Sub(entry.claimedAt) < window {
+			break
+		}
+		// The message may have been forgotten and claimed again since
+		if d.seen[entry.messageID].Equal(entry.claimedAt) {
+			delete(d.seen, entry.messageID)
+		}
+		expired++
+	}
+	d.order = d.order[expired:]
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDecodedBodyBytes caps a decompressed webhook body when MAX_WEBHOOK_BODY_BYTES is unlimited
+const maxDecodedBodyBytes = 10 << 20
+
+// errDecodedBodyTooLarge is returned when a compressed body expands beyond the size limit
+var errDecodedBodyTooLarge = errors.New("decompressed body exceeds size limit")
+
+// decodeBody undoes the request's Content-Encoding so the signature is checked over the JSON LINE signed
+// Only gzip is supported; the decompressed size is capped to guard against decompression bombs
+func decodeBody(r *http.Request, body []byte, limit int64) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	if limit <= 0 {
+		limit = maxDecodedBodyBytes
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	defer reader.Close()
+
+	// Read one byte past the limit to tell a body of exactly the limit from a larger one
+	decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errDecodedBodyTooLarge
+	}
+
+	// The body handed on is plain JSON from here
+	r.Header.Del("Content-Encoding")
+	return decoded, nil
+}
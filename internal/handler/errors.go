@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// ErrorsHandler reports recent download, save and upload failures
+type ErrorsHandler struct {
+	config     *config.Config
+	logger     *utils.Logger
+	mediaStore *media.MediaStore
+}
+
+// ErrorsResponse represents the response for the errors endpoint
+type ErrorsResponse struct {
+	Count  int                `json:"count"`
+	Errors []media.ErrorEvent `json:"errors"` // Newest first
+}
+
+// NewErrorsHandler creates a new errors handler
+func NewErrorsHandler(cfg *config.Config, logger *utils.Logger, mediaStore *media.MediaStore) *ErrorsHandler {
+	return &ErrorsHandler{
+		config:     cfg,
+		logger:     logger,
+		mediaStore: mediaStore,
+	}
+}
+
+// HandleErrors returns the most recent errors as JSON
+// Requires a GET with the admin token as a bearer token
+func (h *ErrorsHandler) HandleErrors(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdminMethod(w, r, http.MethodGet, h.config, h.logger) {
+		return
+	}
+
+	events := h.mediaStore.RecentErrors()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ErrorsResponse{Count: len(events), Errors: events}); err != nil {
+		h.logger.Error("Failed to encode errors response: %v", err)
+	}
+}
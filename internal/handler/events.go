@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// PersistedEvent is a verified webhook body saved for replay and debugging
+// The signature header is deliberately not stored; replays are re-signed
+type PersistedEvent struct {
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// persistEvent writes a webhook body to a per-day folder under eventsDir
+func persistEvent(eventsDir string, body []byte) error {
+	// Rotate event files by day
+	dir := filepath.Join(eventsDir, utils.GetDateString())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create events directory: %v", err)
+	}
+
+	filename, err := utils.GenerateUniqueFilename("event", ".json")
+	if err != nil {
+		return fmt.Errorf("failed to generate filename: %v", err)
+	}
+
+	data, err := json.MarshalIndent(PersistedEvent{
+		ReceivedAt: utils.Now(),
+		Body:       json.RawMessage(body),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, filename), data, 0600); err != nil {
+		return fmt.Errorf("failed to write event file: %v", err)
+	}
+
+	return nil
+}
+
+// pruneEvents removes the per-day folders under eventsDir older than retentionDays, returning how many were removed
+// Folders whose names aren't dates are left alone; a retention of 0 keeps everything
+func pruneEvents(eventsDir string, retentionDays int) (int, error) {
+	if retentionDays <= 0 {
+		return 0, nil
+	}
+
+	entries, err := os.ReadDir(eventsDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read events directory: %v", err)
+	}
+
+	today, err := time.ParseInLocation("2006-01-02", utils.GetDateString(), time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse today's date: %v", err)
+	}
+	cutoff := today.AddDate(0, 0, -retentionDays)
+
+	removed := 0
+	for _, entry := range entries {
+		day, err := time.ParseInLocation("2006-01-02", entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() || !day.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(eventsDir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove events from %s: %v", entry.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Resign returns the saved body as LINE would send it, with its signature for the given channel secret
+// Saved bodies are indented, so they are compacted first
+func (e PersistedEvent) Resign(channelSecret string) ([]byte, string, error) {
+	var body bytes.Buffer
+	if err := json.Compact(&body, e.Body); err != nil {
+		return nil, "", fmt.Errorf("failed to encode event body: %v", err)
+	}
+	return body.Bytes(), lineapi.ComputeSignature(channelSecret, body.Bytes()), nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// buildUploadCompleteFlex builds the upload-complete card with the file's name, type and size
+// and a button linking to the cloud copy
+// altText is shown in notifications and by clients that don't render Flex messages
+func buildUploadCompleteFlex(filename, mediaType string, size int64, fileLink, altText string) *linebot.FlexMessage {
+	detailRow := func(label, value string) linebot.FlexComponent {
+		return &linebot.BoxComponent{
+			Type:    linebot.FlexComponentTypeBox,
+			Layout:  linebot.FlexBoxLayoutTypeBaseline,
+			Spacing: linebot.FlexComponentSpacingTypeSm,
+			Contents: []linebot.FlexComponent{
+				&linebot.TextComponent{
+					Type:  linebot.FlexComponentTypeText,
+					Text:  label,
+					Size:  linebot.FlexTextSizeTypeSm,
+					Color: "#aaaaaa",
+					Flex:  linebot.IntPtr(1),
+				},
+				&linebot.TextComponent{
+					Type: linebot.FlexComponentTypeText,
+					Text: value,
+					Size: linebot.FlexTextSizeTypeSm,
+					Wrap: true,
+					Flex: linebot.IntPtr(3),
+				},
+			},
+		}
+	}
+
+	bubble := &linebot.BubbleContainer{
+		Type: linebot.FlexContainerTypeBubble,
+		Body: &linebot.BoxComponent{
+			Type:    linebot.FlexComponentTypeBox,
+			Layout:  linebot.FlexBoxLayoutTypeVertical,
+			Spacing: linebot.FlexComponentSpacingTypeMd,
+			Contents: []linebot.FlexComponent{
+				&linebot.TextComponent{
+					Type:   linebot.FlexComponentTypeText,
+					Text:   "📁 File backed up",
+					Weight: linebot.FlexTextWeightTypeBold,
+					Size:   linebot.FlexTextSizeTypeLg,
+				},
+				detailRow("Name", filename),
+				detailRow("Type", mediaType),
+				detailRow("Size", formatFileSize(size)),
+			},
+		},
+		Footer: &linebot.BoxComponent{
+			Type:   linebot.FlexComponentTypeBox,
+			Layout: linebot.FlexBoxLayoutTypeVertical,
+			Contents: []linebot.FlexComponent{
+				&linebot.ButtonComponent{
+					Type:   linebot.FlexComponentTypeButton,
+					Style:  linebot.FlexButtonStyleTypePrimary,
+					Action: linebot.NewURIAction("Open file", fileLink),
+				},
+			},
+		},
+	}
+
+	return linebot.NewFlexMessage(altText, bubble)
+}
+
+// formatFileSize formats a byte count for display, e.g. "1.5 MB"
+func formatFileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
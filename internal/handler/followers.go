@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// FollowerStats counts the follow and unfollow events received since the server started
+type FollowerStats struct {
+	Follows   int64 `json:"follows"`
+	Unfollows int64 `json:"unfollows"`
+	Net       int64 `json:"net"` // Followers gained since startup, negative if more users left than joined
+}
+
+// FollowerStats returns the follower counts
+func (h *WebhookHandler) FollowerStats() FollowerStats {
+	follows := h.follows.Load()
+	unfollows := h.unfollows.Load()
+
+	return FollowerStats{
+		Follows:   follows,
+		Unfollows: unfollows,
+		Net:       follows - unfollows,
+	}
+}
+
+// handleFollowEvent counts a new follower and sends them the welcome message, if enabled
+func (h *WebhookHandler) handleFollowEvent(ctx context.Context, cfg *config.Config, event *linebot.Event) {
+	logger := h.logger.ForContext(ctx)
+
+	h.follows.Add(1)
+
+	var userID string
+	if event.Source != nil {
+		userID = event.Source.UserID
+	}
+	logger.Info("User %s followed the bot", userID)
+
+	if !cfg.SendWelcome {
+		return
+	}
+
+	message := cfg.WelcomeMessage
+	if message == "" {
+		message = catalogFor(h.userLanguage(ctx, cfg, userID)).welcome
+	}
+
+	if err := h.replyOrPush(ctx, cfg, h.freshReplyToken(cfg, event), userID, linebot.NewTextMessage(message)); err != nil {
+		logger.Error("Error sending welcome message: %v", err)
+	}
+}
+
+// handleUnfollowEvent counts a lost follower and forgets their cached profile language
+// Unfollow events have no reply token, and the user can no longer be messaged
+func (h *WebhookHandler) handleUnfollowEvent(ctx context.Context, event *linebot.Event) {
+	h.unfollows.Add(1)
+
+	var userID string
+	if event.Source != nil {
+		userID = event.Source.UserID
+	}
+	h.logger.ForContext(ctx).Info("User %s unfollowed the bot", userID)
+
+	h.profiles.forget(userID)
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// How long a group or room the bot left is remembered, covering redeliveries of its earlier events
+const leftChatTTL = 24 * time.Hour
+
+// leftChats remembers the groups and rooms the bot was removed from,
+// so their redelivered messages aren't saved and nothing more is pushed to them
+type leftChats struct {
+	mu    sync.Mutex
+	chats map[string]time.Time // Group or room ID to when the bot left
+}
+
+// newLeftChats creates an empty set of left chats
+func newLeftChats() *leftChats {
+	return &leftChats{
+		chats: make(map[string]time.Time),
+	}
+}
+
+// leave records that the bot was removed from a chat, dropping entries that have expired
+func (c *leftChats) leave(chatID string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, leftAt := range c.chats {
+		if now.Sub(leftAt) >= leftChatTTL {
+			delete(c.chats, id)
+		}
+	}
+	c.chats[chatID] = now
+}
+
+// join forgets that the bot left a chat, as it has been added again
+func (c *leftChats) join(chatID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.chats, chatID)
+}
+
+// has reports whether the bot recently left a chat
+func (c *leftChats) has(chatID string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leftAt, ok := c.chats[chatID]
+	return ok && now.Sub(leftAt) < leftChatTTL
+}
+
+// handleJoinEvent greets a group or room the bot was added to, if enabled
+func (h *WebhookHandler) handleJoinEvent(ctx context.Context, cfg *config.Config, event *linebot.Event) {
+	logger := h.logger.ForContext(ctx)
+
+	chatID := getSourceID(event.Source)
+	h.left.join(chatID)
+
+	logger.Info("Bot joined %s %s", event.Source.Type, chatID)
+
+	if !cfg.SendGroupGreeting {
+		return
+	}
+
+	message := cfg.GroupGreeting
+	if message == "" {
+		message = catalogFor(cfg.DefaultLanguage).groupGreeting
+	}
+
+	if err := h.replyOrPush(ctx, cfg, h.freshReplyToken(cfg, event), chatID, linebot.NewTextMessage(message)); err != nil {
+		logger.Error("Error sending group greeting: %v", err)
+	}
+}
+
+// handleLeaveEvent forgets a group or room the bot was removed from
+// Leave events have no reply token, and the chat can no longer be messaged
+func (h *WebhookHandler) handleLeaveEvent(ctx context.Context, event *linebot.Event) {
+	chatID := getSourceID(event.Source)
+	h.left.leave(chatID, time.Now())
+
+	h.logger.ForContext(ctx).Info("Bot left %s %s", event.Source.Type, chatID)
+}
+
+// handleMemberJoinedEvent logs users joining a group or room the bot is in
+// They aren't greeted, only the chat is when the bot itself joins
+func (h *WebhookHandler) handleMemberJoinedEvent(ctx context.Context, event *linebot.Event) {
+	h.logger.ForContext(ctx).Info("%d members joined %s %s",
+		len(event.Members), event.Source.Type, getSourceID(event.Source))
+}
@@ -4,27 +4,48 @@ import (
 	"encoding/json"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 
 	"code.olipicus.com/line_file_catcher/internal/media"
 	"code.olipicus.com/line_file_catcher/internal/utils"
 )
 
+// cloudHealthTTL is how long a cloud storage check is reused, so frequent probes don't each call the backend
+const cloudHealthTTL = 30 * time.Second
+
 // HealthCheckHandler handles health check requests
 type HealthCheckHandler struct {
 	startTime  time.Time
 	logger     *utils.Logger
 	mediaStore *media.MediaStore
+
+	cloud        CloudHealth // Result of the last cloud storage check
+	cloudChecked time.Time   // Time of the last cloud storage check
+	cloudMu      sync.Mutex
 }
 
 // HealthCheckResponse represents the health check response
 type HealthCheckResponse struct {
-	Status    string      `json:"status"`
-	Uptime    string      `json:"uptime"`
-	GoVersion string      `json:"goVersion"`
-	Memory    MemStats    `json:"memory"`
-	Stats     media.Stats `json:"stats"`
-	Timestamp time.Time   `json:"timestamp"`
+	Status      string      `json:"status"`
+	Uptime      string      `json:"uptime"`
+	GoVersion   string      `json:"goVersion"`
+	Memory      MemStats    `json:"memory"`
+	Stats       media.Stats `json:"stats"`
+	Cloud       CloudHealth `json:"cloud"`
+	Paused      bool        `json:"paused"` // Processing is paused with POST /pause
+	PausedSince *time.Time  `json:"pausedSince,omitempty"`
+	Timestamp   time.Time   `json:"timestamp"`
+
+	// Work waiting for and being done by the download and upload workers
+	Queues media.QueueStats `json:"queues"`
+}
+
+// CloudHealth represents the reachability of the cloud storage backend
+type CloudHealth struct {
+	Enabled bool   `json:"enabled"`
+	Status  string `json:"status"`          // "OK", "UNREACHABLE" or "DISABLED"
+	Error   string `json:"error,omitempty"` // Reason the backend is unreachable
 }
 
 // MemStats represents memory statistics
@@ -44,15 +65,49 @@ func NewHealthCheckHandler(logger *utils.Logger, mediaStore *media.MediaStore) *
 	}
 }
 
+// checkCloud returns the reachability of the cloud storage backend, checking it at most once per cloudHealthTTL
+func (h *HealthCheckHandler) checkCloud() CloudHealth {
+	h.cloudMu.Lock()
+	defer h.cloudMu.Unlock()
+
+	if !h.cloudChecked.IsZero() && time.Since(h.cloudChecked) < cloudHealthTTL {
+		return h.cloud
+	}
+
+	cloud := CloudHealth{Status: "DISABLED"}
+	enabled, err := h.mediaStore.PingCloud()
+	if enabled {
+		cloud.Enabled = true
+		cloud.Status = "OK"
+		if err != nil {
+			h.logger.Warning("Cloud storage health check failed: %v", err)
+			cloud.Status = "UNREACHABLE"
+			cloud.Error = err.Error()
+		}
+	}
+
+	h.cloud = cloud
+	h.cloudChecked = time.Now()
+	return cloud
+}
+
 // HandleHealthCheck processes health check requests
+// The response is always 200 unless ?strict=true is passed and the service is degraded
 func (h *HealthCheckHandler) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	h.logger.Debug("Received health check request from %s", r.RemoteAddr)
+	h.logger.Debug("Received health check request from %s", clientIP(r))
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
+	// Check the cloud storage backend
+	status := "OK"
+	cloud := h.checkCloud()
+	if cloud.Status == "UNREACHABLE" {
+		status = "DEGRADED"
+	}
+
 	response := HealthCheckResponse{
-		Status:    "OK",
+		Status:    status,
 		Uptime:    time.Since(h.startTime).String(),
 		GoVersion: runtime.Version(),
 		Memory: MemStats{
@@ -62,11 +117,24 @@ func (h *HealthCheckHandler) HandleHealthCheck(w http.ResponseWriter, r *http.Re
 			NumGC:      m.NumGC,
 		},
 		Stats:     h.mediaStore.GetStats(), // Include media processing statistics
+		Cloud:     cloud,
 		Timestamp: time.Now(),
+		Queues:    h.mediaStore.QueueStats(),
+	}
+
+	// Pausing is deliberate, so it doesn't degrade the status and webhooks keep being routed here
+	if since := h.mediaStore.PausedSince(); !since.IsZero() {
+		response.Paused = true
+		response.PausedSince = &since
+	}
+
+	statusCode := http.StatusOK
+	if status != "OK" && r.URL.Query().Get("strict") == "true" {
+		statusCode = http.StatusServiceUnavailable
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		h.logger.Error("Failed to encode health check response: %v", err)
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// MediaSaver stores the media received by the webhook handler
+// It is implemented by media.MediaStore
+type MediaSaver interface {
+	// SaveMedia saves message content and returns the path of the saved file
+	SaveMedia(ctx context.Context, messageID, messageType string, content *linebot.MessageContentResponse) (string, error)
+
+	// SaveVideoPreview saves the preview image of a saved video and returns its path
+	SaveVideoPreview(ctx context.Context, videoPath string, content *linebot.MessageContentResponse) (string, error)
+
+	// SaveImagePreview saves the preview of a saved image and returns its path
+	SaveImagePreview(ctx context.Context, imagePath string, content *linebot.MessageContentResponse) (string, error)
+
+	// SaveVideoMetadata records the duration and preview of a saved video
+	SaveVideoMetadata(ctx context.Context, videoPath, messageID string, durationMs int, previewPath string) error
+
+	// RegisterUploadCallback registers a function to call once a saved file is uploaded to cloud storage
+	RegisterUploadCallback(filePath string, callback media.FileUploadCallback)
+
+	// RecordError adds a failure to the recent errors list
+	RecordError(operation string, err error)
+
+	// RecordExpired counts a message whose content LINE no longer had
+	RecordExpired()
+
+	// GetStats returns the counts of saved files since the statistics started
+	GetStats() media.Stats
+
+	// Paused reports whether processing is paused, in which case media isn't fetched or saved
+	Paused() bool
+
+	// WaitForDownloads waits for all queued downloads to complete
+	WaitForDownloads()
+}
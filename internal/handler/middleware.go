@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// RequestIDHeader is the response header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status before writing the body
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// WithLogging wraps a handler so every request gets a request ID and an access log line,
+// and a panic in the handler is logged with its stack and answered with 500 instead of crashing the server
+// The request ID is stored in the request context so the handler's log lines can be tagged with it
+func WithLogging(logger *utils.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := utils.GenerateRequestID()
+		w.Header().Set(RequestIDHeader, requestID)
+		r = r.WithContext(utils.WithRequestID(r.Context(), requestID))
+		logger := logger.ForContext(r.Context())
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			if err := recover(); err != nil {
+				// The client went away; let net/http handle it as usual
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				logger.Error("Panic handling %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+
+				// Only send an error response if the handler hasn't started one
+				if rec.status == 0 {
+					http.Error(rec, "Internal Server Error", http.StatusInternalServerError)
+				}
+			}
+
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			logger.Info("%s %s %d %v", r.Method, r.URL.Path, status, time.Since(start))
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// WithClientIP wraps a handler so the request context carries the client IP,
+// taken from the forwarding headers when the request came through a trusted proxy
+func WithClientIP(proxies *utils.TrustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(utils.WithClientIP(r.Context(), proxies.ClientIP(r)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the client IP set by WithClientIP, or the direct peer's address without it
+func clientIP(r *http.Request) string {
+	if ip := utils.ClientIPFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// WithStatsAuth wraps a handler so it requires STATS_AUTH_TOKEN, either as a bearer token
+// or as the basic auth password (any username), and answers 401 otherwise
+// Requests pass through unchecked when no token is configured
+func WithStatsAuth(cfg *config.Config, logger *utils.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.StatsAuthToken == "" || hasStatsToken(r, cfg.StatsAuthToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Warning("Rejected unauthenticated %s from %s", r.URL.Path, clientIP(r))
+		w.Header().Set("WWW-Authenticate", `Basic realm="stats"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// hasStatsToken reports whether a request carries the token as a bearer token or basic auth password
+func hasStatsToken(r *http.Request, token string) bool {
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, provided, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// PauseHandler handles requests to pause and resume processing for maintenance
+type PauseHandler struct {
+	config     *config.Config
+	logger     *utils.Logger
+	mediaStore *media.MediaStore
+}
+
+// PauseResponse represents the response for the pause and resume endpoints
+type PauseResponse struct {
+	Status      string     `json:"status"`
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"pausedSince,omitempty"`
+	Changed     bool       `json:"changed"` // False if processing was already in the requested state
+}
+
+// NewPauseHandler creates a new pause handler
+func NewPauseHandler(cfg *config.Config, logger *utils.Logger, mediaStore *media.MediaStore) *PauseHandler {
+	return &PauseHandler{
+		config:     cfg,
+		logger:     logger,
+		mediaStore: mediaStore,
+	}
+}
+
+// HandlePause stops downloading and uploading while webhooks keep being acknowledged
+// Requires a POST with the admin token as a bearer token
+func (h *PauseHandler) HandlePause(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.config, h.logger) {
+		return
+	}
+
+	changed := h.mediaStore.Pause()
+	h.logger.Info("Pause requested by %s (changed: %v)", clientIP(r), changed)
+
+	h.writeResponse(w, changed)
+}
+
+// HandleResume restarts downloading and uploading
+// Requires a POST with the admin token as a bearer token
+func (h *PauseHandler) HandleResume(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.config, h.logger) {
+		return
+	}
+
+	changed := h.mediaStore.Resume()
+	h.logger.Info("Resume requested by %s (changed: %v)", clientIP(r), changed)
+
+	h.writeResponse(w, changed)
+}
+
+// writeResponse writes the current pause state
+func (h *PauseHandler) writeResponse(w http.ResponseWriter, changed bool) {
+	response := PauseResponse{
+		Status:  "ok",
+		Changed: changed,
+	}
+	if since := h.mediaStore.PausedSince(); !since.IsZero() {
+		response.Paused = true
+		response.PausedSince = &since
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Failed to encode pause response: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Postback actions, sent by rich menu buttons as postback data such as "action=stats"
+const (
+	postbackActionStats = "stats" // Reply with the saved file counts
+	postbackActionHelp  = "help"  // Reply with what the bot does
+)
+
+// statsMediaTypes is the order media types are listed in a stats reply
+var statsMediaTypes = []string{"image", "video", "audio", "file"}
+
+// handlePostbackEvent answers a postback, such as a rich menu tap, whose data names a known action
+// The data is query-string style; postbacks with an unknown or missing action are ignored
+func (h *WebhookHandler) handlePostbackEvent(ctx context.Context, cfg *config.Config, event *linebot.Event) {
+	logger := h.logger.ForContext(ctx)
+
+	if event.Postback == nil || event.Source == nil {
+		return
+	}
+
+	values, err := url.ParseQuery(event.Postback.Data)
+	if err != nil {
+		logger.Debug("Ignoring postback with unparsable data %q: %v", event.Postback.Data, err)
+		return
+	}
+
+	catalog := catalogFor(h.userLanguage(ctx, cfg, event.Source.UserID))
+
+	var message string
+	switch action := values.Get("action"); action {
+	case postbackActionStats:
+		message = catalog.statsReply(h.mediaStore.GetStats())
+	case postbackActionHelp:
+		message = catalog.help
+	default:
+		logger.Debug("Ignoring postback with unknown action %q", action)
+		return
+	}
+
+	logger.Info("Answering %s postback from %s", values.Get("action"), getSourceID(event.Source))
+
+	if err := h.replyOrPush(ctx, cfg, h.freshReplyToken(cfg, event), getSourceID(event.Source), linebot.NewTextMessage(message)); err != nil {
+		logger.Error("Error answering postback: %v", err)
+	}
+}
+
+// statsReply describes the files saved since the statistics started, e.g. "3 images and 1 video (2.5 MB)"
+func (c messageCatalog) statsReply(stats media.Stats) string {
+	counts := map[string]int{
+		"image": stats.ImageCount,
+		"video": stats.VideoCount,
+		"audio": stats.AudioCount,
+		"file":  stats.FileCount,
+	}
+
+	var types []string
+	for _, mediaType := range statsMediaTypes {
+		if counts[mediaType] > 0 {
+			types = append(types, mediaType)
+		}
+	}
+
+	since := utils.FormatDate(stats.StartTime)
+	if len(types) == 0 {
+		return utils.FormatTemplate(c.statsEmpty, map[string]string{"since": since})
+	}
+	return utils.FormatTemplate(c.stats, map[string]string{
+		"summary": c.summary(types, counts),
+		"size":    fmt.Sprintf("%.1f MB", float64(stats.TotalBytes)/(1<<20)),
+		"since":   since,
+	})
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// Profile language cache settings
+const (
+	profileCacheTTL        = 24 * time.Hour // How long a user's language is remembered
+	profileCacheMaxEntries = 10000          // Expired entries are purged when the cache reaches this size
+)
+
+// profileLanguageCache remembers users' profile languages so the profile API isn't called for every message
+// Failed lookups are cached too, as an empty language, so they aren't retried for every message
+type profileLanguageCache struct {
+	mu      sync.Mutex
+	entries map[string]profileLanguage // User ID to language
+}
+
+// profileLanguage is a cached profile language and when it was fetched
+type profileLanguage struct {
+	language  string
+	fetchedAt time.Time
+}
+
+// newProfileLanguageCache creates an empty profile language cache
+func newProfileLanguageCache() *profileLanguageCache {
+	return &profileLanguageCache{
+		entries: make(map[string]profileLanguage),
+	}
+}
+
+// get returns the cached language of a user, if it hasn't expired
+func (c *profileLanguageCache) get(userID string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok || now.Sub(entry.fetchedAt) >= profileCacheTTL {
+		return "", false
+	}
+	return entry.language, true
+}
+
+// put caches the language of a user
+func (c *profileLanguageCache) put(userID, language string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= profileCacheMaxEntries {
+		for id, entry := range c.entries {
+			if now.Sub(entry.fetchedAt) >= profileCacheTTL {
+				delete(c.entries, id)
+			}
+		}
+	}
+
+	// Still full of fresh entries, so start over rather than grow without bound
+	if len(c.entries) >= profileCacheMaxEntries {
+		c.entries = make(map[string]profileLanguage)
+	}
+
+	c.entries[userID] = profileLanguage{language: language, fetchedAt: now}
+}
+
+// forget removes a user's cached language, e.g. once they unfollow the bot
+func (c *profileLanguageCache) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
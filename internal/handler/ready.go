@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// ReadinessHandler handles readiness probe requests
+type ReadinessHandler struct {
+	config *config.Config
+	logger *utils.Logger
+}
+
+// ReadinessResponse represents the readiness probe response
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewReadinessHandler creates a new readiness handler
+// The media store is set up before the server starts listening, so only the storage directory needs checking
+func NewReadinessHandler(cfg *config.Config, logger *utils.Logger) *ReadinessHandler {
+	return &ReadinessHandler{
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// HandleReady processes readiness requests
+// Returns 503 while the storage directory is not writable
+func (h *ReadinessHandler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug("Received readiness request from %s", clientIP(r))
+
+	ready := true
+	checks := make(map[string]string)
+
+	// Check that the storage directory is writable
+	if err := utils.CheckWritable(h.config.StorageDir); err != nil {
+		h.logger.Warning("Storage directory is not writable: %v", err)
+		checks["storage"] = err.Error()
+		ready = false
+	} else {
+		checks["storage"] = "OK"
+	}
+
+	response := ReadinessResponse{
+		Status: "READY",
+		Checks: checks,
+	}
+	statusCode := http.StatusOK
+	if !ready {
+		response.Status = "NOT_READY"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Failed to encode readiness response: %v", err)
+		return
+	}
+
+	h.logger.Debug("Readiness request processed successfully")
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// messageRetryDelay is the wait before the first retry of a failed message, doubled for each further retry
+const messageRetryDelay = 200 * time.Millisecond
+
+// sendWithRetry calls send, retrying transient failures up to MESSAGE_RETRY_COUNT times with backoff
+// Errors LINE won't recover from, such as an invalid recipient or reply token, are returned immediately
+func (h *WebhookHandler) sendWithRetry(ctx context.Context, cfg *config.Config, description string, send func() error) error {
+	logger := h.logger.ForContext(ctx)
+	retries := cfg.MessageRetryCount
+
+	delay := messageRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if err == nil {
+			if attempt > 0 {
+				logger.Info("Sent %s after %d retries", description, attempt)
+			}
+			return nil
+		}
+
+		if !isTransientMessageError(err) {
+			return err
+		}
+		if attempt >= retries {
+			if retries > 0 {
+				logger.Error("Giving up on %s after %d retries: %v", description, retries, err)
+			}
+			return err
+		}
+
+		logger.Warning("Failed to send %s, retrying in %v: %v", description, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isTransientMessageError reports whether a failed reply or push may succeed if sent again
+// LINE's rate limiting and server errors are transient, as are network errors; other API errors are not
+func isTransientMessageError(err error) bool {
+	var apiErr *linebot.APIError
+	if !errors.As(err, &apiErr) {
+		return !errors.Is(err, context.Canceled)
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
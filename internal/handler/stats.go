@@ -4,41 +4,73 @@ import (
 	"encoding/json"
 	"net/http"
 	"runtime"
+	"strconv"
 	"time"
 
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
 	"code.olipicus.com/line_file_catcher/internal/media"
 	"code.olipicus.com/line_file_catcher/internal/utils"
 )
 
 // StatsResponse represents the response for the stats endpoint
 type StatsResponse struct {
-	Status        string                 `json:"status"`
-	Uptime        string                 `json:"uptime"`
-	FileStats     media.Stats            `json:"fileStats"`
-	CloudStats    map[string]interface{} `json:"cloudStats"`
-	MemoryStats   map[string]interface{} `json:"memoryStats"`
-	ProcessUptime string                 `json:"processUptime"`
+	Status        string                    `json:"status"`
+	Uptime        string                    `json:"uptime"`
+	FileStats     media.Stats               `json:"fileStats"`
+	FileSummary   media.StatsSummary        `json:"fileSummary"` // Rates and averages derived from fileStats
+	CloudStats    interface{}               `json:"cloudStats"`  // media.CloudStats with ?format=structured, otherwise its map layout
+	ContentFetch  lineapi.ContentFetchStats `json:"contentFetchStats"`
+	Queues        media.QueueStats          `json:"queues"`
+	Followers     *FollowerStats            `json:"followerStats,omitempty"`
+	Webhook       *WebhookStats             `json:"webhookStats,omitempty"`
+	MemoryStats   map[string]interface{}    `json:"memoryStats"`
+	ProcessUptime string                    `json:"processUptime"`
+}
+
+// StatsResetResponse represents the response for the stats reset endpoint
+type StatsResetResponse struct {
+	Status     string    `json:"status"`
+	ResetAt    time.Time `json:"resetAt"`
+	CloudReset bool      `json:"cloudReset"`
 }
 
 // StatsHandler struct to handle stats requests
 type StatsHandler struct {
+	config     *config.Config
 	startTime  time.Time
 	logger     *utils.Logger
 	mediaStore *media.MediaStore
+	lineClient *lineapi.Client
+	followers  func() FollowerStats // Source of the follower counts, if tracked
+	webhook    func() WebhookStats  // Source of the webhook request counts, if tracked
 }
 
 // NewStatsHandler creates a new stats handler
-func NewStatsHandler(logger *utils.Logger, mediaStore *media.MediaStore) *StatsHandler {
+func NewStatsHandler(cfg *config.Config, logger *utils.Logger, mediaStore *media.MediaStore, lineClient *lineapi.Client) *StatsHandler {
 	return &StatsHandler{
-		startTime:  time.Now(),
+		config:     cfg,
+		startTime:  utils.Now(),
 		logger:     logger,
 		mediaStore: mediaStore,
+		lineClient: lineClient,
 	}
 }
 
+// TrackFollowers adds the follower counts from a source such as WebhookHandler.FollowerStats to the stats
+func (h *StatsHandler) TrackFollowers(source func() FollowerStats) {
+	h.followers = source
+}
+
+// TrackWebhook adds the webhook request counts from a source such as WebhookHandler.WebhookStats to the stats
+func (h *StatsHandler) TrackWebhook(source func() WebhookStats) {
+	h.webhook = source
+}
+
 // HandleStats processes stats requests
+// With ?format=structured the cloud statistics use typed, numeric fields instead of the map layout
 func (h *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
-	h.logger.Debug("Received stats request from %s", r.RemoteAddr)
+	h.logger.Debug("Received stats request from %s", clientIP(r))
 
 	// Get memory statistics
 	var memStats runtime.MemStats
@@ -54,15 +86,34 @@ func (h *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	// Get cloud storage statistics
 	cloudStats := h.mediaStore.GetCloudStats()
+	var cloudOutput interface{} = cloudStats.Map()
+	if r.URL.Query().Get("format") == "structured" {
+		cloudOutput = cloudStats
+	}
+
+	// Derive the rates from the same snapshot that is returned
+	fileStats := h.mediaStore.GetStats()
 
 	// Create the response
 	response := StatsResponse{
 		Status:        "ok",
-		Uptime:        time.Since(h.startTime).String(),
-		FileStats:     h.mediaStore.GetStats(),
-		CloudStats:    cloudStats,
+		Uptime:        utils.Now().Sub(h.startTime).String(),
+		FileStats:     fileStats,
+		FileSummary:   fileStats.Summary(utils.Now()),
+		CloudStats:    cloudOutput,
+		ContentFetch:  h.lineClient.GetContentFetchStats(),
+		Queues:        h.mediaStore.QueueStats(),
 		MemoryStats:   memoryStats,
-		ProcessUptime: time.Since(h.startTime).String(),
+		ProcessUptime: utils.Now().Sub(h.startTime).String(),
+	}
+
+	if h.followers != nil {
+		followers := h.followers()
+		response.Followers = &followers
+	}
+	if h.webhook != nil {
+		webhook := h.webhook()
+		response.Webhook = &webhook
 	}
 
 	// Set content type and encode the response as JSON
@@ -75,3 +126,62 @@ func (h *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	h.logger.Debug("Stats request processed successfully")
 }
+
+// SourceStatsResponse represents the response for the per-source stats endpoint
+type SourceStatsResponse struct {
+	Count   int                 `json:"count"`
+	Limit   int                 `json:"limit"`   // Most sources tracked; smaller ones are dropped beyond it
+	Sources []media.SourceStats `json:"sources"` // Largest volume first
+}
+
+// HandleSourceStats lists the users, groups and rooms that sent media, by volume
+// ?limit=N returns only the top N; requires a GET with the admin token as source IDs identify users
+func (h *StatsHandler) HandleSourceStats(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdminMethod(w, r, http.MethodGet, h.config, h.logger) {
+		return
+	}
+
+	sources := h.mediaStore.SourceStats()
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(sources) {
+		sources = sources[:limit]
+	}
+
+	response := SourceStatsResponse{
+		Count:   len(sources),
+		Limit:   h.mediaStore.SourceStatsLimit(),
+		Sources: sources,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Failed to encode source stats response: %v", err)
+	}
+}
+
+// HandleStatsReset zeroes the file statistics, and the cloud statistics with ?cloud=true
+// Requires a POST with the admin token as a bearer token
+func (h *StatsHandler) HandleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.config, h.logger) {
+		return
+	}
+
+	h.mediaStore.ResetStats()
+
+	cloudReset := r.URL.Query().Get("cloud") == "true"
+	if cloudReset {
+		h.mediaStore.ResetCloudStats()
+	}
+
+	h.logger.Info("Statistics reset by %s (cloud: %v)", clientIP(r), cloudReset)
+
+	response := StatsResetResponse{
+		Status:     "ok",
+		ResetAt:    h.mediaStore.GetStats().StartTime,
+		CloudReset: cloudReset,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Failed to encode stats reset response: %v", err)
+	}
+}
@@ -1,136 +1,500 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"code.olipicus.com/line_file_catcher/internal/config"
 	"code.olipicus.com/line_file_catcher/internal/lineapi"
 	"code.olipicus.com/line_file_catcher/internal/media"
 	"code.olipicus.com/line_file_catcher/internal/utils"
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 )
 
+// defaultWebhookRateLimit is used when WEBHOOK_RATE_LIMIT is not configured
+const defaultWebhookRateLimit = 60
+
+// receivedMedia records a saved media file awaiting confirmation
+type receivedMedia struct {
+	mediaType  string
+	replyToken string
+	issuedAt   time.Time // When the event, and so its reply token, was created
+	sourceID   string
+	userID     string // Sender, whose profile language is used for the confirmation
+	compressed bool   // Stored with zstd compression
+}
+
 // WebhookHandler handles LINE webhook events
 type WebhookHandler struct {
+	config      atomic.Pointer[config.Config] // Replaced when the configuration is reloaded
 	lineClient  *lineapi.Client
-	mediaStore  *media.MediaStore
+	mediaStore  MediaSaver
 	logger      *utils.Logger
 	rateLimiter *utils.RateLimiter
+	dedup       *messageDedup          // Recently processed message IDs
+	profiles    *profileLanguageCache  // Users' profile languages
+	botID       atomic.Pointer[string] // The bot's own user ID, once fetched
+	follows     atomic.Int64           // Follow events since startup
+	unfollows   atomic.Int64           // Unfollow events since startup
+	left        *leftChats             // Groups and rooms the bot was removed from
+	sigFailures atomic.Int64           // Requests rejected for an invalid signature since startup
+	eventsDay   atomic.Pointer[string] // Day old saved events were last pruned
 }
 
 // NewWebhookHandler creates a new webhook handler
-func NewWebhookHandler(lineClient *lineapi.Client, mediaStore *media.MediaStore, logger *utils.Logger) *WebhookHandler {
-	// Create a rate limiter that allows 60 requests per minute (1 request per second on average)
-	rateLimiter := utils.NewRateLimiter(60, time.Minute)
+func NewWebhookHandler(cfg *config.Config, lineClient *lineapi.Client, mediaStore MediaSaver, logger *utils.Logger) *WebhookHandler {
+	// Create a rate limiter that allows the configured number of requests per minute
+	rateLimiter := utils.NewRateLimiter(webhookRateLimit(cfg), time.Minute)
 
-	return &WebhookHandler{
+	h := &WebhookHandler{
 		lineClient:  lineClient,
 		mediaStore:  mediaStore,
 		logger:      logger,
 		rateLimiter: rateLimiter,
+		dedup:       newMessageDedup(),
+		profiles:    newProfileLanguageCache(),
+		left:        newLeftChats(),
+	}
+	h.config.Store(cfg)
+
+	return h
+}
+
+// webhookRateLimit returns the configured webhook requests per minute
+func webhookRateLimit(cfg *config.Config) int {
+	if cfg.WebhookRateLimit <= 0 {
+		return defaultWebhookRateLimit
 	}
+	return cfg.WebhookRateLimit
+}
+
+// ApplyConfig applies the hot-reloadable settings of a reloaded configuration
+func (h *WebhookHandler) ApplyConfig(cfg *config.Config) {
+	updated := WithReloadableSettings(h.config.Load(), cfg)
+	h.config.Store(&updated)
+
+	h.rateLimiter.SetRate(webhookRateLimit(&updated))
+}
+
+// WithReloadableSettings returns a copy of current with the settings ApplyConfig can change at runtime taken from reloaded
+// Reply templates and languages, non-media, welcome and group greeting replies, confirmation, message retry, event persistence, captured types, body size, dedup window, event age and rate limit settings take effect immediately
+func WithReloadableSettings(current, reloaded *config.Config) config.Config {
+	updated := *current
+	updated.WebhookRateLimit = reloaded.WebhookRateLimit
+	updated.MaxWebhookBodyBytes = reloaded.MaxWebhookBodyBytes
+	updated.DedupWindowSeconds = reloaded.DedupWindowSeconds
+	updated.MaxEventAge = reloaded.MaxEventAge
+	updated.CaptureTypes = reloaded.CaptureTypes
+	updated.SendConfirmation = reloaded.SendConfirmation
+	updated.ReplyTokenMaxAgeSeconds = reloaded.ReplyTokenMaxAgeSeconds
+	updated.MessageRetryCount = reloaded.MessageRetryCount
+	updated.ReplyTemplate = reloaded.ReplyTemplate
+	updated.BatchReplyTemplate = reloaded.BatchReplyTemplate
+	updated.DriveLinkTemplate = reloaded.DriveLinkTemplate
+	updated.DriveLinkFlex = reloaded.DriveLinkFlex
+	updated.DefaultLanguage = reloaded.DefaultLanguage
+	updated.ProfileLanguage = reloaded.ProfileLanguage
+	updated.AutoReplyNonMedia = reloaded.AutoReplyNonMedia
+	updated.AutoReplyNonMediaInGroups = reloaded.AutoReplyNonMediaInGroups
+	updated.NonMediaReplyTemplate = reloaded.NonMediaReplyTemplate
+	updated.SendWelcome = reloaded.SendWelcome
+	updated.WelcomeMessage = reloaded.WelcomeMessage
+	updated.SendGroupGreeting = reloaded.SendGroupGreeting
+	updated.GroupGreeting = reloaded.GroupGreeting
+	updated.PersistEvents = reloaded.PersistEvents
+	updated.EventsDir = reloaded.EventsDir
+	updated.EventsRetentionDays = reloaded.EventsRetentionDays
+	return updated
+}
+
+// WebhookStats counts the webhook requests rejected since the server started
+type WebhookStats struct {
+	SignatureFailures int64 `json:"signatureFailures"` // Requests whose X-Line-Signature didn't match the body
+}
+
+// WebhookStats returns the webhook request counts
+func (h *WebhookHandler) WebhookStats() WebhookStats {
+	return WebhookStats{SignatureFailures: h.sigFailures.Load()}
 }
 
 // HandleWebhook processes webhook requests from LINE
 func (h *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	h.logger.Info("Received webhook request from %s", r.RemoteAddr)
+	// Tag the request's log lines, including those of its downloads and uploads, with a request ID
+	// The logging middleware normally assigns one already
+	if utils.RequestIDFromContext(r.Context()) == "" {
+		r = r.WithContext(utils.WithRequestID(r.Context(), utils.GenerateRequestID()))
+	}
+	logger := h.logger.ForContext(r.Context())
+
+	logger.Info("Received webhook request from %s", clientIP(r))
+
+	// Use the same configuration for the whole request even if it is reloaded meanwhile
+	cfg := h.config.Load()
 
 	// Apply rate limiting
 	if !h.rateLimiter.Allow() {
-		h.logger.Warning("Rate limit exceeded for request from %s", r.RemoteAddr)
+		logger.Warning("Rate limit exceeded for request from %s", clientIP(r))
 		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(h.rateLimiter.ResetInterval().Seconds())))
 		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 		return
 	}
 
-	// Verify signature
-	events, err := h.lineClient.GetBot().ParseRequest(r)
+	// Cap the body size so oversized requests can't exhaust memory
+	if cfg.MaxWebhookBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxWebhookBodyBytes)
+	}
+
+	// Read the body so the signature can be verified independently of the SDK
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		if err == linebot.ErrInvalidSignature {
-			h.logger.Error("Invalid signature in webhook request: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			logger.Warning("Webhook request from %s exceeds body limit of %d bytes", clientIP(r), maxBytesErr.Limit)
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 			return
 		}
-		h.logger.Error("Error parsing webhook request: %v", err)
+		logger.Error("Error reading webhook request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	// Decompress bodies compressed by a proxy; LINE signs the uncompressed JSON
+	body, err = decodeBody(r, body, cfg.MaxWebhookBodyBytes)
+	if err != nil {
+		if errors.Is(err, errDecodedBodyTooLarge) {
+			logger.Warning("Decompressed webhook request from %s exceeds body limit", clientIP(r))
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		logger.Error("Error decoding webhook request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Verify signature
+	signature := r.Header.Get("X-Line-Signature")
+	if !lineapi.VerifySignature(h.lineClient.GetChannelSecret(), body, signature) {
+		h.sigFailures.Add(1)
+		logger.Error("Invalid signature in webhook request from %s", clientIP(r))
+		logger.Debug("Signature mismatch: received %q, computed %q",
+			signature, lineapi.ComputeSignature(h.lineClient.GetChannelSecret(), body))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Save the verified body for later replay
+	if cfg.PersistEvents {
+		if err := persistEvent(cfg.EventsDir, body); err != nil {
+			logger.Error("Failed to persist webhook event: %v", err)
+		}
+
+		// Prune once a day, when the first event of the day is saved
+		today := utils.GetDateString()
+		if previous := h.eventsDay.Swap(&today); previous == nil || *previous != today {
+			removed, err := pruneEvents(cfg.EventsDir, cfg.EventsRetentionDays)
+			if err != nil {
+				logger.Error("Failed to prune saved webhook events: %v", err)
+			} else if removed > 0 {
+				logger.Info("Removed %d days of saved webhook events older than %d days", removed, cfg.EventsRetentionDays)
+			}
+		}
+	}
+
+	// Restore the body for the SDK parser
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	events, err := h.lineClient.GetBot().ParseRequest(r)
+	if err != nil {
+		logger.Error("Error parsing webhook request body: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	h.logger.Info("Received %d events in webhook request", len(events))
+	logger.Info("Received %d events in webhook request", len(events))
 
+	// Collect saved media so confirmations can be sent once per request
+	var received []receivedMedia
+	maxAge := time.Duration(cfg.MaxEventAge) * time.Second
+	now := time.Now()
 	for i, event := range events {
-		h.logger.Debug("Processing event %d of type %s", i+1, event.Type)
-		if err := h.handleEvent(event); err != nil {
-			h.logger.Error("Error handling event: %v", err)
+		logger.Debug("Processing event %d of type %s", i+1, event.Type)
+		// Old events may be captured payloads replayed with their valid signature
+		if isStaleEvent(event, maxAge, now) {
+			logger.Warning("Skipping stale %s event %s sent at %s, %v ago (MAX_EVENT_AGE is %v)",
+				event.Type, event.WebhookEventID, event.Timestamp.Format(time.RFC3339), now.Sub(event.Timestamp).Round(time.Second), maxAge)
+			continue
+		}
+		item, err := h.handleEvent(r.Context(), cfg, event)
+		if err != nil {
+			logger.Error("Error handling event: %v", err)
+			continue
+		}
+		if item != nil {
+			received = append(received, *item)
 		}
 	}
 
+	h.sendConfirmations(r.Context(), cfg, received)
+
 	w.WriteHeader(http.StatusOK)
-	h.logger.Info("Webhook request processed successfully")
+	logger.Info("Webhook request processed successfully")
+}
+
+// isStaleEvent reports whether an event was sent more than maxAge ago; a maxAge of 0 disables the check
+func isStaleEvent(event *linebot.Event, maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && !event.Timestamp.IsZero() && now.Sub(event.Timestamp) > maxAge
 }
 
 // handleEvent processes a single LINE event
-func (h *WebhookHandler) handleEvent(event *linebot.Event) error {
+// Returns the saved media awaiting confirmation, if any
+func (h *WebhookHandler) handleEvent(ctx context.Context, cfg *config.Config, event *linebot.Event) (*receivedMedia, error) {
 	switch event.Type {
 	case linebot.EventTypeMessage:
-		return h.handleMessageEvent(event)
+		return h.handleMessageEvent(ctx, cfg, event)
+	case linebot.EventTypeFollow:
+		h.handleFollowEvent(ctx, cfg, event)
+		return nil, nil
+	case linebot.EventTypeUnfollow:
+		h.handleUnfollowEvent(ctx, event)
+		return nil, nil
+	case linebot.EventTypeJoin:
+		h.handleJoinEvent(ctx, cfg, event)
+		return nil, nil
+	case linebot.EventTypeLeave:
+		h.handleLeaveEvent(ctx, event)
+		return nil, nil
+	case linebot.EventTypeMemberJoined:
+		h.handleMemberJoinedEvent(ctx, event)
+		return nil, nil
+	case linebot.EventTypePostback:
+		h.handlePostbackEvent(ctx, cfg, event)
+		return nil, nil
 	default:
-		// Ignore other event types
-		h.logger.Debug("Ignoring non-message event type: %s", event.Type)
-		return nil
+		// Ignore other event types, logging them in full to help debug integrations
+		h.logUnhandledEvent(ctx, event)
+		return nil, nil
+	}
+}
+
+// logUnhandledEvent logs an ignored event with its source and JSON payload when debug logging is on
+func (h *WebhookHandler) logUnhandledEvent(ctx context.Context, event *linebot.Event) {
+	logger := h.logger.ForContext(ctx)
+	if !logger.DebugEnabled() {
+		return
 	}
+
+	sourceType, sourceID := "unknown", ""
+	if event.Source != nil {
+		sourceType, sourceID = string(event.Source.Type), getSourceID(event.Source)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Debug("Ignoring %s event %s from %s %s (payload unavailable: %v)",
+			event.Type, event.WebhookEventID, sourceType, sourceID, err)
+		return
+	}
+	logger.Debug("Ignoring %s event %s from %s %s sent at %s: %s",
+		event.Type, event.WebhookEventID, sourceType, sourceID, event.Timestamp.Format(time.RFC3339), payload)
 }
 
 // handleMessageEvent processes a message event
-func (h *WebhookHandler) handleMessageEvent(event *linebot.Event) error {
+func (h *WebhookHandler) handleMessageEvent(ctx context.Context, cfg *config.Config, event *linebot.Event) (*receivedMedia, error) {
+	logger := h.logger.ForContext(ctx)
+
 	// Since event.Message is an interface, we need to check its type
 	if !lineapi.IsMedia(event.Message) {
-		// Ignore non-media messages
-		h.logger.Debug("Ignoring non-media message type")
-		return nil
+		// Ignore non-media messages, only answering text if configured
+		logger.Debug("Ignoring non-media message type")
+		if _, ok := event.Message.(*linebot.TextMessage); ok {
+			h.replyNonMedia(ctx, cfg, event)
+		}
+		return nil, nil
 	}
 
 	// Get media type and ID
 	mediaType := lineapi.GetMediaType(event.Message)
 	messageID := getMessageID(event.Message)
 
-	h.logger.Info("Processing %s message with ID: %s from user: %s",
+	// Don't save redelivered messages from a group or room the bot has since left
+	if h.left.has(getSourceID(event.Source), time.Now()) {
+		logger.Info("Ignoring %s message %s: the bot has left %s", mediaType, messageID, getSourceID(event.Source))
+		return nil, nil
+	}
+
+	// Ignore media types this deployment doesn't capture, before downloading anything
+	if !cfg.CapturesType(mediaType) {
+		logger.Debug("Ignoring %s message %s: type is not in CAPTURE_TYPES", mediaType, messageID)
+		return nil, nil
+	}
+
+	// Acknowledge but don't fetch anything while processing is paused for maintenance
+	if h.mediaStore.Paused() {
+		logger.Info("Processing is paused, skipping %s message %s", mediaType, messageID)
+		return nil, nil
+	}
+
+	logger.Info("Processing %s message with ID: %s from user: %s",
 		mediaType, messageID, event.Source.UserID)
 
+	// Skip duplicate deliveries of a message that was recently processed
+	if window := time.Duration(cfg.DedupWindowSeconds) * time.Second; window > 0 {
+		if !h.dedup.claim(messageID, window, time.Now()) {
+			logger.Info("Skipping duplicate delivery of message %s", messageID)
+			return nil, nil
+		}
+	}
+
 	// Get content directly using the LINE client
-	content, err := h.lineClient.GetMessageContent(messageID)
+	content, err := h.lineClient.GetMessageContent(ctx, messageID)
+	if errors.Is(err, lineapi.ErrFetchInProgress) {
+		// A redelivery of a message that is already being saved
+		logger.Info("Skipping message %s, it is already being processed", messageID)
+		return nil, nil
+	}
+	if errors.Is(err, lineapi.ErrContentExpired) {
+		// Not a failure worth retrying, so a redelivery stays deduplicated
+		logger.Warning("Content of %s message %s is no longer available on LINE: %v", mediaType, messageID, err)
+		h.mediaStore.RecordExpired()
+		h.sendFailureMessage(ctx, cfg, h.freshReplyToken(cfg, event), getSourceID(event.Source), event.Source.UserID, mediaType, err)
+		return nil, nil
+	}
 	if err != nil {
-		h.logger.Error("Failed to get message content: %v", err)
-		return err
+		logger.Error("Failed to get message content: %v", err)
+		h.mediaStore.RecordError("fetch", fmt.Errorf("message %s: %v", messageID, err))
+		h.dedup.forget(messageID)
+		return nil, err
+	}
+	defer content.Content.Close()
+
+	// Record the sender for the cloud folder template and the metadata sidecar
+	ctx = media.WithUserID(ctx, event.Source.UserID)
+	ctx = media.WithEventSource(ctx, media.EventSource{
+		Type:      string(event.Source.Type),
+		ID:        getSourceID(event.Source),
+		Timestamp: event.Timestamp,
+	})
+
+	// Keep the original file name so its extension can be used if the content type is unknown
+	if file, ok := event.Message.(*linebot.FileMessage); ok {
+		ctx = media.WithFileName(ctx, file.FileName)
 	}
 
 	// Process the content using our MediaStore
-	filePath, err := h.mediaStore.SaveMedia(messageID, mediaType, content)
+	filePath, err := h.mediaStore.SaveMedia(ctx, messageID, mediaType, content)
 	if err != nil {
-		h.logger.Error("Failed to save media: %v", err)
-		return err
+		logger.Error("Failed to save media: %v", err)
+		h.mediaStore.RecordError("save", fmt.Errorf("message %s: %v", messageID, err))
+		h.dedup.forget(messageID)
+		h.sendFailureMessage(ctx, cfg, h.freshReplyToken(cfg, event), getSourceID(event.Source), event.Source.UserID, mediaType, err)
+		return nil, err
 	}
 
-	h.logger.Info("Media saved to: %s", filePath)
+	logger.Info("Media saved to: %s", filePath)
+
+	// Keep the video's preview image and duration alongside it
+	if video, ok := event.Message.(*linebot.VideoMessage); ok && cfg.SavePreviews {
+		h.saveVideoExtras(ctx, filePath, video)
+	}
+
+	// Keep LINE's lower resolution preview alongside the original image
+	if image, ok := event.Message.(*linebot.ImageMessage); ok && cfg.SaveImagePreview {
+		h.saveImagePreview(ctx, filePath, image)
+	}
+
+	// Skip confirmation and Drive link messages when disabled
+	if !cfg.SendConfirmation {
+		logger.Debug("Confirmation messages disabled, not notifying user")
+		return nil, nil
+	}
 
 	// Get user ID for sending follow-up messages
 	userID := event.Source.UserID
 
 	// Register a callback for when the file is uploaded to Google Drive
-	h.mediaStore.RegisterUploadCallback(filePath, func(filename string, fileLink string) error {
+	h.mediaStore.RegisterUploadCallback(filePath, func(ctx context.Context, filename string, fileLink string) error {
 		// Send a message with the Google Drive link
-		return h.sendDriveLinkMessage(userID, filename, fileLink)
+		return h.sendDriveLinkMessage(ctx, userID, filePath, mediaType, filename, fileLink)
 	})
 
-	// Optional: Send a confirmation message back to the user
-	if replyToken := event.ReplyToken; replyToken != "" {
-		if err := h.sendConfirmationMessage(replyToken, mediaType); err != nil {
-			h.logger.Error("Error sending confirmation: %v", err)
+	return &receivedMedia{
+		mediaType:  mediaType,
+		replyToken: event.ReplyToken,
+		issuedAt:   event.Timestamp,
+		sourceID:   getSourceID(event.Source),
+		userID:     event.Source.UserID,
+		compressed: media.IsCompressed(filePath),
+	}, nil
+}
+
+// saveVideoExtras saves a video's preview image and its metadata sidecar
+// Failures are logged but don't fail the message, since the video itself was saved
+func (h *WebhookHandler) saveVideoExtras(ctx context.Context, videoPath string, video *linebot.VideoMessage) {
+	logger := h.logger.ForContext(ctx)
+
+	var previewPath string
+	preview, err := h.lineClient.GetMessagePreview(ctx, video.ID)
+	if err != nil {
+		logger.Warning("Failed to get preview for video %s: %v", video.ID, err)
+	} else {
+		previewPath, err = h.mediaStore.SaveVideoPreview(ctx, videoPath, preview)
+		preview.Content.Close()
+		if err != nil {
+			logger.Warning("Failed to save preview for video %s: %v", video.ID, err)
 		}
 	}
 
-	return nil
+	if err := h.mediaStore.SaveVideoMetadata(ctx, videoPath, video.ID, video.Duration, previewPath); err != nil {
+		logger.Warning("Failed to save metadata for video %s: %v", video.ID, err)
+	}
+}
+
+// saveImagePreview saves the preview LINE generated for an image; failures are only logged
+// Images from an external content provider have no preview on LINE's servers
+func (h *WebhookHandler) saveImagePreview(ctx context.Context, imagePath string, image *linebot.ImageMessage) {
+	logger := h.logger.ForContext(ctx)
+
+	if image.ContentProvider != nil && image.ContentProvider.Type != linebot.ContentProviderTypeLINE {
+		logger.Debug("Not saving a preview of image %s from content provider %s", image.ID, image.ContentProvider.Type)
+		return
+	}
+
+	preview, err := h.lineClient.GetMessagePreview(ctx, image.ID)
+	if err != nil {
+		logger.Warning("Failed to get preview for image %s: %v", image.ID, err)
+		return
+	}
+	defer preview.Content.Close()
+
+	if _, err := h.mediaStore.SaveImagePreview(ctx, imagePath, preview); err != nil {
+		logger.Warning("Failed to save preview for image %s: %v", image.ID, err)
+	}
+}
+
+// getSourceID returns the ID of the chat an event came from (group, room or user)
+func getSourceID(source *linebot.EventSource) string {
+	if source == nil {
+		return ""
+	}
+
+	switch source.Type {
+	case linebot.EventSourceTypeGroup:
+		return source.GroupID
+	case linebot.EventSourceTypeRoom:
+		return source.RoomID
+	default:
+		return source.UserID
+	}
 }
 
 // getMessageID extracts the message ID from the message interface
@@ -155,30 +519,298 @@ func getMessageID(message linebot.Message) string {
 	}
 }
 
+// sendConfirmations sends one combined confirmation per chat for the media received in a request
+func (h *WebhookHandler) sendConfirmations(ctx context.Context, cfg *config.Config, received []receivedMedia) {
+	logger := h.logger.ForContext(ctx)
+
+	// Group the media by chat, keeping the order in which chats first appeared
+	var sourceOrder []string
+	bySource := make(map[string][]receivedMedia)
+	for _, item := range received {
+		if _, exists := bySource[item.sourceID]; !exists {
+			sourceOrder = append(sourceOrder, item.sourceID)
+		}
+		bySource[item.sourceID] = append(bySource[item.sourceID], item)
+	}
+
+	for _, sourceID := range sourceOrder {
+		items := bySource[sourceID]
+
+		// Use the first reply token for the chat that is likely still valid; without one the confirmation is pushed
+		var replyToken string
+		for _, item := range items {
+			if item.replyToken != "" && h.replyTokenFresh(cfg, item.issuedAt) {
+				replyToken = item.replyToken
+				break
+			}
+		}
+
+		if err := h.sendConfirmationMessage(ctx, cfg, replyToken, sourceID, items); err != nil {
+			logger.Error("Error sending confirmation: %v", err)
+		}
+	}
+}
+
+// buildConfirmationText builds the confirmation text for the media received from a chat
+// Configured reply templates take precedence over the catalog's messages
+func (h *WebhookHandler) buildConfirmationText(cfg *config.Config, items []receivedMedia, catalog messageCatalog) string {
+	// A single file uses the regular reply template
+	if len(items) == 1 {
+		template := cfg.ReplyTemplate
+		if template == "" {
+			template = catalog.reply
+		}
+		return catalog.format(template, items[0].mediaType)
+	}
+
+	// Count the files per media type, e.g. "3 images and 1 video"
+	var typeOrder []string
+	counts := make(map[string]int)
+	for _, item := range items {
+		if counts[item.mediaType] == 0 {
+			typeOrder = append(typeOrder, item.mediaType)
+		}
+		counts[item.mediaType]++
+	}
+
+	template := cfg.BatchReplyTemplate
+	if template == "" {
+		template = catalog.batchReply
+	}
+	return utils.FormatTemplate(template, map[string]string{
+		"summary": catalog.summary(typeOrder, counts),
+		"count":   fmt.Sprintf("%d", len(items)),
+	})
+}
+
 // sendConfirmationMessage sends a confirmation message back to the user
-func (h *WebhookHandler) sendConfirmationMessage(replyToken, mediaType string) error {
-	message := fmt.Sprintf("Thanks for sharing! Your %s file has been received and is being processed.", mediaType)
+func (h *WebhookHandler) sendConfirmationMessage(ctx context.Context, cfg *config.Config, replyToken, sourceID string, items []receivedMedia) error {
+	logger := h.logger.ForContext(ctx)
+
+	catalog := catalogFor(h.userLanguage(ctx, cfg, items[0].userID))
+	message := h.buildConfirmationText(cfg, items, catalog)
+
+	// Let the user know if any of the files were compressed
+	for _, item := range items {
+		if item.compressed {
+			message += " " + catalog.compressedNote
+			break
+		}
+	}
 
-	h.logger.Debug("Sending confirmation message for %s", mediaType)
+	logger.Debug("Sending confirmation message for %d files", len(items))
 
-	if _, err := h.lineClient.GetBot().ReplyMessage(replyToken, linebot.NewTextMessage(message)).Do(); err != nil {
+	if err := h.replyOrPush(ctx, cfg, replyToken, sourceID, linebot.NewTextMessage(message)); err != nil {
 		return fmt.Errorf("error sending confirmation message: %v", err)
 	}
 
-	h.logger.Debug("Confirmation message sent successfully")
+	logger.Debug("Confirmation message sent successfully")
 	return nil
 }
 
+// sendFailureMessage tells the user why their media could not be saved
+func (h *WebhookHandler) sendFailureMessage(ctx context.Context, cfg *config.Config, replyToken, sourceID, userID, mediaType string, err error) {
+	logger := h.logger.ForContext(ctx)
+
+	if !cfg.SendConfirmation {
+		return
+	}
+
+	catalog := catalogFor(h.userLanguage(ctx, cfg, userID))
+
+	var message string
+	switch {
+	case errors.Is(err, media.ErrFileTooLarge):
+		message = catalog.format(catalog.tooLarge, mediaType)
+	case errors.Is(err, media.ErrDiskFull), errors.Is(err, media.ErrQuotaExceeded):
+		message = catalog.format(catalog.diskFull, mediaType)
+	case errors.Is(err, media.ErrBlockedType):
+		message = catalog.format(catalog.blockedType, mediaType)
+	case errors.Is(err, lineapi.ErrContentExpired):
+		message = catalog.format(catalog.expired, mediaType)
+	default:
+		message = catalog.format(catalog.saveFailed, mediaType)
+	}
+
+	logger.Debug("Sending failure message for %s", mediaType)
+
+	if err := h.replyOrPush(ctx, cfg, replyToken, sourceID, linebot.NewTextMessage(message)); err != nil {
+		logger.Error("Error sending failure message: %v", err)
+	}
+}
+
+// replyNonMedia tells the sender of a text message that only media is saved, if AUTO_REPLY_NON_MEDIA is enabled
+// Groups and rooms are only answered with AUTO_REPLY_NON_MEDIA_IN_GROUPS, and the bot never answers itself
+func (h *WebhookHandler) replyNonMedia(ctx context.Context, cfg *config.Config, event *linebot.Event) {
+	logger := h.logger.ForContext(ctx)
+
+	if !cfg.AutoReplyNonMedia || event.Source == nil || event.Source.UserID == "" {
+		return
+	}
+	if event.Source.Type != linebot.EventSourceTypeUser && !cfg.AutoReplyNonMediaInGroups {
+		logger.Debug("Not replying to a text message in %s %s", event.Source.Type, getSourceID(event.Source))
+		return
+	}
+	if event.Source.UserID == h.botUserID(ctx) {
+		return
+	}
+
+	message := cfg.NonMediaReplyTemplate
+	if message == "" {
+		message = catalogFor(h.userLanguage(ctx, cfg, event.Source.UserID)).nonMedia
+	}
+
+	logger.Debug("Replying to a text message from %s", event.Source.UserID)
+
+	if err := h.replyOrPush(ctx, cfg, h.freshReplyToken(cfg, event), getSourceID(event.Source), linebot.NewTextMessage(message)); err != nil {
+		logger.Error("Error sending non-media reply: %v", err)
+	}
+}
+
+// botUserID returns the bot's own user ID, fetching it once it is first needed
+// Returns an empty string if it can't be fetched, in which case it is tried again next time
+func (h *WebhookHandler) botUserID(ctx context.Context) string {
+	if userID := h.botID.Load(); userID != nil {
+		return *userID
+	}
+
+	info, err := h.lineClient.GetBot().GetBotInfo().WithContext(ctx).Do()
+	if err != nil {
+		h.logger.ForContext(ctx).Warning("Failed to get the bot's info: %v", err)
+		return ""
+	}
+
+	h.botID.Store(&info.UserID)
+	return info.UserID
+}
+
+// replyTokenFresh reports whether a reply token issued at the given time is likely still valid
+// LINE only accepts reply tokens for a short time, so older tokens aren't tried at all
+func (h *WebhookHandler) replyTokenFresh(cfg *config.Config, issuedAt time.Time) bool {
+	maxAge := time.Duration(cfg.ReplyTokenMaxAgeSeconds) * time.Second
+	if maxAge <= 0 || issuedAt.IsZero() {
+		return true
+	}
+	return time.Since(issuedAt) < maxAge
+}
+
+// freshReplyToken returns the event's reply token, or an empty string if it has likely expired
+func (h *WebhookHandler) freshReplyToken(cfg *config.Config, event *linebot.Event) string {
+	if !h.replyTokenFresh(cfg, event.Timestamp) {
+		h.logger.Debug("Reply token issued at %s has likely expired, pushing instead", event.Timestamp.Format(time.RFC3339))
+		return ""
+	}
+	return event.ReplyToken
+}
+
+// replyOrPush replies with the reply token, falling back to pushing to the chat
+// when there is no reply token or LINE rejects it, e.g. because it expired
+func (h *WebhookHandler) replyOrPush(ctx context.Context, cfg *config.Config, replyToken, sourceID string, messages ...linebot.SendingMessage) error {
+	logger := h.logger.ForContext(ctx)
+
+	if replyToken != "" {
+		err := h.sendWithRetry(ctx, cfg, "reply", func() error {
+			_, err := h.lineClient.GetBot().ReplyMessage(replyToken, messages...).WithContext(ctx).Do()
+			return err
+		})
+		if err == nil || !isInvalidReplyToken(err) {
+			return err
+		}
+		logger.Info("Reply token was rejected, pushing the message to %s instead: %v", sourceID, err)
+	}
+
+	if sourceID == "" {
+		return fmt.Errorf("no reply token or chat to send the message to")
+	}
+	if h.left.has(sourceID, time.Now()) {
+		return fmt.Errorf("not pushing to %s, the bot has left it", sourceID)
+	}
+
+	logger.Debug("Pushing message to %s", sourceID)
+
+	return h.sendWithRetry(ctx, cfg, "push to "+sourceID, func() error {
+		_, err := h.lineClient.GetBot().PushMessage(sourceID, messages...).WithContext(ctx).Do()
+		return err
+	})
+}
+
+// isInvalidReplyToken reports whether LINE rejected a reply because the reply token is invalid or expired
+func isInvalidReplyToken(err error) bool {
+	var apiErr *linebot.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest || apiErr.Response == nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(apiErr.Response.Message), "reply token")
+}
+
 // sendDriveLinkMessage sends a message with the Google Drive link back to the user
-func (h *WebhookHandler) sendDriveLinkMessage(replyToken, filename, fileLink string) error {
-	message := fmt.Sprintf("📁 Your file %s has been backed up to Google Drive and is available at: %s", filename, fileLink)
+// With DRIVE_LINK_FLEX the link is sent as a card, using the text message as its fallback
+func (h *WebhookHandler) sendDriveLinkMessage(ctx context.Context, userID, filePath, mediaType, filename, fileLink string) error {
+	logger := h.logger.ForContext(ctx)
 
-	h.logger.Debug("Sending Google Drive link message for %s", filename)
+	// Uploads finish after the webhook request, so the current configuration is used
+	cfg := h.config.Load()
 
-	if _, err := h.lineClient.GetBot().PushMessage(replyToken, linebot.NewTextMessage(message)).Do(); err != nil {
+	template := cfg.DriveLinkTemplate
+	if template == "" {
+		template = catalogFor(h.userLanguage(ctx, cfg, userID)).driveLink
+	}
+	text := utils.FormatTemplate(template, map[string]string{"filename": filename, "link": fileLink})
+
+	var message linebot.SendingMessage = linebot.NewTextMessage(text)
+	if cfg.DriveLinkFlex {
+		var size int64
+		if info, err := os.Stat(filePath); err == nil {
+			size = info.Size()
+		}
+		message = buildUploadCompleteFlex(filename, mediaType, size, fileLink, text)
+	}
+
+	logger.Debug("Sending Google Drive link message for %s", filename)
+
+	err := h.sendWithRetry(ctx, cfg, "Google Drive link message", func() error {
+		_, err := h.lineClient.GetBot().PushMessage(userID, message).WithContext(ctx).Do()
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("error sending Google Drive link message: %v", err)
 	}
 
-	h.logger.Info("Google Drive link message sent successfully")
+	logger.Info("Google Drive link message sent successfully")
 	return nil
 }
+
+// userLanguage returns the language to use for messages to a user
+// It is the user's profile language if enabled and supported, otherwise DEFAULT_LANGUAGE
+func (h *WebhookHandler) userLanguage(ctx context.Context, cfg *config.Config, userID string) string {
+	if cfg.ProfileLanguage && userID != "" {
+		if language := catalogLanguage(h.profileLanguage(ctx, userID)); language != "" {
+			return language
+		}
+	}
+
+	return cfg.DefaultLanguage
+}
+
+// profileLanguage returns the language of a user's LINE profile, fetching it if it isn't cached
+// Returns an empty string if the profile can't be fetched or has no language
+func (h *WebhookHandler) profileLanguage(ctx context.Context, userID string) string {
+	if language, ok := h.profiles.get(userID, time.Now()); ok {
+		return language
+	}
+
+	var language string
+	profile, err := h.lineClient.GetBot().GetProfile(userID).WithContext(ctx).Do()
+	if err != nil && ctx.Err() != nil {
+		// Not the profile's fault, so try again next time
+		return ""
+	}
+	if err != nil {
+		h.logger.ForContext(ctx).Warning("Failed to get profile of %s, using the default language: %v", userID, err)
+	} else {
+		language = profile.Language
+	}
+
+	h.profiles.put(userID, language, time.Now())
+	return language
+}
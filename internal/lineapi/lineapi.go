@@ -1,17 +1,37 @@
 package lineapi
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/line/line-bot-sdk-go/v7/linebot"
+	"golang.org/x/sync/singleflight"
 )
 
+// ErrFetchInProgress is returned by GetMessageContent when another caller is already
+// fetching the same message; that caller receives the content
+var ErrFetchInProgress = errors.New("message content fetch already in progress")
+
+// ErrContentExpired is returned by GetMessageContent when LINE no longer has the content,
+// usually because the message is too old; fetching it again won't help
+var ErrContentExpired = errors.New("message content no longer available")
+
 // Client encapsulates functionality for interacting with the LINE API
 type Client struct {
-	bot         *linebot.Client
-	apiEndpoint string
+	bot             *linebot.Client
+	contentEndpoint string // Content API base, empty for LINE's own
+	channelSecret   string
+	channelToken    string
+	throttle        *contentThrottle
+	contentFetch    singleflight.Group // Deduplicates concurrent fetches of the same message
 }
 
 // MockContentResponse is a test helper that implements the same interface
@@ -32,49 +52,161 @@ func (m *MockContentResponse) GetContentType() string {
 }
 
 // NewClient creates a new instance of the LINE API client
+// LINE_API_ENDPOINT overrides the messaging API base, and LINE_CONTENT_ENDPOINT the content (data) API base,
+// which otherwise follows LINE_API_ENDPOINT when that is set, or is LINE's own data host
 func NewClient(channelSecret, channelToken string) (*Client, error) {
-	// Allow overriding the API endpoint for testing
+	// Allow overriding the API endpoints for testing and special deployments
 	apiEndpoint := os.Getenv("LINE_API_ENDPOINT")
+	contentEndpoint := contentEndpointOverride()
 
 	// Create LINE bot client with options
-	var bot *linebot.Client
-	var err error
-
+	var options []linebot.ClientOption
 	if apiEndpoint != "" {
-		// Use custom endpoint for testing
-		bot, err = linebot.New(
-			channelSecret,
-			channelToken,
-			linebot.WithEndpointBase(apiEndpoint),
-		)
-	} else {
-		// Use default endpoint
-		bot, err = linebot.New(channelSecret, channelToken)
+		options = append(options, linebot.WithEndpointBase(apiEndpoint))
+	}
+	if contentEndpoint != "" {
+		options = append(options, linebot.WithEndpointBaseData(contentEndpoint))
 	}
 
+	bot, err := linebot.New(channelSecret, channelToken, options...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LINE bot client: %v", err)
 	}
 
 	return &Client{
-		bot:         bot,
-		apiEndpoint: apiEndpoint,
+		bot:             bot,
+		contentEndpoint: contentEndpoint,
+		channelSecret:   channelSecret,
+		channelToken:    channelToken,
+		throttle:        newContentThrottle(),
 	}, nil
 }
 
+// contentEndpointOverride returns the content API base set by LINE_CONTENT_ENDPOINT or LINE_API_ENDPOINT, if any
+func contentEndpointOverride() string {
+	if endpoint := os.Getenv("LINE_CONTENT_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("LINE_API_ENDPOINT")
+}
+
+// ContentEndpoint returns the base URL of the content API that message content is fetched from
+func ContentEndpoint() string {
+	if endpoint := contentEndpointOverride(); endpoint != "" {
+		return endpoint
+	}
+	return linebot.APIEndpointBaseData
+}
+
 // GetBot returns the underlying linebot client
 func (c *Client) GetBot() *linebot.Client {
 	return c.bot
 }
 
+// GetChannelSecret returns the channel secret used to sign webhook requests
+func (c *Client) GetChannelSecret() string {
+	return c.channelSecret
+}
+
+// ComputeSignature computes the base64-encoded HMAC-SHA256 signature of a webhook body
+func ComputeSignature(channelSecret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(channelSecret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks that the X-Line-Signature header matches the webhook body
+func VerifySignature(channelSecret string, body []byte, signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(channelSecret))
+	mac.Write(body)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
 // GetMessageContent retrieves content for a specific message
-func (c *Client) GetMessageContent(messageID string) (*linebot.MessageContentResponse, error) {
-	content, err := c.bot.GetMessageContent(messageID).Do()
+// Fetches are slowed down while LINE is responding with 429 Too Many Requests
+// Concurrent fetches of the same message share one request; the content can only be read once,
+// so only the first caller receives it and the others get ErrFetchInProgress
+func (c *Client) GetMessageContent(ctx context.Context, messageID string) (*linebot.MessageContentResponse, error) {
+	var fetched bool
+	result, err, _ := c.contentFetch.Do(messageID, func() (interface{}, error) {
+		fetched = true
+
+		if err := c.throttle.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		content, err := c.bot.GetMessageContent(messageID).WithContext(ctx).Do()
+		c.throttle.record(err)
+		return content, err
+	})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: message %s: %v", ErrContentExpired, messageID, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get message content: %v", err)
 	}
 
-	return content, nil
+	if !fetched {
+		return nil, fmt.Errorf("%w: message %s", ErrFetchInProgress, messageID)
+	}
+
+	return result.(*linebot.MessageContentResponse), nil
+}
+
+// isNotFound reports whether LINE answered that the requested content doesn't exist
+func isNotFound(err error) bool {
+	var apiErr *linebot.APIError
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone)
+}
+
+// GetMessagePreview retrieves the preview image of a video message
+// The SDK has no call for it, so the content API is requested directly
+func (c *Client) GetMessagePreview(ctx context.Context, messageID string) (*linebot.MessageContentResponse, error) {
+	endpoint := c.contentEndpoint
+	if endpoint == "" {
+		endpoint = linebot.APIEndpointBaseData
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v2/bot/message/"+messageID+"/content/preview", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create preview request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.channelToken)
+
+	if err := c.throttle.wait(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get message preview: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.throttle.record(err)
+		return nil, fmt.Errorf("failed to get message preview: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err := &linebot.APIError{Code: resp.StatusCode}
+		c.throttle.record(err)
+		return nil, fmt.Errorf("failed to get message preview: %v", err)
+	}
+	c.throttle.record(nil)
+
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return &linebot.MessageContentResponse{
+		Content:       resp.Body,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: length,
+	}, nil
+}
+
+// GetContentFetchStats returns statistics about content fetches and throttling
+func (c *Client) GetContentFetchStats() ContentFetchStats {
+	return c.throttle.stats()
 }
 
 // IsMedia checks if a message is a media type that can be downloaded
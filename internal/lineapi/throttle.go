@@ -0,0 +1,112 @@
+package lineapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const (
+	// throttledFetchRate is the number of content fetches allowed per minute while LINE is throttling
+	throttledFetchRate = 30
+
+	// throttleCooldown is how long without a 429 before fetches run at full speed again
+	throttleCooldown = time.Minute
+
+	// throttleStatsWindow is how far back 429 responses are counted in stats
+	throttleStatsWindow = 5 * time.Minute
+)
+
+// ContentFetchStats reports the content fetch rate and throttling from LINE
+type ContentFetchStats struct {
+	FetchesPerMinute int  `json:"fetchesPerMinute"` // Content fetches in the last minute
+	Recent429Count   int  `json:"recent429Count"`   // 429 responses in the last five minutes
+	Throttled        bool `json:"throttled"`        // Whether fetches are currently slowed down
+}
+
+// contentThrottle slows content fetches down when LINE starts returning 429
+type contentThrottle struct {
+	limiter       *utils.RateLimiter // Applied only while throttled
+	lastThrottled time.Time          // Time of the most recent 429
+	fetchTimes    []time.Time        // Fetch times within the last minute
+	throttleTimes []time.Time        // 429 times within the stats window
+	mu            sync.Mutex
+}
+
+// newContentThrottle creates a new content throttle
+func newContentThrottle() *contentThrottle {
+	return &contentThrottle{
+		limiter: utils.NewRateLimiter(throttledFetchRate, time.Minute),
+	}
+}
+
+// wait blocks until a fetch is allowed or the context is done
+func (t *contentThrottle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	throttled := t.isThrottled(time.Now())
+	t.mu.Unlock()
+
+	if !throttled {
+		return nil
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// record records the outcome of a content fetch
+func (t *contentThrottle) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.fetchTimes = append(pruneBefore(t.fetchTimes, now.Add(-time.Minute)), now)
+
+	if isTooManyRequests(err) {
+		// Start backing off right away rather than after the fetches the full bucket still allows
+		if !t.isThrottled(now) {
+			t.limiter.Drain()
+		}
+		t.lastThrottled = now
+		t.throttleTimes = append(pruneBefore(t.throttleTimes, now.Add(-throttleStatsWindow)), now)
+	}
+}
+
+// stats returns the current content fetch statistics
+func (t *contentThrottle) stats() ContentFetchStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.fetchTimes = pruneBefore(t.fetchTimes, now.Add(-time.Minute))
+	t.throttleTimes = pruneBefore(t.throttleTimes, now.Add(-throttleStatsWindow))
+
+	return ContentFetchStats{
+		FetchesPerMinute: len(t.fetchTimes),
+		Recent429Count:   len(t.throttleTimes),
+		Throttled:        t.isThrottled(now),
+	}
+}
+
+// isThrottled reports whether LINE returned a 429 recently; callers must hold the mutex
+func (t *contentThrottle) isThrottled(now time.Time) bool {
+	return !t.lastThrottled.IsZero() && now.Sub(t.lastThrottled) < throttleCooldown
+}
+
+// pruneBefore drops times before the cutoff from a sorted slice
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// isTooManyRequests checks if an error is a 429 response from the LINE API
+func isTooManyRequests(err error) bool {
+	var apiErr *linebot.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests
+}
@@ -0,0 +1,105 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/notify"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// Defaults used when alerting is not fully configured
+const (
+	defaultAlertUploadFailures = 5
+	alertCooldown              = time.Hour // Minimum time between repeated alerts of the same kind
+	alertTimeout               = 30 * time.Second
+)
+
+// Kinds of alerts, used to rate limit repeats
+const (
+	alertUploadFailures = "upload_failures"
+	alertDiskFull       = "disk_full"
+	alertDiskLow        = "disk_low"
+)
+
+// alerter sends operator alerts through a notifier without blocking the caller
+type alerter struct {
+	notifier notify.Notifier
+	mu       sync.Mutex
+	lastSent map[string]time.Time // Kind of alert to when it was last sent
+}
+
+// SetNotifier sets where operator alerts are sent, replacing the ALERT_WEBHOOK_URL notifier
+// Passing nil disables alerts
+func (ms *MediaStore) SetNotifier(notifier notify.Notifier) {
+	ms.alerts.mu.Lock()
+	defer ms.alerts.mu.Unlock()
+
+	ms.alerts.notifier = notifier
+}
+
+// alert sends an alert in the background unless one of the same kind was sent recently
+func (ms *MediaStore) alert(kind, title, message string) {
+	ms.alerts.mu.Lock()
+	notifier := ms.alerts.notifier
+	if notifier == nil || time.Since(ms.alerts.lastSent[kind]) < alertCooldown {
+		ms.alerts.mu.Unlock()
+		return
+	}
+	ms.alerts.lastSent[kind] = time.Now()
+	ms.alerts.mu.Unlock()
+
+	ms.sendAlert(notifier, title, message)
+}
+
+// sendAlert delivers an alert in the background
+func (ms *MediaStore) sendAlert(notifier notify.Notifier, title, message string) {
+	ms.logger.Warning("Sending alert: %s: %s", title, message)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+
+		if err := notifier.Notify(ctx, notify.Alert{Title: title, Message: message, Time: time.Now()}); err != nil {
+			ms.logger.Error("Failed to send alert %q: %v", title, err)
+		}
+	}()
+}
+
+// recordUploadOutcome tracks consecutive upload failures and alerts when they reach the threshold
+func (ms *MediaStore) recordUploadOutcome(filePath string, err error) {
+	if err == nil {
+		ms.consecutiveUploadFailures.Store(0)
+		return
+	}
+
+	threshold := int64(ms.config.AlertUploadFailures)
+	if threshold <= 0 {
+		threshold = defaultAlertUploadFailures
+	}
+
+	if failures := ms.consecutiveUploadFailures.Add(1); failures == threshold {
+		ms.alert(alertUploadFailures, "Cloud uploads failing",
+			fmt.Sprintf("%d uploads in a row have failed; the latest was %s: %v", failures, filePath, err))
+	}
+}
+
+// checkDiskSpace alerts when the free space left in the storage directory drops below ALERT_MIN_FREE_MB
+func (ms *MediaStore) checkDiskSpace(dir string) {
+	if ms.config.AlertMinFreeMB <= 0 {
+		return
+	}
+
+	free, err := utils.FreeDiskSpace(dir)
+	if err != nil {
+		ms.logger.Debug("Skipping disk space check: %v", err)
+		return
+	}
+
+	if minFree := uint64(ms.config.AlertMinFreeMB) << 20; free < minFree {
+		ms.alert(alertDiskLow, "Disk space low",
+			fmt.Sprintf("Only %d MB left in %s (alert threshold %d MB)", free>>20, dir, ms.config.AlertMinFreeMB))
+	}
+}
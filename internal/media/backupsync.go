@@ -0,0 +1,81 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SyncBackups re-uploads stored files that were never successfully uploaded to cloud storage
+// The storage directory is the source of truth; the cloud copy is made eventually consistent
+// Returns the number of files found; they are uploaded in the background by SYNC_WORKERS workers
+func (ms *MediaStore) SyncBackups(ctx context.Context) (int, error) {
+	logger := ms.logger.ForContext(ctx)
+
+	if ms.cloudStore == nil {
+		return 0, ErrCloudDisabled
+	}
+	if ms.sweepCtx.Err() != nil {
+		return 0, ErrSweepsStopped
+	}
+
+	missing, err := ms.findMissingBackups()
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Info("Backup sync found %d files missing from cloud storage", len(missing))
+
+	// Upload in the background with the sweep workers, so the sweep doesn't hold up the caller;
+	// it outlives the request but not StopSweeps, and shutdown waits for the uploads in progress
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ms.sweepCtx, cancel)
+	ms.uploadWg.Add(1)
+	go func() {
+		defer ms.uploadWg.Done()
+		defer stop()
+		defer cancel()
+
+		progress := ms.sweepUploads(ctx, missing, ms.cloudFolderPathForStoredFile, nil)
+		logger.Info("Backup sync uploaded %d files (%d failed) in %s: %.1f files/s, %.2f MB/s",
+			progress.Uploaded, progress.Failed, progress.Elapsed.Round(time.Second), progress.FilesPerSecond(), progress.MBPerSecond())
+	}()
+
+	return len(missing), nil
+}
+
+// findMissingBackups lists the stored files that are pending or missing from the upload index and aren't queued for upload
+func (ms *MediaStore) findMissingBackups() ([]string, error) {
+	var missing []string
+	err := filepath.WalkDir(ms.config.StorageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden files and directories, such as the upload index
+		if strings.HasPrefix(d.Name(), ".") && path != ms.config.StorageDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip downloads and writes that are still in progress
+		if IsInProgress(d.Name()) {
+			return nil
+		}
+
+		if d.Type().IsRegular() && ms.uploadIndex.needsUpload(ms.indexKey(path)) {
+			missing = append(missing, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan storage directory: %v", err)
+	}
+
+	return missing, nil
+}
@@ -0,0 +1,181 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"    // Uploads go through
+	BreakerOpen     = "open"      // Uploads fail fast until the cooldown ends
+	BreakerHalfOpen = "half-open" // A single upload is let through to test recovery
+)
+
+// Circuit breaker timing
+const (
+	defaultBreakerCooldown = time.Minute
+	maxBreakerCooldown     = 30 * time.Minute // The cooldown doubles after each failed probe, up to this
+	breakerProbeWait       = time.Second      // How often a waiting sweep checks whether a test upload has finished
+)
+
+// circuitBreaker stops uploads to a cloud backend that keeps failing
+// After threshold consecutive failures it opens and uploads fail fast for the cooldown;
+// then one upload is let through, closing the breaker if it succeeds or reopening it for twice as long
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int // Consecutive failures that open the breaker, 0 to never open
+	baseCooldown time.Duration
+	state        string
+	failures     int           // Consecutive failures while closed
+	cooldown     time.Duration // Current cooldown, doubled by each failed probe
+	openedAt     time.Time
+	probing      bool // A half-open test upload is in progress
+	trips        int  // Times the breaker has opened
+	skipped      int  // Uploads failed fast while open
+}
+
+// BreakerStats describes the circuit breaker for the cloud statistics
+type BreakerStats struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Trips               int        `json:"trips"`
+	SkippedUploads      int        `json:"skippedUploads"`
+	RetryAt             *time.Time `json:"retryAt,omitempty"` // When the next test upload is allowed, while open
+}
+
+// newCircuitBreaker creates a closed circuit breaker
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &circuitBreaker{
+		threshold:    threshold,
+		baseCooldown: cooldown,
+		cooldown:     cooldown,
+		state:        BreakerClosed,
+	}
+}
+
+// allow reports whether an upload may be attempted
+// Once the cooldown has passed, the first caller gets to make the test upload
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Before(b.openedAt.Add(b.cooldown)) {
+			b.skipped++
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.skipped++
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// blocked reports whether uploads would currently be failed fast, and when to check again
+// Sweeps use it to wait for the backend rather than failing every file while it is down
+func (b *circuitBreaker) blocked(now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.state == BreakerOpen && now.Before(b.openedAt.Add(b.cooldown)):
+		return b.openedAt.Add(b.cooldown), true
+	case b.state == BreakerHalfOpen && b.probing:
+		return now.Add(breakerProbeWait), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// record updates the breaker with the outcome of an allowed upload
+// Returns the state it changed to, or an empty string if it didn't change
+func (b *circuitBreaker) record(err error, now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.cooldown = b.baseCooldown
+		if b.state == BreakerClosed {
+			return ""
+		}
+		b.state = BreakerClosed
+		b.probing = false
+		return BreakerClosed
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		// Still down, so wait longer before the next test
+		b.cooldown = min(b.cooldown*2, maxBreakerCooldown)
+		b.open(now)
+		return BreakerOpen
+	case BreakerClosed:
+		b.failures++
+		if b.threshold > 0 && b.failures >= b.threshold {
+			b.open(now)
+			return BreakerOpen
+		}
+	}
+	return ""
+}
+
+// open opens the breaker for the current cooldown
+// Must be called with mu held
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.probing = false
+	b.trips++
+}
+
+// stats returns the breaker's current state
+func (b *circuitBreaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		SkippedUploads:      b.skipped,
+	}
+	if b.state == BreakerOpen {
+		retryAt := b.openedAt.Add(b.cooldown)
+		stats.RetryAt = &retryAt
+	}
+	return stats
+}
+
+// recordBreakerOutcome updates the circuit breaker with an upload outcome and reports state changes
+// When the backend recovers, the uploads skipped while it was down are queued again
+func (ms *MediaStore) recordBreakerOutcome(err error) {
+	switch ms.breaker.record(err, time.Now()) {
+	case BreakerOpen:
+		stats := ms.breaker.stats()
+		ms.logger.Warning("Cloud storage keeps failing; skipping uploads until %s: %v", stats.RetryAt.Format(time.RFC3339), err)
+		ms.RecordError("upload", fmt.Errorf("circuit breaker opened, uploads paused until %s: %v", stats.RetryAt.Format(time.RFC3339), err))
+	case BreakerClosed:
+		ms.logger.Info("Cloud storage has recovered; re-queuing uploads skipped while it was down")
+		if _, err := ms.SyncBackups(context.Background()); err != nil && !errors.Is(err, ErrSweepsStopped) {
+			ms.logger.Error("Failed to re-queue skipped uploads: %v", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// ChecksumsFile is the file in each storage folder listing the SHA-256 of the files saved there
+// Lines are in the format of sha256sum, so `sha256sum -c` can check a folder too; it is hidden so
+// backup syncs, archives and the storage quota leave it alone
+const ChecksumsFile = ".checksums.txt"
+
+// ChecksumReport is the outcome of verifying stored files against their recorded checksums
+type ChecksumReport struct {
+	Verified   int      // Files whose content still matches
+	Mismatched []string // Files whose content changed since they were saved
+	Missing    []string // Files listed that no longer exist, such as ones evicted by the storage quota
+}
+
+// recordChecksum appends the SHA-256 of a newly saved file to the checksums file of its folder if WRITE_CHECKSUMS is enabled
+// hash is reused when already known, such as from a hash filename, and is computed from the stored file otherwise
+func (ms *MediaStore) recordChecksum(ctx context.Context, filePath, hash string) {
+	if !ms.config.WriteChecksums {
+		return
+	}
+
+	if err := ms.appendChecksum(filePath, hash); err != nil {
+		ms.logger.ForContext(ctx).Warning("Failed to record the checksum of %s: %v", filePath, err)
+		ms.RecordError("checksum", fmt.Errorf("%s: %v", filePath, err))
+	}
+}
+
+// appendChecksum writes a file's checksum line, hashing the file if hash is empty
+func (ms *MediaStore) appendChecksum(filePath, hash string) error {
+	if hash == "" {
+		var err error
+		if hash, err = utils.FileSHA256(filePath); err != nil {
+			return fmt.Errorf("failed to hash file: %v", err)
+		}
+	}
+
+	ms.checksumsMu.Lock()
+	defer ms.checksumsMu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(filepath.Dir(filePath), ChecksumsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return wrapWriteError("failed to open checksums file", err)
+	}
+	if _, err := fmt.Fprintf(file, "%s  %s\n", hash, filepath.Base(filePath)); err != nil {
+		file.Close()
+		return wrapWriteError("failed to write checksums file", err)
+	}
+	return file.Close()
+}
+
+// forgetChecksum removes a file's line from the checksums file of its folder, such as when it is evicted
+// The checksums file is removed once it lists nothing, so an emptied folder can be removed too
+func (ms *MediaStore) forgetChecksum(filePath string) error {
+	ms.checksumsMu.Lock()
+	defer ms.checksumsMu.Unlock()
+
+	path := filepath.Join(filepath.Dir(filePath), ChecksumsFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksums: %v", err)
+	}
+
+	var kept []string
+	name := filepath.Base(filePath)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if _, lineName, ok := strings.Cut(line, "  "); ok && lineName == name {
+			continue
+		}
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+
+	if len(kept) == 0 {
+		return os.Remove(path)
+	}
+
+	// Replace the file atomically, so a crash doesn't leave the other checksums truncated
+	tmp, err := os.CreateTemp(filepath.Dir(path), ChecksumsFile+"-*")
+	if err != nil {
+		return wrapWriteError("failed to write checksums file", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strings.Join(kept, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return wrapWriteError("failed to write checksums file", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return wrapWriteError("failed to write checksums file", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return wrapWriteError("failed to write checksums file", err)
+	}
+	return nil
+}
+
+// readChecksums parses a checksums file into the checksum of each file name
+// A file listed more than once, such as one saved again under a hash filename, keeps its last checksum
+func readChecksums(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %v", err)
+	}
+	defer file.Close()
+
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok || name == "" || filepath.Base(name) != name {
+			continue
+		}
+		checksums[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %v", err)
+	}
+	return checksums, nil
+}
+
+// VerifyChecksums re-hashes every file listed in the checksums files below dir and reports those that changed or are gone
+// onFile, if set, is called with each file as it is checked
+func VerifyChecksums(dir string, onFile func(filePath string)) (ChecksumReport, error) {
+	var report ChecksumReport
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != ChecksumsFile {
+			return nil
+		}
+
+		checksums, err := readChecksums(path)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(checksums))
+		for name := range checksums {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			filePath := filepath.Join(filepath.Dir(path), name)
+			if onFile != nil {
+				onFile(filePath)
+			}
+
+			hash, err := utils.FileSHA256(filePath)
+			switch {
+			case os.IsNotExist(err):
+				report.Missing = append(report.Missing, filePath)
+			case err != nil:
+				return fmt.Errorf("failed to hash %s: %v", filePath, err)
+			case hash != checksums[name]:
+				report.Mismatched = append(report.Mismatched, filePath)
+			default:
+				report.Verified++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to verify checksums: %v", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,95 @@
+package media
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// defaultCloudFolderTemplate matches the local storage layout of one folder per day
+const defaultCloudFolderTemplate = "{year}-{month}-{day}"
+
+// userIDKey is the context key for the ID of the user who sent the media
+type userIDKey struct{}
+
+// WithUserID returns a context carrying the ID of the user who sent the media
+// It is used to expand {user} in the cloud folder template
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// userIDFromContext returns the user ID set with WithUserID, if any
+func userIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey{}).(string)
+	return userID
+}
+
+// cloudFolderPath expands the cloud folder template for a file
+// The result is relative to the cloud provider's base folder; with FLAT_STORAGE it is the base folder itself
+func (ms *MediaStore) cloudFolderPath(mediaType, userID string, t time.Time) string {
+	if ms.config.FlatStorage {
+		return ""
+	}
+
+	template := ms.config.CloudFolderTemplate
+	if template == "" {
+		template = defaultCloudFolderTemplate
+	}
+
+	// The user ID comes from the webhook, so don't let it add or escape folders
+	userID, err := utils.SanitizePathComponent(userID)
+	if err != nil {
+		userID = "unknown"
+	}
+
+	folder := utils.FormatTemplate(template, map[string]string{
+		"year":  t.Format("2006"),
+		"month": t.Format("01"),
+		"day":   t.Format("02"),
+		"type":  mediaType,
+		"user":  userID,
+	})
+
+	// Mirror the local media type subfolder
+	folder = path.Join(folder, ms.config.TypeSubfolder(mediaType))
+
+	// Keep the folder inside the base folder
+	return strings.TrimPrefix(path.Clean("/"+folder), "/")
+}
+
+// cloudFolderPathForStoredFile expands the cloud folder template for a file already in storage
+// The date comes from the date folder and the media type from the filename prefix;
+// the sending user is not recorded, so {user} expands to "unknown"
+func (ms *MediaStore) cloudFolderPathForStoredFile(filePath string) string {
+	// The date folder is the parent, or the grandparent when media types have subfolders
+	dir := filepath.Dir(filePath)
+	t, err := time.ParseInLocation("2006-01-02", filepath.Base(dir), time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", filepath.Base(filepath.Dir(dir)), time.Local)
+	}
+	if err != nil {
+		t = utils.Now()
+	}
+
+	return ms.cloudFolderPath(ms.mediaTypeFromFilename(filepath.Base(filePath)), "", t)
+}
+
+// mediaTypeFromFilename recovers the media type of a stored file from its filename prefix
+// Files without a recognized prefix are treated as generic files
+func (ms *MediaStore) mediaTypeFromFilename(filename string) string {
+	// Prefer the longest matching prefix in case one prefix starts with another
+	mediaType := "file"
+	longest := -1
+	for _, candidate := range []string{"image", "video", "audio", "file"} {
+		prefix := ms.config.FilenamePrefix(candidate)
+		if prefix != "" && strings.HasPrefix(filename, prefix+"_") && len(prefix) > longest {
+			mediaType = candidate
+			longest = len(prefix)
+		}
+	}
+	return mediaType
+}
@@ -0,0 +1,39 @@
+package media
+
+import (
+	"mime"
+	"strings"
+)
+
+// CompressedExtension is appended to the name of files stored with zstd compression
+const CompressedExtension = ".zst"
+
+// compressibleTypes lists the content types worth compressing
+// Images, video, audio and archives are already compressed and are stored as-is
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/rtf":        true,
+	"application/x-tar":      true,
+	"application/sql":        true,
+	"image/svg+xml":          true,
+	"image/bmp":              true,
+}
+
+// isCompressible reports whether content of the given type should be compressed
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// IsCompressed reports whether a stored file was compressed
+func IsCompressed(filePath string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(filePath, EncryptedExtension), CompressedExtension)
+}
@@ -0,0 +1,213 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// PartialExtension is appended to the name of a download that is still in progress
+const PartialExtension = ".part"
+
+// TempExtension is appended to the name of a file while it is being written
+const TempExtension = ".tmp"
+
+// IsInProgress reports whether a file name belongs to a download or write that hasn't completed
+func IsInProgress(name string) bool {
+	return strings.HasSuffix(name, PartialExtension) || strings.HasSuffix(name, TempExtension)
+}
+
+// downloadRetryDelay is how much longer each download retry waits than the previous one
+const downloadRetryDelay = time.Second
+
+// partInfo describes downloaded content, as given by the response headers
+type partInfo struct {
+	contentType string
+	fileName    string // Suggested by a Content-Disposition header, if any
+}
+
+// downloadPart downloads content into a partial file, resuming from its current size
+// The content type and file name in info are updated from the response, keeping the known values if it has none
+// Returns whether a failed download is worth retrying
+func (ms *MediaStore) downloadPart(ctx context.Context, partPath, contentURL string, headers map[string]string, info *partInfo) (bool, error) {
+	// Resume after what was already downloaded
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", contentURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	// Add required headers (e.g., Authorization)
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := ms.downloadClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, fmt.Errorf("download cancelled: %w", ctx.Err())
+		}
+		return true, fmt.Errorf("%w: %v", ErrDownloadFailed, err)
+	}
+	defer resp.Body.Close()
+
+	// Work out where this response's content starts and how long the whole content is
+	flags := os.O_CREATE | os.O_WRONLY
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			// Not the range that was asked for, so start over
+			os.Remove(partPath)
+			return true, fmt.Errorf("%w: unexpected content range %q", ErrDownloadFailed, resp.Header.Get("Content-Range"))
+		}
+		total = size
+		flags |= os.O_APPEND
+		ms.logger.ForContext(ctx).Info("Resuming download at byte %d of %d", offset, total)
+	case resp.StatusCode == http.StatusOK:
+		// A full response, either because nothing was downloaded yet or ranges aren't supported
+		total = resp.ContentLength
+		flags |= os.O_TRUNC
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file doesn't match the content, so start over
+		os.Remove(partPath)
+		return true, fmt.Errorf("%w: status code: %d", ErrDownloadFailed, resp.StatusCode)
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%w: status code: %d", ErrDownloadFailed, resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		info.contentType = contentType
+	}
+	if fileName := utils.FilenameFromContentDisposition(resp.Header.Get("Content-Disposition")); fileName != "" {
+		info.fileName = fileName
+	}
+
+	// Reject oversized content up front when its length is known
+	maxSize := ms.config.MaxFileSizeBytes
+	if maxSize > 0 && total > maxSize {
+		return false, fmt.Errorf("%w: exceeds limit of %d bytes", ErrFileTooLarge, maxSize)
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return false, wrapWriteError("failed to create file", err)
+	}
+
+	// Read one byte past the limit so oversized content can be detected
+	// The body is read no faster than DOWNLOAD_MAX_BYTES_PER_SEC allows across all downloads
+	source := &sourceReader{ctx: ctx, r: ms.downloadLimit.Reader(ctx, resp.Body)}
+	var reader io.Reader = source
+	if maxSize > 0 {
+		reader = io.LimitReader(source, maxSize-offset+1)
+	}
+
+	written, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	size := offset + written
+
+	switch {
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("download cancelled: %w", ctx.Err())
+	case maxSize > 0 && size > maxSize:
+		return false, fmt.Errorf("%w: exceeds limit of %d bytes", ErrFileTooLarge, maxSize)
+	case err != nil && source.err != nil:
+		// The connection dropped; what was received so far is kept for the retry
+		return true, fmt.Errorf("%w: failed to read content: %v", ErrDownloadFailed, err)
+	case err != nil:
+		return false, wrapWriteError("failed to save file", err)
+	case total >= 0 && size != total:
+		return true, fmt.Errorf("%w: received %d of %d bytes", ErrDownloadFailed, size, total)
+	}
+
+	return false, nil
+}
+
+// finishDownload moves a complete partial download to its final path, compressing and encrypting it if requested
+// Returns the size of the content
+func (ms *MediaStore) finishDownload(ctx context.Context, partPath, filePath string, compress bool) (int64, error) {
+	defer os.Remove(partPath)
+
+	// Compression and encryption rewrite the content; otherwise the download is just renamed
+	if compress || IsEncrypted(filePath) {
+		part, err := os.Open(partPath)
+		if err != nil {
+			return 0, wrapWriteError("failed to open downloaded file", err)
+		}
+		defer part.Close()
+
+		return ms.writeFile(ctx, filePath, part, compress)
+	}
+
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return 0, wrapWriteError("failed to open downloaded file", err)
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return 0, wrapWriteError("failed to save file", err)
+	}
+
+	ms.checkDiskSpace(filepath.Dir(filePath))
+
+	return info.Size(), nil
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 100-199/200"
+// Returns the first byte position and the complete length
+func parseContentRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+
+	var start, end, total int64
+	if _, err := fmt.Sscanf(spec, "%d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// Connection timeouts of the download client that aren't configurable
+const (
+	downloadDialTimeout         = 10 * time.Second
+	downloadTLSHandshakeTimeout = 10 * time.Second
+)
+
+// newDownloadClient creates the HTTP client shared by all downloads
+// Reusing its connections avoids a new TCP and TLS handshake for every download
+func newDownloadClient(cfg *config.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   downloadDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = downloadTLSHandshakeTimeout
+	transport.MaxIdleConns = cfg.DownloadMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.DownloadMaxIdlePerHost
+	transport.IdleConnTimeout = time.Duration(cfg.DownloadIdleTimeout) * time.Second
+	transport.ResponseHeaderTimeout = time.Duration(cfg.DownloadHeaderTimeout) * time.Second
+
+	// No overall timeout, as large videos can take a while; cancelling the context stops a download
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,321 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// downloadQueueFile is the name of the persisted download queue in the storage directory
+const downloadQueueFile = ".download_queue.jsonl"
+
+// credentialHeaders are never written to the download queue file
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// queuedDownload is a download waiting in the persisted queue
+// It carries what the context of the original request held, so a replayed download is saved the same way
+type queuedDownload struct {
+	MessageID   string            `json:"messageId"`
+	MessageType string            `json:"messageType"`
+	ContentURL  string            `json:"contentUrl"`
+	Headers     map[string]string `json:"headers,omitempty"`     // Without credentials
+	ChannelAuth bool              `json:"channelAuth,omitempty"` // The channel token was dropped from the headers and is sent again on replay
+	SourceType  string            `json:"sourceType,omitempty"`
+	SourceID    string            `json:"sourceId,omitempty"`
+	UserID      string            `json:"userId,omitempty"`
+	FileName    string            `json:"fileName,omitempty"`
+	SentAt      time.Time         `json:"sentAt,omitempty"`
+	QueuedAt    time.Time         `json:"queuedAt"`
+	SavedPath   string            `json:"savedPath,omitempty"` // Where the download was being saved, if it got that far
+}
+
+// downloadQueueEntry is a line of the queue file: a download being queued, being saved, or one that finished
+type downloadQueueEntry struct {
+	Queued *queuedDownload `json:"queued,omitempty"`
+	Saving string          `json:"saving,omitempty"` // Message ID of a download about to be given its final path
+	Path   string          `json:"path,omitempty"`   // The final path of the download being saved
+	Done   string          `json:"done,omitempty"`   // Message ID of a download that succeeded or failed for good
+}
+
+// downloadQueue persists queued downloads in an append-only file so they survive a restart
+// Finished downloads are appended as done; the file is compacted to the pending downloads when it is opened
+type downloadQueue struct {
+	mu      sync.Mutex
+	file    *os.File
+	pending map[string]bool // Message IDs queued and not yet done
+}
+
+// openDownloadQueue opens the queue file, returning the downloads that were still pending, oldest first
+// A message queued more than once is only returned once
+func openDownloadQueue(path string) (*downloadQueue, []queuedDownload, error) {
+	pending, err := readDownloadQueue(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Rewrite the file with only the pending downloads so it doesn't grow forever
+	if err := writeDownloadQueue(path, pending); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open download queue: %v", err)
+	}
+
+	q := &downloadQueue{file: file, pending: make(map[string]bool)}
+	for _, download := range pending {
+		q.pending[download.MessageID] = true
+	}
+	return q, pending, nil
+}
+
+// readDownloadQueue replays the queue file, skipping lines that can't be parsed, such as one cut off by a crash
+func readDownloadQueue(path string) ([]queuedDownload, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read download queue: %v", err)
+	}
+	defer file.Close()
+
+	var order []string
+	queued := make(map[string]queuedDownload)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry downloadQueueEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		switch {
+		case entry.Queued != nil:
+			if _, ok := queued[entry.Queued.MessageID]; !ok {
+				order = append(order, entry.Queued.MessageID)
+			}
+			queued[entry.Queued.MessageID] = *entry.Queued
+		case entry.Saving != "":
+			if download, ok := queued[entry.Saving]; ok {
+				download.SavedPath = entry.Path
+				queued[entry.Saving] = download
+			}
+		case entry.Done != "":
+			delete(queued, entry.Done)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read download queue: %v", err)
+	}
+
+	var pending []queuedDownload
+	for _, messageID := range order {
+		if download, ok := queued[messageID]; ok {
+			pending = append(pending, download)
+		}
+	}
+	return pending, nil
+}
+
+// writeDownloadQueue replaces the queue file with the given downloads atomically
+func writeDownloadQueue(path string, downloads []queuedDownload) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download_queue-*")
+	if err != nil {
+		return fmt.Errorf("failed to write download queue: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	for i := range downloads {
+		if err := encoder.Encode(downloadQueueEntry{Queued: &downloads[i]}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write download queue: %v", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write download queue: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write download queue: %v", err)
+	}
+	return nil
+}
+
+// add records a queued download
+// Returns false without recording it if the message is already queued
+func (q *downloadQueue) add(download queuedDownload) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[download.MessageID] {
+		return false, nil
+	}
+	q.pending[download.MessageID] = true
+	return true, q.append(downloadQueueEntry{Queued: &download})
+}
+
+// saving records the path a queued download is about to be saved to, so a restart before it is marked done
+// can tell that it was saved
+func (q *downloadQueue) saving(messageID, filePath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.pending[messageID] {
+		return nil
+	}
+	return q.append(downloadQueueEntry{Saving: messageID, Path: filePath})
+}
+
+// done records that a queued download finished, successfully or for good
+func (q *downloadQueue) done(messageID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, messageID)
+	return q.append(downloadQueueEntry{Done: messageID})
+}
+
+// append writes an entry to the end of the queue file
+// Must be called with mu held
+func (q *downloadQueue) append(entry downloadQueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode download queue entry: %v", err)
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write download queue: %v", err)
+	}
+	return nil
+}
+
+// newQueuedDownload describes a download for the queue file, leaving out credentials
+// Only the channel token is remembered, by ChannelAuth, and only for the LINE content API
+func newQueuedDownload(ctx context.Context, messageID, messageType, contentURL string, headers map[string]string, channelToken string) queuedDownload {
+	source := eventSourceFromContext(ctx)
+	download := queuedDownload{
+		MessageID:   messageID,
+		MessageType: messageType,
+		ContentURL:  contentURL,
+		SourceType:  source.Type,
+		SourceID:    source.ID,
+		UserID:      userIDFromContext(ctx),
+		FileName:    fileNameFromContext(ctx),
+		SentAt:      source.Timestamp,
+		QueuedAt:    time.Now(),
+	}
+
+	for key, value := range headers {
+		if isCredentialHeader(key) {
+			if http.CanonicalHeaderKey(key) == "Authorization" && value == "Bearer "+channelToken && isLINEContentURL(contentURL) {
+				download.ChannelAuth = true
+			}
+			continue
+		}
+		if download.Headers == nil {
+			download.Headers = make(map[string]string)
+		}
+		download.Headers[key] = value
+	}
+	return download
+}
+
+// isCredentialHeader reports whether a header carries credentials
+func isCredentialHeader(key string) bool {
+	for _, header := range credentialHeaders {
+		if http.CanonicalHeaderKey(key) == header {
+			return true
+		}
+	}
+	return false
+}
+
+// isLINEContentURL reports whether a URL is on the host of the LINE content API, the only one the channel token is sent to
+func isLINEContentURL(contentURL string) bool {
+	target, err := url.Parse(contentURL)
+	if err != nil {
+		return false
+	}
+	endpoint, err := url.Parse(lineapi.ContentEndpoint())
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(target.Scheme, endpoint.Scheme) && strings.EqualFold(target.Host, endpoint.Host)
+}
+
+// restore returns the context and headers to replay a queued download with
+// The channel token stands in for the Authorization header that wasn't persisted, if the URL is still LINE's,
+// so an edited queue file can't send it elsewhere
+func (d queuedDownload) restore(channelToken string) (context.Context, map[string]string) {
+	ctx := utils.WithRequestID(context.Background(), utils.GenerateRequestID())
+	if d.SourceID != "" || !d.SentAt.IsZero() {
+		ctx = WithEventSource(ctx, EventSource{Type: d.SourceType, ID: d.SourceID, Timestamp: d.SentAt})
+	}
+	if d.UserID != "" {
+		ctx = WithUserID(ctx, d.UserID)
+	}
+	if d.FileName != "" {
+		ctx = WithFileName(ctx, d.FileName)
+	}
+
+	headers := make(map[string]string, len(d.Headers)+1)
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	if d.ChannelAuth && isLINEContentURL(d.ContentURL) {
+		headers["Authorization"] = "Bearer " + channelToken
+	}
+	return ctx, headers
+}
+
+// initDownloadQueue opens the persisted download queue when PERSIST_DOWNLOADS is enabled
+// and queues the downloads left pending by the previous run again
+func (ms *MediaStore) initDownloadQueue() {
+	if !ms.config.PersistDownloads {
+		return
+	}
+
+	if err := os.MkdirAll(ms.config.StorageDir, 0755); err != nil {
+		ms.logger.Error("Failed to create storage directory, downloads won't survive a restart: %v", err)
+		return
+	}
+
+	queue, pending, err := openDownloadQueue(filepath.Join(ms.config.StorageDir, downloadQueueFile))
+	if err != nil {
+		ms.logger.Error("Failed to open the download queue, downloads won't survive a restart: %v", err)
+		return
+	}
+	ms.downloadQueue = queue
+
+	if len(pending) > 0 {
+		ms.logger.Info("Resuming %d downloads queued before the restart", len(pending))
+	}
+	for _, download := range pending {
+		// A download saved just before the restart, but not yet marked done, isn't repeated
+		if download.SavedPath != "" {
+			if _, err := os.Stat(download.SavedPath); err == nil {
+				ms.logger.Info("Media %s was already saved to %s, not downloading it again", download.MessageID, download.SavedPath)
+				if err := queue.done(download.MessageID); err != nil {
+					ms.logger.Warning("Failed to mark the download of media %s done: %v", download.MessageID, err)
+				}
+				continue
+			}
+		}
+
+		ctx, headers := download.restore(ms.config.ChannelToken)
+		ms.startDownload(ctx, download.MessageID, download.MessageType, download.ContentURL, headers)
+	}
+}
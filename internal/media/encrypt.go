@@ -0,0 +1,210 @@
+package media
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EncryptedExtension is appended to the name of files stored with ENCRYPT_AT_REST
+const EncryptedExtension = ".enc"
+
+// Encrypted files start with encryptionMagic and a random nonce prefix, followed by the content
+// sealed with AES-256-GCM in chunks of encryptionChunkSize bytes, so large files never need to be held
+// in memory. Each chunk's nonce is the prefix and the chunk number, and whether it is the last chunk
+// is authenticated, so reordered, dropped or truncated chunks are detected
+const (
+	encryptionMagic       = "LFCE1"
+	encryptionNoncePrefix = 8
+	encryptionChunkSize   = 64 << 10
+)
+
+// ErrDecryptFailed is returned when an encrypted file can't be read, because of a wrong key or damaged content
+var ErrDecryptFailed = errors.New("decryption failed")
+
+// IsEncrypted reports whether a stored file was encrypted
+func IsEncrypted(filePath string) bool {
+	return strings.HasSuffix(filePath, EncryptedExtension)
+}
+
+// newGCM creates the AES-GCM cipher for a 32-byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key is %d bytes, 32 are required", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk: the file's prefix followed by the chunk number
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, encryptionNoncePrefix+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefix:], counter)
+	return nonce
+}
+
+// chunkAAD authenticates whether a chunk is the last one
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter encrypts what is written to it; Close must be called to write the last chunk
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// NewEncryptWriter returns a writer that encrypts content to w with the key
+// Closing it writes the final chunk but doesn't close w
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	if _, err := w.Write(append([]byte(encryptionMagic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, gcm: gcm, prefix: prefix, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+// Write buffers content, sealing each chunk once more content follows it
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed when there is more, as the last chunk is sealed differently
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts the buffered chunk and writes it out
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, chunkAAD(last))
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts content written by an encryptWriter
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte // Decrypted content not yet read
+	sealed  []byte
+	done    bool
+}
+
+// NewDecryptReader returns a reader of the decrypted content of r
+// Reads fail with ErrDecryptFailed if the key is wrong or the content was modified or truncated
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionMagic)+encryptionNoncePrefix)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrDecryptFailed)
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		gcm:    gcm,
+		prefix: header[len(encryptionMagic):],
+		sealed: make([]byte, encryptionChunkSize+gcm.Overhead()),
+	}, nil
+}
+
+// Read returns decrypted content, decrypting the next chunk when the current one is used up
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+// A chunk is the last one if it is short or nothing follows it
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			d.done = true
+		}
+	}
+
+	chunk, err := d.gcm.Open(d.sealed[:0:0], chunkNonce(d.prefix, d.counter), d.sealed[:n], chunkAAD(d.done))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d: %v", ErrDecryptFailed, d.counter, err)
+	}
+	d.counter++
+	d.chunk = chunk
+	return nil
+}
+
+// encryptedName adds EncryptedExtension to a stored file's name when ENCRYPT_AT_REST is enabled
+func (ms *MediaStore) encryptedName(name string) string {
+	if ms.config.EncryptAtRest {
+		return name + EncryptedExtension
+	}
+	return name
+}
+
+// newEncryptor returns a writer encrypting to w with the ENCRYPT_AT_REST key
+func (ms *MediaStore) newEncryptor(w io.Writer) (io.WriteCloser, error) {
+	if ms.encryptionKey == nil {
+		return nil, fmt.Errorf("no usable encryption key")
+	}
+	return NewEncryptWriter(w, ms.encryptionKey)
+}
@@ -0,0 +1,77 @@
+package media
+
+import (
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// defaultErrorLogSize is used when ERROR_LOG_SIZE is not configured
+const defaultErrorLogSize = 100
+
+// ErrorEvent is a recent failure recorded for the errors endpoint
+type ErrorEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"` // e.g. "download", "save" or "upload"
+	Message   string    `json:"message"`
+}
+
+// errorLog is a fixed-size ring buffer of the most recent errors
+type errorLog struct {
+	mu     sync.Mutex
+	events []ErrorEvent
+	next   int  // Index the next event is written to
+	full   bool // Whether the buffer has wrapped around
+}
+
+// newErrorLog creates an error log holding at most size events
+func newErrorLog(size int) *errorLog {
+	if size <= 0 {
+		size = defaultErrorLogSize
+	}
+	return &errorLog{events: make([]ErrorEvent, size)}
+}
+
+// add records an event, overwriting the oldest one when the buffer is full
+func (l *errorLog) add(event ErrorEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the recorded events, newest first
+func (l *errorLog) recent() []ErrorEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.events)
+	}
+
+	events := make([]ErrorEvent, 0, count)
+	for i := 1; i <= count; i++ {
+		events = append(events, l.events[(l.next-i+len(l.events))%len(l.events)])
+	}
+	return events
+}
+
+// RecordError records a failed operation so it shows up in RecentErrors
+func (ms *MediaStore) RecordError(operation string, err error) {
+	ms.errorLog.add(ErrorEvent{
+		Time:      utils.Now(),
+		Operation: operation,
+		Message:   err.Error(),
+	})
+}
+
+// RecentErrors returns the most recent failures, newest first
+func (ms *MediaStore) RecentErrors() []ErrorEvent {
+	return ms.errorLog.recent()
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Errors returned by the media store; callers can branch on them with errors.Is
+var (
+	// ErrFileTooLarge is returned when media exceeds the configured maximum file size
+	ErrFileTooLarge = errors.New("file too large")
+
+	// ErrDiskFull is returned when there is no space left to save media
+	ErrDiskFull = errors.New("disk full")
+
+	// ErrDownloadFailed is returned when media content could not be retrieved
+	ErrDownloadFailed = errors.New("download failed")
+
+	// ErrDownloadTimeout is returned when a download takes longer than MAX_DOWNLOAD_DURATION
+	ErrDownloadTimeout = errors.New("download took too long")
+
+	// ErrBlockedType is returned when media's content type isn't allowed to be saved
+	ErrBlockedType = errors.New("content type not allowed")
+
+	// ErrQuotaExceeded is returned when there is no room for media within MAX_TOTAL_STORAGE_MB
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+	// ErrSaveFailed is returned when media could not be written to disk for another reason
+	ErrSaveFailed = errors.New("save failed")
+
+	// ErrCloudDisabled is returned by cloud operations when no cloud storage is configured
+	ErrCloudDisabled = errors.New("cloud storage disabled")
+
+	// ErrCloudUnavailable is returned for uploads skipped while cloud storage keeps failing
+	ErrCloudUnavailable = errors.New("cloud storage unavailable")
+
+	// ErrSweepsStopped is returned by backup syncs requested after StopSweeps, during shutdown
+	ErrSweepsStopped = errors.New("backup syncs are stopped for shutdown")
+)
+
+// errMaxDownloadDuration is the cause of the context deadline set by MAX_DOWNLOAD_DURATION
+var errMaxDownloadDuration = errors.New("maximum download duration exceeded")
+
+// wrapWriteError classifies an error from writing to disk
+func wrapWriteError(message string, err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %s: %v", ErrDiskFull, message, err)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrSaveFailed, message, err)
+}
+
+// sourceReader records errors from reading the media source
+// so they can be told apart from errors writing to disk
+// Reading stops once the context is cancelled
+type sourceReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
+
+// Read reads from the underlying source and records any error other than EOF
+func (s *sourceReader) Read(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,56 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// sniffLength is how much content is inspected to detect its type, the most http.DetectContentType uses
+const sniffLength = 512
+
+// fileNameKey is the context key for the original name of the file being saved
+type fileNameKey struct{}
+
+// WithFileName returns a context carrying the original name of the file being saved
+// LINE only sends a name with file messages; its extension is used when the content type is unknown
+func WithFileName(ctx context.Context, fileName string) context.Context {
+	return context.WithValue(ctx, fileNameKey{}, fileName)
+}
+
+// fileNameFromContext returns the file name set with WithFileName, if any
+func fileNameFromContext(ctx context.Context) string {
+	fileName, _ := ctx.Value(fileNameKey{}).(string)
+	return fileName
+}
+
+// sniffContent detects the type of content from its first bytes
+// Returns the detected type and a reader that still yields the whole content
+func sniffContent(r io.Reader) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(r, sniffLength)
+
+	// A short read just means the content is small; Peek returns what there is
+	head, _ := buffered.Peek(sniffLength)
+	return http.DetectContentType(head), buffered
+}
+
+// chooseExtension picks the extension for saved content, in priority order:
+// the declared content type, the original file name's extension, then the sniffed content type
+// File messages prefer their original extension, as their declared type is often just application/octet-stream
+func chooseExtension(messageType, declaredType, fileName, sniffedType string) string {
+	fileExtension := utils.SafeExtension(fileName)
+	if messageType == "file" && fileExtension != "" {
+		return fileExtension
+	}
+
+	if extension := utils.GetContentType(declaredType); extension != utils.DefaultExtension {
+		return extension
+	}
+	if fileExtension != "" {
+		return fileExtension
+	}
+	return utils.GetContentType(sniffedType)
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// storeSpooled writes spooled content to a new media file in the storage directory for the date and type
+// If that fails and FALLBACK_STORAGE_DIR is set, the spooled copy is written there instead, without fetching it again
+// The storage directory is tried first every time, so saves return to it once it is writable again
+func (ms *MediaStore) storeSpooled(ctx context.Context, spoolPath, dateStr, mediaType, filename string, compress bool) (string, int64, error) {
+	filePath, bytesWritten, err := ms.writeSpooled(ctx, spoolPath, ms.config.GetMediaDir, dateStr, mediaType, filename, compress)
+	if err == nil || ms.config.FallbackStorageDir == "" || !isStorageError(err) {
+		return filePath, bytesWritten, err
+	}
+
+	logger := ms.logger.ForContext(ctx)
+	filePath, bytesWritten, fallbackErr := ms.writeSpooled(ctx, spoolPath, ms.config.GetFallbackMediaDir, dateStr, mediaType, filename, compress)
+	if fallbackErr != nil {
+		logger.Error("Failed to save to the storage directory (%v) and to the fallback %s: %v",
+			err, ms.config.FallbackStorageDir, fallbackErr)
+		return "", 0, err
+	}
+
+	logger.Warning("Failed to save to the storage directory, saving %s to the fallback %s instead: %v",
+		filename, ms.config.FallbackStorageDir, err)
+	ms.recordFallback()
+	return filePath, bytesWritten, nil
+}
+
+// writeSpooled copies spooled content to filename in the folder returned by mediaDir
+func (ms *MediaStore) writeSpooled(ctx context.Context, spoolPath string, mediaDir func(dateStr, mediaType string) (string, error), dateStr, mediaType, filename string, compress bool) (string, int64, error) {
+	dir, err := mediaDir(dateStr, mediaType)
+	if err != nil {
+		return "", 0, wrapWriteError("failed to create storage directory", err)
+	}
+
+	spool, err := os.Open(spoolPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: failed to open spooled content: %v", ErrSaveFailed, err)
+	}
+	defer spool.Close()
+
+	filePath := filepath.Join(dir, filename)
+	bytesWritten, err := ms.writeFile(ctx, filePath, spool, compress)
+	if err != nil {
+		return "", 0, err
+	}
+	return filePath, bytesWritten, nil
+}
+
+// isStorageError reports whether a save failed because the destination couldn't be written,
+// as opposed to the content being refused or the save being cancelled
+func isStorageError(err error) bool {
+	return errors.Is(err, ErrSaveFailed) || errors.Is(err, ErrDiskFull)
+}
@@ -1,23 +1,32 @@
 package media
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.olipicus.com/line_file_catcher/internal/cloud/common"
 	"code.olipicus.com/line_file_catcher/internal/cloud/drive"
+	"code.olipicus.com/line_file_catcher/internal/cloud/webdav"
 	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/notify"
 	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/klauspost/compress/zstd"
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 )
 
 // FileUploadCallback is a function that is called when a file is uploaded to cloud storage
-type FileUploadCallback func(filename string, fileLink string) error
+// ctx is the upload's context, which keeps the saving request's values but isn't cancelled with it
+type FileUploadCallback func(ctx context.Context, filename string, fileLink string) error
 
 // Stats tracks file processing statistics
 type Stats struct {
@@ -25,21 +34,80 @@ type Stats struct {
 	VideoCount int       `json:"videoCount"`
 	AudioCount int       `json:"audioCount"`
 	FileCount  int       `json:"fileCount"`
-	TotalBytes int64     `json:"totalBytes"`
+	ImageBytes int64     `json:"imageBytes"`
+	VideoBytes int64     `json:"videoBytes"`
+	AudioBytes int64     `json:"audioBytes"`
+	FileBytes  int64     `json:"fileBytes"`
+	TotalBytes int64     `json:"totalBytes"` // Sum of the per-type byte totals
 	StartTime  time.Time `json:"startTime"`
-	mu         sync.Mutex
+
+	// Image previews saved with SAVE_IMAGE_PREVIEW, not included in the image totals
+	ImagePreviewCount int   `json:"imagePreviewCount"`
+	ImagePreviewBytes int64 `json:"imagePreviewBytes"`
+
+	// Files refused because their content type isn't allowed
+	BlockedCount int `json:"blockedCount"`
+
+	// Messages whose content LINE no longer had when it was fetched
+	ExpiredCount int `json:"expiredCount"`
+
+	// Stored files removed to stay within MAX_TOTAL_STORAGE_MB
+	EvictedCount int `json:"evictedCount"`
+
+	// Downloads aborted for taking longer than MAX_DOWNLOAD_DURATION
+	TimedOutCount int `json:"timedOutCount"`
+
+	// Files saved to FALLBACK_STORAGE_DIR because the storage directory couldn't be written
+	FallbackCount int `json:"fallbackCount"`
+
+	// Download throughput in MB/s, from the time taken to receive and write each file
+	AvgThroughputMBps  float64 `json:"avgThroughputMBps"` // Exponential moving average
+	PeakThroughputMBps float64 `json:"peakThroughputMBps"`
+	ThroughputSamples  int     `json:"throughputSamples"`
 }
 
+// throughputSmoothing is the weight of the latest download in the average throughput
+const throughputSmoothing = 0.2
+
 // MediaStore handles the downloading and storing of media files
 type MediaStore struct {
 	config          *config.Config
 	logger          *utils.Logger
 	cloudStore      common.CloudStorage
+	cloudFolder     string // Base folder on the cloud storage
+	cloudInitErr    error  // Set when cloud storage is enabled but failed to initialize
 	downloadWg      sync.WaitGroup
 	uploadWg        sync.WaitGroup
 	stats           Stats
+	statsMu         sync.Mutex                    // Mutex for stats
 	uploadCallbacks map[string]FileUploadCallback // Map of file IDs to callbacks
 	callbackMu      sync.Mutex                    // Mutex for uploadCallbacks map
+	uploadQueue     chan uploadJob                // Uploads waiting for a worker
+	uploadIndex     *uploadIndex                  // Which stored files have been uploaded
+	uploadsInFlight atomic.Int64                  // Uploads currently being processed
+	downloadsQueued atomic.Int64                  // Queued downloads that haven't started yet
+	downloadsActive atomic.Int64                  // Downloads and saves currently running
+	uploadsDropped  atomic.Int64                  // Uploads dropped because the queue was full
+	errorLog        *errorLog                     // Recent failures for the errors endpoint
+	alerts          alerter                       // Operator alerts for repeated failures and low disk space
+	breaker         *circuitBreaker               // Stops uploads while cloud storage keeps failing
+	pause           pauseGate                     // Holds back downloads and uploads while paused
+	quota           storageQuota                  // Storage used, tracked for MAX_TOTAL_STORAGE_MB
+	encryptionKey   []byte                        // Key for ENCRYPT_AT_REST, nil if disabled or unusable
+	sources         *sourceTracker                // Saved media per user, group or room
+	downloadClient  *http.Client                  // Shared by downloads so connections are reused
+	downloadLimit   *utils.BandwidthLimiter       // Shared by downloads, nil when DOWNLOAD_MAX_BYTES_PER_SEC is unset
+	filenames       utils.FilenameStrategy        // Names saved files, chosen by FILENAME_STRATEGY
+	checksumsMu     sync.Mutex                    // Serializes appends to the checksums files
+	downloadQueue   *downloadQueue                // Queued downloads persisted for PERSIST_DOWNLOADS, nil if disabled
+
+	consecutiveUploadFailures atomic.Int64 // Reset by each successful upload
+	retryScheduled            atomic.Bool  // A backup sync is scheduled to retry failed uploads
+
+	sweepCtx   context.Context    // Cancelled by StopSweeps, stopping backup syncs
+	stopSweeps context.CancelFunc // Cancels sweepCtx
+	retryTimer *time.Timer        // Scheduled retry of failed uploads, stopped by StopSweeps
+	retryMu    sync.Mutex         // Guards retryTimer
 }
 
 // NewMediaStore creates a new MediaStore instance
@@ -48,10 +116,37 @@ func NewMediaStore(cfg *config.Config, logger *utils.Logger) *MediaStore {
 		config:          cfg,
 		logger:          logger,
 		uploadCallbacks: make(map[string]FileUploadCallback),
+		errorLog:        newErrorLog(cfg.ErrorLogSize),
+		sources:         newSourceTracker(cfg.SourceStatsLimit),
+		downloadClient:  newDownloadClient(cfg),
+		downloadLimit:   utils.NewBandwidthLimiter(int64(cfg.DownloadMaxBytesPerSec)),
+		filenames:       newFilenameStrategy(cfg),
+		alerts:          alerter{lastSent: make(map[string]time.Time)},
+		breaker:         newCircuitBreaker(cfg.CloudBreakerThreshold, time.Duration(cfg.CloudBreakerCooldownSeconds)*time.Second),
 		stats: Stats{
-			StartTime: time.Now(),
+			StartTime: utils.Now(),
 		},
 	}
+	ms.sweepCtx, ms.stopSweeps = context.WithCancel(context.Background())
+
+	// Load the key for encrypting stored files; saves fail rather than store plaintext without it
+	if cfg.EncryptAtRest {
+		key, err := cfg.LoadEncryptionKey()
+		if err != nil {
+			logger.Error("Encryption at rest is enabled but the key is unusable, saves will fail: %v", err)
+		} else {
+			ms.encryptionKey = key
+			logger.Info("Stored files will be encrypted")
+		}
+	}
+
+	// Measure current usage once so the storage quota can be tracked incrementally
+	ms.initQuota()
+
+	// Send operator alerts to a webhook if configured
+	if cfg.AlertWebhookURL != "" {
+		ms.alerts.notifier = notify.NewWebhookNotifier(cfg, logger)
+	}
 
 	// Initialize cloud storage if enabled
 	if cfg.DriveEnabled {
@@ -60,121 +155,380 @@ func NewMediaStore(cfg *config.Config, logger *utils.Logger) *MediaStore {
 		if err != nil {
 			logger.Error("Failed to initialize Google Drive: %v", err)
 			logger.Warning("Google Drive backup will be disabled")
+			ms.cloudInitErr = err
 		} else {
 			ms.cloudStore = driveService
+			ms.cloudFolder = cfg.DriveFolder
 			logger.Info("Google Drive backup enabled")
 		}
+	} else if cfg.WebDAVEnabled {
+		webdavService := webdav.NewWebDAVService(cfg, logger)
+		err := webdavService.Initialize()
+		if err != nil {
+			logger.Error("Failed to initialize WebDAV: %v", err)
+			logger.Warning("WebDAV backup will be disabled")
+			ms.cloudInitErr = err
+		} else {
+			ms.cloudStore = webdavService
+			ms.cloudFolder = cfg.WebDAVFolder
+			logger.Info("WebDAV backup enabled")
+		}
 	} else {
-		logger.Info("Google Drive backup disabled")
+		logger.Info("Cloud backup disabled")
 	}
 
+	// Start the upload workers if cloud storage is available
+	if ms.cloudStore != nil {
+		index, err := loadUploadIndex(filepath.Join(cfg.StorageDir, uploadIndexFile))
+		if err != nil {
+			logger.Warning("Starting with an empty upload index: %v", err)
+		}
+		ms.uploadIndex = index
+
+		ms.startUploadWorkers()
+	}
+
+	// Resume the downloads that were still queued when the service stopped
+	ms.initDownloadQueue()
+
 	return ms
 }
 
 // SaveMedia saves media content from a LINE MessageContentResponse
-func (ms *MediaStore) SaveMedia(messageID, messageType string, content *linebot.MessageContentResponse) (string, error) {
-	// Use current date for organizing files
-	dateStr := utils.GetDateString()
+// Cancelling the context aborts the save and removes the partial file
+func (ms *MediaStore) SaveMedia(ctx context.Context, messageID, messageType string, content *linebot.MessageContentResponse) (string, error) {
+	logger := ms.logger.ForContext(ctx)
+	defer ms.trackDownload()()
 
-	ms.logger.Debug("Saving %s media with ID %s", messageType, messageID)
+	// Organize files by the date the message was sent
+	sent := sentAt(ctx)
+	dateStr := utils.FormatDate(sent)
 
-	// Get directory for storing files based on date
-	storageDir, err := ms.config.GetMediaDir(dateStr)
-	if err != nil {
-		return "", fmt.Errorf("failed to create storage directory: %v", err)
-	}
+	logger.Debug("Saving %s media with ID %s", messageType, messageID)
 
-	// Determine file extension based on content type
+	// Determine file extension from the content type, the original file name or the content itself
 	contentType := content.ContentType
-	ms.logger.Debug("Media %s has content type: %s", messageID, contentType)
-	extension := utils.GetContentType(contentType)
+	sniffedType, source := sniffContent(content.Content)
+	logger.Debug("Media %s has content type: %q, detected: %s", messageID, contentType, sniffedType)
+	extension := chooseExtension(messageType, contentType, fileNameFromContext(ctx), sniffedType)
+	if contentType == "" {
+		contentType = sniffedType
+	}
 
-	// Generate a unique filename
-	filename, err := utils.GenerateUniqueFilename(messageType, extension)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate filename: %v", err)
+	// Refuse content types that aren't allowed, checking the type implied by the file name too
+	fileNameType := mime.TypeByExtension(utils.SafeExtension(fileNameFromContext(ctx)))
+	if !ms.config.MimeTypeAllowed(content.ContentType, sniffedType, fileNameType) {
+		ms.recordBlocked()
+		logger.Warning("Refusing %s media %s from %s: content type %q (detected %q, file name %q) is not allowed",
+			messageType, messageID, eventSourceFromContext(ctx).ID, content.ContentType, sniffedType, fileNameType)
+		return "", fmt.Errorf("%w: %s", ErrBlockedType, contentType)
 	}
 
-	// Full path to save the file
-	filePath := filepath.Join(storageDir, filename)
+	// Compress text-like content when enabled
+	compress := ms.config.CompressStorage && isCompressible(contentType)
+
+	// Uploads are tagged with the message the file came from
+	ctx = withUploadProperties(ctx, messageID)
+	cloudFolder := ms.cloudFolderPath(messageType, userIDFromContext(ctx), sent)
+
+	// Upload the content to cloud storage as it is received if enabled, which needs the name up front
+	var filename, contentHash string
+	var stream *streamUpload
+	if ms.canStreamUpload(compress) {
+		var err error
+		if filename, _, err = ms.storedName(messageType, contentType, extension, "", compress); err != nil {
+			return "", err
+		}
+		stream = ms.startStreamUpload(ctx, filename, cloudFolder, content.ContentLength)
+		source = io.TeeReader(source, stream)
+	}
 
-	// Create the file
-	file, err := os.Create(filePath)
+	// Receive the content into a spool file first, timing it for the throughput statistics,
+	// so a failure to write it to storage doesn't lose content that can't be fetched again
+	startTime := time.Now()
+	spoolPath, err := ms.spoolContent(ctx, source)
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %v", err)
+		stream.abort(err)
+		return "", err
 	}
-	defer file.Close()
+	defer os.Remove(spoolPath)
 
-	// Copy content to file
-	bytesWritten, err := io.Copy(file, content.Content)
+	// Otherwise name the file once the content is known
+	if stream == nil {
+		if filename, contentHash, err = ms.storedName(messageType, contentType, extension, spoolPath, compress); err != nil {
+			return "", err
+		}
+	}
+
+	// Write it to the date and type folder, or the fallback storage directory
+	filePath, bytesWritten, err := ms.storeSpooled(ctx, spoolPath, dateStr, messageType, filename, compress)
 	if err != nil {
-		return "", fmt.Errorf("failed to save file: %v", err)
+		stream.abort(err)
+		return "", err
+	}
+
+	// Keep total storage within MAX_TOTAL_STORAGE_MB
+	if err := ms.enforceQuota(ctx, filePath); err != nil {
+		stream.abort(err)
+		return "", err
+	}
+
+	// Only now let a streamed upload complete, so a file that wasn't kept doesn't end up in cloud storage alone
+	var streamed streamResult
+	if stream != nil {
+		streamed = stream.finish()
 	}
 
 	// Update statistics
-	ms.updateStats(messageType, bytesWritten)
+	ms.updateStats(messageType, bytesWritten, time.Since(startTime))
+	ms.recordSource(ctx, bytesWritten)
 
-	ms.logger.Info("Saved %s media file of %d bytes to %s", messageType, bytesWritten, filePath)
+	logger.Info("Saved %s media file of %d bytes to %s", messageType, bytesWritten, filePath)
 
-	// Upload to cloud storage if enabled
-	ms.uploadToCloudAsync(filePath, dateStr)
+	// Record the checksum for later integrity checks
+	ms.recordChecksum(ctx, filePath, storedHash(contentHash, filePath, compress))
+
+	// Upload to cloud storage if enabled and not already streamed there
+	if stream != nil {
+		ms.recordStreamUpload(ctx, filePath, cloudFolder, streamed)
+	} else {
+		ms.uploadToCloudAsync(ctx, filePath, cloudFolder)
+	}
+
+	// Record who sent the file and when
+	ms.saveFileMetadata(ctx, filePath, messageID, messageType, contentType, bytesWritten, cloudFolder)
+
+	// Produce an mp3 copy of audio files if enabled
+	if messageType == "audio" {
+		ms.transcodeAudioAsync(ctx, filePath, cloudFolder)
+	}
 
 	return filePath, nil
 }
 
-// uploadToCloudAsync uploads a file to cloud storage asynchronously
-func (ms *MediaStore) uploadToCloudAsync(filePath, folderPath string) {
-	// Skip if cloud storage is not configured
-	if ms.cloudStore == nil {
-		return
+// storedName returns the name a file received with a message is stored under, and its content hash if the name used it
+// contentPath is the received content, which may be empty if the filename strategy doesn't use the content hash
+func (ms *MediaStore) storedName(messageType, contentType, extension, contentPath string, compress bool) (string, string, error) {
+	filename, contentHash, err := ms.fileName(messageType, "", contentType, extension, contentPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate filename: %v", err)
 	}
 
-	ms.uploadWg.Add(1)
-	go func() {
-		defer ms.uploadWg.Done()
+	// Mark the original of an image whose preview is saved too, so the two share a base name
+	if messageType == "image" && ms.config.SaveImagePreview {
+		ext := filepath.Ext(filename)
+		filename = strings.TrimSuffix(filename, ext) + originalSuffix + ext
+	}
+
+	if compress {
+		filename += CompressedExtension
+	}
+	return ms.encryptedName(filename), contentHash, nil
+}
+
+// writeFile copies media content to a new file, enforcing the maximum file size
+// When compress is set the file is written with zstd; the returned count is always the original size
+// The content is written to a temporary file next to it, which is renamed into place once complete,
+// so readers such as the uploader never see a partial file; the temporary file is removed on failure
+func (ms *MediaStore) writeFile(ctx context.Context, filePath string, src io.Reader, compress bool) (int64, error) {
+	// Create the temporary file
+	tempPath := filePath + TempExtension
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return 0, wrapWriteError("failed to create file", err)
+	}
 
-		ms.logger.Debug("Starting cloud upload for %s to folder %s", filePath, folderPath)
+	bytesWritten, err := ms.writeToFile(ctx, file, src, compress, IsEncrypted(filePath))
+	if err != nil {
+		return 0, err
+	}
 
-		// Build the remote folder path using the cloud provider's base folder and the date subfolder
-		remoteFolder := filepath.Join(ms.config.DriveFolder, folderPath)
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return 0, wrapWriteError("failed to save file", err)
+	}
+	return bytesWritten, nil
+}
 
-		// Upload the file
-		fileID, err := ms.cloudStore.UploadFile(filePath, remoteFolder)
+// writeToFile copies media content to a file that has already been created, and closes it
+// The content is encrypted when encrypt is set; a partially written file is removed on failure
+func (ms *MediaStore) writeToFile(ctx context.Context, file *os.File, src io.Reader, compress, encrypt bool) (int64, error) {
+	defer file.Close()
+	filePath := file.Name()
+
+	// Read one byte past the limit so oversized content can be detected
+	source := &sourceReader{ctx: ctx, r: src}
+	var reader io.Reader = source
+	maxSize := ms.config.MaxFileSizeBytes
+	if maxSize > 0 {
+		reader = io.LimitReader(source, maxSize+1)
+	}
+
+	// Encrypt the content on its way to the file if requested
+	var dst io.Writer = file
+	var encryptor io.WriteCloser
+	if encrypt {
+		var err error
+		encryptor, err = ms.newEncryptor(file)
 		if err != nil {
-			ms.logger.Error("Failed to upload file to cloud storage: %v", err)
-			return
+			file.Close()
+			os.Remove(filePath)
+			return 0, fmt.Errorf("%w: failed to create encryptor: %v", ErrSaveFailed, err)
 		}
+		dst = encryptor
+	}
 
-		ms.logger.Info("Successfully uploaded %s to cloud storage (ID: %s)", filePath, fileID)
+	// Compress the content before encrypting it if requested
+	var encoder *zstd.Encoder
+	if compress {
+		var err error
+		encoder, err = zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			os.Remove(filePath)
+			return 0, fmt.Errorf("failed to create compressor: %v", err)
+		}
+		dst = encoder
+	}
 
-		// Call the registered callback function if exists
-		ms.callUploadCallback(fileID, filePath)
-	}()
+	// Copy content to file
+	bytesWritten, err := io.Copy(dst, reader)
+	if encoder != nil {
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if encryptor != nil {
+		if closeErr := encryptor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("save cancelled: %w", ctx.Err())
+	} else if err == nil && maxSize > 0 && bytesWritten > maxSize {
+		err = fmt.Errorf("%w: exceeds limit of %d bytes", ErrFileTooLarge, maxSize)
+	} else if err != nil && source.err != nil {
+		err = fmt.Errorf("%w: failed to read content: %v", ErrDownloadFailed, err)
+	} else if err != nil {
+		err = wrapWriteError("failed to save file", err)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(filePath)
+		if errors.Is(err, ErrDiskFull) {
+			ms.alert(alertDiskFull, "Disk full", fmt.Sprintf("Failed to save %s: %v", filePath, err))
+		}
+		return 0, err
+	}
+
+	ms.checkDiskSpace(filepath.Dir(filePath))
+
+	return bytesWritten, nil
 }
 
 // updateStats updates the statistics counter safely
-func (ms *MediaStore) updateStats(mediaType string, bytes int64) {
-	ms.stats.mu.Lock()
-	defer ms.stats.mu.Unlock()
+// The duration is how long the file took to download and save
+func (ms *MediaStore) updateStats(mediaType string, bytes int64, duration time.Duration) {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.recordThroughput(bytes, duration)
 
 	ms.stats.TotalBytes += bytes
 
 	switch mediaType {
 	case "image":
 		ms.stats.ImageCount++
+		ms.stats.ImageBytes += bytes
 	case "video":
 		ms.stats.VideoCount++
+		ms.stats.VideoBytes += bytes
 	case "audio":
 		ms.stats.AudioCount++
+		ms.stats.AudioBytes += bytes
 	case "file":
 		ms.stats.FileCount++
+		ms.stats.FileBytes += bytes
+	}
+}
+
+// recordBlocked counts a file refused because of its content type
+func (ms *MediaStore) recordBlocked() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.BlockedCount++
+}
+
+// RecordExpired counts a message whose content had expired on LINE's servers
+func (ms *MediaStore) RecordExpired() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.ExpiredCount++
+}
+
+// recordImagePreview adds a saved image preview to the statistics
+func (ms *MediaStore) recordImagePreview(bytes int64) {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.ImagePreviewCount++
+	ms.stats.ImagePreviewBytes += bytes
+}
+
+// recordEvicted counts a stored file removed to make room within the storage quota
+func (ms *MediaStore) recordEvicted() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.EvictedCount++
+}
+
+// recordTimedOut counts a download aborted by MAX_DOWNLOAD_DURATION
+func (ms *MediaStore) recordTimedOut() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.TimedOutCount++
+}
+
+// recordFallback counts a file saved to the fallback storage directory
+func (ms *MediaStore) recordFallback() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats.FallbackCount++
+}
+
+// recordThroughput adds a download to the throughput statistics
+// Must be called with statsMu held
+func (ms *MediaStore) recordThroughput(bytes int64, duration time.Duration) {
+	// Empty or instant saves say nothing about throughput
+	if bytes <= 0 || duration <= 0 {
+		return
+	}
+
+	mbps := float64(bytes) / 1024 / 1024 / duration.Seconds()
+
+	if ms.stats.ThroughputSamples == 0 {
+		ms.stats.AvgThroughputMBps = mbps
+	} else {
+		ms.stats.AvgThroughputMBps += throughputSmoothing * (mbps - ms.stats.AvgThroughputMBps)
 	}
+
+	if mbps > ms.stats.PeakThroughputMBps {
+		ms.stats.PeakThroughputMBps = mbps
+	}
+
+	ms.stats.ThroughputSamples++
 }
 
 // GetStats returns a copy of the current statistics
 func (ms *MediaStore) GetStats() Stats {
-	ms.stats.mu.Lock()
-	defer ms.stats.mu.Unlock()
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
 
 	// Return a copy to avoid race conditions
 	return Stats{
@@ -182,118 +536,385 @@ func (ms *MediaStore) GetStats() Stats {
 		VideoCount: ms.stats.VideoCount,
 		AudioCount: ms.stats.AudioCount,
 		FileCount:  ms.stats.FileCount,
+		ImageBytes: ms.stats.ImageBytes,
+		VideoBytes: ms.stats.VideoBytes,
+		AudioBytes: ms.stats.AudioBytes,
+		FileBytes:  ms.stats.FileBytes,
 		TotalBytes: ms.stats.TotalBytes,
 		StartTime:  ms.stats.StartTime,
+
+		ImagePreviewCount: ms.stats.ImagePreviewCount,
+		ImagePreviewBytes: ms.stats.ImagePreviewBytes,
+
+		BlockedCount:  ms.stats.BlockedCount,
+		ExpiredCount:  ms.stats.ExpiredCount,
+		EvictedCount:  ms.stats.EvictedCount,
+		TimedOutCount: ms.stats.TimedOutCount,
+		FallbackCount: ms.stats.FallbackCount,
+
+		AvgThroughputMBps:  ms.stats.AvgThroughputMBps,
+		PeakThroughputMBps: ms.stats.PeakThroughputMBps,
+		ThroughputSamples:  ms.stats.ThroughputSamples,
 	}
 }
 
-// GetCloudStats returns statistics about cloud storage if available
-func (ms *MediaStore) GetCloudStats() map[string]interface{} {
+// ResetStats zeroes the file and per-source statistics and restarts the collection period
+func (ms *MediaStore) ResetStats() {
+	ms.statsMu.Lock()
+	defer ms.statsMu.Unlock()
+
+	ms.stats = Stats{
+		StartTime: utils.Now(),
+	}
+	ms.sources.reset()
+}
+
+// ResetCloudStats zeroes the cloud storage statistics if available
+func (ms *MediaStore) ResetCloudStats() {
 	if ms.cloudStore == nil {
+		return
+	}
+
+	ms.cloudStore.ResetStats()
+	ms.uploadsDropped.Store(0)
+}
+
+// CloudStats describes cloud storage and the upload queue feeding it
+// The provider statistics are only present when cloud storage is enabled
+type CloudStats struct {
+	Enabled bool `json:"enabled"`
+	*common.BackupStats
+	QueueDepth     int           `json:"queueDepth"`
+	QueueCapacity  int           `json:"queueCapacity"`
+	InFlight       int64         `json:"inFlight"`
+	DroppedUploads int64         `json:"droppedUploads"`
+	CircuitBreaker *BreakerStats `json:"circuitBreaker,omitempty"`
+}
+
+// Map returns the statistics in the original map layout, for existing consumers
+func (s CloudStats) Map() map[string]interface{} {
+	if !s.Enabled || s.BackupStats == nil {
 		return map[string]interface{}{
 			"enabled": false,
 		}
 	}
 
-	stats := ms.cloudStore.GetBackupStats()
+	stats := s.BackupStats.Map()
 	stats["enabled"] = true
+	stats["queueDepth"] = s.QueueDepth
+	stats["queueCapacity"] = s.QueueCapacity
+	stats["inFlight"] = s.InFlight
+	stats["droppedUploads"] = s.DroppedUploads
+	if s.CircuitBreaker != nil {
+		stats["circuitBreaker"] = *s.CircuitBreaker
+	}
 
 	return stats
 }
 
+// GetCloudStats returns statistics about cloud storage if available
+func (ms *MediaStore) GetCloudStats() CloudStats {
+	if ms.cloudStore == nil {
+		return CloudStats{}
+	}
+
+	backupStats := ms.cloudStore.GetBackupStats()
+	breakerStats := ms.breaker.stats()
+
+	return CloudStats{
+		Enabled:        true,
+		BackupStats:    &backupStats,
+		QueueDepth:     len(ms.uploadQueue),
+		QueueCapacity:  cap(ms.uploadQueue),
+		InFlight:       ms.uploadsInFlight.Load(),
+		DroppedUploads: ms.uploadsDropped.Load(),
+		CircuitBreaker: &breakerStats,
+	}
+}
+
+// PingCloud checks whether the configured cloud storage is healthy
+// Returns whether cloud storage is enabled and any problem found
+func (ms *MediaStore) PingCloud() (bool, error) {
+	if ms.cloudStore == nil {
+		if ms.cloudInitErr != nil {
+			return true, fmt.Errorf("cloud storage failed to initialize: %v", ms.cloudInitErr)
+		}
+		return false, nil
+	}
+
+	return true, ms.cloudStore.Ping()
+}
+
 // DownloadMedia downloads media from a URL and saves it to disk
-func (ms *MediaStore) DownloadMedia(messageID, messageType string, contentURL string, headers map[string]string) (string, error) {
-	// Use current date for organizing files
-	dateStr := utils.GetDateString()
+// Progress is kept in a .part file so a failed download resumes where it stopped when retried,
+// if the server supports ranges; the file only gets its final name once it is complete
+// Cancelling the context aborts the download and removes the partial file, as does taking longer
+// than MAX_DOWNLOAD_DURATION, which returns ErrDownloadTimeout
+func (ms *MediaStore) DownloadMedia(ctx context.Context, messageID, messageType string, contentURL string, headers map[string]string) (string, error) {
+	limit := time.Duration(ms.config.MaxDownloadTime) * time.Second
+	if limit <= 0 {
+		return ms.downloadMedia(ctx, messageID, messageType, contentURL, headers)
+	}
 
-	ms.logger.Debug("Downloading %s media with ID %s", messageType, messageID)
+	// Unlike the connection timeouts this bounds the whole download, however steadily data trickles in
+	ctx, cancel := context.WithTimeoutCause(ctx, limit, errMaxDownloadDuration)
+	defer cancel()
 
-	// Get directory for storing files based on date
-	storageDir, err := ms.config.GetMediaDir(dateStr)
-	if err != nil {
-		return "", fmt.Errorf("failed to create storage directory: %v", err)
+	filePath, err := ms.downloadMedia(ctx, messageID, messageType, contentURL, headers)
+	if err != nil && errors.Is(context.Cause(ctx), errMaxDownloadDuration) {
+		ms.recordTimedOut()
+		ms.logger.ForContext(ctx).Warning("Aborted download of %s media %s after %s", messageType, messageID, limit)
+		return "", fmt.Errorf("%w: took longer than %s: %v", ErrDownloadTimeout, limit, err)
 	}
+	return filePath, err
+}
 
-	// Create request to download the content
-	req, err := http.NewRequest("GET", contentURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+// Naming schemes for FILENAME_STRATEGY
+const (
+	FilenameStrategyRandom = "random" // prefix_timestamp_random.ext, or based on the suggested name
+	FilenameStrategyHash   = "hash"   // prefix_hash.ext from the SHA-256 of the content
+)
+
+// newFilenameStrategy returns the FilenameStrategy selected by FILENAME_STRATEGY
+// With FLAT_STORAGE all files share one folder, so random names based on an original name get the time for ordering,
+// as the other random names have
+func newFilenameStrategy(cfg *config.Config) utils.FilenameStrategy {
+	if cfg.FilenameStrategy == FilenameStrategyHash {
+		return utils.HashFilenames{}
 	}
+	return utils.RandomFilenames{TimestampNamed: cfg.FlatStorage}
+}
 
-	// Add required headers (e.g., Authorization)
-	for key, value := range headers {
-		req.Header.Add(key, value)
+// fileName names a file with the configured FilenameStrategy
+// contentPath holds the complete content, which is hashed only if the strategy needs it;
+// the hash is returned too, empty if it wasn't computed
+func (ms *MediaStore) fileName(messageType, originalName, contentType, extension, contentPath string) (string, string, error) {
+	naming := utils.FileNaming{
+		MediaType:    messageType,
+		Prefix:       ms.config.FilenamePrefix(messageType),
+		OriginalName: originalName,
+		ContentType:  contentType,
+		Extension:    extension,
+		Timestamp:    utils.Now(),
 	}
 
-	// Execute the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if ms.filenames.UsesContentHash() {
+		hash, err := utils.FileSHA256(contentPath)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to hash content: %v", err)
+		}
+		naming.ContentHash = hash
+	}
+
+	filename, err := ms.filenames.Filename(naming)
+	return filename, naming.ContentHash, err
+}
+
+// storedHash returns the content hash if the file is stored as received, so it is also the hash of the stored file
+func storedHash(contentHash, filePath string, compress bool) string {
+	if compress || IsEncrypted(filePath) {
+		return ""
+	}
+	return contentHash
+}
+
+// downloadMedia is DownloadMedia without the overall time limit
+func (ms *MediaStore) downloadMedia(ctx context.Context, messageID, messageType string, contentURL string, headers map[string]string) (string, error) {
+	logger := ms.logger.ForContext(ctx)
+	defer ms.trackDownload()()
+
+	// Organize files by the date the message was sent
+	sent := sentAt(ctx)
+	dateStr := utils.FormatDate(sent)
+
+	logger.Debug("Downloading %s media with ID %s", messageType, messageID)
+
+	// Get directory for storing files based on date and media type
+	storageDir, err := ms.config.GetMediaDir(dateStr, messageType)
+	if err != nil {
+		return "", wrapWriteError("failed to create storage directory", err)
+	}
+
+	// The final name depends on the content type, so the partial download is named after the message
+	partName, err := utils.SanitizePathComponent(fmt.Sprintf("%s_%s%s", messageType, messageID, PartialExtension))
 	if err != nil {
-		return "", fmt.Errorf("failed to download media: %v", err)
+		return "", fmt.Errorf("invalid message ID: %v", err)
 	}
-	defer resp.Body.Close()
+	partPath := filepath.Join(storageDir, partName)
+
+	// Download with retries, timing the whole download for the throughput statistics
+	startTime := time.Now()
+	retries := ms.config.DownloadRetryCount
+	var info partInfo
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			logger.Warning("Retrying download of %s (attempt %d of %d): %v", messageID, attempt, retries, err)
+
+			select {
+			case <-time.After(time.Duration(attempt) * downloadRetryDelay):
+			case <-ctx.Done():
+				os.Remove(partPath)
+				return "", fmt.Errorf("download cancelled: %w", ctx.Err())
+			}
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download media, status code: %d", resp.StatusCode)
+		var retry bool
+		retry, err = ms.downloadPart(ctx, partPath, contentURL, headers, &info)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= retries {
+			os.Remove(partPath)
+			if errors.Is(err, ErrDiskFull) {
+				ms.alert(alertDiskFull, "Disk full", fmt.Sprintf("Failed to download %s: %v", messageID, err))
+			}
+			return "", err
+		}
 	}
 
-	// Determine file extension based on content type
-	contentType := resp.Header.Get("Content-Type")
-	ms.logger.Debug("Media %s has content type: %s", messageID, contentType)
-	extension := utils.GetContentType(contentType)
+	// Refuse content types that aren't allowed
+	contentType := info.contentType
+	logger.Debug("Media %s has content type: %s", messageID, contentType)
+	if !ms.config.MimeTypeAllowed(contentType) {
+		os.Remove(partPath)
+		ms.recordBlocked()
+		logger.Warning("Refusing %s media %s from %s: content type %q is not allowed",
+			messageType, messageID, eventSourceFromContext(ctx).ID, contentType)
+		return "", fmt.Errorf("%w: %s", ErrBlockedType, contentType)
+	}
 
-	// Generate a unique filename
-	filename, err := utils.GenerateUniqueFilename(messageType, extension)
+	// Determine file extension based on content type, or the suggested file name
+	extension := chooseExtension(messageType, contentType, info.fileName, "")
+
+	// Name the file, based on the one the server suggested if enabled
+	var originalName string
+	if ms.config.DispositionNames && info.fileName != "" {
+		logger.Debug("Media %s has suggested file name %q", messageID, info.fileName)
+		originalName = info.fileName
+	}
+	filename, contentHash, err := ms.fileName(messageType, originalName, contentType, extension, partPath)
 	if err != nil {
+		os.Remove(partPath)
 		return "", fmt.Errorf("failed to generate filename: %v", err)
 	}
 
+	// Compress text-like content when enabled
+	compress := ms.config.CompressStorage && isCompressible(contentType)
+	if compress {
+		filename += CompressedExtension
+	}
+	filename = ms.encryptedName(filename)
+
 	// Full path to save the file
 	filePath := filepath.Join(storageDir, filename)
 
-	// Create the file
-	file, err := os.Create(filePath)
+	// Give the complete download its final name, noting it in the persisted queue first so a restart
+	// before the download is marked done doesn't save it twice
+	if ms.downloadQueue != nil {
+		if err := ms.downloadQueue.saving(messageID, filePath); err != nil {
+			logger.Warning("Failed to record the path of media %s, it may be saved again after a restart: %v", messageID, err)
+		}
+	}
+	bytesWritten, err := ms.finishDownload(ctx, partPath, filePath, compress)
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %v", err)
+		return "", err
 	}
-	defer file.Close()
 
-	// Copy content to file
-	bytesWritten, err := io.Copy(file, resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to save file: %v", err)
+	// Keep total storage within MAX_TOTAL_STORAGE_MB
+	if err := ms.enforceQuota(ctx, filePath); err != nil {
+		return "", err
 	}
 
 	// Update statistics
-	ms.updateStats(messageType, bytesWritten)
+	ms.updateStats(messageType, bytesWritten, time.Since(startTime))
+	ms.recordSource(ctx, bytesWritten)
+
+	logger.Info("Saved %s media file of %d bytes to %s", messageType, bytesWritten, filePath)
 
-	ms.logger.Info("Saved %s media file of %d bytes to %s", messageType, bytesWritten, filePath)
+	// Record the checksum for later integrity checks
+	ms.recordChecksum(ctx, filePath, storedHash(contentHash, filePath, compress))
 
-	// Upload to cloud storage if enabled
-	ms.uploadToCloudAsync(filePath, dateStr)
+	// Upload to cloud storage if enabled, tagged with the message it came from
+	ctx = withUploadProperties(ctx, messageID)
+	cloudFolder := ms.cloudFolderPath(messageType, userIDFromContext(ctx), sent)
+	ms.uploadToCloudAsync(ctx, filePath, cloudFolder)
+
+	// Record who sent the file and when
+	ms.saveFileMetadata(ctx, filePath, messageID, messageType, contentType, bytesWritten, cloudFolder)
+
+	// Produce an mp3 copy of audio files if enabled
+	if messageType == "audio" {
+		ms.transcodeAudioAsync(ctx, filePath, cloudFolder)
+	}
 
 	return filePath, nil
 }
 
 // AddToDownloadQueue adds a media download task to the queue
-func (ms *MediaStore) AddToDownloadQueue(messageID, messageType string, contentURL string, headers map[string]string) {
-	ms.downloadWg.Add(1)
+// With PERSIST_DOWNLOADS the task is recorded on disk until it finishes, so it is resumed after a restart;
+// a message that is already queued isn't queued again
+func (ms *MediaStore) AddToDownloadQueue(ctx context.Context, messageID, messageType string, contentURL string, headers map[string]string) {
+	logger := ms.logger.ForContext(ctx)
 
-	ms.logger.Info("Queuing download for %s media with ID %s", messageType, messageID)
+	if ms.downloadQueue != nil {
+		added, err := ms.downloadQueue.add(newQueuedDownload(ctx, messageID, messageType, contentURL, headers, ms.config.ChannelToken))
+		if err != nil {
+			logger.Warning("Failed to persist the download of media %s, it won't be resumed after a restart: %v", messageID, err)
+		} else if !added {
+			logger.Info("Download of media %s is already queued", messageID)
+			return
+		}
+	}
+
+	logger.Info("Queuing download for %s media with ID %s", messageType, messageID)
+	ms.startDownload(ctx, messageID, messageType, contentURL, headers)
+}
+
+// startDownload runs a queued download in the background
+// Once it succeeds or fails for good it is marked done in the persisted queue; downloads abandoned
+// because the context was cancelled, such as at shutdown, stay queued to be resumed
+func (ms *MediaStore) startDownload(ctx context.Context, messageID, messageType string, contentURL string, headers map[string]string) {
+	logger := ms.logger.ForContext(ctx)
+
+	ms.downloadWg.Add(1)
+	ms.downloadsQueued.Add(1)
 
 	go func() {
 		defer ms.downloadWg.Done()
 
-		filePath, err := ms.DownloadMedia(messageID, messageType, contentURL, headers)
+		// Downloads that haven't started yet wait while processing is paused
+		err := ms.pause.wait(ctx)
+		ms.downloadsQueued.Add(-1)
 		if err != nil {
-			ms.logger.Error("Error downloading media %s: %v", messageID, err)
+			logger.Warning("Download of media %s abandoned while paused: %v", messageID, err)
+			ms.RecordError("download", fmt.Errorf("media %s: %v", messageID, err))
 			return
 		}
 
-		ms.logger.Info("Successfully downloaded and saved media %s to %s", messageID, filePath)
+		filePath, err := ms.DownloadMedia(ctx, messageID, messageType, contentURL, headers)
+		if ctx.Err() == nil {
+			ms.finishQueuedDownload(ctx, messageID)
+		}
+		if err != nil {
+			logger.Error("Error downloading media %s: %v", messageID, err)
+			ms.RecordError("download", fmt.Errorf("media %s: %v", messageID, err))
+			return
+		}
+
+		logger.Info("Successfully downloaded and saved media %s to %s", messageID, filePath)
 	}()
 }
 
+// finishQueuedDownload removes a finished download from the persisted queue
+func (ms *MediaStore) finishQueuedDownload(ctx context.Context, messageID string) {
+	if ms.downloadQueue == nil {
+		return
+	}
+	if err := ms.downloadQueue.done(messageID); err != nil {
+		ms.logger.ForContext(ctx).Warning("Failed to mark the download of media %s done, it may be repeated after a restart: %v", messageID, err)
+	}
+}
+
 // WaitForDownloads waits for all queued downloads to complete
 func (ms *MediaStore) WaitForDownloads() {
 	ms.logger.Info("Waiting for pending downloads to complete...")
@@ -312,6 +933,19 @@ func (ms *MediaStore) WaitForUploads() {
 	ms.logger.Info("All cloud uploads completed")
 }
 
+// StopSweeps stops backup syncs and any scheduled retry of failed uploads, for shutdown
+// Uploads already in progress finish; files not reached stay pending for the next sync
+// Without it, a sync waiting for the circuit breaker during an outage would hold up WaitForAll
+func (ms *MediaStore) StopSweeps() {
+	ms.stopSweeps()
+
+	ms.retryMu.Lock()
+	defer ms.retryMu.Unlock()
+	if ms.retryTimer != nil {
+		ms.retryTimer.Stop()
+	}
+}
+
 // WaitForAll waits for all pending downloads and uploads to complete
 func (ms *MediaStore) WaitForAll() {
 	ms.WaitForDownloads()
@@ -320,6 +954,8 @@ func (ms *MediaStore) WaitForAll() {
 
 // RegisterUploadCallback registers a callback function for when a file is uploaded to cloud storage
 // The callback will be called with the filename and the shareable link
+// A file that was already uploaded by the time its callback is registered, such as a streamed upload,
+// has its callback called right away
 func (ms *MediaStore) RegisterUploadCallback(filePath string, callback FileUploadCallback) {
 	if ms.cloudStore == nil {
 		ms.logger.Warning("Cloud storage is disabled, not registering callback for %s", filePath)
@@ -327,15 +963,25 @@ func (ms *MediaStore) RegisterUploadCallback(filePath string, callback FileUploa
 	}
 
 	ms.callbackMu.Lock()
-	defer ms.callbackMu.Unlock()
-
 	// Use the filename as the key since we don't have the fileID yet
 	ms.uploadCallbacks[filePath] = callback
+	ms.callbackMu.Unlock()
 	ms.logger.Debug("Registered upload callback for %s", filePath)
+
+	// Checked after registering, so an upload finishing in between still finds the callback
+	if fileID, ok := ms.uploadIndex.uploadedID(ms.indexKey(filePath)); ok {
+		ms.uploadWg.Add(1)
+		go func() {
+			defer ms.uploadWg.Done()
+			ms.callUploadCallback(context.Background(), fileID, filePath)
+		}()
+	}
 }
 
 // callUploadCallback calls the registered callback function for the given fileID
-func (ms *MediaStore) callUploadCallback(fileID string, filePath string) {
+func (ms *MediaStore) callUploadCallback(ctx context.Context, fileID string, filePath string) {
+	logger := ms.logger.ForContext(ctx)
+
 	// Skip if no callback is registered
 	ms.callbackMu.Lock()
 	callback, exists := ms.uploadCallbacks[filePath]
@@ -351,17 +997,17 @@ func (ms *MediaStore) callUploadCallback(fileID string, filePath string) {
 	// Generate a shareable link
 	fileLink, err := ms.cloudStore.GetFileLink(fileID)
 	if err != nil {
-		ms.logger.Error("Failed to generate shareable link for file %s: %v", filePath, err)
+		logger.Error("Failed to generate shareable link for file %s: %v", filePath, err)
 		return
 	}
 
-	ms.logger.Debug("Generated shareable link for %s: %s", filePath, fileLink)
+	logger.Debug("Generated shareable link for %s: %s", filePath, fileLink)
 
 	// Call the callback function with the file name and link
 	filename := filepath.Base(filePath)
-	if err := callback(filename, fileLink); err != nil {
-		ms.logger.Error("Error in upload callback for %s: %v", filePath, err)
+	if err := callback(ctx, filename, fileLink); err != nil {
+		logger.Error("Error in upload callback for %s: %v", filePath, err)
 	} else {
-		ms.logger.Info("Successfully executed upload callback for %s", filePath)
+		logger.Info("Successfully executed upload callback for %s", filePath)
 	}
 }
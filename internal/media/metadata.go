@@ -0,0 +1,147 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/cloud/common"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// MetadataExtension is appended to a saved file's name to form its metadata sidecar
+const MetadataExtension = ".json"
+
+// eventSourceKey is the context key for the source of the message being saved
+type eventSourceKey struct{}
+
+// EventSource describes the chat a message was sent in and when
+type EventSource struct {
+	Type      string    // "user", "group" or "room"
+	ID        string    // ID of the user, group or room
+	Timestamp time.Time // When the message was sent
+}
+
+// WithEventSource returns a context carrying the source of the message being saved
+// It is recorded in the metadata sidecar
+func WithEventSource(ctx context.Context, source EventSource) context.Context {
+	return context.WithValue(ctx, eventSourceKey{}, source)
+}
+
+// eventSourceFromContext returns the source set with WithEventSource, if any
+func eventSourceFromContext(ctx context.Context) EventSource {
+	source, _ := ctx.Value(eventSourceKey{}).(EventSource)
+	return source
+}
+
+// sentAt returns when the message being saved was sent, or now if that isn't known
+// Files are dated by it so redelivered or queued messages land in the day they were sent
+func sentAt(ctx context.Context) time.Time {
+	if timestamp := eventSourceFromContext(ctx).Timestamp; !timestamp.IsZero() {
+		return timestamp.Local()
+	}
+	return utils.Now()
+}
+
+// withUploadProperties returns a context that tags the files uploaded with it with the message they came from
+// and who sent it, so they can be found in cloud storage later
+func withUploadProperties(ctx context.Context, messageID string) context.Context {
+	properties := map[string]string{common.PropertyMessageID: messageID}
+	if userID := userIDFromContext(ctx); userID != "" {
+		properties[common.PropertyUserID] = userID
+	}
+	if source := eventSourceFromContext(ctx); source.ID != "" {
+		properties[common.PropertySourceType] = source.Type
+		properties[common.PropertySourceID] = source.ID
+	}
+	return common.WithFileProperties(ctx, properties)
+}
+
+// FileMetadata is the sidecar metadata saved alongside a media file
+// It preserves who sent the file and when, which the generated filename doesn't
+type FileMetadata struct {
+	MessageID   string    `json:"messageId"`
+	MessageType string    `json:"messageType"`
+	SourceType  string    `json:"sourceType,omitempty"`
+	SourceID    string    `json:"sourceId,omitempty"`
+	UserID      string    `json:"userId,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`             // When the message was sent
+	ContentType string    `json:"contentType,omitempty"` // Content type declared by LINE
+	Size        int64     `json:"size,omitempty"`        // Size of the content in bytes, before compression
+	DurationMs  int       `json:"durationMs,omitempty"`  // Length of a video or audio message
+	Preview     string    `json:"preview,omitempty"`     // Filename of the saved video preview image
+	SavedAt     time.Time `json:"savedAt"`
+}
+
+// MetadataPath returns the path of the metadata sidecar for a saved file
+func MetadataPath(filePath string) string {
+	return filePath + MetadataExtension
+}
+
+// ReadMetadata reads the metadata sidecar of a saved file
+func ReadMetadata(filePath string) (*FileMetadata, error) {
+	data, err := os.ReadFile(MetadataPath(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %v", err)
+	}
+
+	var metadata FileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %v", err)
+	}
+
+	return &metadata, nil
+}
+
+// newFileMetadata builds the metadata for a saved file from the message and its source in the context
+func newFileMetadata(ctx context.Context, messageID, messageType string) FileMetadata {
+	source := eventSourceFromContext(ctx)
+
+	return FileMetadata{
+		MessageID:   messageID,
+		MessageType: messageType,
+		SourceType:  source.Type,
+		SourceID:    source.ID,
+		UserID:      userIDFromContext(ctx),
+		Timestamp:   source.Timestamp,
+		SavedAt:     utils.Now(),
+	}
+}
+
+// saveFileMetadata writes the metadata sidecar for a newly saved file if WRITE_METADATA is enabled
+// A failure is logged rather than failing the save, since the media itself was stored
+func (ms *MediaStore) saveFileMetadata(ctx context.Context, filePath, messageID, messageType, contentType string, size int64, cloudFolder string) {
+	if !ms.config.WriteMetadata {
+		return
+	}
+
+	metadata := newFileMetadata(ctx, messageID, messageType)
+	metadata.ContentType = contentType
+	metadata.Size = size
+
+	if err := ms.writeMetadata(ctx, filePath, metadata, cloudFolder); err != nil {
+		ms.logger.ForContext(ctx).Warning("Failed to save metadata for %s: %v", filePath, err)
+		ms.RecordError("metadata", fmt.Errorf("%s: %v", filePath, err))
+	}
+}
+
+// writeMetadata writes the metadata sidecar for a saved file and backs it up with the file
+func (ms *MediaStore) writeMetadata(ctx context.Context, filePath string, metadata FileMetadata, cloudFolder string) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+
+	metadataPath := MetadataPath(filePath)
+	previousSize := fileSize(metadataPath)
+	if err := os.WriteFile(metadataPath, data, 0644); err != nil {
+		return wrapWriteError("failed to save metadata", err)
+	}
+	ms.countStoredFile(metadataPath, previousSize)
+
+	ms.uploadToCloudAsync(ctx, metadataPath, cloudFolder)
+
+	return nil
+}
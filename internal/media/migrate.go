@@ -0,0 +1,72 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
+
+// MigrationProgress reports how far a migration or backup sync has got
+type MigrationProgress struct {
+	Total    int // Files that needed uploading when the migration started
+	Uploaded int
+	Failed   int
+	Bytes    int64         // Size of the files uploaded
+	Elapsed  time.Duration // Time since the migration started
+}
+
+// FilesPerSecond returns the rate at which files have been uploaded or failed
+func (p MigrationProgress) FilesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Uploaded+p.Failed) / p.Elapsed.Seconds()
+}
+
+// MBPerSecond returns the upload throughput in megabytes per second
+func (p MigrationProgress) MBPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / (1024 * 1024) / p.Elapsed.Seconds()
+}
+
+// MigrateBackups uploads every stored file that is not yet in cloud storage and waits for the uploads
+// Unlike SyncBackups, each file keeps its folder relative to the storage directory rather than
+// following the cloud folder template, so files saved before cloud backup was enabled keep their layout
+// Files are uploaded by SYNC_WORKERS workers that wait out circuit breaker trips, and each one is recorded
+// in the upload index as it completes, so an interrupted migration resumes where it stopped when run again
+// Cancelling the context stops starting new uploads; uploads already started still finish
+func (ms *MediaStore) MigrateBackups(ctx context.Context, onProgress func(MigrationProgress)) (MigrationProgress, error) {
+	logger := ms.logger.ForContext(ctx)
+
+	if ms.cloudStore == nil {
+		return MigrationProgress{}, ErrCloudDisabled
+	}
+
+	missing, err := ms.findMissingBackups()
+	if err != nil {
+		return MigrationProgress{}, err
+	}
+
+	logger.Info("Migration found %d files missing from cloud storage, uploading with %d workers", len(missing), ms.syncWorkers())
+
+	progress := ms.sweepUploads(ctx, missing, ms.relativeCloudFolder, onProgress)
+	logger.Info("Migration uploaded %d files (%d failed) in %s: %.1f files/s, %.2f MB/s",
+		progress.Uploaded, progress.Failed, progress.Elapsed.Round(time.Second), progress.FilesPerSecond(), progress.MBPerSecond())
+
+	if ctx.Err() != nil {
+		return progress, fmt.Errorf("migration interrupted: %w", ctx.Err())
+	}
+	return progress, nil
+}
+
+// relativeCloudFolder returns a stored file's folder relative to the storage directory, as a cloud folder path
+func (ms *MediaStore) relativeCloudFolder(filePath string) string {
+	folder := path.Dir(ms.indexKey(filePath))
+	if folder == "." {
+		return ""
+	}
+	return folder
+}
@@ -0,0 +1,101 @@
+package media
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pauseGate holds back downloads and uploads while processing is paused for maintenance
+type pauseGate struct {
+	mu      sync.Mutex
+	since   time.Time     // When processing was paused, zero while running
+	resumed chan struct{} // Closed when processing resumes
+}
+
+// pause stops processing, returning false if it was already paused
+func (g *pauseGate) pause(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.since.IsZero() {
+		return false
+	}
+
+	g.since = now
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume restarts processing and releases everything waiting, returning false if it wasn't paused
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.since.IsZero() {
+		return false
+	}
+
+	g.since = time.Time{}
+	close(g.resumed)
+	return true
+}
+
+// pausedSince returns when processing was paused, or the zero time if it is running
+func (g *pauseGate) pausedSince() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.since
+}
+
+// wait blocks while processing is paused
+// Returns the context's error if it ends first
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	paused := !g.since.IsZero()
+	g.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops downloading and uploading until Resume is called
+// Queued downloads and uploads wait rather than fail; returns false if already paused
+func (ms *MediaStore) Pause() bool {
+	if !ms.pause.pause(time.Now()) {
+		return false
+	}
+
+	ms.logger.Warning("Processing paused: downloads and uploads will wait until resumed")
+	return true
+}
+
+// Resume restarts downloading and uploading, returning false if processing wasn't paused
+func (ms *MediaStore) Resume() bool {
+	if !ms.pause.resume() {
+		return false
+	}
+
+	ms.logger.Info("Processing resumed")
+	return true
+}
+
+// Paused reports whether processing is paused
+func (ms *MediaStore) Paused() bool {
+	return !ms.pause.pausedSince().IsZero()
+}
+
+// PausedSince returns when processing was paused, or the zero time if it is running
+func (ms *MediaStore) PausedSince() time.Time {
+	return ms.pause.pausedSince()
+}
@@ -0,0 +1,72 @@
+package media
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// SaveVideoPreview saves the preview image of a saved video as <video>_preview.jpg next to it
+// Previews aren't counted in the statistics, but are backed up with the video
+func (ms *MediaStore) SaveVideoPreview(ctx context.Context, videoPath string, content *linebot.MessageContentResponse) (string, error) {
+	previewPath := ms.encryptedName(sidecarPath(videoPath, "_preview.jpg"))
+
+	bytesWritten, err := ms.writeFile(ctx, previewPath, content.Content, false)
+	if err != nil {
+		return "", err
+	}
+	ms.countStoredFile(previewPath, 0)
+
+	ms.logger.ForContext(ctx).Debug("Saved video preview of %d bytes to %s", bytesWritten, previewPath)
+
+	ms.uploadToCloudAsync(ctx, previewPath, ms.cloudFolderPath("video", userIDFromContext(ctx), sentAt(ctx)))
+
+	return previewPath, nil
+}
+
+// originalSuffix ends the base name of images saved with SAVE_IMAGE_PREVIEW, whose preview ends in _preview
+const originalSuffix = "_original"
+
+// SaveImagePreview saves LINE's preview of a saved image as <image>_preview.jpg next to it,
+// replacing the image's _original suffix so both share a base name
+// Previews are counted separately from images in the statistics and are backed up with the image
+func (ms *MediaStore) SaveImagePreview(ctx context.Context, imagePath string, content *linebot.MessageContentResponse) (string, error) {
+	previewPath := ms.encryptedName(strings.TrimSuffix(sidecarPath(imagePath, ""), originalSuffix) + "_preview.jpg")
+
+	bytesWritten, err := ms.writeFile(ctx, previewPath, content.Content, false)
+	if err != nil {
+		return "", err
+	}
+	ms.countStoredFile(previewPath, 0)
+
+	ms.recordImagePreview(bytesWritten)
+	ms.logger.ForContext(ctx).Debug("Saved image preview of %d bytes to %s", bytesWritten, previewPath)
+
+	ms.uploadToCloudAsync(ctx, previewPath, ms.cloudFolderPath("image", userIDFromContext(ctx), sentAt(ctx)))
+
+	return previewPath, nil
+}
+
+// SaveVideoMetadata records a video's duration and preview image in its metadata sidecar
+// The sidecar written for WRITE_METADATA is updated if there is one
+func (ms *MediaStore) SaveVideoMetadata(ctx context.Context, videoPath, messageID string, durationMs int, previewPath string) error {
+	metadata := newFileMetadata(ctx, messageID, "video")
+	if existing, err := ReadMetadata(videoPath); err == nil {
+		metadata = *existing
+	}
+
+	metadata.DurationMs = durationMs
+	if previewPath != "" {
+		metadata.Preview = filepath.Base(previewPath)
+	}
+
+	return ms.writeMetadata(ctx, videoPath, metadata, ms.cloudFolderPath("video", userIDFromContext(ctx), sentAt(ctx)))
+}
+
+// sidecarPath returns the path of a file stored alongside a media file, replacing its extension with suffix
+func sidecarPath(filePath, suffix string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(filePath, EncryptedExtension), CompressedExtension)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + suffix
+}
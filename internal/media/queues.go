@@ -0,0 +1,28 @@
+package media
+
+// QueueStats describes the work waiting for and being done by the download and upload workers
+// Every value is read from an atomic counter or the channel length, so reading them takes no locks
+type QueueStats struct {
+	DownloadQueueDepth  int64 `json:"downloadQueueDepth"` // Queued downloads that haven't started, e.g. while paused
+	DownloadsInFlight   int64 `json:"downloadsActive"`    // Media being downloaded and saved
+	UploadQueueDepth    int   `json:"uploadQueueDepth"`
+	UploadQueueCapacity int   `json:"uploadQueueCapacity"` // 0 when cloud storage is disabled
+	UploadsInFlight     int64 `json:"uploadsInFlight"`
+}
+
+// QueueStats returns the current download and upload queue pressure
+func (ms *MediaStore) QueueStats() QueueStats {
+	return QueueStats{
+		DownloadQueueDepth:  ms.downloadsQueued.Load(),
+		DownloadsInFlight:   ms.downloadsActive.Load(),
+		UploadQueueDepth:    len(ms.uploadQueue),
+		UploadQueueCapacity: cap(ms.uploadQueue),
+		UploadsInFlight:     ms.uploadsInFlight.Load(),
+	}
+}
+
+// trackDownload counts a download or save as in flight until the returned function is called
+func (ms *MediaStore) trackDownload() func() {
+	ms.downloadsActive.Add(1)
+	return func() { ms.downloadsActive.Add(-1) }
+}
@@ -0,0 +1,356 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies applied when a new file would take storage beyond MAX_TOTAL_STORAGE_MB
+const (
+	QuotaPolicyEvict  = "evict"  // Remove the oldest stored files until there is room
+	QuotaPolicyReject = "reject" // Refuse the new file
+)
+
+// storageQuota tracks how much of the storage directory is used, for MAX_TOTAL_STORAGE_MB
+// The directory is scanned once at startup; saves and evictions keep the total up to date from then on
+// Hidden files, such as the upload index and checksums files, aren't counted
+type storageQuota struct {
+	mu   sync.Mutex
+	used int64
+}
+
+// storedFile is a file considered for eviction
+type storedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// initQuota measures the storage directory if MAX_TOTAL_STORAGE_MB is set
+func (ms *MediaStore) initQuota() {
+	if ms.config.MaxTotalStorageMB <= 0 {
+		return
+	}
+
+	used, err := directorySize(ms.config.StorageDir)
+	if err != nil {
+		ms.logger.Warning("Failed to measure storage usage, counting from %d MB: %v", used>>20, err)
+	}
+	ms.quota.used = used
+
+	ms.logger.Info("Storage usage is %d MB of the %d MB quota (policy: %s)",
+		used>>20, ms.config.MaxTotalStorageMB, ms.quotaPolicy())
+}
+
+// quotaPolicy returns STORAGE_QUOTA_POLICY, evicting unless reject is configured
+func (ms *MediaStore) quotaPolicy() string {
+	if ms.config.StorageQuotaPolicy == QuotaPolicyReject {
+		return QuotaPolicyReject
+	}
+	return QuotaPolicyEvict
+}
+
+// enforceQuota counts a newly saved file against MAX_TOTAL_STORAGE_MB
+// If it doesn't fit, the oldest stored files are evicted to make room, unless the policy is reject;
+// when there is still no room the new file is removed and ErrQuotaExceeded returned
+func (ms *MediaStore) enforceQuota(ctx context.Context, filePath string) error {
+	limit := int64(ms.config.MaxTotalStorageMB) << 20
+	if limit <= 0 {
+		return nil
+	}
+
+	// Files saved to FALLBACK_STORAGE_DIR don't count
+	if !ms.inStorageDir(filePath) {
+		return nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return wrapWriteError("failed to check saved file", err)
+	}
+	size := info.Size()
+
+	ms.quota.mu.Lock()
+	defer ms.quota.mu.Unlock()
+
+	if excess := ms.quota.used + size - limit; excess > 0 && ms.quotaPolicy() == QuotaPolicyEvict {
+		ms.quota.used -= ms.evictOldest(ctx, excess, filePath)
+	}
+
+	if ms.quota.used+size > limit {
+		os.Remove(filePath)
+		return fmt.Errorf("%w: %d MB used of %d MB, %s needs %d bytes",
+			ErrQuotaExceeded, ms.quota.used>>20, limit>>20, filepath.Base(filePath), size)
+	}
+
+	ms.quota.used += size
+	return nil
+}
+
+// countStoredFile counts a file written alongside saved media, such as a preview or metadata sidecar,
+// against MAX_TOTAL_STORAGE_MB without enforcing it; previousSize is the size of the file it replaced, if any
+func (ms *MediaStore) countStoredFile(filePath string, previousSize int64) {
+	if ms.config.MaxTotalStorageMB <= 0 || !ms.inStorageDir(filePath) {
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+
+	ms.quota.mu.Lock()
+	defer ms.quota.mu.Unlock()
+
+	ms.quota.used += info.Size() - previousSize
+}
+
+// fileSize returns the size of a file, or 0 if it doesn't exist
+func fileSize(filePath string) int64 {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// inStorageDir reports whether a file is below the storage directory, as opposed to FALLBACK_STORAGE_DIR
+func (ms *MediaStore) inStorageDir(filePath string) bool {
+	rel, err := filepath.Rel(ms.config.StorageDir, filePath)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// evictOldest removes stored files, oldest date folder first, until at least need bytes are freed
+// With FLAT_STORAGE the files directly in the storage directory are removed, oldest first
+// keep is never removed; returns the number of bytes freed
+// Must be called with quota.mu held
+func (ms *MediaStore) evictOldest(ctx context.Context, need int64, keep string) int64 {
+	logger := ms.logger.ForContext(ctx)
+
+	if ms.config.FlatStorage {
+		files, err := listFlatFiles(ms.config.StorageDir)
+		if err != nil {
+			logger.Error("Failed to list storage directory for eviction: %v", err)
+		}
+		freed := ms.evictFiles(ctx, files, need, keep)
+		if freed < need {
+			logger.Warning("Eviction freed %d of the %d bytes needed", freed, need)
+		}
+		return freed
+	}
+
+	entries, err := os.ReadDir(ms.config.StorageDir)
+	if err != nil {
+		logger.Error("Failed to list storage directory for eviction: %v", err)
+		return 0
+	}
+
+	// Only date folders hold media; ReadDir sorts them oldest first
+	var freed int64
+	for _, entry := range entries {
+		if freed >= need {
+			break
+		}
+		if _, err := time.Parse("2006-01-02", entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+
+		dateDir := filepath.Join(ms.config.StorageDir, entry.Name())
+		files, err := listStoredFiles(dateDir)
+		if err != nil {
+			logger.Warning("Failed to list %s for eviction: %v", dateDir, err)
+		}
+
+		freed += ms.evictFiles(ctx, files, need-freed, keep)
+		removeEmptyDirs(dateDir)
+	}
+
+	if freed < need {
+		logger.Warning("Eviction freed %d of the %d bytes needed", freed, need)
+	}
+	return freed
+}
+
+// evictFiles removes files in order until at least need bytes are freed, never removing keep
+// A file's metadata sidecar is removed with it, and it is forgotten by the upload index and checksums file
+// Returns the number of bytes freed
+func (ms *MediaStore) evictFiles(ctx context.Context, files []storedFile, need int64, keep string) int64 {
+	logger := ms.logger.ForContext(ctx)
+
+	var freed int64
+	for _, file := range files {
+		if freed >= need {
+			break
+		}
+		if file.path == keep || !ms.evictable(file.path) {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			logger.Warning("Failed to evict %s: %v", file.path, err)
+			continue
+		}
+		freed += file.size
+
+		forget := []string{file.path}
+		metadataPath := MetadataPath(file.path)
+		if size := fileSize(metadataPath); os.Remove(metadataPath) == nil {
+			freed += size
+			forget = append(forget, metadataPath)
+		}
+		ms.forgetStoredFiles(ctx, forget...)
+
+		ms.recordEvicted()
+		logger.Info("Evicted %s (%d bytes) to stay within MAX_TOTAL_STORAGE_MB", file.path, file.size)
+	}
+	return freed
+}
+
+// evictable reports whether a stored file may be evicted without losing its only copy
+// With cloud storage configured, only files uploaded along with their metadata sidecar are; a backend that
+// failed to initialize counts as configured, since nothing has been backed up then
+func (ms *MediaStore) evictable(filePath string) bool {
+	if ms.cloudStore == nil && ms.cloudInitErr == nil {
+		return true
+	}
+	if !ms.IsUploaded(filePath) {
+		return false
+	}
+
+	metadataPath := MetadataPath(filePath)
+	if _, err := os.Stat(metadataPath); err == nil && !ms.IsUploaded(metadataPath) {
+		return false
+	}
+	return true
+}
+
+// forgetStoredFiles removes evicted files from the upload index and the checksums files
+func (ms *MediaStore) forgetStoredFiles(ctx context.Context, filePaths ...string) {
+	logger := ms.logger.ForContext(ctx)
+
+	if ms.uploadIndex != nil {
+		keys := make([]string, len(filePaths))
+		for i, filePath := range filePaths {
+			keys[i] = ms.indexKey(filePath)
+		}
+		if err := ms.uploadIndex.forget(keys...); err != nil {
+			logger.Error("Failed to update upload index: %v", err)
+		}
+	}
+
+	for _, filePath := range filePaths {
+		if err := ms.forgetChecksum(filePath); err != nil {
+			logger.Warning("Failed to remove the checksum of %s: %v", filePath, err)
+		}
+	}
+}
+
+// listStoredFiles returns the media files below dir, oldest first
+// Hidden files, metadata sidecars, which are evicted with their media, and files still being written are left out
+func listStoredFiles(dir string) ([]storedFile, error) {
+	var files []storedFile
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || IsInProgress(d.Name()) || isMetadataSidecar(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, storedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, err
+}
+
+// listFlatFiles returns the media files directly in dir, oldest first
+// Hidden files, such as the upload index, metadata sidecars and files still being written are left out
+func listFlatFiles(dir string) ([]storedFile, error) {
+	entries, err := os.ReadDir(dir)
+
+	var files []storedFile
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") || IsInProgress(entry.Name()) || isMetadataSidecar(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, storedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, err
+}
+
+// removeEmptyDirs removes dir and its subfolders if nothing is left in them
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir) // Fails, as intended, if anything is left
+}
+
+// isMetadataSidecar reports whether a file is the metadata sidecar of a stored file
+func isMetadataSidecar(path string) bool {
+	if !strings.HasSuffix(path, MetadataExtension) {
+		return false
+	}
+	_, err := os.Stat(strings.TrimSuffix(path, MetadataExtension))
+	return err == nil
+}
+
+// directorySize returns the total size of the regular files below dir that count against the quota,
+// leaving out hidden files and folders
+func directorySize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,123 @@
+package media
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// defaultSourceStatsLimit is used when SOURCE_STATS_LIMIT is not configured
+const defaultSourceStatsLimit = 100
+
+// SourceStats counts the media saved from one user, group or room
+type SourceStats struct {
+	SourceID   string    `json:"sourceId"`
+	SourceType string    `json:"sourceType"` // "user", "group" or "room"
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	LastSaved  time.Time `json:"lastSaved"`
+}
+
+// sourceTracker aggregates saved media per source, keeping at most limit sources
+// When full, the source with the least volume makes way for a new one, so the busiest sources are kept
+type sourceTracker struct {
+	mu      sync.Mutex
+	limit   int
+	sources map[string]*SourceStats
+}
+
+// newSourceTracker creates a tracker keeping up to limit sources
+func newSourceTracker(limit int) *sourceTracker {
+	if limit <= 0 {
+		limit = defaultSourceStatsLimit
+	}
+	return &sourceTracker{
+		limit:   limit,
+		sources: make(map[string]*SourceStats),
+	}
+}
+
+// record adds a saved file to its source's totals
+func (t *sourceTracker) record(source EventSource, bytes int64, now time.Time) {
+	if source.ID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.sources[source.ID]
+	if !ok {
+		if len(t.sources) >= t.limit {
+			t.evictSmallest()
+		}
+		stats = &SourceStats{SourceID: source.ID, SourceType: source.Type}
+		t.sources[source.ID] = stats
+	}
+
+	stats.Files++
+	stats.Bytes += bytes
+	stats.LastSaved = now
+}
+
+// evictSmallest removes the source with the fewest bytes
+// Must be called with mu held
+func (t *sourceTracker) evictSmallest() {
+	var smallest *SourceStats
+	for _, stats := range t.sources {
+		if smallest == nil || stats.Bytes < smallest.Bytes {
+			smallest = stats
+		}
+	}
+	if smallest != nil {
+		delete(t.sources, smallest.SourceID)
+	}
+}
+
+// snapshot returns a copy of the tracked sources, by bytes and then files, largest first
+func (t *sourceTracker) snapshot() []SourceStats {
+	t.mu.Lock()
+	sources := make([]SourceStats, 0, len(t.sources))
+	for _, stats := range t.sources {
+		sources = append(sources, *stats)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Bytes != sources[j].Bytes {
+			return sources[i].Bytes > sources[j].Bytes
+		}
+		if sources[i].Files != sources[j].Files {
+			return sources[i].Files > sources[j].Files
+		}
+		return sources[i].SourceID < sources[j].SourceID
+	})
+	return sources
+}
+
+// reset forgets all sources
+func (t *sourceTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sources = make(map[string]*SourceStats)
+}
+
+// recordSource counts a saved file against the user, group or room it came from
+func (ms *MediaStore) recordSource(ctx context.Context, bytes int64) {
+	ms.sources.record(eventSourceFromContext(ctx), bytes, utils.Now())
+}
+
+// SourceStats returns the media saved per source, largest volume first
+// Only the SOURCE_STATS_LIMIT busiest sources are kept
+func (ms *MediaStore) SourceStats() []SourceStats {
+	return ms.sources.snapshot()
+}
+
+// SourceStatsLimit returns how many sources are tracked at most
+func (ms *MediaStore) SourceStatsLimit() int {
+	return ms.sources.limit
+}
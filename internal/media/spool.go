@@ -0,0 +1,27 @@
+package media
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// spoolContent copies received content to a temporary file in SPOOL_DIR, enforcing the maximum file size
+// Once spooled, the content can be written to storage, and written again elsewhere after a failure,
+// without fetching it from LINE again; the caller removes the returned file
+func (ms *MediaStore) spoolContent(ctx context.Context, src io.Reader) (string, error) {
+	if dir := ms.config.SpoolDir; dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", wrapWriteError("failed to create spool directory", err)
+		}
+	}
+
+	file, err := os.CreateTemp(ms.config.SpoolDir, "spool-*")
+	if err != nil {
+		return "", wrapWriteError("failed to create spool file", err)
+	}
+	if _, err := ms.writeToFile(ctx, file, src, false, false); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
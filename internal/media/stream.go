@@ -0,0 +1,108 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// streamUpload is an upload to cloud storage fed with content while it is being received, for STREAM_UPLOADS
+// It is written to from a single goroutine, the one saving the content
+type streamUpload struct {
+	pw      *io.PipeWriter
+	stopped bool // The upload stopped reading, so the rest of the content is only saved locally
+	result  chan streamResult
+}
+
+// streamResult is the outcome of a streamed upload
+type streamResult struct {
+	fileID string
+	err    error
+}
+
+// canStreamUpload reports whether content being saved can be uploaded as it is received
+// The uploaded file must be identical to the stored one and named before the content is known,
+// and uploads that would wait or fail fast are left to the upload queue
+func (ms *MediaStore) canStreamUpload(compress bool) bool {
+	return ms.config.StreamUploads &&
+		ms.cloudStore != nil &&
+		!compress &&
+		!ms.config.EncryptAtRest &&
+		!ms.filenames.UsesContentHash() &&
+		!ms.Paused() &&
+		ms.breaker.stats().State == BreakerClosed
+}
+
+// startStreamUpload starts uploading a file named name to folderPath under the cloud folder,
+// reading its content from what is written to the returned streamUpload
+// size is the length of the content, or -1 if unknown
+func (ms *MediaStore) startStreamUpload(ctx context.Context, name, folderPath string, size int64) *streamUpload {
+	pr, pw := io.Pipe()
+	s := &streamUpload{
+		pw:     pw,
+		result: make(chan streamResult, 1),
+	}
+
+	remoteFolder := filepath.Join(ms.cloudFolder, folderPath)
+	go func() {
+		fileID, err := ms.cloudStore.UploadStream(ctx, pr, name, remoteFolder, size)
+
+		// Unblock the save if the upload ended without reading everything
+		pr.CloseWithError(fmt.Errorf("upload ended"))
+		s.result <- streamResult{fileID: fileID, err: err}
+	}()
+	return s
+}
+
+// Write passes content on to the upload
+// It never fails, so a failed upload doesn't fail the local save
+func (s *streamUpload) Write(p []byte) (int, error) {
+	if !s.stopped {
+		if _, err := s.pw.Write(p); err != nil {
+			s.stopped = true
+		}
+	}
+	return len(p), nil
+}
+
+// finish ends the content once the file has been stored, letting the upload complete, and waits for its outcome
+func (s *streamUpload) finish() streamResult {
+	s.pw.Close()
+	return <-s.result
+}
+
+// abort fails the upload before the end of the content is reached, so the backend discards it, and waits for it to stop
+// It is used when the content couldn't be received or stored; a nil streamUpload is ignored
+func (s *streamUpload) abort(cause error) {
+	if s == nil {
+		return
+	}
+
+	s.pw.CloseWithError(fmt.Errorf("save failed: %v", cause))
+	<-s.result
+}
+
+// recordStreamUpload records the outcome of a streamed upload once the file has been stored
+// A failed stream is queued as a normal upload of the stored file, which reports the outcome to the
+// circuit breaker and alerts, so a single failure isn't counted twice
+func (ms *MediaStore) recordStreamUpload(ctx context.Context, filePath, folderPath string, result streamResult) {
+	logger := ms.logger.ForContext(ctx)
+
+	if result.err != nil {
+		logger.Warning("Streaming upload of %s failed, queueing it instead: %v", filePath, result.err)
+		ms.uploadToCloudAsync(ctx, filePath, folderPath)
+		return
+	}
+
+	ms.recordBreakerOutcome(nil)
+	ms.recordUploadOutcome(filePath, nil)
+
+	if err := ms.uploadIndex.markDone(ms.indexKey(filePath), result.fileID, nil); err != nil {
+		logger.Error("Failed to update upload index: %v", err)
+	}
+
+	logger.Info("Successfully uploaded %s to cloud storage (ID: %s)", filePath, result.fileID)
+
+	ms.callUploadCallback(ctx, result.fileID, filePath)
+}
@@ -0,0 +1,39 @@
+package media
+
+import "time"
+
+// minRateWindow is the shortest collection period rates are computed for,
+// as counts divided by a near-zero uptime would be meaningless
+const minRateWindow = time.Second
+
+// StatsSummary holds values derived from the file statistics when they are read
+type StatsSummary struct {
+	TotalFiles       int     `json:"totalFiles"`
+	UptimeSeconds    float64 `json:"uptimeSeconds"` // Since the statistics started or were last reset
+	FilesPerMinute   float64 `json:"filesPerMinute"`
+	BytesPerMinute   float64 `json:"bytesPerMinute"`
+	AvgFileSizeBytes float64 `json:"avgFileSizeBytes"`
+}
+
+// Summary derives the throughput and average file size from a statistics snapshot
+// Rates are zero until the statistics have been collected for at least a second
+func (s Stats) Summary(now time.Time) StatsSummary {
+	summary := StatsSummary{
+		TotalFiles: s.ImageCount + s.VideoCount + s.AudioCount + s.FileCount,
+	}
+
+	if summary.TotalFiles > 0 {
+		summary.AvgFileSizeBytes = float64(s.TotalBytes) / float64(summary.TotalFiles)
+	}
+
+	elapsed := now.Sub(s.StartTime)
+	if s.StartTime.IsZero() || elapsed < minRateWindow {
+		return summary
+	}
+
+	summary.UptimeSeconds = elapsed.Seconds()
+	summary.FilesPerMinute = float64(summary.TotalFiles) / elapsed.Minutes()
+	summary.BytesPerMinute = float64(s.TotalBytes) / elapsed.Minutes()
+
+	return summary
+}
@@ -0,0 +1,118 @@
+package media
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultSyncWorkers is used when SYNC_WORKERS is not configured
+const defaultSyncWorkers = 2
+
+// syncWorkers returns the number of uploads a sweep runs at once
+func (ms *MediaStore) syncWorkers() int {
+	if ms.config.SyncWorkers <= 0 {
+		return defaultSyncWorkers
+	}
+	return ms.config.SyncWorkers
+}
+
+// sweepUploads uploads files to the folders returned by folder with a pool of SYNC_WORKERS workers
+// Unlike live uploads, which fail fast while the circuit breaker is open, the workers wait for the backend
+// to recover, and for processing to resume if paused, so a sweep doesn't mark every file failed during an outage
+// Sweep uploads don't go through the upload queue, so they never crowd out newly received files
+// Cancelling the context stops starting new uploads; onProgress, if set, is called after each file
+func (ms *MediaStore) sweepUploads(ctx context.Context, files []string, folder func(filePath string) string, onProgress func(MigrationProgress)) MigrationProgress {
+	start := time.Now()
+	jobCtx := context.WithoutCancel(ctx)
+
+	var mu sync.Mutex
+	progress := MigrationProgress{Total: len(files)}
+	if onProgress != nil {
+		onProgress(progress)
+	}
+
+	record := func(size int64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			progress.Failed++
+		} else {
+			progress.Uploaded++
+			progress.Bytes += size
+		}
+		progress.Elapsed = time.Since(start)
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(ms.syncWorkers(), len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range paths {
+				if ms.waitForUploadSlot(ctx) != nil {
+					continue
+				}
+
+				job, ok := ms.newUploadJob(jobCtx, filePath, folder(filePath))
+				if !ok {
+					// Already queued by a live upload or another sweep
+					continue
+				}
+
+				var size int64
+				if info, err := os.Stat(filePath); err == nil {
+					size = info.Size()
+				}
+
+				ms.uploadsInFlight.Add(1)
+				err := ms.uploadFile(job)
+				ms.uploadsInFlight.Add(-1)
+				ms.uploadWg.Done()
+				record(size, err)
+			}
+		}()
+	}
+
+	for _, filePath := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		paths <- filePath
+	}
+	close(paths)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	progress.Elapsed = time.Since(start)
+	return progress
+}
+
+// waitForUploadSlot waits while processing is paused or the circuit breaker is failing uploads fast
+func (ms *MediaStore) waitForUploadSlot(ctx context.Context) error {
+	for {
+		if err := ms.pause.wait(ctx); err != nil {
+			return err
+		}
+
+		retryAt, blocked := ms.breaker.blocked(time.Now())
+		if !blocked {
+			return nil
+		}
+
+		timer := time.NewTimer(time.Until(retryAt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
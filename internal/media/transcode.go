@@ -0,0 +1,68 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// transcodeAudioAsync converts an audio file to mp3 alongside the original
+func (ms *MediaStore) transcodeAudioAsync(ctx context.Context, filePath, folderPath string) {
+	logger := ms.logger.ForContext(ctx)
+
+	// Skip if transcoding is disabled or the file is already an mp3
+	if !ms.config.TranscodeAudio || strings.EqualFold(filepath.Ext(filePath), ".mp3") {
+		return
+	}
+
+	// ffmpeg can't read encrypted files, and an unencrypted mp3 copy would defeat ENCRYPT_AT_REST
+	if IsEncrypted(filePath) {
+		logger.Debug("Not transcoding encrypted audio %s", filePath)
+		return
+	}
+
+	// Transcoding outlives the request, so keep its values but not its cancellation
+	ctx = context.WithoutCancel(ctx)
+
+	// Transcoding runs alongside downloads so shutdown waits for it
+	ms.downloadWg.Add(1)
+	go func() {
+		defer ms.downloadWg.Done()
+
+		mp3Path, err := transcodeToMP3(ctx, filePath)
+		if err != nil {
+			logger.Warning("Skipping audio transcoding for %s: %v", filePath, err)
+			ms.RecordError("transcode", fmt.Errorf("%s: %v", filePath, err))
+			return
+		}
+
+		logger.Info("Transcoded %s to %s", filePath, mp3Path)
+		ms.countStoredFile(mp3Path, 0)
+
+		// Back up the mp3 copy as well
+		ms.uploadToCloudAsync(ctx, mp3Path, folderPath)
+	}()
+}
+
+// transcodeToMP3 shells out to ffmpeg to convert an audio file to mp3
+// Returns the path of the mp3 file
+func transcodeToMP3(ctx context.Context, filePath string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg not found: %v", err)
+	}
+
+	mp3Path := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".mp3"
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-y", "-loglevel", "error", "-i", filePath, "-vn", "-codec:a", "libmp3lame", "-q:a", "2", mp3Path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// Remove any partial output
+		os.Remove(mp3Path)
+		return "", fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return mp3Path, nil
+}
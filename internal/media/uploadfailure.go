@@ -0,0 +1,60 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policies for an upload that failed after its retries, chosen by UPLOAD_FAILURE_POLICY
+// The file is recorded as pending in the upload index under every policy, so a backup sync uploads it later
+const (
+	UploadFailureKeepLocal  = "keep_local"  // Keep the file locally until a backup sync is run
+	UploadFailureQueueRetry = "queue_retry" // Run a backup sync after UPLOAD_RETRY_DELAY_SECONDS
+	UploadFailureAlert      = "alert"       // Send an operator alert naming the file
+)
+
+// defaultUploadRetryDelay is used when UPLOAD_RETRY_DELAY_SECONDS is not configured
+const defaultUploadRetryDelay = 5 * time.Minute
+
+// handleUploadFailure applies UPLOAD_FAILURE_POLICY to a file whose upload failed after its retries
+func (ms *MediaStore) handleUploadFailure(filePath string, err error) {
+	switch ms.config.UploadFailurePolicy {
+	case UploadFailureQueueRetry:
+		ms.scheduleUploadRetry()
+	case UploadFailureAlert:
+		ms.alerts.mu.Lock()
+		notifier := ms.alerts.notifier
+		ms.alerts.mu.Unlock()
+
+		if notifier != nil {
+			ms.sendAlert(notifier, "Cloud upload failed",
+				fmt.Sprintf("%s was not backed up and is only stored locally: %v", filePath, err))
+		}
+	}
+}
+
+// scheduleUploadRetry runs a backup sync after UPLOAD_RETRY_DELAY_SECONDS, unless one is already scheduled
+// Failures during that sync schedule the next one, so failed files keep being retried until they are uploaded
+// Nothing is scheduled once StopSweeps has been called
+func (ms *MediaStore) scheduleUploadRetry() {
+	if ms.sweepCtx.Err() != nil || !ms.retryScheduled.CompareAndSwap(false, true) {
+		return
+	}
+
+	delay := time.Duration(ms.config.UploadRetryDelaySeconds) * time.Second
+	if delay <= 0 {
+		delay = defaultUploadRetryDelay
+	}
+	ms.logger.Info("Retrying failed cloud uploads in %s", delay)
+
+	ms.retryMu.Lock()
+	defer ms.retryMu.Unlock()
+	ms.retryTimer = time.AfterFunc(delay, func() {
+		ms.retryScheduled.Store(false)
+		if _, err := ms.SyncBackups(context.Background()); err != nil && !errors.Is(err, ErrSweepsStopped) {
+			ms.logger.Error("Failed to retry failed cloud uploads: %v", err)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// uploadIndexFile is the name of the upload index in the storage directory
+const uploadIndexFile = ".upload_index.json"
+
+// Upload statuses recorded in the upload index
+const (
+	UploadStatusUploaded = "uploaded"
+	UploadStatusPending  = "pending" // The last upload failed; a backup sync uploads the file
+
+	// uploadStatusFailed is how older indexes recorded a failed upload, read as pending
+	uploadStatusFailed = "failed"
+)
+
+// UploadRecord is the upload index entry for a stored file
+type UploadRecord struct {
+	Status    string    `json:"status"`
+	FileID    string    `json:"fileId,omitempty"` // Cloud storage file ID once uploaded
+	Error     string    `json:"error,omitempty"`  // Reason the last upload failed
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// uploadIndex records the cloud upload status of stored files
+// It is persisted as JSON in the storage directory so it survives restarts
+// Files are keyed by their path relative to the storage directory
+type uploadIndex struct {
+	path    string
+	records map[string]UploadRecord
+	queued  map[string]bool // Queued or being uploaded; not persisted
+	mu      sync.Mutex
+}
+
+// loadUploadIndex reads the upload index, starting empty if it doesn't exist yet
+func loadUploadIndex(path string) (*uploadIndex, error) {
+	idx := &uploadIndex{
+		path:    path,
+		records: make(map[string]UploadRecord),
+		queued:  make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return idx, fmt.Errorf("failed to read upload index: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &idx.records); err == nil {
+		for file, record := range idx.records {
+			if record.Status == uploadStatusFailed {
+				record.Status = UploadStatusPending
+				idx.records[file] = record
+			}
+		}
+		return idx, nil
+	}
+
+	// Older indexes are a plain list of uploaded files
+	var uploaded []string
+	if err := json.Unmarshal(data, &uploaded); err != nil {
+		return idx, fmt.Errorf("failed to parse upload index: %v", err)
+	}
+	for _, file := range uploaded {
+		idx.records[file] = UploadRecord{Status: UploadStatusUploaded}
+	}
+
+	return idx, nil
+}
+
+// markQueued records that a file has been queued for upload
+// Returns false if the file is already queued
+func (idx *uploadIndex) markQueued(file string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.queued[file] {
+		return false
+	}
+	idx.queued[file] = true
+	return true
+}
+
+// markDone records the outcome of a queued upload and persists the index
+// A failed upload leaves the file pending
+func (idx *uploadIndex) markDone(file, fileID string, uploadErr error) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.queued, file)
+
+	record := UploadRecord{
+		Status:    UploadStatusUploaded,
+		FileID:    fileID,
+		UpdatedAt: utils.Now(),
+	}
+	if uploadErr != nil {
+		record.Status = UploadStatusPending
+		record.Error = uploadErr.Error()
+	}
+	idx.records[file] = record
+
+	return idx.save()
+}
+
+// unmarkQueued forgets a queued upload that was never attempted
+func (idx *uploadIndex) unmarkQueued(file string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.queued, file)
+}
+
+// forget removes files that no longer exist from the index and persists it
+func (idx *uploadIndex) forget(files ...string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, file := range files {
+		delete(idx.records, file)
+	}
+	return idx.save()
+}
+
+// isUploaded reports whether a file has been uploaded
+func (idx *uploadIndex) isUploaded(file string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.records[file].Status == UploadStatusUploaded
+}
+
+// uploadedID returns the cloud storage file ID of a file that has been uploaded
+func (idx *uploadIndex) uploadedID(file string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	record := idx.records[file]
+	return record.FileID, record.Status == UploadStatusUploaded && record.FileID != ""
+}
+
+// needsUpload reports whether a file is pending or not in the index, and isn't queued
+func (idx *uploadIndex) needsUpload(file string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.records[file].Status != UploadStatusUploaded && !idx.queued[file]
+}
+
+// save writes the index to disk, replacing the previous version atomically
+// Must be called with mu held
+func (idx *uploadIndex) save() error {
+	data, err := json.MarshalIndent(idx.records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload index: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), ".upload_index-*")
+	if err != nil {
+		return fmt.Errorf("failed to write upload index: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write upload index: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write upload index: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), idx.path); err != nil {
+		return fmt.Errorf("failed to write upload index: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Upload queue policies applied when the queue is full
+const (
+	UploadPolicyBlock = "block" // Wait briefly for a free slot, then drop
+	UploadPolicyDrop  = "drop"  // Drop immediately
+)
+
+// Defaults used when the upload queue is not configured
+const (
+	defaultUploadWorkers      = 4
+	defaultUploadQueueSize    = 100
+	defaultUploadBlockTimeout = 5 * time.Second
+)
+
+// uploadJob is a file waiting to be uploaded to cloud storage
+type uploadJob struct {
+	ctx        context.Context
+	filePath   string
+	folderPath string
+	done       func(error) // Called with the outcome once the upload has been attempted, if set
+}
+
+// startUploadWorkers creates the upload queue and its fixed pool of workers
+func (ms *MediaStore) startUploadWorkers() {
+	workers := ms.config.UploadWorkers
+	if workers <= 0 {
+		workers = defaultUploadWorkers
+	}
+
+	queueSize := ms.config.UploadQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultUploadQueueSize
+	}
+
+	ms.uploadQueue = make(chan uploadJob, queueSize)
+	for i := 0; i < workers; i++ {
+		go ms.uploadWorker()
+	}
+
+	ms.logger.Info("Started %d cloud upload workers (queue size %d)", workers, queueSize)
+}
+
+// uploadWorker processes queued uploads one at a time
+func (ms *MediaStore) uploadWorker() {
+	for job := range ms.uploadQueue {
+		// Hold queued uploads while processing is paused
+		ms.pause.wait(context.Background())
+
+		ms.uploadsInFlight.Add(1)
+		err := ms.uploadFile(job)
+		ms.uploadsInFlight.Add(-1)
+		if job.done != nil {
+			job.done(err)
+		}
+		ms.uploadWg.Done()
+	}
+}
+
+// uploadToCloudAsync queues a file for upload to cloud storage
+// The upload outlives the request, so it keeps the context's values but not its cancellation
+// When the queue is full the caller blocks briefly or the upload is dropped, depending on the policy
+func (ms *MediaStore) uploadToCloudAsync(ctx context.Context, filePath, folderPath string) {
+	// Skip if cloud storage is not configured
+	if ms.cloudStore == nil {
+		return
+	}
+
+	job, ok := ms.newUploadJob(ctx, filePath, folderPath)
+	if !ok {
+		return
+	}
+
+	// Queue the upload if there is room
+	select {
+	case ms.uploadQueue <- job:
+		return
+	default:
+	}
+
+	if ms.config.UploadQueuePolicy == UploadPolicyDrop {
+		ms.dropUpload(job)
+		return
+	}
+
+	// Wait for a free slot, but not indefinitely
+	timeout := time.Duration(ms.config.UploadQueueBlockSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultUploadBlockTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case ms.uploadQueue <- job:
+	case <-timer.C:
+		ms.dropUpload(job)
+	}
+}
+
+// newUploadJob registers a queued upload
+// Returns false if the file is already queued
+func (ms *MediaStore) newUploadJob(ctx context.Context, filePath, folderPath string) (uploadJob, bool) {
+	logger := ms.logger.ForContext(ctx)
+
+	job := uploadJob{
+		ctx:        context.WithoutCancel(ctx),
+		filePath:   filePath,
+		folderPath: folderPath,
+	}
+
+	if !ms.uploadIndex.markQueued(ms.indexKey(filePath)) {
+		logger.Debug("Upload for %s is already queued", filePath)
+		return job, false
+	}
+
+	ms.uploadWg.Add(1)
+	return job, true
+}
+
+// dropUpload records an upload that could not be queued
+func (ms *MediaStore) dropUpload(job uploadJob) {
+	logger := ms.logger.ForContext(job.ctx)
+
+	ms.uploadIndex.unmarkQueued(ms.indexKey(job.filePath))
+	ms.uploadsDropped.Add(1)
+	ms.RecordError("upload", fmt.Errorf("%s: upload queue is full, upload dropped", job.filePath))
+	ms.uploadWg.Done()
+	logger.Warning("Cloud upload queue is full, dropping upload for %s (the file is kept locally)", job.filePath)
+}
+
+// IsUploaded reports whether a stored file, as returned by SaveMedia, has been uploaded to cloud storage
+func (ms *MediaStore) IsUploaded(path string) bool {
+	if ms.uploadIndex == nil {
+		return false
+	}
+
+	return ms.uploadIndex.isUploaded(ms.indexKey(path))
+}
+
+// indexKey returns the upload index key for a stored file
+func (ms *MediaStore) indexKey(filePath string) string {
+	rel, err := filepath.Rel(ms.config.StorageDir, filePath)
+	if err != nil {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// uploadFile uploads a queued file and runs its callback
+func (ms *MediaStore) uploadFile(job uploadJob) error {
+	logger := ms.logger.ForContext(job.ctx)
+
+	logger.Debug("Starting cloud upload for %s to folder %s", job.filePath, job.folderPath)
+
+	// Build the remote folder path using the cloud provider's base folder and the expanded folder template
+	remoteFolder := filepath.Join(ms.cloudFolder, job.folderPath)
+
+	// Fail fast while the backend is down; the file is recorded as pending so a backup sync retries it,
+	// and UPLOAD_FAILURE_POLICY applies as it does to any other failed upload
+	if !ms.breaker.allow(time.Now()) {
+		err := fmt.Errorf("%w: skipping upload of %s", ErrCloudUnavailable, job.filePath)
+		logger.Debug("Cloud storage circuit breaker is open, skipping upload of %s", job.filePath)
+		if indexErr := ms.uploadIndex.markDone(ms.indexKey(job.filePath), "", err); indexErr != nil {
+			logger.Error("Failed to update upload index: %v", indexErr)
+		}
+		ms.handleUploadFailure(job.filePath, err)
+		return err
+	}
+
+	// Upload the file
+	fileID, err := ms.cloudStore.UploadFile(job.ctx, job.filePath, remoteFolder)
+	ms.recordBreakerOutcome(err)
+
+	// Record the outcome so a backup sweep can retry failed uploads, and alert if uploads keep failing
+	ms.recordUploadOutcome(job.filePath, err)
+	if indexErr := ms.uploadIndex.markDone(ms.indexKey(job.filePath), fileID, err); indexErr != nil {
+		logger.Error("Failed to update upload index: %v", indexErr)
+	}
+
+	if err != nil {
+		logger.Error("Failed to upload file to cloud storage: %v", err)
+		ms.RecordError("upload", fmt.Errorf("%s: %v", job.filePath, err))
+		ms.handleUploadFailure(job.filePath, err)
+		return err
+	}
+
+	logger.Info("Successfully uploaded %s to cloud storage (ID: %s)", job.filePath, fileID)
+
+	// Call the registered callback function if exists
+	ms.callUploadCallback(job.ctx, fileID, job.filePath)
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package notify
+
+import (
+	"context"
+	"time"
+)
+
+// Alert is an operational problem worth telling an operator about
+type Alert struct {
+	Title   string    // Short summary, e.g. "Cloud uploads failing"
+	Message string    // Details of what went wrong
+	Time    time.Time // When the problem was detected
+}
+
+// Notifier defines the interface for alert destinations
+type Notifier interface {
+	// Notify delivers an alert
+	Notify(ctx context.Context, alert Alert) error
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// webhookTimeout bounds how long delivering an alert may take
+const webhookTimeout = 10 * time.Second
+
+// WebhookNotifier posts alerts as JSON to a webhook URL
+// The payload's text field makes it work with Slack incoming webhooks as-is
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+	logger *utils.Logger
+}
+
+// webhookPayload is the JSON body posted for an alert
+type webhookPayload struct {
+	Text    string    `json:"text"` // Slack-compatible summary
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// NewWebhookNotifier creates a notifier posting to ALERT_WEBHOOK_URL
+func NewWebhookNotifier(cfg *config.Config, logger *utils.Logger) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    cfg.AlertWebhookURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+}
+
+// Notify posts an alert to the webhook
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(webhookPayload{
+		Text:    fmt.Sprintf("⚠️ LineFileCatcher: %s\n%s", alert.Title, alert.Message),
+		Title:   alert.Title,
+		Message: alert.Message,
+		Time:    alert.Time,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create alert request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send alert: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned status %d", resp.StatusCode)
+	}
+
+	n.logger.Debug("Sent alert: %s", alert.Title)
+	return nil
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter caps the combined rate of the data read through the readers it wraps
+// Readers share the limit, so concurrent transfers together stay under it
+type BandwidthLimiter struct {
+	bytesPerSec int64
+	next        time.Time // When the data already let through has been sent at the limit
+	mu          sync.Mutex
+}
+
+// NewBandwidthLimiter creates a limiter allowing bytesPerSec bytes per second across its readers
+// Returns nil, which lets data through unlimited, if bytesPerSec is not positive
+func NewBandwidthLimiter(bytesPerSec int64) *BandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{bytesPerSec: bytesPerSec}
+}
+
+// Reader returns a reader that reads from r no faster than the limit allows
+// Reads stop waiting and fail when ctx is cancelled; a nil limiter returns r itself
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// chunkSize returns how much a single read may take, so one reader can't hold the limit for long
+func (l *BandwidthLimiter) chunkSize() int {
+	return int(max(l.bytesPerSec/10, 1))
+}
+
+// reserve accounts for n bytes and returns how long to wait for them to fit within the limit
+func (l *BandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSec))
+	return l.next.Sub(now)
+}
+
+// limitedReader is a reader throttled by a shared BandwidthLimiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+// Read reads at most a chunk, then waits until the limit allows the bytes read
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.limiter.chunkSize() {
+		p = p[:lr.limiter.chunkSize()]
+	}
+
+	n, err := lr.r.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+
+	if wait := lr.limiter.reserve(n); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-lr.ctx.Done():
+			return n, lr.ctx.Err()
+		}
+	}
+	return n, err
+}
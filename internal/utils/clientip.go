@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies resolves the real client IP of requests that arrive through trusted reverse proxies
+// Forwarding headers are only believed when the direct peer is a trusted proxy, so clients can't spoof them
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedProxies parses a list of CIDR ranges or single IP addresses
+func ParseTrustedProxies(entries []string) (*TrustedProxies, error) {
+	proxies := &TrustedProxies{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy range %q: %v", entry, err)
+			}
+			proxies.prefixes = append(proxies.prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q: %v", entry, err)
+		}
+		addr = addr.Unmap()
+		proxies.prefixes = append(proxies.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// trusts reports whether an address belongs to a trusted proxy
+func (p *TrustedProxies) trusts(addr netip.Addr) bool {
+	if p == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent a request
+// When the direct peer is a trusted proxy, X-Forwarded-For is walked from the right, skipping trusted proxies,
+// and the first untrusted address is the client; X-Real-IP is used when X-Forwarded-For is absent
+// Otherwise, or when the headers can't be parsed, the direct peer's address is returned
+func (p *TrustedProxies) ClientIP(r *http.Request) string {
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !p.trusts(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+			return realIP.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseIP(hops[i])
+		if !ok {
+			// Nothing further left can be trusted; the last valid hop is the best answer
+			break
+		}
+		client = hop
+		if !p.trusts(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// parseIP parses an address with or without a port
+func parseIP(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// clientIPKey is the context key for the client IP
+type clientIPKey struct{}
+
+// WithClientIP returns a context carrying the IP address of the client that sent the request
+func WithClientIP(ctx context.Context, clientIP string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, clientIP)
+}
+
+// ClientIPFromContext returns the client IP stored in the context, or "" if there is none
+func ClientIPFromContext(ctx context.Context) string {
+	clientIP, _ := ctx.Value(clientIPKey{}).(string)
+	return clientIP
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time
+// Dates of saved files, generated filenames and statistics are taken from it, so tests can fix the time
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+// Now returns the current system time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock is the Clock used by Now, the system clock unless replaced with SetClock
+var clock = struct {
+	sync.RWMutex
+	Clock
+}{Clock: realClock{}}
+
+// Now returns the current time from the clock set with SetClock
+func Now() time.Time {
+	clock.RLock()
+	defer clock.RUnlock()
+
+	return clock.Now()
+}
+
+// SetClock replaces the clock used by Now and returns a function restoring the previous one
+func SetClock(c Clock) (restore func()) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	previous := clock.Clock
+	clock.Clock = c
+	return func() {
+		clock.Lock()
+		defer clock.Unlock()
+
+		clock.Clock = previous
+	}
+}
+
+// FakeClock is a Clock that only moves when told to, for tests
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a FakeClock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time the clock is stopped at
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Set stops the clock at a new time
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// Advance moves the clock forward
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,16 @@
+package utils
+
+import "io"
+
+// CountingReader counts the bytes read through it, for content whose size isn't known up front
+type CountingReader struct {
+	R io.Reader
+	N int64 // Bytes read so far
+}
+
+// Read reads from the underlying reader and counts the bytes returned
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// FreeDiskSpace is not supported on this platform
+func FreeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("disk space check not supported on this platform")
+}
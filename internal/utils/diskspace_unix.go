@@ -0,0 +1,18 @@
+//go:build unix
+
+package utils
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeDiskSpace returns the number of bytes available to unprivileged users on the filesystem holding dir
+func FreeDiskSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get disk space: %v", err)
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// maxNameRunes is the longest base name kept from a suggested filename
+const maxNameRunes = 100
+
+// FilenameFromContentDisposition returns the filename suggested by a Content-Disposition header
+// Both quoted filename and RFC 5987 filename* parameters are understood, the latter taking precedence
+// Returns an empty string if the header is absent, malformed or has no filename
+func FilenameFromContentDisposition(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+
+	// Only the last path element counts, whichever separator the sender used
+	name := params["filename"]
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+// GenerateNamedFilename creates a unique filename based on a suggested name, such as one sent by the server
+// The format is: prefix_name_randomString.extension; characters that are unsafe in file names are replaced
+// Falls back to GenerateUniqueFilename when nothing usable is left of the name
+func GenerateNamedFilename(prefix, name, extension string) (string, error) {
+	base := sanitizeName(strings.TrimSuffix(name, filepath.Ext(name)))
+	if base == "" {
+		return GenerateUniqueFilename(prefix, extension)
+	}
+
+	randomString, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	// Ensure extension starts with a dot
+	if extension != "" && extension[0] != '.' {
+		extension = "." + extension
+	}
+
+	filename := fmt.Sprintf("%s_%s%s", base, randomString, extension)
+	if prefix != "" {
+		filename = prefix + "_" + filename
+	}
+
+	return filename, nil
+}
+
+// sanitizeName keeps letters, marks, digits, spaces, dots, dashes and underscores of a name, replacing anything else with
+// an underscore, and drops leading dots so the file isn't hidden
+func sanitizeName(name string) string {
+	var b strings.Builder
+	runes := 0
+	for _, r := range name {
+		if runes == maxNameRunes {
+			break
+		}
+		switch {
+		case unicode.IsLetter(r), unicode.IsMark(r), unicode.IsDigit(r), r == '-', r == '_', r == '.', r == ' ':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+		runes++
+	}
+
+	return strings.TrimSpace(strings.TrimLeft(b.String(), ". "))
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// hashNameLength is how many hex characters of the content hash HashFilenames keeps
+const hashNameLength = 16
+
+// FileNaming describes a file being saved, for a FilenameStrategy to name it
+type FileNaming struct {
+	MediaType    string    // image, video, audio or file
+	Prefix       string    // From FILENAME_PREFIXES, possibly empty
+	OriginalName string    // Name suggested by the sender or content server, empty if none or not used
+	ContentType  string    // Declared or detected content type
+	Extension    string    // Chosen from the content type or original name
+	Timestamp    time.Time // When the file was received
+	ContentHash  string    // Hex SHA-256 of the content, only set for strategies that use it
+}
+
+// FilenameStrategy decides the names saved files get
+type FilenameStrategy interface {
+	// Filename returns the name to save a file under, without a folder
+	Filename(f FileNaming) (string, error)
+
+	// UsesContentHash reports whether Filename needs FileNaming.ContentHash, which takes a pass over the content
+	UsesContentHash() bool
+}
+
+// RandomFilenames names files prefix_timestamp_random.ext, or after their original name when there is one
+type RandomFilenames struct {
+	TimestampNamed bool // Also put the timestamp in names based on an original name, so they sort by time
+}
+
+// Filename returns a unique name using GenerateUniqueFilename, or GenerateNamedFilename for a file with an original name
+func (s RandomFilenames) Filename(f FileNaming) (string, error) {
+	if f.OriginalName == "" {
+		return GenerateUniqueFilename(f.Prefix, f.Extension)
+	}
+
+	prefix := f.Prefix
+	if s.TimestampNamed {
+		timestamp := strconv.FormatInt(f.Timestamp.UnixMilli(), 10)
+		if prefix == "" {
+			prefix = timestamp
+		} else {
+			prefix += "_" + timestamp
+		}
+	}
+	return GenerateNamedFilename(prefix, f.OriginalName, f.Extension)
+}
+
+// UsesContentHash reports that random names don't depend on the content
+func (s RandomFilenames) UsesContentHash() bool {
+	return false
+}
+
+// HashFilenames names files prefix_hash.ext after the start of their content's SHA-256
+// The same content always gets the same name, so saving it again in the same folder replaces the earlier copy
+type HashFilenames struct{}
+
+// Filename returns a name derived from the content hash
+func (HashFilenames) Filename(f FileNaming) (string, error) {
+	if len(f.ContentHash) < hashNameLength {
+		return "", fmt.Errorf("no content hash to name the file after")
+	}
+
+	extension := f.Extension
+	if extension != "" && extension[0] != '.' {
+		extension = "." + extension
+	}
+
+	filename := f.ContentHash[:hashNameLength] + extension
+	if f.Prefix != "" {
+		filename = f.Prefix + "_" + filename
+	}
+	return filename, nil
+}
+
+// UsesContentHash reports that hash names need the content hash
+func (HashFilenames) UsesContentHash() bool {
+	return true
+}
+
+// FileSHA256 returns the hex SHA-256 of a file's content
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +18,8 @@ type Logger struct {
 	debugLogger   *log.Logger
 	warningLogger *log.Logger
 	logFile       *os.File
+	debug         *atomic.Bool // Whether debug messages are logged, shared with derived loggers
+	prefix        string       // Prepended to every message, e.g. the request ID
 }
 
 // NewLogger creates a new logger that writes to both console and file
@@ -41,13 +45,40 @@ func NewLogger(logDir string) (*Logger, error) {
 	debugLogger := log.New(multiWriter, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
 	warningLogger := log.New(multiWriter, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	return &Logger{
+	logger := &Logger{
 		infoLogger:    infoLogger,
 		errorLogger:   errorLogger,
 		debugLogger:   debugLogger,
 		warningLogger: warningLogger,
 		logFile:       logFile,
-	}, nil
+		debug:         new(atomic.Bool),
+	}
+	logger.debug.Store(os.Getenv("DEBUG") == "true")
+
+	return logger, nil
+}
+
+// SetDebug enables or disables debug messages
+func (l *Logger) SetDebug(enabled bool) {
+	l.debug.Store(enabled)
+}
+
+// DebugEnabled reports whether debug messages are logged, so costly debug output can be skipped
+func (l *Logger) DebugEnabled() bool {
+	return l.debug.Load()
+}
+
+// ForContext returns a logger that tags every message with the request ID stored in the context
+// It writes to the same outputs as l; returns l itself if the context has no request ID
+func (l *Logger) ForContext(ctx context.Context) *Logger {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		return l
+	}
+
+	derived := *l
+	derived.prefix = "[" + requestID + "] "
+	return &derived
 }
 
 // Close closes the log file
@@ -57,22 +88,22 @@ func (l *Logger) Close() error {
 
 // Info logs an informational message
 func (l *Logger) Info(format string, v ...interface{}) {
-	l.infoLogger.Printf(format, v...)
+	l.infoLogger.Printf(l.prefix+format, v...)
 }
 
 // Error logs an error message
 func (l *Logger) Error(format string, v ...interface{}) {
-	l.errorLogger.Printf(format, v...)
+	l.errorLogger.Printf(l.prefix+format, v...)
 }
 
 // Debug logs a debug message
 func (l *Logger) Debug(format string, v ...interface{}) {
-	if os.Getenv("DEBUG") == "true" {
-		l.debugLogger.Printf(format, v...)
+	if l.debug.Load() {
+		l.debugLogger.Printf(l.prefix+format, v...)
 	}
 }
 
 // Warning logs a warning message
 func (l *Logger) Warning(format string, v ...interface{}) {
-	l.warningLogger.Printf(format, v...)
+	l.warningLogger.Printf(l.prefix+format, v...)
 }
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -98,3 +99,36 @@ func (rl *RateLimiter) ResetInterval() time.Duration {
 
 	return rl.interval - time.Since(rl.lastRefill)
 }
+
+// SetRate changes the maximum number of requests per time window
+// Available tokens are capped at the new rate
+func (rl *RateLimiter) SetRate(rate int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.rate = rate
+	rl.tokens = min(rl.tokens, rate)
+}
+
+// Drain uses up the available tokens, so requests are allowed only as the bucket refills
+func (rl *RateLimiter) Drain() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.tokens = 0
+	rl.lastRefill = time.Now()
+}
+
+// Wait blocks until a request is allowed by the rate limit or the context is done
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	for !rl.Allow() {
+		timer := time.NewTimer(rl.interval / time.Duration(rl.rate))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
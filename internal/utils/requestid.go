@@ -0,0 +1,17 @@
+package utils
+
+import "context"
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the request being handled
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID stored in the context, or "" if there is none
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
@@ -3,8 +3,12 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"mime"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -12,30 +16,56 @@ import (
 // The format is: prefix_timestamp_randomString.extension
 func GenerateUniqueFilename(prefix, extension string) (string, error) {
 	// Get current timestamp
-	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	timestamp := Now().UnixMilli()
 
 	// Generate random string (8 bytes = 16 hex chars)
-	randomBytes := make([]byte, 8)
-	if _, err := rand.Read(randomBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+	randomString, err := randomHex(8)
+	if err != nil {
+		return "", err
 	}
 
-	randomString := hex.EncodeToString(randomBytes)
-
 	// Ensure extension starts with a dot
 	if extension != "" && extension[0] != '.' {
 		extension = "." + extension
 	}
 
-	// Create filename
-	filename := fmt.Sprintf("%s_%d_%s%s", prefix, timestamp, randomString, extension)
+	// Create filename, leaving out the separator when there is no prefix
+	filename := fmt.Sprintf("%d_%s%s", timestamp, randomString, extension)
+	if prefix != "" {
+		filename = prefix + "_" + filename
+	}
 
 	return filename, nil
 }
 
+// GenerateRequestID creates a random ID used to correlate the log lines of one request
+func GenerateRequestID() string {
+	id, err := randomHex(8)
+	if err != nil {
+		// Fall back to the timestamp, which is still unique enough for tracing
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return id
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
+
 // GetDateString returns the current date formatted as YYYY-MM-DD
 func GetDateString() string {
-	return time.Now().Format("2006-01-02")
+	return FormatDate(Now())
+}
+
+// FormatDate returns a time's date in the local time zone formatted as YYYY-MM-DD
+func FormatDate(t time.Time) string {
+	return t.Local().Format("2006-01-02")
 }
 
 // GetFileExtension extracts the extension from a filename
@@ -43,8 +73,16 @@ func GetFileExtension(filename string) string {
 	return filepath.Ext(filename)
 }
 
+// DefaultExtension is used for content of an unknown type
+const DefaultExtension = ".bin"
+
 // GetContentType determines the file extension based on content type
 func GetContentType(contentType string) string {
+	// Ignore parameters such as "; codecs=mp4a.40.2"
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
 	switch contentType {
 	case "image/jpeg":
 		return ".jpg"
@@ -56,9 +94,86 @@ func GetContentType(contentType string) string {
 		return ".mp4"
 	case "video/3gpp":
 		return ".3gp"
-	case "audio/mp4", "audio/mpeg", "audio/mp3":
+	case "audio/mp4", "audio/aac", "audio/x-m4a":
+		return ".m4a"
+	case "audio/mpeg", "audio/mp3":
 		return ".mp3"
+	case "image/webp":
+		return ".webp"
+	case "audio/wave", "audio/wav":
+		return ".wav"
+	case "application/pdf":
+		return ".pdf"
+	case "application/zip":
+		return ".zip"
+	case "text/plain":
+		return ".txt"
 	default:
-		return ".bin" // Default binary extension
+		return DefaultExtension
+	}
+}
+
+// SafeExtension returns the lowercased extension of a file name sent by a user,
+// or an empty string if it has none or it isn't a short alphanumeric extension
+func SafeExtension(filename string) string {
+	extension := strings.ToLower(filepath.Ext(filename))
+	if len(extension) < 2 || len(extension) > 10 {
+		return ""
 	}
+
+	for _, r := range extension[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return extension
+}
+
+// FormatTemplate substitutes {key} placeholders in a template with the given values
+func FormatTemplate(template string, values map[string]string) string {
+	replacements := make([]string, 0, len(values)*2)
+	for key, value := range values {
+		replacements = append(replacements, "{"+key+"}", value)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// ErrInvalidPathComponent is returned for names that could escape the directory they are used in
+var ErrInvalidPathComponent = errors.New("invalid path component")
+
+// SanitizePathComponent validates a single file or folder name that will be joined under a base directory
+// Surrounding whitespace is trimmed; names containing separators or control characters, and "." or "..", are rejected
+func SanitizePathComponent(name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	switch name {
+	case "", ".", "..":
+		return "", fmt.Errorf("%w: %q", ErrInvalidPathComponent, name)
+	}
+
+	for _, r := range name {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPathComponent, name)
+		}
+	}
+
+	return name, nil
+}
+
+// CheckWritable verifies a directory is writable by creating and removing a temp file
+func CheckWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".writecheck-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	name := file.Name()
+	file.Close()
+
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove temp file: %v", err)
+	}
+
+	return nil
 }
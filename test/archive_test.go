@@ -0,0 +1,129 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestArchiveHandler tests that a day's files are sent as a zip, and the errors for bad requests
+func TestArchiveHandler(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+		AdminToken: testAdminToken,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	// A day with files at the top level and in a media type subfolder, plus files that are left out
+	files := map[string]string{
+		"image_a.jpg":        "first image",
+		"file_b.pdf":         "a document",
+		"videos/video_c.mp4": "a video",
+		"image_d.part":       "still downloading",
+		".hidden":            "not media",
+	}
+	dateDir := filepath.Join(cfg.StorageDir, "2025-01-02")
+	for name, content := range files {
+		path := filepath.Join(dateDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	archiveHandler := handler.NewArchiveHandler(cfg, logger)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		archiveHandler.HandleArchive(res, req)
+		return res
+	}
+
+	res := get("/archive/2025-01-02.zip", testAdminToken)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Errorf("Expected content type application/zip, got %q", contentType)
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `attachment; filename="2025-01-02.zip"` {
+		t.Errorf("Unexpected content disposition %q", disposition)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+
+	var names []string
+	for _, entry := range archive.File {
+		names = append(names, entry.Name)
+
+		reader, err := entry.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", entry.Name, err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", entry.Name, err)
+		}
+		if string(content) != files[entry.Name] {
+			t.Errorf("Expected %s to contain %q, got %q", entry.Name, files[entry.Name], content)
+		}
+	}
+	sort.Strings(names)
+
+	expected := []string{"file_b.pdf", "image_a.jpg", "videos/video_c.mp4"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected entries %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected entries %v, got %v", expected, names)
+			break
+		}
+	}
+
+	// Bad requests
+	errorCases := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"missing token", "/archive/2025-01-02.zip", "", http.StatusUnauthorized},
+		{"missing day", "/archive/2025-01-03.zip", testAdminToken, http.StatusNotFound},
+		{"invalid date", "/archive/2025-13-01.zip", testAdminToken, http.StatusBadRequest},
+		{"path traversal", "/archive/../logs.zip", testAdminToken, http.StatusBadRequest},
+		{"missing extension", "/archive/2025-01-02", testAdminToken, http.StatusBadRequest},
+	}
+	for _, tc := range errorCases {
+		if res := get(tc.path, tc.token); res.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, res.Code)
+		}
+	}
+}
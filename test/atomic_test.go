@@ -0,0 +1,102 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestSaveMediaNeverExposesPartialFiles tests that listing the storage directory during saves
+// only ever finds complete files, apart from temporary files marked as in progress
+func TestSaveMediaNeverExposesPartialFiles(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		SpoolDir:   filepath.Join(testDir, "spool"),
+		LogDir:     filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	const saves = 10
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256*1024) // 4MB
+
+	done := make(chan struct{})
+	var partial []string
+	var listed sync.WaitGroup
+	listed.Add(1)
+	go func() {
+		defer listed.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			filepath.WalkDir(cfg.StorageDir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() || media.IsInProgress(d.Name()) {
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					// Renamed or removed since it was listed
+					return nil
+				}
+				if info.Size() != int64(len(content)) {
+					partial = append(partial, fmt.Sprintf("%s (%d bytes)", path, info.Size()))
+				}
+				return nil
+			})
+		}
+	}()
+
+	for i := 0; i < saves; i++ {
+		response := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(bytes.NewReader(content)),
+			ContentType: "application/octet-stream",
+		}
+		if _, err := mediaStore.SaveMedia(context.Background(), fmt.Sprintf("file%d", i), "file", response); err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+	}
+	close(done)
+	listed.Wait()
+
+	if len(partial) > 0 {
+		t.Errorf("Expected listings to only show complete files, saw %d partial: %v", len(partial), partial)
+	}
+
+	// Every save ends up as a complete file with no temporary files left behind
+	var complete, inProgress int
+	filepath.WalkDir(cfg.StorageDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if media.IsInProgress(d.Name()) {
+				inProgress++
+			} else {
+				complete++
+			}
+		}
+		return nil
+	})
+	if complete != saves || inProgress != 0 {
+		t.Errorf("Expected %d complete files and no temporary files, got %d and %d", saves, complete, inProgress)
+	}
+
+}
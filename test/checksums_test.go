@@ -0,0 +1,93 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestChecksumsVerify tests that WRITE_CHECKSUMS records each saved file and that verification finds changed and missing files
+func TestChecksumsVerify(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:      filepath.Join(testDir, "storage"),
+		LogDir:          filepath.Join(testDir, "logs"),
+		WriteChecksums:  true,
+		CompressStorage: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// The text file is stored compressed, so its checksum is of the stored file rather than the content
+	var saved []string
+	for i, contentType := range []string{"image/jpeg", "image/png", "text/plain"} {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader(fmt.Sprintf("content %d", i))),
+			ContentType: contentType,
+		}
+		filePath, err := mediaStore.SaveMedia(context.Background(), fmt.Sprintf("message%d", i), "file", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		saved = append(saved, filePath)
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(saved[0]), media.ChecksumsFile))
+	if err != nil {
+		t.Fatalf("Failed to read checksums file: %v", err)
+	}
+	for _, filePath := range saved {
+		hash, err := utils.FileSHA256(filePath)
+		if err != nil {
+			t.Fatalf("Failed to hash %s: %v", filePath, err)
+		}
+		if line := hash + "  " + filepath.Base(filePath) + "\n"; !strings.Contains(string(data), line) {
+			t.Errorf("Expected checksums file to contain %q, got:\n%s", line, data)
+		}
+	}
+
+	report, err := media.VerifyChecksums(cfg.StorageDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to verify checksums: %v", err)
+	}
+	if report.Verified != 3 || len(report.Mismatched) != 0 || len(report.Missing) != 0 {
+		t.Errorf("Expected 3 verified files, got %+v", report)
+	}
+
+	// One file rots, another is removed
+	if err := os.WriteFile(saved[0], []byte("content X"), 0644); err != nil {
+		t.Fatalf("Failed to change file: %v", err)
+	}
+	if err := os.Remove(saved[1]); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	report, err = media.VerifyChecksums(cfg.StorageDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to verify checksums: %v", err)
+	}
+	if report.Verified != 1 {
+		t.Errorf("Expected 1 verified file, got %d", report.Verified)
+	}
+	if len(report.Mismatched) != 1 || report.Mismatched[0] != saved[0] {
+		t.Errorf("Expected %s to be reported as changed, got %v", saved[0], report.Mismatched)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != saved[1] {
+		t.Errorf("Expected %s to be reported as missing, got %v", saved[1], report.Missing)
+	}
+}
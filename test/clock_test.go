@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// setLocalZone makes loc the local time zone for the rest of the test
+func setLocalZone(t *testing.T, loc *time.Location) {
+	previous := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = previous })
+}
+
+// TestFakeClock tests that dates and generated filenames follow the clock set with SetClock
+func TestFakeClock(t *testing.T) {
+	setLocalZone(t, time.UTC)
+
+	clock := utils.NewFakeClock(time.Date(2024, 3, 15, 23, 30, 0, 0, time.UTC))
+	defer utils.SetClock(clock)()
+
+	if date := utils.GetDateString(); date != "2024-03-15" {
+		t.Errorf("Expected the date of the fake clock, got %s", date)
+	}
+	filename, err := utils.GenerateUniqueFilename("image", ".jpg")
+	if err != nil {
+		t.Fatalf("Failed to generate filename: %v", err)
+	}
+	if !strings.HasPrefix(filename, "image_1710545400000_") {
+		t.Errorf("Expected the filename to carry the fake clock's time, got %s", filename)
+	}
+
+	// The same instant is the next day further east
+	setLocalZone(t, time.FixedZone("UTC+9", 9*60*60))
+	if date := utils.GetDateString(); date != "2024-03-16" {
+		t.Errorf("Expected the date in the local time zone, got %s", date)
+	}
+
+	clock.Advance(24 * time.Hour)
+	if date := utils.GetDateString(); date != "2024-03-17" {
+		t.Errorf("Expected the date to follow the clock, got %s", date)
+	}
+}
+
+// TestSaveMediaDateFolders tests that files are dated by when the message was sent, in the local time zone,
+// falling back to the clock when the send time isn't known
+func TestSaveMediaDateFolders(t *testing.T) {
+	setLocalZone(t, time.FixedZone("UTC+7", 7*60*60))
+
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	defer utils.SetClock(utils.NewFakeClock(now))()
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	if start := mediaStore.GetStats().StartTime; !start.Equal(now) {
+		t.Errorf("Expected the statistics to start at the fake clock's time, got %s", start)
+	}
+
+	tests := []struct {
+		name     string
+		sent     time.Time
+		expected string
+	}{
+		{"unknown send time", time.Time{}, "2024-03-15"},
+		{"sent days ago", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), "2024-01-02"},
+		// 20:00 UTC is already the next day at UTC+7
+		{"sent late in UTC", time.Date(2024, 1, 2, 20, 0, 0, 0, time.UTC), "2024-01-03"},
+	}
+
+	for _, tt := range tests {
+		ctx := context.Background()
+		if !tt.sent.IsZero() {
+			ctx = media.WithEventSource(ctx, media.EventSource{Type: "user", ID: "U123", Timestamp: tt.sent})
+		}
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content")),
+			ContentType: "image/jpeg",
+		}
+
+		filePath, err := mediaStore.SaveMedia(ctx, "message", "image", content)
+		if err != nil {
+			t.Fatalf("%s: failed to save media: %v", tt.name, err)
+		}
+		if date := filepath.Base(filepath.Dir(filePath)); date != tt.expected {
+			t.Errorf("%s: expected the file in %s, got %s", tt.name, tt.expected, filePath)
+		}
+	}
+
+	// Rates are computed against the clock
+	if summary := mediaStore.GetStats().Summary(now.Add(time.Minute)); summary.FilesPerMinute != 3 {
+		t.Errorf("Expected 3 files per minute, got %v", summary.FilesPerMinute)
+	}
+}
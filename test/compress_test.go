@@ -0,0 +1,115 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// newCompressingStore creates a media store with COMPRESS_STORAGE enabled
+func newCompressingStore(t *testing.T) *media.MediaStore {
+	t.Helper()
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:      filepath.Join(testDir, "storage"),
+		LogDir:          filepath.Join(testDir, "logs"),
+		CompressStorage: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+
+	return media.NewMediaStore(cfg, logger)
+}
+
+// TestSaveMediaCompressesText tests that COMPRESS_STORAGE stores text as .zst that decompresses to the original content
+func TestSaveMediaCompressesText(t *testing.T) {
+	mediaStore := newCompressingStore(t)
+
+	content := []byte(strings.Repeat("line file catcher keeps every file it is sent\n", 200))
+	filePath, err := mediaStore.SaveMedia(context.Background(), "text123", "file", &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(content)),
+		ContentType: "text/plain; charset=utf-8",
+	})
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	if !strings.HasSuffix(filePath, media.CompressedExtension) || !media.IsCompressed(filePath) {
+		t.Fatalf("Expected a compressed file name, got %s", filePath)
+	}
+
+	stored, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read stored file: %v", err)
+	}
+	if len(stored) >= len(content) {
+		t.Errorf("Expected the stored file to be smaller than %d bytes, got %d", len(content), len(stored))
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("Failed to create decoder: %v", err)
+	}
+	defer decoder.Close()
+
+	decompressed, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("Failed to decompress stored file: %v", err)
+	}
+	if !bytes.Equal(decompressed, content) {
+		t.Errorf("Expected the stored file to decompress to the original %d bytes, got %d bytes", len(content), len(decompressed))
+	}
+}
+
+// TestSaveMediaSkipsCompressingMedia tests that images, video and archives are stored as-is with COMPRESS_STORAGE
+func TestSaveMediaSkipsCompressingMedia(t *testing.T) {
+	tests := []struct {
+		messageType string
+		contentType string
+	}{
+		{"image", "image/jpeg"},
+		{"image", "image/png"},
+		{"video", "video/mp4"},
+		{"file", "application/zip"},
+		{"file", "application/gzip"},
+	}
+
+	mediaStore := newCompressingStore(t)
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			content := []byte(strings.Repeat("already compressed ", 100))
+			filePath, err := mediaStore.SaveMedia(context.Background(), "message-"+strings.ReplaceAll(tt.contentType, "/", "-"), tt.messageType, &linebot.MessageContentResponse{
+				Content:     io.NopCloser(bytes.NewReader(content)),
+				ContentType: tt.contentType,
+			})
+			if err != nil {
+				t.Fatalf("Failed to save media: %v", err)
+			}
+			if media.IsCompressed(filePath) {
+				t.Fatalf("Expected %s to be stored uncompressed, got %s", tt.contentType, filePath)
+			}
+
+			stored, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("Failed to read stored file: %v", err)
+			}
+			if !bytes.Equal(stored, content) {
+				t.Errorf("Expected the stored file to match the original content")
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestDownloadMediaResumesPartialDownload tests that a download cut off partway resumes with a Range request
+func TestDownloadMediaResumesPartialDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	half := len(content) / 2
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		ranges = append(ranges, rangeHeader)
+
+		if rangeHeader == "" {
+			// Promise the whole content but drop the connection halfway through
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack connection: %v", err)
+				return
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(content))
+			buf.Write(content[:half])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+
+		var start int
+		if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &start); err != nil {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start:])
+	}))
+	defer server.Close()
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		LogDir:             filepath.Join(testDir, "logs"),
+		DownloadRetryCount: 1,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	filePath, err := mediaStore.DownloadMedia(context.Background(), "12345", "image", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to download media: %v", err)
+	}
+
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", half) {
+		t.Errorf("Expected a full request followed by a resume from byte %d, got %q", half, ranges)
+	}
+
+	saved, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if !bytes.Equal(saved, content) {
+		t.Errorf("Downloaded file has %d bytes, expected the original %d bytes", len(saved), len(content))
+	}
+
+	// Only the final file should be left behind
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatalf("Failed to read storage directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), media.PartialExtension) {
+			t.Errorf("Partial download %s was left behind", entry.Name())
+		}
+	}
+}
+
+// TestDownloadMediaAbortsSlowDownloads tests that MAX_DOWNLOAD_DURATION aborts a download that keeps trickling in
+func TestDownloadMediaAbortsSlowDownloads(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+
+		// A byte at a time, never slow enough for a read timeout
+		for i := 0; i < 1000; i++ {
+			if _, err := w.Write([]byte{'x'}); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:      filepath.Join(testDir, "storage"),
+		LogDir:          filepath.Join(testDir, "logs"),
+		MaxDownloadTime: 1,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	start := time.Now()
+	_, err = mediaStore.DownloadMedia(context.Background(), "12345", "image", server.URL, nil)
+	if !errors.Is(err, media.ErrDownloadTimeout) {
+		t.Fatalf("Expected ErrDownloadTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the download to be aborted after about a second, took %s", elapsed)
+	}
+
+	if stats := mediaStore.GetStats(); stats.TimedOutCount != 1 {
+		t.Errorf("Expected 1 timed out download in the stats, got %d", stats.TimedOutCount)
+	}
+
+	// Nothing is left behind
+	matches, _ := filepath.Glob(filepath.Join(cfg.StorageDir, "*", "*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected the partial download to be removed, found %v", matches)
+	}
+}
+
+// TestDownloadMediaUsesContentDispositionName tests that downloads are named after the file name the server suggests
+func TestDownloadMediaUsesContentDispositionName(t *testing.T) {
+	disposition := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		if disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		w.Write([]byte("pdf content"))
+	}))
+	defer server.Close()
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		DispositionNames: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	tests := []struct {
+		name        string
+		disposition string
+		enabled     bool
+		expected    string
+	}{
+		{"quoted filename", `attachment; filename="Quarterly Report.pdf"`, true, `^file_Quarterly Report_[0-9a-f]{8}\.pdf$`},
+		{"RFC 5987 filename", `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, true, `^file_résumé_[0-9a-f]{8}\.pdf$`},
+		{"missing header", "", true, `^file_\d+_[0-9a-f]{16}\.pdf$`},
+		{"malformed header", `attachment; filename="broken`, true, `^file_\d+_[0-9a-f]{16}\.pdf$`},
+		{"disabled", `attachment; filename="report.pdf"`, false, `^file_\d+_[0-9a-f]{16}\.pdf$`},
+	}
+
+	for _, tt := range tests {
+		disposition = tt.disposition
+		cfg.DispositionNames = tt.enabled
+
+		filePath, err := mediaStore.DownloadMedia(context.Background(), "12345", "file", server.URL, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to download media: %v", tt.name, err)
+		}
+		if name := filepath.Base(filePath); !regexp.MustCompile(tt.expected).MatchString(name) {
+			t.Errorf("%s: expected the file name to match %s, got %q", tt.name, tt.expected, name)
+		}
+		if data, err := os.ReadFile(filePath); err != nil || string(data) != "pdf content" {
+			t.Errorf("%s: expected the downloaded content, got %q (%v)", tt.name, data, err)
+		}
+	}
+}
+
+// TestDownloadMediaBandwidthLimit tests that DOWNLOAD_MAX_BYTES_PER_SEC caps the combined rate of concurrent downloads
+func TestDownloadMediaBandwidthLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 40*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	const limit = 100 * 1024
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:             filepath.Join(testDir, "storage"),
+		LogDir:                 filepath.Join(testDir, "logs"),
+		DownloadMaxBytesPerSec: limit,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(messageID string) {
+			defer wg.Done()
+			filePath, err := mediaStore.DownloadMedia(context.Background(), messageID, "image", server.URL, nil)
+			if err != nil {
+				t.Errorf("Failed to download media: %v", err)
+				return
+			}
+			if info, err := os.Stat(filePath); err != nil || info.Size() != int64(len(content)) {
+				t.Errorf("Expected %d bytes to be saved to %s: %v", len(content), filePath, err)
+			}
+		}(fmt.Sprintf("message-%d", i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// 80KB at 100KB/s takes about 0.8s; allow a little for timer granularity
+	if rate := float64(2*len(content)) / elapsed.Seconds(); rate > limit*1.05 {
+		t.Errorf("Expected downloads to stay under %d bytes/s combined, got %.0f bytes/s over %s", limit, rate, elapsed)
+	}
+}
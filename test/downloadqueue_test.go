@@ -0,0 +1,237 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestDownloadQueueSurvivesRestart tests that downloads still queued when the service stops are resumed by the next one,
+// without their credentials being written to disk and without repeating finished downloads
+func TestDownloadQueueSurvivesRestart(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string][]string) // Authorization headers received per message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		messageID := strings.TrimPrefix(r.URL.Path, "/")
+		requests[messageID] = append(requests[messageID], r.Header.Get("Authorization"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image bytes"))
+	}))
+	defer server.Close()
+
+	received := func(messageID string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[messageID]
+	}
+
+	// The channel token is only sent again to the LINE content API
+	t.Setenv("LINE_CONTENT_ENDPOINT", server.URL)
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		ChannelToken:     testChannelToken,
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		PersistDownloads: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	headers := map[string]string{"Authorization": "Bearer " + testChannelToken}
+
+	// A download that completes before the restart
+	mediaStore := media.NewMediaStore(cfg, logger)
+	mediaStore.AddToDownloadQueue(context.Background(), "finished", "image", server.URL+"/finished", headers)
+	mediaStore.WaitForDownloads()
+
+	// A download still waiting when the service stops, queued twice
+	sent := time.Date(2024, 3, 15, 10, 0, 0, 0, time.Local)
+	ctx, cancel := context.WithCancel(media.WithEventSource(context.Background(), media.EventSource{Type: "user", ID: "U123", Timestamp: sent}))
+	mediaStore.Pause()
+	mediaStore.AddToDownloadQueue(ctx, "pending", "image", server.URL+"/pending", headers)
+	mediaStore.AddToDownloadQueue(ctx, "pending", "image", server.URL+"/pending", headers)
+	if depth := mediaStore.QueueStats().DownloadQueueDepth; depth != 1 {
+		t.Errorf("Expected a message queued twice to be queued once, got %d queued downloads", depth)
+	}
+	cancel()
+	mediaStore.WaitForDownloads()
+
+	if got := received("pending"); len(got) != 0 {
+		t.Fatalf("Expected no download while paused, got %d requests", len(got))
+	}
+
+	// Credentials are never persisted
+	data, err := os.ReadFile(filepath.Join(cfg.StorageDir, ".download_queue.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to read the download queue: %v", err)
+	}
+	if strings.Contains(string(data), testChannelToken) {
+		t.Errorf("Expected the download queue not to contain the channel token, got %s", data)
+	}
+
+	// The next start resumes the pending download with the channel token, dated when the message was sent
+	restarted := media.NewMediaStore(cfg, logger)
+	restarted.WaitForDownloads()
+
+	if got := received("pending"); len(got) != 1 || got[0] != "Bearer "+testChannelToken {
+		t.Errorf("Expected the pending download to be resumed with the channel token, got %q", got)
+	}
+	if got := received("finished"); len(got) != 1 {
+		t.Errorf("Expected the finished download not to be repeated, got %d requests", len(got))
+	}
+	matches, _ := filepath.Glob(filepath.Join(cfg.StorageDir, utils.FormatDate(sent), "image_*.jpg"))
+	if len(matches) != 1 {
+		t.Errorf("Expected the resumed download to be saved in the folder of the day it was sent, got %v", matches)
+	}
+	if sources := restarted.SourceStats(); len(sources) != 1 || sources[0].SourceID != "U123" {
+		t.Errorf("Expected the resumed download to be counted for its source, got %+v", sources)
+	}
+
+	// Once done, nothing is resumed again
+	media.NewMediaStore(cfg, logger).WaitForDownloads()
+	if got := received("pending"); len(got) != 1 {
+		t.Errorf("Expected the resumed download not to be repeated, got %d requests", len(got))
+	}
+}
+
+// newDownloadQueueStore returns a config persisting downloads, with a logger
+func newDownloadQueueStore(t *testing.T) (*config.Config, *utils.Logger) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		ChannelToken:     testChannelToken,
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		PersistDownloads: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+	return cfg, logger
+}
+
+// TestDownloadQueueKeepsChannelTokenOnLINE tests that a resumed download only gets the channel token back
+// when it is fetched from the LINE content API
+func TestDownloadQueueKeepsChannelTokenOnLINE(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]string) // Authorization header received per message
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[strings.TrimPrefix(r.URL.Path, "/")] = r.Header.Get("Authorization")
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image bytes"))
+	})
+	lineServer := httptest.NewServer(handler)
+	defer lineServer.Close()
+	otherServer := httptest.NewServer(handler)
+	defer otherServer.Close()
+	t.Setenv("LINE_CONTENT_ENDPOINT", lineServer.URL)
+
+	cfg, logger := newDownloadQueueStore(t)
+
+	// Queue downloads while paused, so they are still pending at the restart
+	mediaStore := media.NewMediaStore(cfg, logger)
+	mediaStore.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	channelAuth := map[string]string{"Authorization": "Bearer " + testChannelToken}
+	mediaStore.AddToDownloadQueue(ctx, "line", "image", lineServer.URL+"/line", channelAuth)
+	mediaStore.AddToDownloadQueue(ctx, "other", "image", otherServer.URL+"/other", channelAuth)
+	mediaStore.AddToDownloadQueue(ctx, "provider", "image", lineServer.URL+"/provider", map[string]string{"Authorization": "Bearer provider-token"})
+	cancel()
+	mediaStore.WaitForDownloads()
+
+	media.NewMediaStore(cfg, logger).WaitForDownloads()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]string{
+		"line":     "Bearer " + testChannelToken,
+		"other":    "",
+		"provider": "",
+	}
+	for messageID, auth := range expected {
+		got, ok := received[messageID]
+		if !ok {
+			t.Errorf("Expected the download of %s to be resumed", messageID)
+		} else if got != auth {
+			t.Errorf("Expected the download of %s to be resumed with Authorization %q, got %q", messageID, auth, got)
+		}
+	}
+}
+
+// TestDownloadQueueSkipsSavedDownloads tests that a download saved just before a restart, but not marked done,
+// isn't downloaded again
+func TestDownloadQueueSkipsSavedDownloads(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image bytes"))
+	}))
+	defer server.Close()
+
+	cfg, logger := newDownloadQueueStore(t)
+
+	// A queue file as left by a crash after the file got its final name
+	savedPath := filepath.Join(cfg.StorageDir, "2024-03-15", "image_saved.jpg")
+	if err := os.MkdirAll(filepath.Dir(savedPath), 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+	if err := os.WriteFile(savedPath, []byte("image bytes"), 0644); err != nil {
+		t.Fatalf("Failed to write saved file: %v", err)
+	}
+	var lines []string
+	for _, entry := range []interface{}{
+		map[string]interface{}{"queued": map[string]interface{}{"messageId": "saved", "messageType": "image", "contentUrl": server.URL + "/saved"}},
+		map[string]interface{}{"saving": "saved", "path": savedPath},
+	} {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatalf("Failed to encode queue entry: %v", err)
+		}
+		lines = append(lines, string(line))
+	}
+	queuePath := filepath.Join(cfg.StorageDir, ".download_queue.jsonl")
+	if err := os.WriteFile(queuePath, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write download queue: %v", err)
+	}
+
+	media.NewMediaStore(cfg, logger).WaitForDownloads()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 0 {
+		t.Errorf("Expected the saved download not to be repeated, got %d requests", requests)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(savedPath), "image_*"))
+	if len(matches) != 1 {
+		t.Errorf("Expected only the saved file, got %v", matches)
+	}
+}
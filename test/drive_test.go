@@ -0,0 +1,1169 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/cloud/common"
+	"code.olipicus.com/line_file_catcher/internal/cloud/drive"
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// mockDriveFolder represents a folder created on the mock Drive server
+type mockDriveFolder struct {
+	ID       string
+	Name     string
+	ParentID string
+}
+
+// mockDriveUpload represents a file uploaded to the mock Drive server
+type mockDriveUpload struct {
+	ID            string
+	Name          string
+	Parents       []string
+	AppProperties map[string]string
+	Content       []byte
+	MimeType      string
+}
+
+// mockDriveServer creates a mock Google Drive API server for testing
+type mockDriveServer struct {
+	server      *httptest.Server
+	folders     []mockDriveFolder
+	uploads     []mockDriveUpload
+	listCalls   int
+	createCalls int
+	shareCalls  int           // Files shared with permissions.create
+	createDelay time.Duration // Simulated latency of folder creation
+	uploadDelay time.Duration // Simulated latency of file uploads
+	uploadBlock chan struct{} // If set, uploads wait until it is closed or the client gives up
+	failUploads int           // Number of upcoming uploads to reject
+	inFlight    int           // Uploads being handled
+	peakUploads int           // Most uploads handled at once
+	nextID      int
+	mu          sync.Mutex
+}
+
+// newMockDriveServer creates a new mock Google Drive API server
+func newMockDriveServer() *mockDriveServer {
+	mock := &mockDriveServer{}
+
+	mock.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Mock Drive server received request: %s %s\n", r.Method, r.URL.Path)
+
+		switch {
+		// files.list is used to search for existing folders and files
+		case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files":
+			mock.handleList(w, r)
+
+		// files.create without media is used to create folders
+		case r.Method == http.MethodPost && r.URL.Path == "/drive/v3/files":
+			mock.handleCreateFolder(w, r)
+
+		// files.create with media is used to upload files
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/drive/v3/files":
+			mock.handleUpload(w, r)
+
+		// permissions.create is used to share files
+		case r.Method == http.MethodPost && regexp.MustCompile(`^/drive/v3/files/[^/]+/permissions$`).MatchString(r.URL.Path):
+			mock.mu.Lock()
+			mock.shareCalls++
+			mock.mu.Unlock()
+			mock.writeJSON(w, map[string]interface{}{"id": "permission", "type": "anyone", "role": "reader"})
+
+		// files.get is used to look up file info
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/drive/v3/files/"):
+			fileID := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+			mock.writeJSON(w, map[string]interface{}{"id": fileID, "name": fileID})
+
+		default:
+			fmt.Printf("Unhandled Drive request path: %s\n", r.URL.Path)
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}))
+
+	return mock
+}
+
+// handleList handles folder and file search requests
+func (m *mockDriveServer) handleList(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.listCalls++
+
+	// Extract the name and parent from the query
+	query := r.URL.Query().Get("q")
+	matches := regexp.MustCompile(`name='([^']*)'.*'([^']*)' in parents`).FindStringSubmatch(query)
+
+	files := make([]map[string]interface{}, 0)
+	if len(matches) == 3 && strings.Contains(query, "mimeType='application/vnd.google-apps.folder'") {
+		for _, folder := range m.folders {
+			if folder.Name == matches[1] && folder.ParentID == matches[2] {
+				files = append(files, map[string]interface{}{"id": folder.ID, "name": folder.Name})
+			}
+		}
+	} else if len(matches) == 3 {
+		for _, upload := range m.uploads {
+			if upload.Name == matches[1] && len(upload.Parents) > 0 && upload.Parents[0] == matches[2] {
+				checksum := md5.Sum(upload.Content)
+				files = append(files, map[string]interface{}{
+					"id":          upload.ID,
+					"name":        upload.Name,
+					"md5Checksum": hex.EncodeToString(checksum[:]),
+				})
+			}
+		}
+	}
+
+	m.writeJSON(w, map[string]interface{}{"files": files})
+}
+
+// handleCreateFolder handles folder creation requests
+func (m *mockDriveServer) handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	var metadata struct {
+		Name     string   `json:"name"`
+		MimeType string   `json:"mimeType"`
+		Parents  []string `json:"parents"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Simulate a slow API so concurrent requests overlap
+	time.Sleep(m.createDelay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.createCalls++
+	m.nextID++
+
+	folder := mockDriveFolder{
+		ID:   fmt.Sprintf("folder_%d", m.nextID),
+		Name: metadata.Name,
+	}
+	if len(metadata.Parents) > 0 {
+		folder.ParentID = metadata.Parents[0]
+	}
+	m.folders = append(m.folders, folder)
+
+	m.writeJSON(w, map[string]interface{}{"id": folder.ID})
+}
+
+// handleUpload handles multipart file upload requests
+func (m *mockDriveServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.inFlight++
+	m.peakUploads = max(m.peakUploads, m.inFlight)
+	block := m.uploadBlock
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+	}()
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		http.Error(w, "Expected multipart upload", http.StatusBadRequest)
+		return
+	}
+
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	// The first part holds the file metadata
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		http.Error(w, "Missing metadata part", http.StatusBadRequest)
+		return
+	}
+
+	var metadata struct {
+		Name          string            `json:"name"`
+		Parents       []string          `json:"parents"`
+		AppProperties map[string]string `json:"appProperties"`
+	}
+	if err := json.NewDecoder(metadataPart).Decode(&metadata); err != nil {
+		http.Error(w, "Invalid metadata", http.StatusBadRequest)
+		return
+	}
+
+	// The second part holds the file content
+	contentPart, err := reader.NextPart()
+	if err != nil {
+		http.Error(w, "Missing content part", http.StatusBadRequest)
+		return
+	}
+
+	content, err := io.ReadAll(contentPart)
+	if err != nil {
+		http.Error(w, "Failed to read content", http.StatusBadRequest)
+		return
+	}
+
+	// Simulate a slow API so concurrent uploads overlap
+	time.Sleep(m.uploadDelay)
+	if block != nil {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Rejected with a status the client doesn't retry on its own
+	if m.failUploads > 0 {
+		m.failUploads--
+		http.Error(w, "Simulated failure", http.StatusBadRequest)
+		return
+	}
+
+	m.nextID++
+	upload := mockDriveUpload{
+		ID:            fmt.Sprintf("file_%d", m.nextID),
+		Name:          metadata.Name,
+		Parents:       metadata.Parents,
+		AppProperties: metadata.AppProperties,
+		Content:       content,
+		MimeType:      contentPart.Header.Get("Content-Type"),
+	}
+	m.uploads = append(m.uploads, upload)
+
+	m.writeJSON(w, map[string]interface{}{
+		"id":   upload.ID,
+		"name": upload.Name,
+		"size": fmt.Sprintf("%d", len(content)),
+	})
+}
+
+// writeJSON writes a JSON response
+func (m *mockDriveServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+// close closes the mock server
+func (m *mockDriveServer) close() {
+	m.server.Close()
+}
+
+// getEndpointURL returns the Drive API base URL for the mock server
+func (m *mockDriveServer) getEndpointURL() string {
+	return m.server.URL + "/drive/v3/"
+}
+
+// writeDriveCredentials writes fake OAuth credentials and a non-expiring token for the mock server
+func writeDriveCredentials(t *testing.T, dir string) (string, string) {
+	credentialsPath := filepath.Join(dir, "credentials.json")
+	credentials := `{"installed":{"client_id":"test_client_id","client_secret":"test_client_secret",` +
+		`"auth_uri":"http://localhost/auth","token_uri":"http://localhost/token","redirect_uris":["http://localhost"]}}`
+	if err := os.WriteFile(credentialsPath, []byte(credentials), 0600); err != nil {
+		t.Fatalf("Failed to write credentials file: %v", err)
+	}
+
+	tokenPath := filepath.Join(dir, "token.json")
+	token := `{"access_token":"test_access_token","token_type":"Bearer","expiry":"2099-01-01T00:00:00Z"}`
+	if err := os.WriteFile(tokenPath, []byte(token), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	return credentialsPath, tokenPath
+}
+
+// setupDrive sets up a media store backed by the mock Drive server
+func setupDrive(t *testing.T) (*mockDriveServer, *config.Config, *media.MediaStore, func()) {
+	// Create a mock Drive server
+	mockDrive := newMockDriveServer()
+
+	testDir := t.TempDir()
+	credentialsPath, tokenPath := writeDriveCredentials(t, testDir)
+
+	// Create a test config with Drive enabled
+	cfg := &config.Config{
+		ChannelSecret:    testChannelSecret,
+		ChannelToken:     testChannelToken,
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		Debug:            true,
+		Port:             "8080",
+		DriveEnabled:     true,
+		DriveCredentials: credentialsPath,
+		DriveTokenFile:   tokenPath,
+		DriveFolder:      "LineFileCatcher",
+		DriveRetryCount:  0,
+		DriveAPIEndpoint: mockDrive.getEndpointURL(),
+	}
+
+	// Create a logger
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	// Create a media store
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// Return a cleanup function
+	cleanup := func() {
+		mockDrive.close()
+		logger.Close()
+	}
+
+	return mockDrive, cfg, mediaStore, cleanup
+}
+
+// TestDriveUploadAfterSave tests that saved media is uploaded to Google Drive
+func TestDriveUploadAfterSave(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockDrive, cfg, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+
+	if !mediaStore.GetCloudStats().Enabled {
+		t.Fatalf("Expected cloud storage to be enabled")
+	}
+
+	// Read the sample image file
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	// Save two files so the second upload can reuse the cached folders
+	savedPaths := make([]string, 0, 2)
+	for _, messageID := range []string{"image1", "image2"} {
+		content := &linebot.MessageContentResponse{
+			Content:       io.NopCloser(bytes.NewReader(imageContent)),
+			ContentType:   "image/jpeg",
+			ContentLength: int64(len(imageContent)),
+		}
+
+		filePath, err := mediaStore.SaveMedia(context.Background(), messageID, "image", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		savedPaths = append(savedPaths, filePath)
+
+		// Wait for the upload to finish
+		mediaStore.WaitForUploads()
+	}
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	// Verify that both files were uploaded with their content
+	if len(mockDrive.uploads) != len(savedPaths) {
+		t.Fatalf("Expected %d uploads, got %d", len(savedPaths), len(mockDrive.uploads))
+	}
+	for i, upload := range mockDrive.uploads {
+		if upload.Name != filepath.Base(savedPaths[i]) {
+			t.Errorf("Expected uploaded file name %s, got %s", filepath.Base(savedPaths[i]), upload.Name)
+		}
+		if !bytes.Equal(upload.Content, imageContent) {
+			t.Errorf("Uploaded content for %s does not match the saved file", upload.Name)
+		}
+	}
+
+	// Verify that the root and date folders were created exactly once
+	if mockDrive.createCalls != 2 {
+		t.Errorf("Expected 2 folder creations, got %d", mockDrive.createCalls)
+	}
+	if len(mockDrive.folders) == 2 {
+		root, date := mockDrive.folders[0], mockDrive.folders[1]
+		if root.Name != cfg.DriveFolder || root.ParentID != "root" {
+			t.Errorf("Expected root folder %s under root, got %s under %s", cfg.DriveFolder, root.Name, root.ParentID)
+		}
+		if date.Name != utils.GetDateString() || date.ParentID != root.ID {
+			t.Errorf("Expected date folder %s under %s, got %s under %s", utils.GetDateString(), root.ID, date.Name, date.ParentID)
+		}
+		for _, upload := range mockDrive.uploads {
+			if len(upload.Parents) != 1 || upload.Parents[0] != date.ID {
+				t.Errorf("Expected %s to be uploaded into %s, got %v", upload.Name, date.ID, upload.Parents)
+			}
+		}
+	}
+
+	// Verify that the folders were cached instead of searched again
+	if mockDrive.listCalls != 2 {
+		t.Errorf("Expected 2 folder searches, got %d", mockDrive.listCalls)
+	}
+
+	// Verify that the backup statistics reflect the uploads
+	stats := mediaStore.GetCloudStats()
+	if stats.UploadCount != len(savedPaths) {
+		t.Errorf("Expected uploadCount %d, got %d", len(savedPaths), stats.UploadCount)
+	}
+	if stats.TotalUploaded != int64(len(imageContent)*len(savedPaths)) {
+		t.Errorf("Expected totalUploaded %d, got %d", len(imageContent)*len(savedPaths), stats.TotalUploaded)
+	}
+	if stats.FolderCreatedCount != 2 {
+		t.Errorf("Expected folderCreatedCount 2, got %d", stats.FolderCreatedCount)
+	}
+	if stats.FailedUploads != 0 {
+		t.Errorf("Expected no failed uploads, got %d", stats.FailedUploads)
+	}
+}
+
+// TestDriveUploadSetsAppProperties tests that uploaded files are tagged with the message and sender they came from
+func TestDriveUploadSetsAppProperties(t *testing.T) {
+	// Set up the test environment
+	mockDrive, _, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+
+	ctx := media.WithUserID(context.Background(), "U123")
+	ctx = media.WithEventSource(ctx, media.EventSource{Type: "group", ID: "G456", Timestamp: time.Now()})
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(strings.NewReader("image content")),
+		ContentType: "image/jpeg",
+	}
+	if _, err := mediaStore.SaveMedia(ctx, "message789", "image", content); err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	mediaStore.WaitForUploads()
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	if len(mockDrive.uploads) != 1 {
+		t.Fatalf("Expected 1 upload, got %d", len(mockDrive.uploads))
+	}
+	expected := map[string]string{
+		common.PropertyMessageID:  "message789",
+		common.PropertyUserID:     "U123",
+		common.PropertySourceType: "group",
+		common.PropertySourceID:   "G456",
+	}
+	properties := mockDrive.uploads[0].AppProperties
+	if len(properties) != len(expected) {
+		t.Errorf("Expected app properties %v, got %v", expected, properties)
+	}
+	for key, value := range expected {
+		if properties[key] != value {
+			t.Errorf("Expected app property %s to be %q, got %q", key, value, properties[key])
+		}
+	}
+}
+
+// TestDriveUploadWithFolderTemplate tests that uploads follow the cloud folder template
+// and that the expanded folders are cached
+func TestDriveUploadWithFolderTemplate(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockDrive, cfg, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+
+	cfg.CloudFolderTemplate = "{year}/{month}/{user}/{type}"
+
+	// Read the sample image file
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	// Save two files from the same user so the second upload can reuse the cached folders
+	ctx := media.WithUserID(context.Background(), "U1234")
+	for _, messageID := range []string{"image1", "image2"} {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(bytes.NewReader(imageContent)),
+			ContentType: "image/jpeg",
+		}
+
+		if _, err := mediaStore.SaveMedia(ctx, messageID, "image", content); err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+
+		// Wait for the upload to finish
+		mediaStore.WaitForUploads()
+	}
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	// Verify that each level of the expanded path was created once, nested under the previous one
+	now := time.Now()
+	expected := []string{cfg.DriveFolder, now.Format("2006"), now.Format("01"), "U1234", "image"}
+	if len(mockDrive.folders) != len(expected) {
+		t.Fatalf("Expected %d folders, got %d: %+v", len(expected), len(mockDrive.folders), mockDrive.folders)
+	}
+
+	parentID := "root"
+	for i, folder := range mockDrive.folders {
+		if folder.Name != expected[i] || folder.ParentID != parentID {
+			t.Errorf("Expected folder %s under %s, got %s under %s", expected[i], parentID, folder.Name, folder.ParentID)
+		}
+		parentID = folder.ID
+	}
+
+	// Verify that both files were uploaded into the innermost folder
+	if len(mockDrive.uploads) != 2 {
+		t.Fatalf("Expected 2 uploads, got %d", len(mockDrive.uploads))
+	}
+	for _, upload := range mockDrive.uploads {
+		if len(upload.Parents) != 1 || upload.Parents[0] != parentID {
+			t.Errorf("Expected %s to be uploaded into %s, got %v", upload.Name, parentID, upload.Parents)
+		}
+	}
+
+	// Verify that the folders were only searched for once
+	if mockDrive.listCalls != len(expected) {
+		t.Errorf("Expected %d folder searches, got %d", len(expected), mockDrive.listCalls)
+	}
+}
+
+// TestDriveUploadWithTypeSubfolder tests that the media type subfolder is used locally and mirrored in Drive
+func TestDriveUploadWithTypeSubfolder(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockDrive, cfg, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+
+	cfg.SubfolderByType = true
+
+	// Read the sample image file
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(imageContent)),
+		ContentType: "image/jpeg",
+	}
+
+	filePath, err := mediaStore.SaveMedia(context.Background(), "image1", "image", content)
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+
+	// Wait for the upload to finish
+	mediaStore.WaitForUploads()
+
+	// Verify the local file is in the type subfolder of the date folder
+	dateStr := utils.GetDateString()
+	if dir := filepath.Dir(filePath); dir != filepath.Join(cfg.StorageDir, dateStr, "images") {
+		t.Errorf("Expected file in the images subfolder, got %s", dir)
+	}
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	// Verify the same subfolder was created under the date folder in Drive
+	expected := []string{cfg.DriveFolder, dateStr, "images"}
+	if len(mockDrive.folders) != len(expected) {
+		t.Fatalf("Expected %d folders, got %d: %+v", len(expected), len(mockDrive.folders), mockDrive.folders)
+	}
+	for i, folder := range mockDrive.folders {
+		if folder.Name != expected[i] {
+			t.Errorf("Expected folder %s, got %s", expected[i], folder.Name)
+		}
+	}
+}
+
+// TestDriveConcurrentFolderCreation tests that concurrent requests for the same folders
+// create each folder exactly once
+func TestDriveConcurrentFolderCreation(t *testing.T) {
+	// Set up the test environment
+	mockDrive, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	mockDrive.mu.Lock()
+	mockDrive.createDelay = 20 * time.Millisecond
+	mockDrive.mu.Unlock()
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	// Use a fresh service so its folder cache is empty
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	// Many goroutines request overlapping paths at the same time
+	paths := []string{
+		"LineFileCatcher/2025/01/01",
+		"LineFileCatcher/2025/01/02",
+		"LineFileCatcher/2025/01",
+		"LineFileCatcher/2025/02/01",
+	}
+
+	const goroutines = 50
+	ids := make([]string, goroutines)
+	errs := make([]error, goroutines)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			ids[i], errs[i] = driveService.CreateFolder(context.Background(), paths[i%len(paths)])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	// Every request for the same path must get the same folder
+	idsByPath := make(map[string]string)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("CreateFolder failed: %v", err)
+		}
+		path := paths[i%len(paths)]
+		if id, ok := idsByPath[path]; ok && id != ids[i] {
+			t.Errorf("Expected a single folder ID for %s, got %s and %s", path, id, ids[i])
+		}
+		idsByPath[path] = ids[i]
+	}
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	// No folder may exist twice under the same parent
+	seen := make(map[string]bool)
+	for _, folder := range mockDrive.folders {
+		key := folder.ParentID + "/" + folder.Name
+		if seen[key] {
+			t.Errorf("Folder %s was created more than once under %s", folder.Name, folder.ParentID)
+		}
+		seen[key] = true
+	}
+
+	// LineFileCatcher, 2025, 01, 01, 02, 02 and 01 under 02
+	if len(mockDrive.folders) != 7 {
+		t.Errorf("Expected 7 folders, got %d", len(mockDrive.folders))
+	}
+}
+
+// TestDriveConcurrentUploadsAndStats tests that statistics can be read while uploads are in progress
+// and that the totals and average upload time add up afterwards; run with -race to check for data races
+func TestDriveConcurrentUploadsAndStats(t *testing.T) {
+	// Set up the test environment
+	_, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	// Files of different sizes to upload at once
+	const uploads = 20
+	var totalSize int64
+	files := make([]string, uploads)
+	for i := range files {
+		files[i] = filepath.Join(cfg.StorageDir, fmt.Sprintf("file_%d.bin", i))
+		content := bytes.Repeat([]byte("x"), 100+i)
+		totalSize += int64(len(content))
+		if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+			t.Fatalf("Failed to create storage directory: %v", err)
+		}
+		if err := os.WriteFile(files[i], content, 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Keep reading the statistics until the uploads finish
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				driveService.GetBackupStats()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make([]error, uploads)
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			_, errs[i] = driveService.UploadFile(context.Background(), file, "LineFileCatcher/concurrent")
+		}(i, file)
+	}
+	wg.Wait()
+	close(done)
+	<-readerDone
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	stats := driveService.Stats()
+	if stats.UploadCount != uploads || stats.TotalUploaded != totalSize || stats.FailedUploads != 0 {
+		t.Errorf("Expected %d uploads of %d bytes, got %+v", uploads, totalSize, stats)
+	}
+	if stats.FirstTrySuccess != uploads || stats.RetriedSuccess != 0 {
+		t.Errorf("Expected all %d uploads to succeed on the first try, got %d first try and %d retried",
+			uploads, stats.FirstTrySuccess, stats.RetriedSuccess)
+	}
+	if backupStats := driveService.GetBackupStats(); backupStats.FirstTrySuccess != uploads {
+		t.Errorf("Expected the backup statistics to report %d first try successes, got %d", uploads, backupStats.FirstTrySuccess)
+	}
+	if stats.AverageUploadTime != stats.TotalUploadTime/uploads {
+		t.Errorf("Expected average upload time %v, got %v", stats.TotalUploadTime/uploads, stats.AverageUploadTime)
+	}
+}
+
+// writeDriveTestFiles writes count small files to upload into the storage directory
+func writeDriveTestFiles(t *testing.T, cfg *config.Config, count int) []string {
+	t.Helper()
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	files := make([]string, count)
+	for i := range files {
+		files[i] = filepath.Join(cfg.StorageDir, fmt.Sprintf("file_%d.bin", i))
+		if err := os.WriteFile(files[i], []byte(fmt.Sprintf("content %d", i)), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	return files
+}
+
+// TestDriveMaxConcurrentUploads tests that no more than DRIVE_MAX_CONCURRENT uploads are sent to Drive at once
+func TestDriveMaxConcurrentUploads(t *testing.T) {
+	mockDrive, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	mockDrive.mu.Lock()
+	mockDrive.uploadDelay = 50 * time.Millisecond
+	mockDrive.mu.Unlock()
+
+	cfg.DriveMaxConcurrent = 2
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	files := writeDriveTestFiles(t, cfg, 8)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(files))
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			_, errs[i] = driveService.UploadFile(context.Background(), file, "LineFileCatcher/limited")
+		}(i, file)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+
+	if len(mockDrive.uploads) != len(files) {
+		t.Errorf("Expected %d uploads, got %d", len(files), len(mockDrive.uploads))
+	}
+	if mockDrive.peakUploads != 2 {
+		t.Errorf("Expected at most 2 uploads at once, with the limit reached, got a peak of %d", mockDrive.peakUploads)
+	}
+}
+
+// TestDriveUploadSlotFreedOnFailure tests that failed and cancelled uploads, including those still
+// waiting for a slot, don't keep an upload slot from later uploads
+func TestDriveUploadSlotFreedOnFailure(t *testing.T) {
+	mockDrive, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	cfg.DriveMaxConcurrent = 1
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	files := writeDriveTestFiles(t, cfg, 4)
+	const folder = "LineFileCatcher/slots"
+
+	// uploadWithin uploads a file, failing the test instead of hanging if no slot becomes free
+	uploadWithin := func(file string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := driveService.UploadFile(ctx, file, folder)
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Upload of %s timed out waiting for a free slot", file)
+		}
+		return err
+	}
+
+	// A rejected upload releases its slot
+	mockDrive.mu.Lock()
+	mockDrive.failUploads = 1
+	mockDrive.mu.Unlock()
+
+	if err := uploadWithin(files[0]); err == nil {
+		t.Fatalf("Expected the rejected upload to fail")
+	}
+	if err := uploadWithin(files[0]); err != nil {
+		t.Fatalf("Expected the upload after a failure to succeed: %v", err)
+	}
+
+	// Hold the only slot with an upload the server doesn't answer
+	block := make(chan struct{})
+	mockDrive.mu.Lock()
+	mockDrive.uploadBlock = block
+	mockDrive.mu.Unlock()
+
+	heldCtx, cancelHeld := context.WithCancel(context.Background())
+	heldErr := make(chan error, 1)
+	go func() {
+		_, err := driveService.UploadFile(heldCtx, files[1], folder)
+		heldErr <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for driveService.GetBackupStats().ActiveUploads == nil || *driveService.GetBackupStats().ActiveUploads != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the upload to start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// An upload waiting for the slot gives up when its context is cancelled
+	waitingCtx, cancelWaiting := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelWaiting()
+	if _, err := driveService.UploadFile(waitingCtx, files[2], folder); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the waiting upload to stop at its deadline, got %v", err)
+	}
+
+	// Cancelling the upload in progress releases its slot
+	cancelHeld()
+	if err := <-heldErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the held upload to be cancelled, got %v", err)
+	}
+
+	close(block)
+	if err := uploadWithin(files[3]); err != nil {
+		t.Fatalf("Expected the upload after a cancellation to succeed: %v", err)
+	}
+
+	if active := *driveService.GetBackupStats().ActiveUploads; active != 0 {
+		t.Errorf("Expected no active uploads, got %d", active)
+	}
+}
+
+// TestDriveSkipsDuplicateUploads tests that a file already in the folder with the same name and content
+// is not uploaded again, while changed content or a disabled check still uploads
+func TestDriveSkipsDuplicateUploads(t *testing.T) {
+	// Set up the test environment
+	mockDrive, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	cfg.DriveSkipDuplicates = true
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	filePath := filepath.Join(cfg.StorageDir, "image_1.jpg")
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+	if err := os.WriteFile(filePath, []byte("original content"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	upload := func() string {
+		id, err := driveService.UploadFile(context.Background(), filePath, "LineFileCatcher/dedup")
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		return id
+	}
+	uploadCount := func() int {
+		mockDrive.mu.Lock()
+		defer mockDrive.mu.Unlock()
+		return len(mockDrive.uploads)
+	}
+
+	firstID := upload()
+	if secondID := upload(); secondID != firstID {
+		t.Errorf("Expected the existing file %s to be returned, got %s", firstID, secondID)
+	}
+	if count := uploadCount(); count != 1 {
+		t.Errorf("Expected 1 upload of an unchanged file, got %d", count)
+	}
+
+	stats := driveService.GetBackupStats()
+	if stats.SkippedDuplicates == nil || *stats.SkippedDuplicates != 1 || stats.UploadCount != 1 {
+		t.Errorf("Expected 1 upload and 1 skipped duplicate, got %+v", stats)
+	}
+
+	// The same name with different content is a different file
+	if err := os.WriteFile(filePath, []byte("changed content"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if id := upload(); id == firstID {
+		t.Error("Expected changed content to be uploaded as a new file")
+	}
+	if count := uploadCount(); count != 2 {
+		t.Errorf("Expected changed content to be uploaded, got %d uploads", count)
+	}
+
+	// Without the check, identical files are uploaded again
+	cfg.DriveSkipDuplicates = false
+	upload()
+	if count := uploadCount(); count != 3 {
+		t.Errorf("Expected an upload with duplicate checking disabled, got %d uploads", count)
+	}
+}
+
+// TestDriveCachesFileLinks tests that a file's link is shared once and reused until it expires from the cache
+func TestDriveCachesFileLinks(t *testing.T) {
+	// Set up the test environment
+	mockDrive, cfg, _, cleanup := setupDrive(t)
+	defer cleanup()
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	shareCalls := func() int {
+		mockDrive.mu.Lock()
+		defer mockDrive.mu.Unlock()
+		return mockDrive.shareCalls
+	}
+
+	tests := []struct {
+		name     string
+		size     int
+		seconds  int
+		expected int // Share calls for getting file1, file1 again, file2, then file1 once more
+	}{
+		{"cached", 10, 3600, 2},
+		{"evicted", 1, 3600, 3},
+		{"disabled", 10, 0, 4},
+	}
+
+	for _, tt := range tests {
+		cfg.DriveLinkCacheSize = tt.size
+		cfg.DriveLinkCacheSeconds = tt.seconds
+		driveService := drive.NewDriveService(cfg, logger)
+		if err := driveService.Initialize(); err != nil {
+			t.Fatalf("Failed to initialize Drive service: %v", err)
+		}
+
+		before := shareCalls()
+		for _, fileID := range []string{"file1", "file1", "file2", "file1"} {
+			link, err := driveService.GetFileLink(fileID)
+			if err != nil {
+				t.Fatalf("%s: failed to get link: %v", tt.name, err)
+			}
+			if expected := "https://drive.google.com/file/d/" + fileID + "/view"; link != expected {
+				t.Errorf("%s: expected link %s, got %s", tt.name, expected, link)
+			}
+		}
+
+		if calls := shareCalls() - before; calls != tt.expected {
+			t.Errorf("%s: expected %d share calls, got %d", tt.name, tt.expected, calls)
+		}
+	}
+
+	// A link is shared again once it expires
+	clock := utils.NewFakeClock(time.Now())
+	defer utils.SetClock(clock)()
+
+	cfg.DriveLinkCacheSize = 10
+	cfg.DriveLinkCacheSeconds = 60
+	driveService := drive.NewDriveService(cfg, logger)
+	if err := driveService.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize Drive service: %v", err)
+	}
+
+	before := shareCalls()
+	for _, wait := range []time.Duration{0, 59 * time.Second, 2 * time.Second} {
+		clock.Advance(wait)
+		if _, err := driveService.GetFileLink("file1"); err != nil {
+			t.Fatalf("Failed to get link: %v", err)
+		}
+	}
+	if calls := shareCalls() - before; calls != 2 {
+		t.Errorf("Expected the link to be shared again after 61 seconds, got %d share calls", calls)
+	}
+}
+
+// TestDriveStreamUploads tests that STREAM_UPLOADS uploads content while it is saved, and that a save that fails uploads nothing
+func TestDriveStreamUploads(t *testing.T) {
+	// Set up the test environment
+	mockDrive, cfg, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+	cfg.StreamUploads = true
+
+	content := []byte("streamed image content")
+	filePath, err := mediaStore.SaveMedia(context.Background(), "message1", "image", &linebot.MessageContentResponse{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentType:   "image/jpeg",
+		ContentLength: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+
+	// The upload has finished by the time the save returns, without going through the queue
+	if !mediaStore.IsUploaded(filePath) {
+		t.Errorf("Expected %s to be recorded as uploaded when the save returns", filePath)
+	}
+	mockDrive.mu.Lock()
+	if len(mockDrive.uploads) != 1 {
+		t.Fatalf("Expected 1 upload, got %d", len(mockDrive.uploads))
+	}
+	upload := mockDrive.uploads[0]
+	mockDrive.mu.Unlock()
+	if upload.Name != filepath.Base(filePath) {
+		t.Errorf("Expected uploaded file name %s, got %s", filepath.Base(filePath), upload.Name)
+	}
+	if !bytes.Equal(upload.Content, content) {
+		t.Errorf("Expected uploaded content %q, got %q", content, upload.Content)
+	}
+	if upload.AppProperties[common.PropertyMessageID] != "message1" {
+		t.Errorf("Expected the upload to be tagged with message1, got %v", upload.AppProperties)
+	}
+
+	// The local copy is kept too
+	stored, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("Expected the stored file to hold the content, got %q (%v)", stored, err)
+	}
+
+	// A callback registered after the save is still called
+	called := make(chan string, 1)
+	mediaStore.RegisterUploadCallback(filePath, func(ctx context.Context, filename, fileLink string) error {
+		called <- filename
+		return nil
+	})
+	select {
+	case filename := <-called:
+		if filename != filepath.Base(filePath) {
+			t.Errorf("Expected callback for %s, got %s", filepath.Base(filePath), filename)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the upload callback to be called")
+	}
+
+	// Content over the size limit is neither saved nor uploaded
+	cfg.MaxFileSizeBytes = 5
+	_, err = mediaStore.SaveMedia(context.Background(), "message2", "image", &linebot.MessageContentResponse{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentType:   "image/jpeg",
+		ContentLength: int64(len(content)),
+	})
+	if err == nil {
+		t.Fatal("Expected the oversized save to fail")
+	}
+	mediaStore.WaitForUploads()
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+	if len(mockDrive.uploads) != 1 {
+		t.Errorf("Expected the aborted stream not to be uploaded, got %d uploads", len(mockDrive.uploads))
+	}
+}
+
+// TestDriveStreamUploadsQuotaReject tests that a streamed file refused by the storage quota isn't left in cloud storage
+func TestDriveStreamUploadsQuotaReject(t *testing.T) {
+	// Set up the test environment
+	mockDrive, cfg, mediaStore, cleanup := setupDrive(t)
+	defer cleanup()
+	cfg.StreamUploads = true
+	cfg.MaxTotalStorageMB = 1
+	cfg.StorageQuotaPolicy = media.QuotaPolicyReject
+
+	content := make([]byte, 2<<20)
+	filePath, err := mediaStore.SaveMedia(context.Background(), "message1", "image", &linebot.MessageContentResponse{
+		Content:       io.NopCloser(bytes.NewReader(content)),
+		ContentType:   "image/jpeg",
+		ContentLength: int64(len(content)),
+	})
+	if !errors.Is(err, media.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v (saved to %q)", err, filePath)
+	}
+	mediaStore.WaitForUploads()
+
+	mockDrive.mu.Lock()
+	defer mockDrive.mu.Unlock()
+	if len(mockDrive.uploads) != 0 {
+		t.Errorf("Expected the refused file not to be uploaded, got %d uploads", len(mockDrive.uploads))
+	}
+	if stats := mediaStore.GetCloudStats(); stats.UploadCount != 0 {
+		t.Errorf("Expected no successful uploads, got %d", stats.UploadCount)
+	}
+}
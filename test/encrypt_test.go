@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// testEncryptionKey is a hex encoded 32-byte key
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// decryptFile decrypts a stored file with the key
+func decryptFile(t *testing.T, filePath string, key []byte) ([]byte, error) {
+	t.Helper()
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", filePath, err)
+	}
+	defer f.Close()
+
+	reader, err := media.NewDecryptReader(f, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// TestSaveMediaEncryptsAtRest tests that ENCRYPT_AT_REST stores files as .enc that decrypt to the original content
+func TestSaveMediaEncryptsAtRest(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:    filepath.Join(testDir, "storage"),
+		LogDir:        filepath.Join(testDir, "logs"),
+		EncryptAtRest: true,
+		EncryptionKey: testEncryptionKey,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	key, err := cfg.LoadEncryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+
+	// Several chunks, ending part way through one
+	content := make([]byte, 200<<10+123)
+	rand.Read(content)
+
+	filePath, err := mediaStore.SaveMedia(context.Background(), "file123", "file", &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(content)),
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	if !strings.HasSuffix(filePath, media.EncryptedExtension) {
+		t.Fatalf("Expected an encrypted file name, got %s", filePath)
+	}
+
+	stored, _ := os.ReadFile(filePath)
+	if bytes.Contains(stored, content[:64]) {
+		t.Errorf("Expected the stored file not to contain the plaintext")
+	}
+
+	decrypted, err := decryptFile(t, filePath, key)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Errorf("Decrypted content doesn't match: got %d bytes, want %d", len(decrypted), len(content))
+	}
+
+	// The wrong key is refused
+	wrongKey, _ := hex.DecodeString(strings.Repeat("ff", 32))
+	if _, err := decryptFile(t, filePath, wrongKey); !errors.Is(err, media.ErrDecryptFailed) {
+		t.Errorf("Expected ErrDecryptFailed with the wrong key, got %v", err)
+	}
+
+	// Truncating the file at a chunk boundary is detected
+	truncated := filepath.Join(testDir, "truncated.enc")
+	os.WriteFile(truncated, stored[:len(stored)-123-16], 0644)
+	if _, err := decryptFile(t, truncated, key); !errors.Is(err, media.ErrDecryptFailed) {
+		t.Errorf("Expected ErrDecryptFailed for a truncated file, got %v", err)
+	}
+}
+
+// TestEncryptEmptyContent tests that empty content round-trips
+func TestEncryptEmptyContent(t *testing.T) {
+	key, _ := hex.DecodeString(testEncryptionKey)
+
+	var buf bytes.Buffer
+	writer, err := media.NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("Failed to create encryptor: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close encryptor: %v", err)
+	}
+
+	reader, err := media.NewDecryptReader(&buf, key)
+	if err != nil {
+		t.Fatalf("Failed to create decryptor: %v", err)
+	}
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || len(decrypted) != 0 {
+		t.Errorf("Expected empty content, got %d bytes and %v", len(decrypted), err)
+	}
+}
@@ -0,0 +1,200 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// newErrorLogStore creates a media store keeping at most size recent errors
+func newErrorLogStore(t *testing.T, size int) (*config.Config, *utils.Logger, *media.MediaStore) {
+	t.Helper()
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:   filepath.Join(testDir, "storage"),
+		LogDir:       filepath.Join(testDir, "logs"),
+		AdminToken:   testAdminToken,
+		ErrorLogSize: size,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+
+	return cfg, logger, media.NewMediaStore(cfg, logger)
+}
+
+// recentMessages returns the messages of the recent errors, newest first
+func recentMessages(mediaStore *media.MediaStore) []string {
+	var messages []string
+	for _, event := range mediaStore.RecentErrors() {
+		messages = append(messages, event.Message)
+	}
+	return messages
+}
+
+// TestErrorLogWrapsAround tests that the error log keeps the newest ERROR_LOG_SIZE errors, newest first
+func TestErrorLogWrapsAround(t *testing.T) {
+	_, _, mediaStore := newErrorLogStore(t, 3)
+
+	if events := mediaStore.RecentErrors(); len(events) != 0 {
+		t.Fatalf("Expected no errors yet, got %v", events)
+	}
+
+	tests := []struct {
+		recorded int
+		expected []string
+	}{
+		{2, []string{"error 2", "error 1"}},
+		{3, []string{"error 3", "error 2", "error 1"}},
+		{4, []string{"error 4", "error 3", "error 2"}},
+		{6, []string{"error 6", "error 5", "error 4"}},
+		{8, []string{"error 8", "error 7", "error 6"}},
+	}
+
+	recorded := 0
+	for _, tt := range tests {
+		for ; recorded < tt.recorded; recorded++ {
+			mediaStore.RecordError("save", fmt.Errorf("error %d", recorded+1))
+		}
+
+		if messages := recentMessages(mediaStore); fmt.Sprint(messages) != fmt.Sprint(tt.expected) {
+			t.Errorf("After %d errors: expected %v, got %v", tt.recorded, tt.expected, messages)
+		}
+	}
+}
+
+// TestErrorLogDefaultSize tests that an ERROR_LOG_SIZE of zero keeps the default 100 errors
+func TestErrorLogDefaultSize(t *testing.T) {
+	_, _, mediaStore := newErrorLogStore(t, 0)
+
+	for i := 1; i <= 101; i++ {
+		mediaStore.RecordError("upload", fmt.Errorf("error %d", i))
+	}
+
+	messages := recentMessages(mediaStore)
+	if len(messages) != 100 {
+		t.Fatalf("Expected 100 errors, got %d", len(messages))
+	}
+	if messages[0] != "error 101" || messages[99] != "error 2" {
+		t.Errorf("Expected errors 101 to 2, got %s to %s", messages[0], messages[99])
+	}
+}
+
+// TestErrorsEndpoint tests that the errors endpoint requires the admin token and returns the recent errors as JSON
+func TestErrorsEndpoint(t *testing.T) {
+	cfg, logger, mediaStore := newErrorLogStore(t, 2)
+	errorsHandler := handler.NewErrorsHandler(cfg, logger, mediaStore)
+
+	rejected := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"POST request", http.MethodPost, testAdminToken, http.StatusMethodNotAllowed},
+		{"missing token", http.MethodGet, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "wrong_token", http.StatusUnauthorized},
+	}
+
+	for _, tc := range rejected {
+		req := httptest.NewRequest(tc.method, "/errors", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res := httptest.NewRecorder()
+
+		errorsHandler.HandleErrors(res, req)
+
+		if res.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, res.Code)
+		}
+	}
+
+	// getErrors fetches the errors endpoint as an admin and decodes the response
+	getErrors := func() map[string]json.RawMessage {
+		req := httptest.NewRequest(http.MethodGet, "/errors", nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		res := httptest.NewRecorder()
+
+		errorsHandler.HandleErrors(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, res.Code)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Expected a JSON response, got %q", contentType)
+		}
+
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return body
+	}
+
+	// With no errors the list is empty rather than null
+	if body := getErrors(); string(body["count"]) != "0" || string(body["errors"]) != "[]" {
+		t.Errorf("Expected no errors, got count %s and errors %s", body["count"], body["errors"])
+	}
+
+	mediaStore.RecordError("download", fmt.Errorf("message 1: timeout"))
+	mediaStore.RecordError("save", fmt.Errorf("message 2: disk full"))
+	mediaStore.RecordError("upload", fmt.Errorf("message 3: quota exceeded"))
+
+	body := getErrors()
+	if string(body["count"]) != "2" {
+		t.Errorf("Expected a count of 2, got %s", body["count"])
+	}
+
+	var events []map[string]string
+	if err := json.Unmarshal(body["errors"], &events); err != nil {
+		t.Fatalf("Failed to decode errors: %v", err)
+	}
+	expected := []struct{ operation, message string }{
+		{"upload", "message 3: quota exceeded"},
+		{"save", "message 2: disk full"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), events)
+	}
+	for i, event := range events {
+		if len(event) != 3 {
+			t.Errorf("Expected time, operation and message fields, got %v", event)
+		}
+		if event["operation"] != expected[i].operation || event["message"] != expected[i].message {
+			t.Errorf("Error %d: expected %s %q, got %s %q", i, expected[i].operation, expected[i].message, event["operation"], event["message"])
+		}
+		if recordedAt, err := time.Parse(time.RFC3339Nano, event["time"]); err != nil || time.Since(recordedAt) > time.Minute {
+			t.Errorf("Error %d: expected a recent RFC 3339 time, got %q", i, event["time"])
+		}
+	}
+}
+
+// TestErrorsEndpointWithoutAdminToken tests that the errors endpoint is disabled without an admin token
+func TestErrorsEndpointWithoutAdminToken(t *testing.T) {
+	cfg, logger, mediaStore := newErrorLogStore(t, 0)
+	cfg.AdminToken = ""
+	errorsHandler := handler.NewErrorsHandler(cfg, logger, mediaStore)
+
+	req := httptest.NewRequest(http.MethodGet, "/errors", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	res := httptest.NewRecorder()
+
+	errorsHandler.HandleErrors(res, req)
+
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, res.Code)
+	}
+}
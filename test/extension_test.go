@@ -0,0 +1,77 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestSaveMediaExtensionWithoutContentType tests how the extension is chosen when LINE sends no content type
+func TestSaveMediaExtensionWithoutContentType(t *testing.T) {
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	tests := []struct {
+		name      string
+		fileName  string
+		content   []byte
+		extension string
+	}{
+		{"known file name", "report.pdf", []byte{0x00, 0x01, 0x02, 0x03}, ".pdf"},
+		{"file name takes priority over sniffing", "Scan.PNG", []byte("plain text"), ".png"},
+		{"sniffable content", "", pngHeader, ".png"},
+		{"unsafe file name extension is ignored", "notes.t/xt", pngHeader, ".png"},
+		{"unknown binary", "", []byte{0x00, 0x01, 0x02, 0x03}, ".bin"},
+	}
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.fileName != "" {
+				ctx = media.WithFileName(ctx, tt.fileName)
+			}
+
+			content := &linebot.MessageContentResponse{
+				Content: io.NopCloser(bytes.NewReader(tt.content)),
+			}
+
+			filePath, err := mediaStore.SaveMedia(ctx, "file123", "file", content)
+			if err != nil {
+				t.Fatalf("Failed to save media: %v", err)
+			}
+			if got := filepath.Ext(filePath); got != tt.extension {
+				t.Errorf("Expected extension %s, got %s", tt.extension, got)
+			}
+
+			// Sniffing must not consume any of the content
+			saved, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("Failed to read saved file: %v", err)
+			}
+			if !bytes.Equal(saved, tt.content) {
+				t.Errorf("Expected saved content %q, got %q", tt.content, saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// savedMedia records a file the handler asked the fake media store to save
+type savedMedia struct {
+	MessageID   string
+	MessageType string
+	ContentType string
+	Content     []byte
+	Path        string
+}
+
+// fakeMediaStore is an in-memory implementation of handler.MediaSaver for testing
+// It records what was saved instead of writing to disk or uploading
+type fakeMediaStore struct {
+	mu        sync.Mutex
+	saved     []savedMedia
+	callbacks map[string]media.FileUploadCallback
+	errors    []string
+
+	// saveErr, if set, is returned by SaveMedia
+	saveErr error
+
+	// saveDelay simulates a slow save
+	saveDelay time.Duration
+
+	// paused is returned by Paused
+	paused atomic.Bool
+
+	// expired counts RecordExpired calls
+	expired atomic.Int64
+
+	// startTime is reported as the start of the statistics
+	startTime time.Time
+}
+
+// newFakeMediaStore creates an empty fake media store
+func newFakeMediaStore() *fakeMediaStore {
+	return &fakeMediaStore{
+		callbacks: make(map[string]media.FileUploadCallback),
+		startTime: time.Now(),
+	}
+}
+
+// SaveMedia records the content and returns a made-up path for it
+func (f *fakeMediaStore) SaveMedia(ctx context.Context, messageID, messageType string, content *linebot.MessageContentResponse) (string, error) {
+	data, err := io.ReadAll(content.Content)
+	content.Content.Close()
+	if err != nil {
+		return "", err
+	}
+
+	time.Sleep(f.saveDelay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.saveErr != nil {
+		return "", f.saveErr
+	}
+
+	filePath := path.Join("memory", fmt.Sprintf("%s_%s", messageType, messageID))
+	f.saved = append(f.saved, savedMedia{
+		MessageID:   messageID,
+		MessageType: messageType,
+		ContentType: content.ContentType,
+		Content:     data,
+		Path:        filePath,
+	})
+	return filePath, nil
+}
+
+// SaveImagePreview records the preview as saved media of type "preview"
+func (f *fakeMediaStore) SaveImagePreview(ctx context.Context, imagePath string, content *linebot.MessageContentResponse) (string, error) {
+	return f.SaveMedia(ctx, path.Base(imagePath), "preview", content)
+}
+
+// SaveVideoPreview records the preview as saved media of type "preview"
+func (f *fakeMediaStore) SaveVideoPreview(ctx context.Context, videoPath string, content *linebot.MessageContentResponse) (string, error) {
+	return f.SaveMedia(ctx, path.Base(videoPath), "preview", content)
+}
+
+// SaveVideoMetadata does nothing
+func (f *fakeMediaStore) SaveVideoMetadata(ctx context.Context, videoPath, messageID string, durationMs int, previewPath string) error {
+	return nil
+}
+
+// RegisterUploadCallback records the callback so a test can simulate the upload completing
+func (f *fakeMediaStore) RegisterUploadCallback(filePath string, callback media.FileUploadCallback) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.callbacks[filePath] = callback
+}
+
+// RecordError records the operation that failed
+func (f *fakeMediaStore) RecordError(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.errors = append(f.errors, operation)
+}
+
+// RecordExpired counts the expired message
+func (f *fakeMediaStore) RecordExpired() {
+	f.expired.Add(1)
+}
+
+// GetStats counts the saved media by type
+func (f *fakeMediaStore) GetStats() media.Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := media.Stats{StartTime: f.startTime}
+	for _, saved := range f.saved {
+		switch saved.MessageType {
+		case "image":
+			stats.ImageCount++
+		case "video":
+			stats.VideoCount++
+		case "audio":
+			stats.AudioCount++
+		case "file":
+			stats.FileCount++
+		default:
+			continue
+		}
+		stats.TotalBytes += int64(len(saved.Content))
+	}
+	return stats
+}
+
+// Paused reports the paused flag set by the test
+func (f *fakeMediaStore) Paused() bool {
+	return f.paused.Load()
+}
+
+// WaitForDownloads returns immediately, as the fake saves synchronously
+func (f *fakeMediaStore) WaitForDownloads() {}
+
+// savedFiles returns a copy of the saved media
+func (f *fakeMediaStore) savedFiles() []savedMedia {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]savedMedia(nil), f.saved...)
+}
+
+// recordedErrors returns the operations that recorded an error
+func (f *fakeMediaStore) recordedErrors() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.errors...)
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestSaveMediaFallbackStorage tests that saves use FALLBACK_STORAGE_DIR while the storage directory can't be written
+func TestSaveMediaFallbackStorage(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		FallbackStorageDir: filepath.Join(testDir, "fallback"),
+		LogDir:             filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	save := func() string {
+		t.Helper()
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(bytes.NewReader([]byte("image bytes"))),
+			ContentType: "image/jpeg",
+		}
+		filePath, err := mediaStore.SaveMedia(context.Background(), "image123", "image", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		return filePath
+	}
+
+	// A file where the storage directory should be makes it unwritable
+	if err := os.WriteFile(cfg.StorageDir, nil, 0644); err != nil {
+		t.Fatalf("Failed to block the storage directory: %v", err)
+	}
+
+	filePath := save()
+	if !strings.HasPrefix(filePath, cfg.FallbackStorageDir+string(filepath.Separator)) {
+		t.Errorf("Expected the file to be saved to the fallback directory, got %s", filePath)
+	}
+	if stats := mediaStore.GetStats(); stats.FallbackCount != 1 {
+		t.Errorf("Expected 1 fallback save in the stats, got %d", stats.FallbackCount)
+	}
+
+	// Once the storage directory is usable again it is preferred
+	if err := os.Remove(cfg.StorageDir); err != nil {
+		t.Fatalf("Failed to unblock the storage directory: %v", err)
+	}
+
+	filePath = save()
+	if !strings.HasPrefix(filePath, cfg.StorageDir+string(filepath.Separator)) {
+		t.Errorf("Expected the file to be saved to the storage directory, got %s", filePath)
+	}
+	if stats := mediaStore.GetStats(); stats.FallbackCount != 1 || stats.ImageCount != 2 {
+		t.Errorf("Expected 2 saved images and 1 fallback save, got %+v", stats)
+	}
+}
+
+// TestSaveMediaSpoolsContent tests that content is spooled before it is stored and the spool file is always removed
+func TestSaveMediaSpoolsContent(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		FallbackStorageDir: filepath.Join(testDir, "fallback"),
+		SpoolDir:           filepath.Join(testDir, "spool"),
+		LogDir:             filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	save := func() (string, error) {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(bytes.NewReader([]byte("image bytes"))),
+			ContentType: "image/jpeg",
+		}
+		return mediaStore.SaveMedia(context.Background(), "image123", "image", content)
+	}
+	assertSpoolEmpty := func() {
+		t.Helper()
+		entries, err := os.ReadDir(cfg.SpoolDir)
+		if err != nil {
+			t.Fatalf("Failed to read the spool directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Expected the spool directory to be empty, found %d entries", len(entries))
+		}
+	}
+
+	filePath, err := save()
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	if data, err := os.ReadFile(filePath); err != nil || string(data) != "image bytes" {
+		t.Errorf("Expected the saved file to hold the content, got %q (%v)", data, err)
+	}
+	assertSpoolEmpty()
+
+	// When neither directory can be written the save fails, and the spooled content is still removed
+	for _, dir := range []string{cfg.StorageDir, cfg.FallbackStorageDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("Failed to remove %s: %v", dir, err)
+		}
+		if err := os.WriteFile(dir, nil, 0644); err != nil {
+			t.Fatalf("Failed to block %s: %v", dir, err)
+		}
+	}
+
+	if _, err := save(); err == nil {
+		t.Errorf("Expected the save to fail without a writable directory")
+	}
+	assertSpoolEmpty()
+}
@@ -0,0 +1,253 @@
+package test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestSaveMediaFilenamePrefixes tests that FILENAME_PREFIXES replaces or removes the media type prefix
+func TestSaveMediaFilenamePrefixes(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		pattern   string
+	}{
+		{"image", `^img_\d+_[0-9a-f]{16}\.jpg$`},
+		{"video", `^\d+_[0-9a-f]{16}\.jpg$`},
+		{"audio", `^audio_\d+_[0-9a-f]{16}\.jpg$`},
+	}
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+		// Custom prefix for images, none for videos, and the default for everything else
+		FilenamePrefixes: map[string]string{"image": "img", "video": ""},
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	for _, tt := range tests {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content")),
+			ContentType: "image/jpeg",
+		}
+
+		filePath, err := mediaStore.SaveMedia(context.Background(), tt.mediaType+"123", tt.mediaType, content)
+		if err != nil {
+			t.Fatalf("Failed to save %s: %v", tt.mediaType, err)
+		}
+
+		if name := filepath.Base(filePath); !regexp.MustCompile(tt.pattern).MatchString(name) {
+			t.Errorf("Expected %s filename to match %s, got %s", tt.mediaType, tt.pattern, name)
+		}
+	}
+}
+
+// TestSyncBackupsRecognizesFilenamePrefixes tests that a backup sync recovers the media type from a custom prefix
+func TestSyncBackupsRecognizesFilenamePrefixes(t *testing.T) {
+	// Set up the test environment
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.CloudFolderTemplate = "{type}"
+	cfg.FilenamePrefixes = map[string]string{"image": "img", "video": "vid"}
+
+	// Files saved while cloud backup was unavailable
+	for _, name := range []string{"img_1_abc.jpg", "vid_2_def.mp4", "3_ghi.bin"} {
+		filePath := filepath.Join(cfg.StorageDir, "2024-01-05", name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filePath, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	if _, err := mediaStore.SyncBackups(context.Background()); err != nil {
+		t.Fatalf("Failed to sync backups: %v", err)
+	}
+	mediaStore.WaitForUploads()
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+
+	for _, remotePath := range []string{"image/img_1_abc.jpg", "video/vid_2_def.mp4", "file/3_ghi.bin"} {
+		if _, ok := mockWebDAV.files[cfg.WebDAVFolder+"/"+remotePath]; !ok {
+			t.Errorf("Expected %s to be uploaded, got %v", remotePath, getMapKeys(mockWebDAV.files))
+		}
+	}
+}
+
+// TestFilenameFromContentDisposition tests reading the suggested file name of a download
+func TestFilenameFromContentDisposition(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{`attachment; filename="report.pdf"`, "report.pdf"},
+		{`attachment; filename="my holiday photo.jpg"`, "my holiday photo.jpg"},
+		{`attachment; filename=plain.txt`, "plain.txt"},
+		{`attachment; filename*=UTF-8''%E0%B8%A3%E0%B8%B9%E0%B8%9B.png`, "รูป.png"},
+		{`attachment; filename="fallback.png"; filename*=UTF-8''caf%C3%A9.png`, "café.png"},
+		{`inline; filename="../../etc/passwd"`, "passwd"},
+		{`attachment; filename="C:\\Users\\me\\notes.txt"`, "notes.txt"},
+		{``, ""},
+		{`attachment`, ""},
+		{`attachment; filename="unterminated`, ""},
+		{`; filename=missing-type.txt`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := utils.FilenameFromContentDisposition(tt.header); got != tt.expected {
+			t.Errorf("FilenameFromContentDisposition(%q) = %q, expected %q", tt.header, got, tt.expected)
+		}
+	}
+}
+
+// TestGenerateNamedFilename tests that suggested names are sanitized and made unique
+func TestGenerateNamedFilename(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		name     string
+		expected string
+	}{
+		{"file", "report.pdf", `^file_report_[0-9a-f]{8}\.pdf$`},
+		{"", "report.pdf", `^report_[0-9a-f]{8}\.pdf$`},
+		{"file", "รูป.pdf", `^file_รูป_[0-9a-f]{8}\.pdf$`},
+		{"file", `bad:name*?.pdf`, `^file_bad_name___[0-9a-f]{8}\.pdf$`},
+		{"file", ".hidden.pdf", `^file_hidden_[0-9a-f]{8}\.pdf$`},
+		// Nothing usable left falls back to a generated name
+		{"file", "...", `^file_\d+_[0-9a-f]{16}\.pdf$`},
+	}
+
+	for _, tt := range tests {
+		got, err := utils.GenerateNamedFilename(tt.prefix, tt.name, ".pdf")
+		if err != nil {
+			t.Fatalf("GenerateNamedFilename(%q, %q) returned error: %v", tt.prefix, tt.name, err)
+		}
+		if !regexp.MustCompile(tt.expected).MatchString(got) {
+			t.Errorf("GenerateNamedFilename(%q, %q) = %q, expected to match %s", tt.prefix, tt.name, got, tt.expected)
+		}
+	}
+
+	first, _ := utils.GenerateNamedFilename("file", "report.pdf", ".pdf")
+	second, _ := utils.GenerateNamedFilename("file", "report.pdf", ".pdf")
+	if first == second {
+		t.Errorf("Expected two files with the same suggested name to be named differently, got %q twice", first)
+	}
+}
+
+// TestRandomFilenames tests the default naming strategy
+func TestRandomFilenames(t *testing.T) {
+	timestamp := time.UnixMilli(1700000000000)
+	tests := []struct {
+		strategy utils.RandomFilenames
+		naming   utils.FileNaming
+		expected string
+	}{
+		{utils.RandomFilenames{}, utils.FileNaming{Prefix: "image", Extension: ".jpg"}, `^image_\d+_[0-9a-f]{16}\.jpg$`},
+		{utils.RandomFilenames{}, utils.FileNaming{Extension: "jpg"}, `^\d+_[0-9a-f]{16}\.jpg$`},
+		{utils.RandomFilenames{}, utils.FileNaming{Prefix: "file", OriginalName: "report.pdf", Extension: ".pdf"}, `^file_report_[0-9a-f]{8}\.pdf$`},
+		// Named files get the time too when asked, so they sort with the others
+		{utils.RandomFilenames{TimestampNamed: true}, utils.FileNaming{Prefix: "file", OriginalName: "report.pdf", Extension: ".pdf", Timestamp: timestamp}, `^file_1700000000000_report_[0-9a-f]{8}\.pdf$`},
+		{utils.RandomFilenames{TimestampNamed: true}, utils.FileNaming{OriginalName: "report.pdf", Extension: ".pdf", Timestamp: timestamp}, `^1700000000000_report_[0-9a-f]{8}\.pdf$`},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.strategy.Filename(tt.naming)
+		if err != nil {
+			t.Fatalf("Filename(%+v) returned error: %v", tt.naming, err)
+		}
+		if !regexp.MustCompile(tt.expected).MatchString(got) {
+			t.Errorf("Filename(%+v) = %q, expected to match %s", tt.naming, got, tt.expected)
+		}
+	}
+
+	if (utils.RandomFilenames{}).UsesContentHash() {
+		t.Error("Expected random names not to need the content hash")
+	}
+}
+
+// TestHashFilenames tests that hash names depend only on the prefix, content and extension
+func TestHashFilenames(t *testing.T) {
+	strategy := utils.HashFilenames{}
+	if !strategy.UsesContentHash() {
+		t.Fatal("Expected hash names to need the content hash")
+	}
+
+	hash := strings.Repeat("0123456789abcdef", 4)
+	got, err := strategy.Filename(utils.FileNaming{Prefix: "image", OriginalName: "ignored.png", Extension: "jpg", ContentHash: hash})
+	if err != nil {
+		t.Fatalf("Filename returned error: %v", err)
+	}
+	if got != "image_0123456789abcdef.jpg" {
+		t.Errorf("Expected image_0123456789abcdef.jpg, got %q", got)
+	}
+
+	got, err = strategy.Filename(utils.FileNaming{Extension: ".jpg", ContentHash: hash})
+	if err != nil || got != "0123456789abcdef.jpg" {
+		t.Errorf("Expected 0123456789abcdef.jpg without a prefix, got %q: %v", got, err)
+	}
+
+	if _, err := strategy.Filename(utils.FileNaming{Prefix: "image", Extension: ".jpg"}); err == nil {
+		t.Error("Expected an error without a content hash")
+	}
+}
+
+// TestSaveMediaHashFilenames tests that FILENAME_STRATEGY=hash names saved files after their content
+func TestSaveMediaHashFilenames(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		FilenameStrategy: media.FilenameStrategyHash,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// sha256("content")
+	const expected = "image_ed7002b439e9ac84.jpg"
+	for _, messageID := range []string{"first", "second"} {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content")),
+			ContentType: "image/jpeg",
+		}
+		filePath, err := mediaStore.SaveMedia(context.Background(), messageID, "image", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		if name := filepath.Base(filePath); name != expected {
+			t.Errorf("Expected %s to be saved as %s, got %s", messageID, expected, name)
+		}
+	}
+
+	// The same content saved twice is stored once
+	matches, _ := filepath.Glob(filepath.Join(cfg.StorageDir, "*", "*.jpg"))
+	if len(matches) != 1 {
+		t.Errorf("Expected one stored file, got %v", matches)
+	}
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+)
+
+// TestLineClientSeparateContentEndpoint tests that message content is fetched from LINE_CONTENT_ENDPOINT
+// while other API calls use LINE_API_ENDPOINT
+func TestLineClientSeparateContentEndpoint(t *testing.T) {
+	var apiPaths, contentPaths []string
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiPaths = append(apiPaths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"userId":"bot123"}`))
+	}))
+	defer apiServer.Close()
+
+	contentServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentPaths = append(contentPaths, r.URL.Path)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image bytes"))
+	}))
+	defer contentServer.Close()
+
+	os.Setenv("LINE_API_ENDPOINT", apiServer.URL)
+	os.Setenv("LINE_CONTENT_ENDPOINT", contentServer.URL)
+	defer os.Unsetenv("LINE_API_ENDPOINT")
+	defer os.Unsetenv("LINE_CONTENT_ENDPOINT")
+
+	client, err := lineapi.NewClient(testChannelSecret, testChannelToken)
+	if err != nil {
+		t.Fatalf("Failed to create LINE client: %v", err)
+	}
+
+	content, err := client.GetMessageContent(context.Background(), "image123")
+	if err != nil {
+		t.Fatalf("Failed to get message content: %v", err)
+	}
+	body, _ := io.ReadAll(content.Content)
+	content.Content.Close()
+	if string(body) != "image bytes" {
+		t.Errorf("Expected the content server's response, got %q", body)
+	}
+
+	preview, err := client.GetMessagePreview(context.Background(), "video123")
+	if err != nil {
+		t.Fatalf("Failed to get message preview: %v", err)
+	}
+	preview.Content.Close()
+
+	if _, err := client.GetBot().GetBotInfo().Do(); err != nil {
+		t.Fatalf("Failed to get bot info: %v", err)
+	}
+
+	expectedContent := []string{"/v2/bot/message/image123/content", "/v2/bot/message/video123/content/preview"}
+	if len(contentPaths) != len(expectedContent) || contentPaths[0] != expectedContent[0] || contentPaths[1] != expectedContent[1] {
+		t.Errorf("Expected content requests %v, got %v", expectedContent, contentPaths)
+	}
+	if len(apiPaths) != 1 || apiPaths[0] != "/v2/bot/info" {
+		t.Errorf("Expected only the bot info request on the API endpoint, got %v", apiPaths)
+	}
+}
+
+// TestLineClientBacksOffAfter429 tests that a 429 from LINE is counted and slows the following fetches down
+func TestLineClientBacksOffAfter429(t *testing.T) {
+	var requests int
+	contentServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message":"Too Many Requests"}`))
+	}))
+	defer contentServer.Close()
+
+	os.Setenv("LINE_CONTENT_ENDPOINT", contentServer.URL)
+	defer os.Unsetenv("LINE_CONTENT_ENDPOINT")
+
+	client, err := lineapi.NewClient(testChannelSecret, testChannelToken)
+	if err != nil {
+		t.Fatalf("Failed to create LINE client: %v", err)
+	}
+
+	if _, err := client.GetMessageContent(context.Background(), "image123"); err == nil {
+		t.Fatal("Expected the 429 to fail the fetch")
+	}
+
+	stats := client.GetContentFetchStats()
+	if stats.Recent429Count != 1 || !stats.Throttled || stats.FetchesPerMinute != 1 {
+		t.Errorf("Expected one throttled fetch to be recorded, got %+v", stats)
+	}
+
+	// The next fetch waits for the throttled rate, and gives up when its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetMessageContent(ctx, "image456"); err == nil {
+		t.Fatal("Expected the fetch to be held back while throttled")
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected the fetch to wait until its context was done")
+	}
+	if requests != 1 {
+		t.Errorf("Expected no request to LINE while backing off, got %d", requests)
+	}
+}
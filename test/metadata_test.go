@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestWriteMetadataSidecar tests that the metadata sidecar describes the saved media and its sender
+func TestWriteMetadataSidecar(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:    filepath.Join(testDir, "storage"),
+		LogDir:        filepath.Join(testDir, "logs"),
+		WriteMetadata: true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(imageContent)),
+		ContentType: "image/jpeg",
+	}
+
+	// The handler passes the event's source and timestamp along with the save
+	sentAt := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+	ctx := media.WithUserID(context.Background(), "U1234")
+	ctx = media.WithEventSource(ctx, media.EventSource{
+		Type:      "group",
+		ID:        "C5678",
+		Timestamp: sentAt,
+	})
+
+	filePath, err := mediaStore.SaveMedia(ctx, "image_meta", "image", content)
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+
+	if _, err := os.Stat(media.MetadataPath(filePath)); err != nil {
+		t.Fatalf("Expected a metadata sidecar next to %s: %v", filePath, err)
+	}
+
+	metadata, err := media.ReadMetadata(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("Failed to stat saved file: %v", err)
+	}
+
+	if metadata.MessageID != "image_meta" || metadata.MessageType != "image" {
+		t.Errorf("Expected message image_meta of type image, got %s of type %s", metadata.MessageID, metadata.MessageType)
+	}
+	if metadata.SourceType != "group" || metadata.SourceID != "C5678" || metadata.UserID != "U1234" {
+		t.Errorf("Expected group C5678 from U1234, got %s %s from %s", metadata.SourceType, metadata.SourceID, metadata.UserID)
+	}
+	if !metadata.Timestamp.Equal(sentAt) {
+		t.Errorf("Expected timestamp %v, got %v", sentAt, metadata.Timestamp)
+	}
+	if metadata.ContentType != "image/jpeg" {
+		t.Errorf("Expected content type image/jpeg, got %s", metadata.ContentType)
+	}
+	if metadata.Size != info.Size() || metadata.Size != int64(len(imageContent)) {
+		t.Errorf("Expected size %d, got %d", info.Size(), metadata.Size)
+	}
+
+	// The sidecar isn't counted as saved media
+	if stats := mediaStore.GetStats(); stats.ImageCount != 1 || stats.FileCount != 0 {
+		t.Errorf("Expected only the image to be counted, got %+v", stats)
+	}
+}
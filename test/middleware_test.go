@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestWithLoggingRecoversPanic tests that a panicking handler returns 500 instead of crashing the server
+func TestWithLoggingRecoversPanic(t *testing.T) {
+	logger, err := utils.NewLogger(filepath.Join(t.TempDir(), "logs"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	panicking := handler.WithLogging(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something went wrong")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	res := httptest.NewRecorder()
+
+	panicking.ServeHTTP(res, req)
+
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, res.Code)
+	}
+	if res.Header().Get(handler.RequestIDHeader) == "" {
+		t.Errorf("Expected the %s header to be set", handler.RequestIDHeader)
+	}
+
+	// Requests that don't panic are passed through unchanged
+	ok := handler.WithLogging(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	res = httptest.NewRecorder()
+	ok.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if res.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, res.Code)
+	}
+}
+
+// TestWithStatsAuth tests that the stats token is required as a bearer token or basic auth password
+func TestWithStatsAuth(t *testing.T) {
+	logger, err := utils.NewLogger(filepath.Join(t.TempDir(), "logs"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	cfg := &config.Config{StatsAuthToken: "stats_token"}
+	protected := handler.WithStatsAuth(cfg, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		setup  func(req *http.Request)
+		status int
+	}{
+		{"no credentials", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"wrong bearer token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"wrong basic auth password", func(req *http.Request) { req.SetBasicAuth("stats", "wrong") }, http.StatusUnauthorized},
+		{"bearer token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer stats_token") }, http.StatusOK},
+		{"basic auth password", func(req *http.Request) { req.SetBasicAuth("anyone", "stats_token") }, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		tc.setup(req)
+		res := httptest.NewRecorder()
+
+		protected.ServeHTTP(res, req)
+
+		if res.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, res.Code)
+		}
+		if tc.status == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", tc.name)
+		}
+	}
+
+	// Without a token the endpoint stays open
+	cfg.StatsAuthToken = ""
+	res := httptest.NewRecorder()
+	protected.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected status %d without a configured token, got %d", http.StatusOK, res.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// TestSaveMediaMimeTypeFilter tests that content is refused by ALLOWED_MIME_TYPES and BLOCKED_MIME_TYPES
+func TestSaveMediaMimeTypeFilter(t *testing.T) {
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	pdfHeader := []byte("%PDF-1.4\n")
+
+	tests := []struct {
+		name        string
+		contentType string
+		fileName    string
+		content     []byte
+		saved       bool
+	}{
+		{"allowed family", "image/png", "", pngHeader, true},
+		{"allowed type", "application/pdf", "", pdfHeader, true},
+		{"not in the allowlist", "video/mp4", "", []byte{0x00, 0x01}, false},
+		{"blocked despite a wildcard", "image/svg+xml", "", []byte("<svg/>"), false},
+		{"blocked detected type", "image/png", "", []byte("#!/bin/sh\necho hi\n"), false},
+		{"blocked by file name", "", "install.html", pdfHeader, false},
+	}
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		AllowedMimeTypes: []string{"image/*", "application/pdf"},
+		BlockedMimeTypes: []string{"image/svg+xml", "text/plain", "text/html"},
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	blocked := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.fileName != "" {
+				ctx = media.WithFileName(ctx, tt.fileName)
+			}
+
+			content := &linebot.MessageContentResponse{
+				Content:     io.NopCloser(bytes.NewReader(tt.content)),
+				ContentType: tt.contentType,
+			}
+
+			filePath, err := mediaStore.SaveMedia(ctx, "file123", "file", content)
+			if tt.saved {
+				if err != nil {
+					t.Fatalf("Expected the file to be saved, got %v", err)
+				}
+				if _, err := os.Stat(filePath); err != nil {
+					t.Errorf("Expected the saved file to exist: %v", err)
+				}
+				return
+			}
+
+			blocked++
+			if !errors.Is(err, media.ErrBlockedType) {
+				t.Errorf("Expected ErrBlockedType, got %v", err)
+			}
+		})
+	}
+
+	stats := mediaStore.GetStats()
+	if stats.BlockedCount != blocked {
+		t.Errorf("Expected %d blocked files in the stats, got %d", blocked, stats.BlockedCount)
+	}
+	if stats.FileCount != len(tests)-blocked {
+		t.Errorf("Expected %d saved files in the stats, got %d", len(tests)-blocked, stats.FileCount)
+	}
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestPauseHoldsQueuedDownloads tests the pause and resume endpoints, the paused state in /health,
+// and that a queued download is reported as queued and only starts once processing is resumed
+func TestPauseHoldsQueuedDownloads(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image bytes"))
+	}))
+	defer server.Close()
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+		AdminToken: testAdminToken,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	pauseHandler := handler.NewPauseHandler(cfg, logger, mediaStore)
+	healthHandler := handler.NewHealthCheckHandler(logger, mediaStore)
+
+	post := func(handle http.HandlerFunc, path, token string) (int, handler.PauseResponse) {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		handle(res, req)
+
+		var response handler.PauseResponse
+		if res.Code == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode %s response: %v", path, err)
+			}
+		}
+		return res.Code, response
+	}
+
+	// The endpoints require the admin token
+	if code, _ := post(pauseHandler.HandlePause, "/pause", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without a token, got %d", http.StatusUnauthorized, code)
+	}
+	if mediaStore.Paused() {
+		t.Fatalf("Expected processing not to be paused by a rejected request")
+	}
+
+	code, response := post(pauseHandler.HandlePause, "/pause", testAdminToken)
+	if code != http.StatusOK || !response.Paused || !response.Changed || response.PausedSince == nil {
+		t.Fatalf("Expected processing to be paused, got status %d and %+v", code, response)
+	}
+
+	// The paused state is reported by /health without failing it
+	res := httptest.NewRecorder()
+	healthHandler.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health?strict=true", nil))
+	var health handler.HealthCheckResponse
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		t.Fatalf("Failed to decode health response: %v", err)
+	}
+	if res.Code != http.StatusOK || !health.Paused {
+		t.Errorf("Expected a healthy, paused status, got %d and %+v", res.Code, health)
+	}
+
+	// A download queued while paused waits
+	mediaStore.AddToDownloadQueue(context.Background(), "image1", "image", server.URL, nil)
+	time.Sleep(100 * time.Millisecond)
+	if requests.Load() != 0 {
+		t.Fatalf("Expected no download while paused, got %d requests", requests.Load())
+	}
+
+	// It shows up as queued in /health
+	res = httptest.NewRecorder()
+	healthHandler.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+	health = handler.HealthCheckResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		t.Fatalf("Failed to decode health response: %v", err)
+	}
+	if health.Queues.DownloadQueueDepth != 1 || health.Queues.DownloadsInFlight != 0 {
+		t.Errorf("Expected 1 queued download and none in flight, got %+v", health.Queues)
+	}
+
+	code, response = post(pauseHandler.HandleResume, "/resume", testAdminToken)
+	if code != http.StatusOK || response.Paused || !response.Changed {
+		t.Fatalf("Expected processing to be resumed, got status %d and %+v", code, response)
+	}
+
+	mediaStore.WaitForDownloads()
+	if requests.Load() != 1 {
+		t.Errorf("Expected the queued download to run after resuming, got %d requests", requests.Load())
+	}
+	if queues := mediaStore.QueueStats(); queues.DownloadQueueDepth != 0 || queues.DownloadsInFlight != 0 {
+		t.Errorf("Expected the download queue to be empty, got %+v", queues)
+	}
+
+	// Resuming again changes nothing
+	if _, response := post(pauseHandler.HandleResume, "/resume", testAdminToken); response.Changed {
+		t.Errorf("Expected a second resume not to change anything, got %+v", response)
+	}
+}
@@ -0,0 +1,279 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// newQuotaStore creates a media store limited to 1 MB, with a 700 KB file already stored in an old date folder
+func newQuotaStore(t *testing.T, policy string) (*media.MediaStore, string, func()) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		LogDir:             filepath.Join(testDir, "logs"),
+		MaxTotalStorageMB:  1,
+		StorageQuotaPolicy: policy,
+	}
+
+	oldFile := filepath.Join(cfg.StorageDir, "2020-01-01", "image_old.jpg")
+	if err := os.MkdirAll(filepath.Dir(oldFile), 0755); err != nil {
+		t.Fatalf("Failed to create old date folder: %v", err)
+	}
+	if err := os.WriteFile(oldFile, make([]byte, 700<<10), 0644); err != nil {
+		t.Fatalf("Failed to create old file: %v", err)
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	return media.NewMediaStore(cfg, logger), oldFile, func() { logger.Close() }
+}
+
+// saveImage saves size bytes as an image
+func saveImage(mediaStore *media.MediaStore, size int) (string, error) {
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(make([]byte, size))),
+		ContentType: "image/jpeg",
+	}
+	return mediaStore.SaveMedia(context.Background(), "image123", "image", content)
+}
+
+// TestStorageQuotaEvictsOldestFiles tests that the oldest files make room for a save over MAX_TOTAL_STORAGE_MB
+func TestStorageQuotaEvictsOldestFiles(t *testing.T) {
+	mediaStore, oldFile, cleanup := newQuotaStore(t, media.QuotaPolicyEvict)
+	defer cleanup()
+
+	// Fits alongside the old file
+	if _, err := saveImage(mediaStore, 100<<10); err != nil {
+		t.Fatalf("Failed to save the first image: %v", err)
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Fatalf("Expected the old file to be kept while there is room: %v", err)
+	}
+
+	// Doesn't fit, so the old file goes
+	filePath, err := saveImage(mediaStore, 500<<10)
+	if err != nil {
+		t.Fatalf("Failed to save the second image: %v", err)
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("Expected the new file to be kept: %v", err)
+	}
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the old file to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(oldFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the emptied date folder to be removed, got %v", err)
+	}
+	if stats := mediaStore.GetStats(); stats.EvictedCount != 1 {
+		t.Errorf("Expected 1 evicted file in the stats, got %d", stats.EvictedCount)
+	}
+}
+
+// TestStorageQuotaRejectsSaves tests that the reject policy refuses a save over MAX_TOTAL_STORAGE_MB
+func TestStorageQuotaRejectsSaves(t *testing.T) {
+	mediaStore, oldFile, cleanup := newQuotaStore(t, media.QuotaPolicyReject)
+	defer cleanup()
+
+	filePath, err := saveImage(mediaStore, 500<<10)
+	if !errors.Is(err, media.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v (saved to %q)", err, filePath)
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Errorf("Expected the old file to be kept: %v", err)
+	}
+
+	// Nothing but the old file is left behind
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(filepath.Dir(oldFile)), "*", "image_*"))
+	if len(matches) != 1 {
+		t.Errorf("Expected only the old file to remain, got %v", matches)
+	}
+
+	// A smaller file still fits
+	if _, err := saveImage(mediaStore, 100<<10); err != nil {
+		t.Errorf("Expected a file within the quota to be saved, got %v", err)
+	}
+}
+
+// TestStorageQuotaEvictsFlatStorage tests that the oldest files in the storage directory are evicted with FLAT_STORAGE,
+// leaving hidden files such as the upload index alone
+func TestStorageQuotaEvictsFlatStorage(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		LogDir:             filepath.Join(testDir, "logs"),
+		MaxTotalStorageMB:  1,
+		StorageQuotaPolicy: media.QuotaPolicyEvict,
+		FlatStorage:        true,
+	}
+
+	oldFile := filepath.Join(cfg.StorageDir, "image_old.jpg")
+	hiddenFile := filepath.Join(cfg.StorageDir, ".hidden")
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+	if err := os.WriteFile(oldFile, make([]byte, 700<<10), 0644); err != nil {
+		t.Fatalf("Failed to create old file: %v", err)
+	}
+	if err := os.WriteFile(hiddenFile, make([]byte, 10<<10), 0644); err != nil {
+		t.Fatalf("Failed to create hidden file: %v", err)
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	filePath, err := saveImage(mediaStore, 500<<10)
+	if err != nil {
+		t.Fatalf("Failed to save the image: %v", err)
+	}
+	if filepath.Dir(filePath) != cfg.StorageDir {
+		t.Errorf("Expected the image to be saved directly in the storage directory, got %s", filePath)
+	}
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the old file to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(hiddenFile); err != nil {
+		t.Errorf("Expected the hidden file to be kept: %v", err)
+	}
+}
+
+// TestStorageQuotaKeepsFilesNotBackedUp tests that with cloud storage configured, files that haven't been uploaded
+// are never evicted, and evicted files are forgotten by the upload index
+func TestStorageQuotaKeepsFilesNotBackedUp(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.MaxTotalStorageMB = 1
+	cfg.StorageQuotaPolicy = media.QuotaPolicyEvict
+
+	oldFile := filepath.Join(cfg.StorageDir, "2020-01-01", "image_old.jpg")
+	if err := os.MkdirAll(filepath.Dir(oldFile), 0755); err != nil {
+		t.Fatalf("Failed to create old date folder: %v", err)
+	}
+	if err := os.WriteFile(oldFile, make([]byte, 700<<10), 0644); err != nil {
+		t.Fatalf("Failed to create old file: %v", err)
+	}
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// The old file has never been uploaded, so it isn't evicted and the save doesn't fit
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = true
+	mockWebDAV.mu.Unlock()
+	if _, err := saveImage(mediaStore, 500<<10); !errors.Is(err, media.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded while the old file isn't backed up, got %v", err)
+	}
+	mediaStore.WaitForUploads()
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Fatalf("Expected the old file to be kept: %v", err)
+	}
+
+	// Once it is backed up it makes room
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = false
+	mockWebDAV.mu.Unlock()
+	if _, err := mediaStore.SyncBackups(context.Background()); err != nil {
+		t.Fatalf("Failed to sync backups: %v", err)
+	}
+	mediaStore.WaitForUploads()
+	if !mediaStore.IsUploaded(oldFile) {
+		t.Fatalf("Expected the old file to be uploaded by the sync")
+	}
+
+	if _, err := saveImage(mediaStore, 500<<10); err != nil {
+		t.Fatalf("Failed to save the image: %v", err)
+	}
+	mediaStore.WaitForUploads()
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the backed up old file to be evicted, got %v", err)
+	}
+	if mediaStore.IsUploaded(oldFile) {
+		t.Errorf("Expected the evicted file to be removed from the upload index")
+	}
+}
+
+// TestStorageQuotaEvictsSidecars tests that an evicted file takes its metadata sidecar and checksum with it,
+// and that hidden files are never evicted on their own
+func TestStorageQuotaEvictsSidecars(t *testing.T) {
+	mediaStore, oldFile, cleanup := newQuotaStore(t, media.QuotaPolicyEvict)
+	defer cleanup()
+
+	oldDir := filepath.Dir(oldFile)
+	otherFile := filepath.Join(oldDir, "image_other.jpg")
+	files := map[string][]byte{
+		media.MetadataPath(oldFile):                []byte(`{"messageId":"old"}`),
+		filepath.Join(oldDir, media.ChecksumsFile): []byte("aaaa  image_old.jpg\nbbbb  image_other.jpg\n"),
+		otherFile: make([]byte, 10<<10),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	if _, err := saveImage(mediaStore, 500<<10); err != nil {
+		t.Fatalf("Failed to save the image: %v", err)
+	}
+
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the old file to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(media.MetadataPath(oldFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the old file's metadata to be evicted with it, got %v", err)
+	}
+	if _, err := os.Stat(otherFile); err != nil {
+		t.Errorf("Expected the newer file to be kept: %v", err)
+	}
+	checksums, err := os.ReadFile(filepath.Join(oldDir, media.ChecksumsFile))
+	if err != nil {
+		t.Fatalf("Expected the checksums file to be kept for the remaining file: %v", err)
+	}
+	if string(checksums) != "bbbb  image_other.jpg\n" {
+		t.Errorf("Expected only the remaining file's checksum, got %q", checksums)
+	}
+}
+
+// TestStorageQuotaCountsSidecars tests that metadata sidecars count against the quota
+func TestStorageQuotaCountsSidecars(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:         filepath.Join(testDir, "storage"),
+		LogDir:             filepath.Join(testDir, "logs"),
+		MaxTotalStorageMB:  1,
+		StorageQuotaPolicy: media.QuotaPolicyReject,
+		WriteMetadata:      true,
+	}
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	// Fill all but 100 bytes of the quota with images, then the sidecars leave no room for the last one
+	first, err := saveImage(mediaStore, 1000<<10)
+	if err != nil {
+		t.Fatalf("Failed to save the first image: %v", err)
+	}
+	if info, err := os.Stat(media.MetadataPath(first)); err != nil || info.Size() <= 100 {
+		t.Fatalf("Expected a metadata sidecar of over 100 bytes, got %v", err)
+	}
+	if _, err := saveImage(mediaStore, 24<<10-100); !errors.Is(err, media.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded once the sidecar is counted, got %v", err)
+	}
+}
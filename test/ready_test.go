@@ -0,0 +1,63 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestReadiness tests that /ready reports whether files can be saved to the storage directory
+func TestReadiness(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	readinessHandler := handler.NewReadinessHandler(cfg, logger)
+	ready := func() (int, handler.ReadinessResponse) {
+		res := httptest.NewRecorder()
+		readinessHandler.HandleReady(res, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+		var response handler.ReadinessResponse
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode readiness response: %v", err)
+		}
+		return res.Code, response
+	}
+
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+	if code, response := ready(); code != http.StatusOK || response.Status != "READY" {
+		t.Errorf("Expected READY with a writable storage directory, got %d %+v", code, response)
+	}
+
+	// A storage directory that can't be written to, here because it is a file, makes the service not ready
+	if err := os.RemoveAll(cfg.StorageDir); err != nil {
+		t.Fatalf("Failed to remove storage directory: %v", err)
+	}
+	if err := os.WriteFile(cfg.StorageDir, []byte("not a directory"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	code, response := ready()
+	if code != http.StatusServiceUnavailable || response.Status != "NOT_READY" {
+		t.Errorf("Expected NOT_READY with an unwritable storage directory, got %d %+v", code, response)
+	}
+	if response.Checks["storage"] == "OK" {
+		t.Errorf("Expected the storage check to report the problem, got %+v", response.Checks)
+	}
+}
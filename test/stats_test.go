@@ -0,0 +1,264 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/lineapi"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const testAdminToken = "test_admin_token"
+
+// TestStatsReset tests that the stats reset endpoint zeroes the counters for admins only
+func TestStatsReset(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		ChannelSecret: testChannelSecret,
+		ChannelToken:  testChannelToken,
+		StorageDir:    filepath.Join(testDir, "storage"),
+		LogDir:        filepath.Join(testDir, "logs"),
+		AdminToken:    testAdminToken,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	lineClient, err := lineapi.NewClient(testChannelSecret, testChannelToken)
+	if err != nil {
+		t.Fatalf("Failed to create LINE client: %v", err)
+	}
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	statsHandler := handler.NewStatsHandler(cfg, logger, mediaStore, lineClient)
+
+	// Save a file so there is something to reset
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(bytes.NewReader(imageContent)),
+		ContentType: "image/jpeg",
+	}
+	if _, err := mediaStore.SaveMedia(context.Background(), "image1", "image", content); err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+
+	before := mediaStore.GetStats()
+	if before.ImageCount != 1 || before.ImageBytes != int64(len(imageContent)) || before.TotalBytes != int64(len(imageContent)) {
+		t.Fatalf("Expected 1 image of %d bytes before reset, got %+v", len(imageContent), before)
+	}
+
+	// Requests that are not authenticated POSTs must be rejected
+	rejected := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"GET request", http.MethodGet, testAdminToken, http.StatusMethodNotAllowed},
+		{"missing token", http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "wrong_token", http.StatusUnauthorized},
+	}
+
+	for _, tc := range rejected {
+		req := httptest.NewRequest(tc.method, "/stats/reset", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res := httptest.NewRecorder()
+
+		statsHandler.HandleStatsReset(res, req)
+
+		if res.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, res.Code)
+		}
+	}
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 1 {
+		t.Fatalf("Expected stats to be unchanged by rejected requests, got %+v", stats)
+	}
+
+	// An authenticated POST resets the counters
+	req := httptest.NewRequest(http.MethodPost, "/stats/reset", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	res := httptest.NewRecorder()
+
+	statsHandler.HandleStatsReset(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	after := mediaStore.GetStats()
+	if after.ImageCount != 0 || after.VideoCount != 0 || after.AudioCount != 0 || after.FileCount != 0 || after.ImageBytes != 0 || after.TotalBytes != 0 {
+		t.Errorf("Expected all counters to be zero after reset, got %+v", after)
+	}
+	if !after.StartTime.After(before.StartTime) || time.Since(after.StartTime) > time.Minute {
+		t.Errorf("Expected start time to be updated, got %v (was %v)", after.StartTime, before.StartTime)
+	}
+}
+
+// TestStatsResetWithoutAdminToken tests that the stats reset endpoint is disabled without an admin token
+func TestStatsResetWithoutAdminToken(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir: filepath.Join(testDir, "storage"),
+		LogDir:     filepath.Join(testDir, "logs"),
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	statsHandler := handler.NewStatsHandler(cfg, logger, mediaStore, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/stats/reset", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	res := httptest.NewRecorder()
+
+	statsHandler.HandleStatsReset(res, req)
+
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, res.Code)
+	}
+}
+
+// TestStatsSummary tests the rates and averages derived from the file statistics
+func TestStatsSummary(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	stats := media.Stats{
+		ImageCount: 3,
+		VideoCount: 1,
+		TotalBytes: 4000,
+		StartTime:  start,
+	}
+
+	summary := stats.Summary(start.Add(2 * time.Minute))
+	if summary.TotalFiles != 4 || summary.AvgFileSizeBytes != 1000 {
+		t.Errorf("Expected 4 files of 1000 bytes on average, got %+v", summary)
+	}
+	if summary.FilesPerMinute != 2 || summary.BytesPerMinute != 2000 || summary.UptimeSeconds != 120 {
+		t.Errorf("Expected 2 files and 2000 bytes per minute over 120s, got %+v", summary)
+	}
+
+	// Rates aren't computed for a near-zero uptime, nor averages without files
+	if summary := stats.Summary(start); summary.FilesPerMinute != 0 || summary.BytesPerMinute != 0 {
+		t.Errorf("Expected no rates right after the start, got %+v", summary)
+	}
+	if summary := (media.Stats{StartTime: start}).Summary(start.Add(time.Hour)); summary.AvgFileSizeBytes != 0 || summary.FilesPerMinute != 0 {
+		t.Errorf("Expected zero values without files, got %+v", summary)
+	}
+}
+
+// TestSourceStats tests that saved media is broken down per source, largest volume first
+func TestSourceStats(t *testing.T) {
+	setupTestData(t)
+
+	testDir := t.TempDir()
+	cfg := &config.Config{
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		AdminToken:       testAdminToken,
+		SourceStatsLimit: 2,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	statsHandler := handler.NewStatsHandler(cfg, logger, mediaStore, nil)
+
+	save := func(messageID string, source media.EventSource, size int) {
+		t.Helper()
+		ctx := media.WithEventSource(context.Background(), source)
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(bytes.NewReader(make([]byte, size))),
+			ContentType: "application/octet-stream",
+		}
+		if _, err := mediaStore.SaveMedia(ctx, messageID, "file", content); err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+	}
+
+	user := media.EventSource{Type: "user", ID: "U123"}
+	group := media.EventSource{Type: "group", ID: "C456"}
+	room := media.EventSource{Type: "room", ID: "R789"}
+	save("file1", user, 100)
+	save("file2", user, 100)
+	save("file3", group, 500)
+	// Beyond the limit the smallest source makes way for the new one
+	save("file4", room, 300)
+
+	get := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/stats/sources"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		statsHandler.HandleSourceStats(res, req)
+		return res
+	}
+
+	if res := get("", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without a token, got %d", http.StatusUnauthorized, res.Code)
+	}
+
+	res := get("", testAdminToken)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	var response handler.SourceStatsResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Count != 2 || response.Limit != 2 || len(response.Sources) != 2 {
+		t.Fatalf("Expected 2 of at most 2 sources, got %+v", response)
+	}
+	if got := response.Sources[0]; got.SourceID != group.ID || got.SourceType != "group" || got.Files != 1 || got.Bytes != 500 {
+		t.Errorf("Expected the group first with 1 file of 500 bytes, got %+v", got)
+	}
+	if got := response.Sources[1]; got.SourceID != room.ID || got.Bytes != 300 {
+		t.Errorf("Expected the room second with 300 bytes, got %+v", got)
+	}
+
+	res = get("?limit=1", testAdminToken)
+	response = handler.SourceStatsResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Count != 1 || response.Sources[0].SourceID != group.ID {
+		t.Errorf("Expected only the group with ?limit=1, got %+v", response)
+	}
+
+	// Resetting the stats forgets the sources
+	mediaStore.ResetStats()
+	if sources := mediaStore.SourceStats(); len(sources) != 0 {
+		t.Errorf("Expected no sources after reset, got %+v", sources)
+	}
+}
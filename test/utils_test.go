@@ -0,0 +1,529 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+)
+
+// TestGetContentType tests the mapping of content types to file extensions
+func TestGetContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{"image/jpeg", ".jpg"},
+		{"image/png", ".png"},
+		{"image/gif", ".gif"},
+		{"video/mp4", ".mp4"},
+		{"video/3gpp", ".3gp"},
+		{"audio/mp4", ".m4a"},
+		{"audio/aac", ".m4a"},
+		{"audio/x-m4a", ".m4a"},
+		{"audio/mpeg", ".mp3"},
+		{"audio/mp3", ".mp3"},
+		{"audio/mp4; codecs=mp4a.40.2", ".m4a"},
+		{"Audio/MPEG", ".mp3"},
+		{"application/octet-stream", ".bin"},
+		{"", ".bin"},
+	}
+
+	for _, tt := range tests {
+		if got := utils.GetContentType(tt.contentType); got != tt.expected {
+			t.Errorf("GetContentType(%q) = %q, expected %q", tt.contentType, got, tt.expected)
+		}
+	}
+}
+
+// TestSanitizePathComponent tests that names which could escape the storage directory are rejected
+func TestSanitizePathComponent(t *testing.T) {
+	valid := []struct {
+		name     string
+		expected string
+	}{
+		{"2025-01-01", "2025-01-01"},
+		{"U1234567890abcdef", "U1234567890abcdef"},
+		{"  padded  ", "padded"},
+		{"..hidden", "..hidden"},
+		{"ファイル", "ファイル"},
+	}
+
+	for _, tt := range valid {
+		got, err := utils.SanitizePathComponent(tt.name)
+		if err != nil {
+			t.Errorf("SanitizePathComponent(%q) returned error: %v", tt.name, err)
+		} else if got != tt.expected {
+			t.Errorf("SanitizePathComponent(%q) = %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+
+	malicious := []string{
+		"",
+		"   ",
+		".",
+		"..",
+		" .. ",
+		"../etc",
+		"../../etc/passwd",
+		"/etc/passwd",
+		"2025-01-01/../../escape",
+		"..\\windows\\system32",
+		"C:\\Windows",
+		"name\x00.jpg",
+		"line\nbreak",
+	}
+
+	for _, name := range malicious {
+		if got, err := utils.SanitizePathComponent(name); !errors.Is(err, utils.ErrInvalidPathComponent) {
+			t.Errorf("SanitizePathComponent(%q) = %q, %v, expected ErrInvalidPathComponent", name, got, err)
+		}
+	}
+}
+
+// TestGetMediaDirRejectsTraversal tests that media directories can't be created outside the storage directory
+func TestGetMediaDirRejectsTraversal(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{StorageDir: filepath.Join(testDir, "storage")}
+
+	dir, err := cfg.GetMediaDir("2025-01-01", "image")
+	if err != nil {
+		t.Fatalf("Failed to get media directory: %v", err)
+	}
+	if dir != filepath.Join(cfg.StorageDir, "2025-01-01") {
+		t.Errorf("Expected media directory inside storage, got %s", dir)
+	}
+
+	for _, dateStr := range []string{"..", "../escape", "2025-01-01/../../escape", "/tmp/escape"} {
+		if dir, err := cfg.GetMediaDir(dateStr, "image"); err == nil {
+			t.Errorf("GetMediaDir(%q) = %s, expected an error", dateStr, dir)
+		}
+	}
+
+	// Nothing may have been created next to the storage directory
+	entries, err := os.ReadDir(testDir)
+	if err != nil {
+		t.Fatalf("Failed to read test directory: %v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "storage") {
+			t.Errorf("Unexpected directory created outside storage: %s", entry.Name())
+		}
+	}
+}
+
+// TestGetMediaDirWithTypeSubfolders tests that each media type gets its own subfolder when enabled
+func TestGetMediaDirWithTypeSubfolders(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{StorageDir: filepath.Join(testDir, "storage")}
+
+	// Types share the date folder by default
+	dir, err := cfg.GetMediaDir("2025-01-01", "video")
+	if err != nil {
+		t.Fatalf("Failed to get media directory: %v", err)
+	}
+	if dir != filepath.Join(cfg.StorageDir, "2025-01-01") {
+		t.Errorf("Expected the date folder, got %s", dir)
+	}
+
+	cfg.SubfolderByType = true
+	expected := map[string]string{
+		"image":   "images",
+		"video":   "videos",
+		"audio":   "audio",
+		"file":    "files",
+		"unknown": "files",
+	}
+	for mediaType, folder := range expected {
+		dir, err := cfg.GetMediaDir("2025-01-01", mediaType)
+		if err != nil {
+			t.Fatalf("Failed to get media directory for %s: %v", mediaType, err)
+		}
+		if dir != filepath.Join(cfg.StorageDir, "2025-01-01", folder) {
+			t.Errorf("Expected %s media in %s, got %s", mediaType, folder, dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("Expected %s to be created", dir)
+		}
+	}
+}
+
+// TestGetMediaDirFlatStorage tests that every file goes directly in the storage directory with FLAT_STORAGE
+func TestGetMediaDirFlatStorage(t *testing.T) {
+	testDir := t.TempDir()
+	cfg := &config.Config{StorageDir: filepath.Join(testDir, "storage"), FlatStorage: true, SubfolderByType: true}
+
+	for _, mediaType := range []string{"image", "video", "file"} {
+		dir, err := cfg.GetMediaDir("2025-01-01", mediaType)
+		if err != nil {
+			t.Fatalf("Failed to get media directory for %s: %v", mediaType, err)
+		}
+		if dir != cfg.StorageDir {
+			t.Errorf("Expected %s media in the storage directory, got %s", mediaType, dir)
+		}
+	}
+
+	// The date is still checked
+	if _, err := cfg.GetMediaDir("../outside", "image"); err == nil {
+		t.Error("Expected a date with a path separator to be rejected")
+	}
+}
+
+// TestClientIP tests that forwarding headers are only believed from trusted proxies
+func TestClientIP(t *testing.T) {
+	proxies, err := utils.ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		expected     string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.5:4000", []string{"1.2.3.4"}, "", "203.0.113.5"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.5:4000", nil, "1.2.3.4", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted single IP", "192.168.1.1:4000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"chain of trusted proxies", "10.1.2.3:4000", []string{"198.51.100.7, 10.9.9.9"}, "", "198.51.100.7"},
+		{"client spoofing the left of the chain", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.7"}, "", "198.51.100.7"},
+		{"spoofed entry in an earlier header", "10.1.2.3:4000", []string{"1.2.3.4", "198.51.100.7"}, "", "198.51.100.7"},
+		{"invalid hop", "10.1.2.3:4000", []string{"1.2.3.4, not-an-ip"}, "", "10.1.2.3"},
+		{"X-Real-IP from a trusted proxy", "10.1.2.3:4000", nil, "198.51.100.7", "198.51.100.7"},
+		{"X-Forwarded-For wins over X-Real-IP", "10.1.2.3:4000", []string{"198.51.100.7"}, "1.2.3.4", "198.51.100.7"},
+		{"invalid X-Real-IP", "10.1.2.3:4000", nil, "garbage", "10.1.2.3"},
+		{"IPv6 trusted proxy", "[fd00::1]:4000", []string{"2001:db8::7"}, "", "2001:db8::7"},
+		{"peer just outside a trusted range", "11.0.0.1:4000", []string{"1.2.3.4"}, "", "11.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, header := range tt.forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		if got := proxies.ClientIP(req); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, got)
+		}
+	}
+
+	// Without trusted proxies the headers are always ignored
+	none, err := utils.ParseTrustedProxies(nil)
+	if err != nil {
+		t.Fatalf("Failed to parse empty trusted proxies: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.RemoteAddr = "10.1.2.3:4000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := none.ClientIP(req); got != "10.1.2.3" {
+		t.Errorf("Expected the peer address without trusted proxies, got %s", got)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := utils.ParseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("Expected an error for trusted proxy %q", invalid)
+		}
+	}
+}
+
+// TestConfigValidate tests that every problem in a configuration is reported at once
+func TestConfigValidate(t *testing.T) {
+	testDir := t.TempDir()
+	valid := func() *config.Config {
+		return &config.Config{
+			ChannelSecret:      testChannelSecret,
+			ChannelToken:       testChannelToken,
+			Port:               "8080",
+			StorageDir:         filepath.Join(testDir, "storage"),
+			LogDir:             filepath.Join(testDir, "logs"),
+			StorageQuotaPolicy: "evict",
+			UploadQueuePolicy:  "block",
+			DriveRetryCount:    3,
+		}
+	}
+
+	if problems := valid().Validate(); len(problems) != 0 {
+		t.Fatalf("Expected a valid configuration, got %v", problems)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "storage")); err != nil {
+		t.Errorf("Expected the storage directory to be created: %v", err)
+	}
+
+	// A file where a directory should be can't be written to
+	blocker := filepath.Join(testDir, "not_a_dir")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	cfg := valid()
+	cfg.Port = "80a"
+	cfg.DriveRetryCount = -1
+	cfg.DriveEnabled = true
+	cfg.DriveCredentials = filepath.Join(testDir, "missing.json")
+	cfg.UploadQueuePolicy = "queue"
+	cfg.LogDir = filepath.Join(blocker, "logs")
+
+	problems := cfg.Validate()
+	expected := []string{"PORT", "DRIVE_RETRY_COUNT", "DRIVE_CREDENTIALS", "UPLOAD_QUEUE_POLICY", "LOG_DIR"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for _, name := range expected {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, name)
+		}
+		if !found {
+			t.Errorf("Expected a problem with %s, got %v", name, problems)
+		}
+	}
+}
+
+// TestConfigValidateResolvesStorageDir tests that the storage directory is made absolute
+// with ~ expanded, and that a file in its place is reported
+func TestConfigValidateResolvesStorageDir(t *testing.T) {
+	testDir := t.TempDir()
+	t.Setenv("HOME", testDir)
+
+	cfg := &config.Config{
+		ChannelSecret:      testChannelSecret,
+		ChannelToken:       testChannelToken,
+		Port:               "8080",
+		StorageDir:         "~/files/../storage/",
+		LogDir:             filepath.Join(testDir, "logs"),
+		StorageQuotaPolicy: "evict",
+		UploadQueuePolicy:  "block",
+	}
+	if problems := cfg.Validate(); len(problems) != 0 {
+		t.Fatalf("Expected a valid configuration, got %v", problems)
+	}
+	if expected := filepath.Join(testDir, "storage"); cfg.StorageDir != expected {
+		t.Errorf("Expected storage directory %s, got %s", expected, cfg.StorageDir)
+	}
+
+	// Relative paths are resolved against the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(testDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	cfg.StorageDir = "./relative"
+	if problems := cfg.Validate(); len(problems) != 0 {
+		t.Fatalf("Expected a valid configuration, got %v", problems)
+	}
+	if !filepath.IsAbs(cfg.StorageDir) || filepath.Base(cfg.StorageDir) != "relative" {
+		t.Errorf("Expected an absolute storage directory, got %s", cfg.StorageDir)
+	}
+
+	// A file is not a directory
+	filePath := filepath.Join(testDir, "file.txt")
+	if err := os.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	cfg.StorageDir = filePath
+	problems := cfg.Validate()
+	if len(problems) != 1 || !strings.Contains(problems[0], "not a directory") {
+		t.Errorf("Expected the storage directory to be reported as not a directory, got %v", problems)
+	}
+}
+
+// TestConfigFile tests that settings are read from a YAML or JSON CONFIG_FILE
+// and that environment variables take precedence over the file
+func TestConfigFile(t *testing.T) {
+	testDir := t.TempDir()
+	storageDir := filepath.Join(testDir, "storage")
+	logDir := filepath.Join(testDir, "logs")
+
+	files := map[string]string{
+		"config.yaml": `
+line_channel_secret: file_secret
+line_channel_token: file_token
+port: "9090"
+storage_dir: ` + filepath.Join(testDir, "ignored") + `
+log_dir: ` + logDir + `
+capture_types: [image, video]
+filename_prefixes:
+  image: img
+send_confirmation: false
+drive_retry_count: 7
+`,
+		"config.json": `{
+  "line_channel_secret": "file_secret",
+  "line_channel_token": "file_token",
+  "port": "9090",
+  "storage_dir": "` + filepath.Join(testDir, "ignored") + `",
+  "log_dir": "` + logDir + `",
+  "capture_types": ["image", "video"],
+  "filename_prefixes": {"image": "img"},
+  "send_confirmation": false,
+  "drive_retry_count": 7
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(testDir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			// Variables set by the file are removed again so other tests see the default environment
+			t.Cleanup(func() {
+				for _, key := range []string{"LINE_CHANNEL_SECRET", "LINE_CHANNEL_TOKEN", "PORT", "LOG_DIR",
+					"CAPTURE_TYPES", "FILENAME_PREFIXES", "SEND_CONFIRMATION", "DRIVE_RETRY_COUNT"} {
+					os.Unsetenv(key)
+				}
+			})
+			t.Setenv("CONFIG_FILE", path)
+			t.Setenv("STORAGE_DIR", storageDir)
+
+			cfg, err := config.Reload()
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+
+			if cfg.ChannelSecret != "file_secret" || cfg.Port != "9090" || cfg.LogDir != logDir || cfg.DriveRetryCount != 7 {
+				t.Errorf("Expected the file's settings, got %+v", cfg)
+			}
+			if cfg.StorageDir != storageDir {
+				t.Errorf("Expected STORAGE_DIR to override the file, got %s", cfg.StorageDir)
+			}
+			if strings.Join(cfg.CaptureTypes, ",") != "image,video" || cfg.FilenamePrefix("image") != "img" {
+				t.Errorf("Expected lists and maps from the file, got %v and %v", cfg.CaptureTypes, cfg.FilenamePrefixes)
+			}
+			if cfg.SendConfirmation {
+				t.Error("Expected send_confirmation: false to override the default")
+			}
+			if cfg.UploadWorkers != 4 {
+				t.Errorf("Expected settings missing from the file to keep their defaults, got %d upload workers", cfg.UploadWorkers)
+			}
+		})
+	}
+
+	// Misspelled keys are reported rather than ignored
+	path := filepath.Join(testDir, "typo.yaml")
+	if err := os.WriteFile(path, []byte("storage_dri: ./storage\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	if _, err := config.Reload(); err == nil || !strings.Contains(err.Error(), "storage_dri") {
+		t.Errorf("Expected an error naming the unknown key, got %v", err)
+	}
+}
+
+// TestConfigReloadDotEnv tests that a reload picks up edits to .env without overriding the real environment
+func TestConfigReloadDotEnv(t *testing.T) {
+	testDir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(testDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.Unsetenv("LINE_CHANNEL_TOKEN")
+		os.Unsetenv("DRIVE_RETRY_COUNT")
+	})
+
+	t.Setenv("LINE_CHANNEL_SECRET", "env_secret")
+	t.Setenv("STORAGE_DIR", filepath.Join(testDir, "storage"))
+
+	writeDotEnv := func(content string) {
+		if err := os.WriteFile(filepath.Join(testDir, ".env"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write .env: %v", err)
+		}
+	}
+
+	writeDotEnv("LINE_CHANNEL_SECRET=dotenv_secret\nLINE_CHANNEL_TOKEN=dotenv_token\nDRIVE_RETRY_COUNT=5\n")
+	first, err := config.Reload()
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if first.ChannelSecret != "env_secret" {
+		t.Errorf("Expected the environment to take precedence over .env, got %s", first.ChannelSecret)
+	}
+	if first.ChannelToken != "dotenv_token" || first.DriveRetryCount != 5 {
+		t.Errorf("Expected settings from .env, got %s and %d", first.ChannelToken, first.DriveRetryCount)
+	}
+
+	// Edited and removed settings are picked up, the environment still wins
+	writeDotEnv("LINE_CHANNEL_SECRET=other_secret\nLINE_CHANNEL_TOKEN=edited_token\n")
+	second, err := config.Reload()
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if second.ChannelSecret != "env_secret" || second.ChannelToken != "edited_token" {
+		t.Errorf("Expected the edited token and the environment's secret, got %s and %s", second.ChannelToken, second.ChannelSecret)
+	}
+	if second.DriveRetryCount != 3 {
+		t.Errorf("Expected a setting removed from .env to return to its default, got %d", second.DriveRetryCount)
+	}
+
+	changed := config.ChangedSettings(first, second)
+	if strings.Join(changed, ",") != "LINE_CHANNEL_TOKEN,DRIVE_RETRY_COUNT" {
+		t.Errorf("Expected the changed settings to be reported, got %v", changed)
+	}
+}
+
+// TestBandwidthLimiter tests that readers sharing a limiter stay under its combined rate
+func TestBandwidthLimiter(t *testing.T) {
+	if utils.NewBandwidthLimiter(0) != nil {
+		t.Error("Expected no limiter for a limit of 0")
+	}
+	var unlimited *utils.BandwidthLimiter
+	source := strings.NewReader("data")
+	if unlimited.Reader(context.Background(), source) != source {
+		t.Error("Expected a nil limiter to return the reader unchanged")
+	}
+
+	// Two readers of 20KB each through a 100KB/s limit; only the first chunk goes through without waiting
+	limiter := utils.NewBandwidthLimiter(100 * 1024)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, limiter.Reader(context.Background(), bytes.NewReader(make([]byte, 20*1024))))
+			if err != nil || n != 20*1024 {
+				t.Errorf("Expected to read 20KB, got %d bytes: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 40KB at 100KB/s to take about 0.3s, took %v", elapsed)
+	}
+
+	// A cancelled context stops a throttled read
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := utils.NewBandwidthLimiter(1)
+	if _, err := io.Copy(io.Discard, slow.Reader(ctx, bytes.NewReader(make([]byte, 10)))); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled read to fail with context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,780 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.olipicus.com/line_file_catcher/internal/cloud/webdav"
+	"code.olipicus.com/line_file_catcher/internal/config"
+	"code.olipicus.com/line_file_catcher/internal/handler"
+	"code.olipicus.com/line_file_catcher/internal/media"
+	"code.olipicus.com/line_file_catcher/internal/notify"
+	"code.olipicus.com/line_file_catcher/internal/utils"
+	"github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+const (
+	testWebDAVUsername = "test_user"
+	testWebDAVPassword = "test_app_token"
+	webdavRoot         = "/remote.php/dav/files/test_user/"
+	webdavSharePath    = "/ocs/v2.php/apps/files_sharing/api/v1/shares"
+)
+
+// mockWebDAVServer is a minimal WebDAV server with an OCS share endpoint
+type mockWebDAVServer struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	folders     map[string]bool
+	files       map[string][]byte
+	mkcolCalls  int
+	putCalls    int
+	pings       int  // PROPFIND requests, which the client only sends to check the server
+	failPuts    bool // Respond to uploads with a server error
+	failNext    int  // Respond to this many more uploads with a server error
+	sharedPaths []string
+}
+
+// newMockWebDAVServer creates a new mock WebDAV server
+func newMockWebDAVServer() *mockWebDAVServer {
+	m := &mockWebDAVServer{
+		folders: make(map[string]bool),
+		files:   make(map[string][]byte),
+	}
+
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Mock WebDAV server received request: %s %s\n", r.Method, r.URL.Path)
+
+		// Check the basic auth credentials
+		username, password, ok := r.BasicAuth()
+		if !ok || username != testWebDAVUsername || password != testWebDAVPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == webdavSharePath {
+			m.handleShare(w, r)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, webdavRoot) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		remotePath := strings.Trim(strings.TrimPrefix(r.URL.Path, webdavRoot), "/")
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		switch r.Method {
+		case "PROPFIND":
+			m.pings++
+			w.WriteHeader(http.StatusMultiStatus)
+		case "MKCOL":
+			m.mkcolCalls++
+			if m.folders[remotePath] {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if parent := path.Dir(remotePath); parent != "." && !m.folders[parent] {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			m.folders[remotePath] = true
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodPut:
+			m.putCalls++
+			if m.failPuts || m.failNext > 0 {
+				if m.failNext > 0 {
+					m.failNext--
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if parent := path.Dir(remotePath); parent != "." && !m.folders[parent] {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			m.files[remotePath] = body
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	return m
+}
+
+// handleShare handles OCS public link share requests
+func (m *mockWebDAVServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("OCS-APIRequest") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("shareType") != "3" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	m.sharedPaths = append(m.sharedPaths, r.PostForm.Get("path"))
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ocs": map[string]interface{}{
+			"data": map[string]interface{}{
+				"url": m.server.URL + "/s/test_share",
+			},
+		},
+	})
+}
+
+// close shuts down the mock server
+func (m *mockWebDAVServer) close() {
+	m.server.Close()
+}
+
+// setupWebDAV creates a test environment with WebDAV backup enabled
+func setupWebDAV(t *testing.T) (*mockWebDAVServer, *config.Config, *utils.Logger, func()) {
+	// Create a mock WebDAV server
+	mockWebDAV := newMockWebDAVServer()
+
+	testDir := t.TempDir()
+
+	// Create a test config with WebDAV enabled
+	cfg := &config.Config{
+		ChannelSecret:    testChannelSecret,
+		ChannelToken:     testChannelToken,
+		StorageDir:       filepath.Join(testDir, "storage"),
+		LogDir:           filepath.Join(testDir, "logs"),
+		Debug:            true,
+		Port:             "8080",
+		WebDAVEnabled:    true,
+		WebDAVURL:        mockWebDAV.server.URL + webdavRoot,
+		WebDAVUsername:   testWebDAVUsername,
+		WebDAVPassword:   testWebDAVPassword,
+		WebDAVFolder:     "LineFileCatcher",
+		WebDAVRetryCount: 0,
+	}
+
+	// Create a logger
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	// Return a cleanup function
+	cleanup := func() {
+		mockWebDAV.close()
+		logger.Close()
+	}
+
+	return mockWebDAV, cfg, logger, cleanup
+}
+
+// TestWebDAVUploadAfterSave tests that saved media is uploaded to the WebDAV server
+func TestWebDAVUploadAfterSave(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	if !mediaStore.GetCloudStats().Enabled {
+		t.Fatalf("Expected cloud storage to be enabled")
+	}
+
+	// Read the sample image file
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	content := &linebot.MessageContentResponse{
+		Content:       io.NopCloser(bytes.NewReader(imageContent)),
+		ContentType:   "image/jpeg",
+		ContentLength: int64(len(imageContent)),
+	}
+
+	filePath, err := mediaStore.SaveMedia(context.Background(), "image1", "image", content)
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+
+	// Wait for the upload to finish
+	mediaStore.WaitForUploads()
+
+	// Verify that the upload was recorded in the index
+	if !mediaStore.IsUploaded(filePath) {
+		t.Errorf("Expected %s to be recorded as uploaded", filePath)
+	}
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+
+	// Verify that the root and date folders were created
+	dateFolder := path.Join(cfg.WebDAVFolder, utils.GetDateString())
+	for _, folder := range []string{cfg.WebDAVFolder, dateFolder} {
+		if !mockWebDAV.folders[folder] {
+			t.Errorf("Expected folder %s to be created", folder)
+		}
+	}
+
+	// Verify that the file was uploaded into the date folder with its content
+	remotePath := path.Join(dateFolder, filepath.Base(filePath))
+	uploaded, ok := mockWebDAV.files[remotePath]
+	if !ok {
+		t.Fatalf("Expected file to be uploaded to %s, got %v", remotePath, mockWebDAV.files)
+	}
+	if !bytes.Equal(uploaded, imageContent) {
+		t.Errorf("Uploaded content does not match the saved file")
+	}
+
+	// Verify that the backup statistics reflect the upload
+	stats := mediaStore.GetCloudStats()
+	if stats.UploadCount != 1 {
+		t.Errorf("Expected uploadCount 1, got %d", stats.UploadCount)
+	}
+	if stats.FolderCreatedCount != 2 {
+		t.Errorf("Expected folderCreatedCount 2, got %d", stats.FolderCreatedCount)
+	}
+
+	// The structured output has a numeric average, the map layout keeps the duration string too
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("Failed to encode cloud stats: %v", err)
+	}
+	var structured map[string]interface{}
+	if err := json.Unmarshal(encoded, &structured); err != nil {
+		t.Fatalf("Failed to decode cloud stats: %v", err)
+	}
+	if _, ok := structured["averageUploadMs"].(float64); !ok {
+		t.Errorf("Expected a numeric averageUploadMs, got %v", structured["averageUploadMs"])
+	}
+	if _, ok := structured["uploadCount"]; !ok {
+		t.Errorf("Expected the provider stats at the top level, got %s", encoded)
+	}
+	compat := stats.Map()
+	if _, ok := compat["averageUploadTime"].(string); !ok {
+		t.Errorf("Expected averageUploadTime in the map layout, got %v", compat["averageUploadTime"])
+	}
+	if count, _ := compat["uploadCount"].(int); count != 1 {
+		t.Errorf("Expected uploadCount 1 in the map layout, got %v", compat["uploadCount"])
+	}
+}
+
+// TestWebDAVRetriedUploadStats tests that uploads are counted as succeeding on the first try or after retrying
+func TestWebDAVRetriedUploadStats(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.WebDAVRetryCount = 1
+	service := webdav.NewWebDAVService(cfg, logger)
+	if err := service.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize WebDAV service: %v", err)
+	}
+
+	filePath := filepath.Join(cfg.StorageDir, "image_1.jpg")
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatalf("Failed to create storage directory: %v", err)
+	}
+	if err := os.WriteFile(filePath, []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	if _, err := service.UploadFile(context.Background(), filePath, "LineFileCatcher/stats"); err != nil {
+		t.Fatalf("First upload failed: %v", err)
+	}
+
+	// The next upload only succeeds on its retry
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failNext = 1
+	mockWebDAV.mu.Unlock()
+	if _, err := service.UploadFile(context.Background(), filePath, "LineFileCatcher/stats"); err != nil {
+		t.Fatalf("Retried upload failed: %v", err)
+	}
+
+	stats := service.GetBackupStats()
+	if stats.FirstTrySuccess != 1 || stats.RetriedSuccess != 1 || stats.RetryCount != 1 || stats.UploadCount != 2 {
+		t.Errorf("Expected 1 first try and 1 retried success, got %+v", stats)
+	}
+	if m := stats.Map(); m["firstTrySuccess"] != 1 || m["retriedSuccess"] != 1 {
+		t.Errorf("Expected the counts in the original layout, got %v", m)
+	}
+}
+
+// TestWebDAVFileLink tests the direct and shared links returned for uploaded files
+func TestWebDAVFileLink(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	fileID := "LineFileCatcher/2025-01-01/image_test.jpg"
+
+	// Without the share API, the direct WebDAV URL is returned
+	service := webdav.NewWebDAVService(cfg, logger)
+	if err := service.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize WebDAV service: %v", err)
+	}
+
+	link, err := service.GetFileLink(fileID)
+	if err != nil {
+		t.Fatalf("Failed to get file link: %v", err)
+	}
+	if expected := mockWebDAV.server.URL + webdavRoot + fileID; link != expected {
+		t.Errorf("Expected direct link %s, got %s", expected, link)
+	}
+
+	// With the share API configured, a public share link is created
+	cfg.WebDAVShareAPIURL = mockWebDAV.server.URL + webdavSharePath
+	link, err = service.GetFileLink(fileID)
+	if err != nil {
+		t.Fatalf("Failed to get share link: %v", err)
+	}
+	if expected := mockWebDAV.server.URL + "/s/test_share"; link != expected {
+		t.Errorf("Expected share link %s, got %s", expected, link)
+	}
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+	if len(mockWebDAV.sharedPaths) != 1 || mockWebDAV.sharedPaths[0] != "/"+fileID {
+		t.Errorf("Expected share request for /%s, got %v", fileID, mockWebDAV.sharedPaths)
+	}
+}
+
+// TestWebDAVMigrateBackups tests that existing files are uploaded with their folders preserved
+// and that a second run skips files that were already migrated
+func TestWebDAVMigrateBackups(t *testing.T) {
+	// Set up the test environment
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	// Files saved before cloud backup was enabled
+	existing := map[string]string{
+		"2024-01-05/image_1.jpg":                          "first",
+		"2024-01-05/video_2.mp4":                          "second",
+		"archive/old/file_3.pdf":                          "third",
+		"2024-01-06/file_4.bin":                           "fourth",
+		"2024-01-06/image_5.jpg":                          "fifth",
+		"2024-01-06/video_6.mp4" + media.PartialExtension: "unfinished",
+	}
+	for name, content := range existing {
+		filePath := filepath.Join(cfg.StorageDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	cfg.SyncWorkers = 3
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	var reports []media.MigrationProgress
+	progress, err := mediaStore.MigrateBackups(context.Background(), func(p media.MigrationProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if progress.Total != 5 || progress.Uploaded != 5 || progress.Failed != 0 {
+		t.Errorf("Expected 5 of 5 files migrated, got %+v", progress)
+	}
+	if len(reports) != 6 {
+		t.Errorf("Expected a progress report before starting and after each file, got %d", len(reports))
+	}
+	if want := int64(len("first" + "second" + "third" + "fourth" + "fifth")); progress.Bytes != want {
+		t.Errorf("Expected %d bytes uploaded, got %d", want, progress.Bytes)
+	}
+	if progress.Elapsed <= 0 || progress.FilesPerSecond() <= 0 {
+		t.Errorf("Expected the throughput to be reported, got %+v", progress)
+	}
+
+	mockWebDAV.mu.Lock()
+	for name, content := range existing {
+		remotePath := cfg.WebDAVFolder + "/" + name
+		uploaded, ok := mockWebDAV.files[remotePath]
+		if strings.HasSuffix(name, media.PartialExtension) {
+			if ok {
+				t.Errorf("Partial download %s should not be migrated", name)
+			}
+			continue
+		}
+		if string(uploaded) != content {
+			t.Errorf("Expected %s to be uploaded with %q, got %q", remotePath, content, uploaded)
+		}
+	}
+	mockWebDAV.mu.Unlock()
+
+	// A second run, as after an interruption, finds nothing left to migrate
+	progress, err = mediaStore.MigrateBackups(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Failed to migrate again: %v", err)
+	}
+	if progress.Total != 0 {
+		t.Errorf("Expected already migrated files to be skipped, got %+v", progress)
+	}
+}
+
+// TestWebDAVCircuitBreaker tests that uploads are skipped while the server keeps failing
+// and that the skipped files are uploaded once it recovers
+func TestWebDAVCircuitBreaker(t *testing.T) {
+	// Set up the test environment
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.CloudBreakerThreshold = 2
+	cfg.CloudBreakerCooldownSeconds = 1
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = true
+	mockWebDAV.mu.Unlock()
+
+	save := func(messageID string) {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content of " + messageID)),
+			ContentType: "image/jpeg",
+		}
+		if _, err := mediaStore.SaveMedia(context.Background(), messageID, "image", content); err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		mediaStore.WaitForUploads()
+	}
+
+	// Two failures open the breaker, so the next two uploads aren't attempted
+	for _, messageID := range []string{"image1", "image2", "image3", "image4"} {
+		save(messageID)
+	}
+
+	mockWebDAV.mu.Lock()
+	if mockWebDAV.putCalls != 2 {
+		t.Errorf("Expected 2 upload attempts before the breaker opened, got %d", mockWebDAV.putCalls)
+	}
+	mockWebDAV.failPuts = false
+	mockWebDAV.mu.Unlock()
+
+	breaker := mediaStore.GetCloudStats().CircuitBreaker
+	if breaker == nil {
+		t.Fatalf("Expected circuit breaker stats")
+	}
+	if breaker.State != media.BreakerOpen || breaker.SkippedUploads != 2 || breaker.RetryAt == nil {
+		t.Errorf("Expected an open breaker that skipped 2 uploads, got %+v", breaker)
+	}
+
+	// After the cooldown a test upload goes through, closing the breaker and re-queuing the skipped files
+	time.Sleep(time.Duration(cfg.CloudBreakerCooldownSeconds) * time.Second)
+	save("image5")
+
+	breaker = mediaStore.GetCloudStats().CircuitBreaker
+	if breaker.State != media.BreakerClosed {
+		t.Errorf("Expected the breaker to close after a successful upload, got %s", breaker.State)
+	}
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+
+	if len(mockWebDAV.files) != 5 {
+		t.Errorf("Expected all 5 files to be uploaded after recovery, got %d", len(mockWebDAV.files))
+	}
+}
+
+// alertRecorder is a notifier that passes alerts on to a channel
+type alertRecorder chan notify.Alert
+
+// Notify records the alert
+func (r alertRecorder) Notify(ctx context.Context, alert notify.Alert) error {
+	r <- alert
+	return nil
+}
+
+// TestWebDAVUploadFailurePolicy tests that a failed upload is retried later with queue_retry
+// and reported with alert
+func TestWebDAVUploadFailurePolicy(t *testing.T) {
+	// Set up the test environment
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.UploadRetryDelaySeconds = 1
+	mediaStore := media.NewMediaStore(cfg, logger)
+	alerts := make(alertRecorder, 10)
+	mediaStore.SetNotifier(alerts)
+
+	setFailing := func(failing bool) {
+		mockWebDAV.mu.Lock()
+		defer mockWebDAV.mu.Unlock()
+		mockWebDAV.failPuts = failing
+	}
+	save := func(messageID string) string {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content of " + messageID)),
+			ContentType: "image/jpeg",
+		}
+		filePath, err := mediaStore.SaveMedia(context.Background(), messageID, "image", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		mediaStore.WaitForUploads()
+		return filePath
+	}
+
+	// With alert, the failed file is named in an alert
+	cfg.UploadFailurePolicy = media.UploadFailureAlert
+	setFailing(true)
+	filePath := save("image1")
+	select {
+	case alert := <-alerts:
+		if alert.Title != "Cloud upload failed" || !strings.Contains(alert.Message, filePath) {
+			t.Errorf("Expected an alert naming %s, got %+v", filePath, alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an alert for the failed upload")
+	}
+
+	// With queue_retry, failed files are uploaded by a backup sync once the server recovers
+	cfg.UploadFailurePolicy = media.UploadFailureQueueRetry
+	retried := save("image2")
+	if mediaStore.IsUploaded(retried) {
+		t.Fatalf("Expected the upload of %s to fail", retried)
+	}
+	setFailing(false)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(mediaStore.IsUploaded(filePath) && mediaStore.IsUploaded(retried)) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failed uploads to be retried")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mediaStore.WaitForUploads()
+}
+
+// TestWebDAVUploadFailurePolicyWhileBreakerOpen tests that uploads skipped by the open circuit breaker
+// follow UPLOAD_FAILURE_POLICY too, so queue_retry schedules a backup sync for them
+func TestWebDAVUploadFailurePolicyWhileBreakerOpen(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.CloudBreakerThreshold = 1
+	cfg.CloudBreakerCooldownSeconds = 1
+	cfg.UploadRetryDelaySeconds = 1
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	save := func(messageID string) string {
+		content := &linebot.MessageContentResponse{
+			Content:     io.NopCloser(strings.NewReader("content of " + messageID)),
+			ContentType: "image/jpeg",
+		}
+		filePath, err := mediaStore.SaveMedia(context.Background(), messageID, "image", content)
+		if err != nil {
+			t.Fatalf("Failed to save media: %v", err)
+		}
+		mediaStore.WaitForUploads()
+		return filePath
+	}
+
+	// A failure that schedules nothing opens the breaker
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = true
+	mockWebDAV.mu.Unlock()
+	failed := save("image1")
+	if state := mediaStore.GetCloudStats().CircuitBreaker.State; state != media.BreakerOpen {
+		t.Fatalf("Expected the breaker to open, got %s", state)
+	}
+
+	// The next upload is skipped by the breaker, and queue_retry schedules a sync that uploads both files
+	cfg.UploadFailurePolicy = media.UploadFailureQueueRetry
+	skipped := save("image2")
+
+	mockWebDAV.mu.Lock()
+	if mockWebDAV.putCalls != 1 {
+		t.Errorf("Expected the breaker to skip the second upload, got %d upload attempts", mockWebDAV.putCalls)
+	}
+	mockWebDAV.failPuts = false
+	mockWebDAV.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(mediaStore.IsUploaded(failed) && mediaStore.IsUploaded(skipped)) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a retry sync to be scheduled for the skipped upload")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mediaStore.WaitForUploads()
+}
+
+// TestWebDAVFailedUploadsRecordedPending tests that failed uploads are recorded as pending in the upload index,
+// and that pending files, including those an older index recorded as failed, are uploaded by a backup sync
+func TestWebDAVFailedUploadsRecordedPending(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = true
+	mockWebDAV.mu.Unlock()
+
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(strings.NewReader("image content")),
+		ContentType: "image/jpeg",
+	}
+	filePath, err := mediaStore.SaveMedia(context.Background(), "image1", "image", content)
+	if err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	mediaStore.WaitForUploads()
+
+	indexPath := filepath.Join(cfg.StorageDir, ".upload_index.json")
+	readIndex := func() map[string]media.UploadRecord {
+		data, err := os.ReadFile(indexPath)
+		if err != nil {
+			t.Fatalf("Failed to read upload index: %v", err)
+		}
+		var records map[string]media.UploadRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			t.Fatalf("Failed to parse upload index: %v", err)
+		}
+		return records
+	}
+
+	key, _ := filepath.Rel(cfg.StorageDir, filePath)
+	key = filepath.ToSlash(key)
+	if record := readIndex()[key]; record.Status != media.UploadStatusPending || record.Error == "" {
+		t.Fatalf("Expected the failed upload to be recorded as pending with its error, got %+v", record)
+	}
+
+	// An older index recorded the failure as failed
+	legacy, err := json.Marshal(map[string]media.UploadRecord{key: {Status: "failed", Error: "server error"}})
+	if err != nil {
+		t.Fatalf("Failed to encode upload index: %v", err)
+	}
+	if err := os.WriteFile(indexPath, legacy, 0644); err != nil {
+		t.Fatalf("Failed to write upload index: %v", err)
+	}
+
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = false
+	mockWebDAV.mu.Unlock()
+
+	restarted := media.NewMediaStore(cfg, logger)
+	if found, err := restarted.SyncBackups(context.Background()); err != nil || found != 1 {
+		t.Fatalf("Expected the backup sync to find the pending file, got %d (%v)", found, err)
+	}
+	restarted.WaitForUploads()
+
+	if !restarted.IsUploaded(filePath) {
+		t.Errorf("Expected the pending file to be uploaded by the backup sync")
+	}
+	if record := readIndex()[key]; record.Status != media.UploadStatusUploaded {
+		t.Errorf("Expected the file to be recorded as uploaded, got %+v", record)
+	}
+}
+
+// TestWebDAVStopSweeps tests that shutdown doesn't wait for a backup sync held up by the open circuit breaker,
+// or for a scheduled retry of failed uploads
+func TestWebDAVStopSweeps(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	cfg.CloudBreakerThreshold = 1
+	cfg.CloudBreakerCooldownSeconds = 60
+	cfg.UploadFailurePolicy = media.UploadFailureQueueRetry
+	cfg.UploadRetryDelaySeconds = 1
+	mediaStore := media.NewMediaStore(cfg, logger)
+
+	mockWebDAV.mu.Lock()
+	mockWebDAV.failPuts = true
+	mockWebDAV.mu.Unlock()
+
+	// The failed upload opens the breaker and schedules a retry
+	content := &linebot.MessageContentResponse{
+		Content:     io.NopCloser(strings.NewReader("image content")),
+		ContentType: "image/jpeg",
+	}
+	if _, err := mediaStore.SaveMedia(context.Background(), "image1", "image", content); err != nil {
+		t.Fatalf("Failed to save media: %v", err)
+	}
+	mediaStore.WaitForUploads()
+
+	// The sync waits for the breaker's cooldown
+	if found, err := mediaStore.SyncBackups(context.Background()); err != nil || found != 1 {
+		t.Fatalf("Expected the sync to find the failed file, got %d (%v)", found, err)
+	}
+
+	mediaStore.StopSweeps()
+	waitForUploads := func() {
+		done := make(chan struct{})
+		go func() {
+			mediaStore.WaitForUploads()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the stopped sync not to hold up shutdown")
+		}
+	}
+	waitForUploads()
+
+	// The scheduled retry doesn't start a sync after the shutdown
+	time.Sleep(1500 * time.Millisecond)
+	waitForUploads()
+	if _, err := mediaStore.SyncBackups(context.Background()); !errors.Is(err, media.ErrSweepsStopped) {
+		t.Errorf("Expected syncs to be refused after StopSweeps, got %v", err)
+	}
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+	if mockWebDAV.putCalls != 1 {
+		t.Errorf("Expected only the first upload attempt, got %d", mockWebDAV.putCalls)
+	}
+}
+
+// TestWebDAVHealthCheckCached tests that frequent health checks reuse the last cloud storage check
+func TestWebDAVHealthCheckCached(t *testing.T) {
+	mockWebDAV, cfg, logger, cleanup := setupWebDAV(t)
+	defer cleanup()
+
+	mediaStore := media.NewMediaStore(cfg, logger)
+	healthHandler := handler.NewHealthCheckHandler(logger, mediaStore)
+
+	mockWebDAV.mu.Lock()
+	before := mockWebDAV.pings
+	mockWebDAV.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		res := httptest.NewRecorder()
+		healthHandler.HandleHealthCheck(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		var health handler.HealthCheckResponse
+		if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+			t.Fatalf("Failed to decode health response: %v", err)
+		}
+		if health.Status != "OK" || health.Cloud.Status != "OK" {
+			t.Errorf("Expected a healthy cloud backend, got %+v", health.Cloud)
+		}
+	}
+
+	mockWebDAV.mu.Lock()
+	defer mockWebDAV.mu.Unlock()
+	if pings := mockWebDAV.pings - before; pings != 1 {
+		t.Errorf("Expected the WebDAV server to be checked once, got %d checks", pings)
+	}
+}
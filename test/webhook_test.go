@@ -2,6 +2,7 @@ package test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -31,6 +32,9 @@ const (
 	testChannelToken  = "test_channel_token"
 	testStorageDir    = "/tmp/line_file_catcher_test"
 	testLogDir        = "/tmp/line_file_catcher_test/logs"
+
+	// expiredReplyToken is rejected by the mock LINE server as an invalid reply token
+	expiredReplyToken = "expired_reply_token"
 )
 
 // mockLineServer creates a mock LINE API server for testing
@@ -39,6 +43,14 @@ type mockLineServer struct {
 	messageContentMap map[string][]byte
 	contentTypeMap    map[string]string
 	repliesReceived   []linebot.Message
+	pushesReceived    []linebot.Message
+	replyTokens       []string          // Reply token of each successful reply request
+	pushTargets       []string          // Recipient of each successful push request
+	profileLanguages  map[string]string // User ID to profile language
+	profileRequests   int
+	messageRequests   int // Reply and push requests, including failed ones
+	failMessages      int // Number of upcoming reply and push requests to fail
+	failStatus        int // Status code of the failed requests
 }
 
 // newMockLineServer creates a new mock LINE API server
@@ -47,6 +59,8 @@ func newMockLineServer() *mockLineServer {
 		messageContentMap: make(map[string][]byte),
 		contentTypeMap:    make(map[string]string),
 		repliesReceived:   make([]linebot.Message, 0),
+		pushesReceived:    make([]linebot.Message, 0),
+		profileLanguages:  make(map[string]string),
 	}
 
 	// Create a test server
@@ -64,6 +78,12 @@ func newMockLineServer() *mockLineServer {
 			}
 		}
 
+		// Match user profile endpoint: "/v2/bot/profile/%s"
+		if profileRegex := regexp.MustCompile(`^/v2/bot/profile/([^/]+)$`); profileRegex.MatchString(r.URL.Path) {
+			mock.handleProfileRequest(w, profileRegex.FindStringSubmatch(r.URL.Path)[1])
+			return
+		}
+
 		// Handle other LINE API endpoints based on exact path
 		switch r.URL.Path {
 		// Message API endpoints
@@ -71,7 +91,7 @@ func newMockLineServer() *mockLineServer {
 			fmt.Printf("Handling reply message request\n")
 			mock.handleReplyRequest(w, r)
 		case "/v2/bot/message/push":
-			mock.handleDefaultSuccess(w, r)
+			mock.handlePushRequest(w, r)
 		case "/v2/bot/message/multicast":
 			mock.handleDefaultSuccess(w, r)
 		case "/v2/bot/message/broadcast":
@@ -200,21 +220,91 @@ func (m *mockLineServer) handleReplyRequest(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// For each message, try to parse it as a text message
-	for _, msgJSON := range replyRequest.Messages {
+	if m.failMessage(w) {
+		return
+	}
+
+	// Reject expired reply tokens the way LINE does
+	if replyRequest.ReplyToken == expiredReplyToken {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"Invalid reply token"}`))
+		return
+	}
+
+	m.repliesReceived = append(m.repliesReceived, parseTextMessages(replyRequest.Messages)...)
+	m.replyTokens = append(m.replyTokens, replyRequest.ReplyToken)
+
+	// Respond with success (as per LINE API documentation)
+	m.handleDefaultSuccess(w, r)
+}
+
+// handleProfileRequest handles user profile requests
+func (m *mockLineServer) handleProfileRequest(w http.ResponseWriter, userID string) {
+	m.profileRequests++
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"userId":      userID,
+		"displayName": "Test User",
+		"language":    m.profileLanguages[userID],
+	})
+}
+
+// handlePushRequest handles push message requests
+func (m *mockLineServer) handlePushRequest(w http.ResponseWriter, r *http.Request) {
+	var pushRequest struct {
+		To       string            `json:"to"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	fmt.Printf("Push request body: %s\n", string(body))
+
+	if err := json.Unmarshal(body, &pushRequest); err != nil || pushRequest.To == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if m.failMessage(w) {
+		return
+	}
+
+	m.pushesReceived = append(m.pushesReceived, parseTextMessages(pushRequest.Messages)...)
+	m.pushTargets = append(m.pushTargets, pushRequest.To)
+
+	m.handleDefaultSuccess(w, r)
+}
+
+// failMessage counts a reply or push request and fails it if failures were requested
+func (m *mockLineServer) failMessage(w http.ResponseWriter) bool {
+	m.messageRequests++
+	if m.failMessages <= 0 {
+		return false
+	}
+
+	m.failMessages--
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(m.failStatus)
+	w.Write([]byte(`{"message":"Simulated failure"}`))
+	return true
+}
+
+// parseTextMessages returns the text messages in a reply or push request
+func parseTextMessages(messages []json.RawMessage) []linebot.Message {
+	var parsed []linebot.Message
+	for _, msgJSON := range messages {
 		var textMsg struct {
 			Type string `json:"type"`
 			Text string `json:"text"`
 		}
 
 		if err := json.Unmarshal(msgJSON, &textMsg); err == nil && textMsg.Type == "text" {
-			m.repliesReceived = append(m.repliesReceived, linebot.NewTextMessage(textMsg.Text))
-			fmt.Printf("Received reply message: %s\n", textMsg.Text)
+			parsed = append(parsed, linebot.NewTextMessage(textMsg.Text))
+			fmt.Printf("Received message: %s\n", textMsg.Text)
 		}
 	}
-
-	// Respond with success (as per LINE API documentation)
-	m.handleDefaultSuccess(w, r)
+	return parsed
 }
 
 // handleDefaultSuccess responds with a standard success response
@@ -268,12 +358,14 @@ func setup(t *testing.T) (*mockLineServer, *handler.WebhookHandler, *config.Conf
 
 	// Create a test config
 	cfg := &config.Config{
-		ChannelSecret: testChannelSecret,
-		ChannelToken:  testChannelToken,
-		StorageDir:    testStorageDir,
-		LogDir:        testLogDir,
-		Debug:         true,
-		Port:          "8080",
+		ChannelSecret:       testChannelSecret,
+		ChannelToken:        testChannelToken,
+		StorageDir:          testStorageDir,
+		LogDir:              testLogDir,
+		Debug:               true,
+		Port:                "8080",
+		MaxWebhookBodyBytes: 1 << 20,
+		SendConfirmation:    true,
 	}
 
 	// Create directories if they don't exist
@@ -296,7 +388,7 @@ func setup(t *testing.T) (*mockLineServer, *handler.WebhookHandler, *config.Conf
 	mediaStore := media.NewMediaStore(cfg, logger)
 
 	// Create a webhook handler
-	webhookHandler := handler.NewWebhookHandler(lineClient, mediaStore, logger)
+	webhookHandler := handler.NewWebhookHandler(cfg, lineClient, mediaStore, logger)
 
 	// Return a cleanup function
 	cleanup := func() {
@@ -309,6 +401,46 @@ func setup(t *testing.T) (*mockLineServer, *handler.WebhookHandler, *config.Conf
 	return mockServer, webhookHandler, cfg, mediaStore, cleanup
 }
 
+// setupWithFakeStore sets up a webhook handler that saves to an in-memory media store
+func setupWithFakeStore(t *testing.T) (*mockLineServer, *handler.WebhookHandler, *fakeMediaStore, func()) {
+	// Create a mock LINE server
+	mockServer := newMockLineServer()
+
+	// Set environment variable to point to the mock server
+	os.Setenv("LINE_API_ENDPOINT", mockServer.getEndpointURL())
+
+	cfg := &config.Config{
+		ChannelSecret:       testChannelSecret,
+		ChannelToken:        testChannelToken,
+		LogDir:              t.TempDir(),
+		Debug:               true,
+		MaxWebhookBodyBytes: 1 << 20,
+		SendConfirmation:    true,
+		ProfileLanguage:     true,
+	}
+
+	logger, err := utils.NewLogger(cfg.LogDir)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	lineClient, err := lineapi.NewClient(testChannelSecret, testChannelToken)
+	if err != nil {
+		t.Fatalf("Failed to create LINE client: %v", err)
+	}
+
+	mediaStore := newFakeMediaStore()
+	webhookHandler := handler.NewWebhookHandler(cfg, lineClient, mediaStore, logger)
+
+	cleanup := func() {
+		mockServer.close()
+		logger.Close()
+		os.Unsetenv("LINE_API_ENDPOINT")
+	}
+
+	return mockServer, webhookHandler, mediaStore, cleanup
+}
+
 // setupTestData creates the test data directory if it doesn't exist
 func setupTestData(t *testing.T) {
 	testDataDir := "../test_data"
@@ -428,6 +560,33 @@ func TestWebhookHandlerWithImageMessage(t *testing.T) {
 	}
 }
 
+// TestWebhookHandlerSavesImagePreview tests that SAVE_IMAGE_PREVIEW stores the preview next to the original
+func TestWebhookHandlerSavesImagePreview(t *testing.T) {
+	mockServer, webhookHandler, cfg, mediaStore, cleanup := setup(t)
+	defer cleanup()
+
+	cfg.SaveImagePreview = true
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	originals, _ := filepath.Glob(filepath.Join(testStorageDir, utils.GetDateString(), "image_*_original.jpg"))
+	if len(originals) != 1 {
+		t.Fatalf("Expected one original image, got %v", originals)
+	}
+	preview := strings.TrimSuffix(originals[0], "_original.jpg") + "_preview.jpg"
+	if _, err := os.Stat(preview); err != nil {
+		t.Errorf("Expected the preview to share the original's base name: %v", err)
+	}
+
+	stats := mediaStore.GetStats()
+	if stats.ImageCount != 1 || stats.ImagePreviewCount != 1 || stats.ImagePreviewBytes != int64(len("image bytes")) {
+		t.Errorf("Expected 1 image and 1 preview in the stats, got %+v", stats)
+	}
+}
+
 // TestWebhookHandlerWithVideoMessage tests the webhook handler with a video message
 func TestWebhookHandlerWithVideoMessage(t *testing.T) {
 	// Set up test data
@@ -510,13 +669,235 @@ func TestWebhookHandlerWithVideoMessage(t *testing.T) {
 	}
 }
 
+// TestWebhookHandlerWithConfirmationDisabled tests that no reply is sent when confirmations are disabled
+func TestWebhookHandlerWithConfirmationDisabled(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockServer, webhookHandler, cfg, mediaStore, cleanup := setup(t)
+	defer cleanup()
+
+	// Disable confirmation messages
+	cfg.SendConfirmation = false
+
+	// Read the sample image file
+	imageID := "image789"
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	// Add test content to the mock server
+	mockServer.addTestContent(imageID, "image/jpeg", imageContent)
+
+	// Create a webhook request with an image message
+	webhookRequest := createImageMessageWebhook(imageID)
+	body, _ := json.Marshal(webhookRequest)
+
+	// Create a test HTTP request
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+	req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, body))
+	req.Header.Set("Content-Type", "application/json")
+
+	// Create a response recorder
+	res := httptest.NewRecorder()
+
+	// Handle the request
+	webhookHandler.HandleWebhook(res, req)
+
+	// Check the response
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, res.Code)
+	}
+
+	// Wait for any downloads to complete
+	mediaStore.WaitForDownloads()
+
+	// The file should still be saved
+	if stats := mediaStore.GetStats(); stats.ImageCount != 1 {
+		t.Errorf("Expected 1 saved image, got %d", stats.ImageCount)
+	}
+
+	// But no reply should have been sent
+	if len(mockServer.repliesReceived) != 0 {
+		t.Errorf("Expected no reply messages, got %d", len(mockServer.repliesReceived))
+	}
+}
+
+// TestWebhookHandlerDeduplicatesMessages tests that a message delivered twice within the dedup window is saved once
+func TestWebhookHandlerDeduplicatesMessages(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	// Set up the test environment
+	mockServer, webhookHandler, cfg, mediaStore, cleanup := setup(t)
+	defer cleanup()
+
+	cfg.DedupWindowSeconds = 1
+
+	imageID := "image_dedup"
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	mockServer.addTestContent(imageID, "image/jpeg", imageContent)
+
+	body, _ := json.Marshal(createImageMessageWebhook(imageID))
+	deliver := func() {
+		req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, body))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+
+		webhookHandler.HandleWebhook(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, res.Code)
+		}
+		mediaStore.WaitForDownloads()
+	}
+
+	// Two deliveries within the window save a single file
+	deliver()
+	deliver()
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 1 {
+		t.Errorf("Expected 1 saved image within the dedup window, got %d", stats.ImageCount)
+	}
+
+	// A delivery after the window has passed is saved again
+	time.Sleep(1100 * time.Millisecond)
+	deliver()
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 2 {
+		t.Errorf("Expected 2 saved images after the dedup window, got %d", stats.ImageCount)
+	}
+
+	files, err := os.ReadDir(filepath.Join(testStorageDir, time.Now().Format("2006-01-02")))
+	if err != nil {
+		t.Fatalf("Failed to read storage directory: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files in storage, got %d", len(files))
+	}
+}
+
+// TestWebhookHandlerSkipsStaleEvents tests that events older than MAX_EVENT_AGE are acknowledged but not processed
+func TestWebhookHandlerSkipsStaleEvents(t *testing.T) {
+	setupTestData(t)
+
+	mockServer, webhookHandler, cfg, mediaStore, cleanup := setup(t)
+	defer cleanup()
+
+	cfg.MaxEventAge = 60
+
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	mockServer.addTestContent("image_stale", "image/jpeg", imageContent)
+	mockServer.addTestContent("image_fresh", "image/jpeg", imageContent)
+
+	// A replayed payload from an hour ago is skipped
+	stale := createImageMessageWebhook("image_stale")
+	stale["events"].([]map[string]interface{})[0]["timestamp"] = time.Now().Add(-time.Hour).UnixMilli()
+	if code := sendWebhook(webhookHandler, stale); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	mediaStore.WaitForDownloads()
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 0 {
+		t.Errorf("Expected the stale event to be skipped, got %d saved images", stats.ImageCount)
+	}
+	if len(mockServer.repliesReceived) != 0 {
+		t.Errorf("Expected no reply to a stale event, got %d replies", len(mockServer.repliesReceived))
+	}
+
+	// A recent event within the allowed age is processed
+	recent := createImageMessageWebhook("image_fresh")
+	recent["events"].([]map[string]interface{})[0]["timestamp"] = time.Now().Add(-30 * time.Second).UnixMilli()
+	if code := sendWebhook(webhookHandler, recent); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	mediaStore.WaitForDownloads()
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 1 {
+		t.Errorf("Expected the recent event to be saved, got %d saved images", stats.ImageCount)
+	}
+
+	// With the check disabled the old payload is processed
+	cfg.MaxEventAge = 0
+	if code := sendWebhook(webhookHandler, stale); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	mediaStore.WaitForDownloads()
+
+	if stats := mediaStore.GetStats(); stats.ImageCount != 2 {
+		t.Errorf("Expected the old event to be saved without MAX_EVENT_AGE, got %d saved images", stats.ImageCount)
+	}
+}
+
+// TestWebhookHandlerPushesWithoutReplyToken tests that confirmations are pushed when the reply token is missing or expired
+func TestWebhookHandlerPushesWithoutReplyToken(t *testing.T) {
+	// Set up test data
+	setupTestData(t)
+
+	imageContent, err := os.ReadFile("../test_data/sample_image.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		replyToken string
+	}{
+		{"empty reply token", ""},
+		{"expired reply token", expiredReplyToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockServer, webhookHandler, _, mediaStore, cleanup := setup(t)
+			defer cleanup()
+
+			imageID := "image_push"
+			mockServer.addTestContent(imageID, "image/jpeg", imageContent)
+
+			webhookRequest := createImageMessageWebhook(imageID)
+			webhookRequest["events"].([]map[string]interface{})[0]["replyToken"] = tc.replyToken
+			body, _ := json.Marshal(webhookRequest)
+
+			req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+			req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, body))
+			req.Header.Set("Content-Type", "application/json")
+			res := httptest.NewRecorder()
+
+			webhookHandler.HandleWebhook(res, req)
+
+			if res.Code != http.StatusOK {
+				t.Errorf("Expected status code %d, got %d", http.StatusOK, res.Code)
+			}
+			mediaStore.WaitForDownloads()
+
+			if len(mockServer.repliesReceived) != 0 {
+				t.Errorf("Expected no reply messages, got %d", len(mockServer.repliesReceived))
+			}
+			if len(mockServer.pushesReceived) != 1 {
+				t.Fatalf("Expected the confirmation to be pushed, got %d push messages", len(mockServer.pushesReceived))
+			}
+			if textMsg, ok := mockServer.pushesReceived[0].(*linebot.TextMessage); !ok || !strings.Contains(textMsg.Text, "image") {
+				t.Errorf("Expected pushed confirmation to mention 'image', got: %v", mockServer.pushesReceived[0])
+			}
+		})
+	}
+}
+
 // TestWebhookHandlerWithInvalidSignature tests the webhook handler with an invalid signature
 func TestWebhookHandlerWithInvalidSignature(t *testing.T) {
 	// Set up test data
 	setupTestData(t)
 
 	// Set up the test environment
-	_, webhookHandler, _, _, cleanup := setup(t)
+	_, webhookHandler, cfg, mediaStore, cleanup := setup(t)
 	defer cleanup()
 
 	// Create a webhook request
@@ -541,6 +922,44 @@ func TestWebhookHandlerWithInvalidSignature(t *testing.T) {
 	if res.Code != http.StatusBadRequest {
 		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, res.Code)
 	}
+
+	// The rejection is counted in the stats output
+	logger, err := utils.NewLogger(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+	lineClient, err := lineapi.NewClient(testChannelSecret, testChannelToken)
+	if err != nil {
+		t.Fatalf("Failed to create LINE client: %v", err)
+	}
+	statsHandler := handler.NewStatsHandler(cfg, logger, mediaStore, lineClient)
+	statsHandler.TrackWebhook(webhookHandler.WebhookStats)
+
+	signatureFailures := func() int64 {
+		res := httptest.NewRecorder()
+		statsHandler.HandleStats(res, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+		var stats handler.StatsResponse
+		if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+			t.Fatalf("Failed to decode stats response: %v", err)
+		}
+		if stats.Webhook == nil {
+			t.Fatal("Expected webhook stats in the stats response")
+		}
+		return stats.Webhook.SignatureFailures
+	}
+	if failures := signatureFailures(); failures != 1 {
+		t.Errorf("Expected 1 signature failure, got %d", failures)
+	}
+
+	// Valid requests don't count
+	if code := sendWebhook(webhookHandler, map[string]interface{}{"events": []interface{}{}}); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	if failures := signatureFailures(); failures != 1 {
+		t.Errorf("Expected the signature failures to stay at 1 after a valid request, got %d", failures)
+	}
 }
 
 // Helper function to create a webhook request with an image message
@@ -584,3 +1003,878 @@ func createVideoMessageWebhook(videoID string) map[string]interface{} {
 		},
 	}
 }
+
+// sendWebhook signs a webhook body and passes it to the handler, returning the response status
+func sendWebhook(webhookHandler *handler.WebhookHandler, webhookRequest map[string]interface{}) int {
+	body, _ := json.Marshal(webhookRequest)
+
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+	req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, body))
+	req.Header.Set("Content-Type", "application/json")
+
+	res := httptest.NewRecorder()
+	webhookHandler.HandleWebhook(res, req)
+	return res.Code
+}
+
+// TestWebhookHandlerSavesToMediaSaver tests what the handler asks the media store to save
+func TestWebhookHandlerSavesToMediaSaver(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	imageContent := []byte("image bytes")
+	mockServer.addTestContent("image123", "image/png", imageContent)
+
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	saved := mediaStore.savedFiles()
+	if len(saved) != 1 {
+		t.Fatalf("Expected 1 saved file, got %d", len(saved))
+	}
+	if saved[0].MessageID != "image123" || saved[0].MessageType != "image" || saved[0].ContentType != "image/png" {
+		t.Errorf("Unexpected saved media: %+v", saved[0])
+	}
+	if !bytes.Equal(saved[0].Content, imageContent) {
+		t.Errorf("Expected content %q, got %q", imageContent, saved[0].Content)
+	}
+
+	if errs := mediaStore.recordedErrors(); len(errs) != 0 {
+		t.Errorf("Expected no recorded errors, got %v", errs)
+	}
+}
+
+// TestWebhookHandlerReportsSaveFailure tests that a failed save is recorded and the user is told
+func TestWebhookHandlerReportsSaveFailure(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	mediaStore.saveErr = media.ErrDiskFull
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if saved := mediaStore.savedFiles(); len(saved) != 0 {
+		t.Errorf("Expected nothing to be saved, got %d files", len(saved))
+	}
+	if errs := mediaStore.recordedErrors(); len(errs) != 1 || errs[0] != "save" {
+		t.Errorf("Expected one save error to be recorded, got %v", errs)
+	}
+	if len(mockServer.repliesReceived) != 1 {
+		t.Errorf("Expected a failure reply, got %d replies", len(mockServer.repliesReceived))
+	}
+}
+
+// TestWebhookHandlerReportsExpiredContent tests that content LINE no longer has is reported to the sender
+// and counted as expired rather than as a fetch failure
+func TestWebhookHandlerReportsExpiredContent(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	// The mock server answers 404 for content it doesn't have
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("expired123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if expired := mediaStore.expired.Load(); expired != 1 {
+		t.Errorf("Expected 1 expired message, got %d", expired)
+	}
+	if errs := mediaStore.recordedErrors(); len(errs) != 0 {
+		t.Errorf("Expected no errors to be recorded, got %v", errs)
+	}
+	if len(mockServer.repliesReceived) != 1 {
+		t.Fatalf("Expected an expired content reply, got %d replies", len(mockServer.repliesReceived))
+	}
+	if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, "no longer available") {
+		t.Errorf("Expected the reply to say the content expired, got %q", text)
+	}
+}
+
+// TestWebhookHandlerSkipsUncapturedTypes tests that media types left out of CAPTURE_TYPES are neither saved nor confirmed
+func TestWebhookHandlerSkipsUncapturedTypes(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		SendConfirmation:    true,
+		CaptureTypes:        []string{"image"},
+	})
+
+	mockServer.addTestContent("video123", "video/mp4", []byte("video bytes"))
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	if code := sendWebhook(webhookHandler, createVideoMessageWebhook("video123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if saved := mediaStore.savedFiles(); len(saved) != 0 {
+		t.Errorf("Expected the video not to be saved, got %d files", len(saved))
+	}
+	if len(mockServer.repliesReceived) != 0 || len(mockServer.pushesReceived) != 0 {
+		t.Errorf("Expected no messages for the video, got %d replies and %d pushes",
+			len(mockServer.repliesReceived), len(mockServer.pushesReceived))
+	}
+	if errs := mediaStore.recordedErrors(); len(errs) != 0 {
+		t.Errorf("Expected no recorded errors, got %v", errs)
+	}
+
+	// Captured types are still saved and confirmed
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	if saved := mediaStore.savedFiles(); len(saved) != 1 || saved[0].MessageID != "image123" {
+		t.Errorf("Expected only the image to be saved, got %+v", saved)
+	}
+	if len(mockServer.repliesReceived) != 1 {
+		t.Errorf("Expected a confirmation for the image, got %d replies", len(mockServer.repliesReceived))
+	}
+}
+
+// createMediaEvent creates a media message event from a source, without a reply token if replyToken is empty
+func createMediaEvent(messageID, mediaType, replyToken string, source map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "message",
+		"replyToken": replyToken,
+		"source":     source,
+		"timestamp":  time.Now().Unix() * 1000,
+		"message": map[string]interface{}{
+			"id":   messageID,
+			"type": mediaType,
+		},
+	}
+}
+
+// TestWebhookHandlerBatchesConfirmations tests that the media a request brings from a chat
+// is confirmed with a single message built from BATCH_REPLY_TEMPLATE
+func TestWebhookHandlerBatchesConfirmations(t *testing.T) {
+	userSource := map[string]interface{}{"type": "user", "userId": "user123"}
+	groupSource := map[string]interface{}{"type": "group", "groupId": "group123", "userId": "user456"}
+
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		SendConfirmation:    true,
+		BatchReplyTemplate:  "Batch of {count}: {summary}",
+	})
+
+	for _, messageID := range []string{"image1", "image2", "video1", "image3", "image4", "image5", "video2"} {
+		mockServer.addTestContent(messageID, "application/octet-stream", []byte(messageID))
+	}
+
+	t.Run("one chat", func(t *testing.T) {
+		webhookRequest := map[string]interface{}{
+			"events": []map[string]interface{}{
+				createMediaEvent("image1", "image", "reply1", userSource),
+				createMediaEvent("image2", "image", "reply2", userSource),
+				createMediaEvent("video1", "video", "reply3", userSource),
+			},
+		}
+		if code := sendWebhook(webhookHandler, webhookRequest); code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+		}
+
+		if saved := mediaStore.savedFiles(); len(saved) != 3 {
+			t.Fatalf("Expected 3 saved files, got %d", len(saved))
+		}
+		if len(mockServer.repliesReceived) != 1 || len(mockServer.pushesReceived) != 0 {
+			t.Fatalf("Expected 1 reply and no pushes, got %d replies and %d pushes",
+				len(mockServer.repliesReceived), len(mockServer.pushesReceived))
+		}
+		if token := mockServer.replyTokens[0]; token != "reply1" {
+			t.Errorf("Expected the first reply token to be used, got %q", token)
+		}
+		expected := "Batch of 3: 2 images and 1 video"
+		if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; text != expected {
+			t.Errorf("Expected confirmation %q, got %q", expected, text)
+		}
+	})
+
+	t.Run("two chats", func(t *testing.T) {
+		mockServer.repliesReceived, mockServer.replyTokens = nil, nil
+
+		// The group's events have no reply token, so its confirmation is pushed
+		webhookRequest := map[string]interface{}{
+			"events": []map[string]interface{}{
+				createMediaEvent("image3", "image", "", groupSource),
+				createMediaEvent("image4", "image", "reply4", userSource),
+				createMediaEvent("image5", "image", "", groupSource),
+				createMediaEvent("video2", "video", "reply5", userSource),
+			},
+		}
+		if code := sendWebhook(webhookHandler, webhookRequest); code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+		}
+
+		if len(mockServer.repliesReceived) != 1 || len(mockServer.pushesReceived) != 1 {
+			t.Fatalf("Expected 1 reply and 1 push, got %d replies and %d pushes",
+				len(mockServer.repliesReceived), len(mockServer.pushesReceived))
+		}
+		if token := mockServer.replyTokens[0]; token != "reply4" {
+			t.Errorf("Expected the user chat to be replied to with its first token, got %q", token)
+		}
+		if expected, text := "Batch of 2: 1 image and 1 video", mockServer.repliesReceived[0].(*linebot.TextMessage).Text; text != expected {
+			t.Errorf("Expected user chat confirmation %q, got %q", expected, text)
+		}
+		if target := mockServer.pushTargets[0]; target != "group123" {
+			t.Errorf("Expected the group confirmation to be pushed to group123, got %q", target)
+		}
+		if expected, text := "Batch of 2: 2 images", mockServer.pushesReceived[0].(*linebot.TextMessage).Text; text != expected {
+			t.Errorf("Expected group confirmation %q, got %q", expected, text)
+		}
+	})
+}
+
+// TestWebhookHandlerRepliesInProfileLanguage tests that confirmations use the language of the sender's profile
+// and that the profile is only fetched once per user
+func TestWebhookHandlerRepliesInProfileLanguage(t *testing.T) {
+	mockServer, webhookHandler, _, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	mockServer.profileLanguages["user123"] = "th"
+	mockServer.addTestContent("image1", "image/jpeg", []byte("first"))
+	mockServer.addTestContent("image2", "image/jpeg", []byte("second"))
+
+	for _, imageID := range []string{"image1", "image2"} {
+		if code := sendWebhook(webhookHandler, createImageMessageWebhook(imageID)); code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	if len(mockServer.repliesReceived) != 2 {
+		t.Fatalf("Expected 2 replies, got %d", len(mockServer.repliesReceived))
+	}
+	for _, reply := range mockServer.repliesReceived {
+		text := reply.(*linebot.TextMessage).Text
+		if !strings.Contains(text, "รูปภาพ") {
+			t.Errorf("Expected a Thai confirmation, got %q", text)
+		}
+	}
+
+	if mockServer.profileRequests != 1 {
+		t.Errorf("Expected the profile to be fetched once, got %d requests", mockServer.profileRequests)
+	}
+}
+
+// TestWebhookHandlerRepliesInDefaultLanguage tests the fallback for profile languages without a catalog
+func TestWebhookHandlerRepliesInDefaultLanguage(t *testing.T) {
+	tests := []struct {
+		defaultLanguage string
+		expected        string
+	}{
+		{"th", "ได้รับรูปภาพของคุณแล้ว"},
+		{"fr", "Your image file has been received"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.defaultLanguage, func(t *testing.T) {
+			mockServer, webhookHandler, _, cleanup := setupWithFakeStore(t)
+			defer cleanup()
+
+			cfg := &config.Config{
+				ChannelSecret:       testChannelSecret,
+				MaxWebhookBodyBytes: 1 << 20,
+				SendConfirmation:    true,
+				DefaultLanguage:     tt.defaultLanguage,
+				ProfileLanguage:     true,
+			}
+			webhookHandler.ApplyConfig(cfg)
+
+			// LINE has no catalog for this profile language
+			mockServer.profileLanguages["user123"] = "de"
+			mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+			if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+			}
+
+			if len(mockServer.repliesReceived) != 1 {
+				t.Fatalf("Expected 1 reply, got %d", len(mockServer.repliesReceived))
+			}
+			if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, tt.expected) {
+				t.Errorf("Expected reply containing %q, got %q", tt.expected, text)
+			}
+		})
+	}
+}
+
+// TestWebhookHandlerKeepsFileMessageExtension tests that a file message is saved with its original extension
+func TestWebhookHandlerKeepsFileMessageExtension(t *testing.T) {
+	// Set up the test environment
+	mockServer, webhookHandler, _, _, cleanup := setup(t)
+	defer cleanup()
+
+	// LINE reports documents as generic binary content
+	mockServer.addTestContent("file123", "application/octet-stream", []byte("PK\x03\x04 docx content"))
+
+	webhookRequest := map[string]interface{}{
+		"events": []map[string]interface{}{
+			{
+				"type":       "message",
+				"replyToken": "reply789",
+				"source": map[string]interface{}{
+					"type":   "user",
+					"userId": "user789",
+				},
+				"timestamp": time.Now().Unix() * 1000,
+				"message": map[string]interface{}{
+					"id":       "file123",
+					"type":     "file",
+					"fileName": "Quarterly Report.docx",
+					"fileSize": 20,
+				},
+			},
+		},
+	}
+
+	if code := sendWebhook(webhookHandler, webhookRequest); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	files, err := filepath.Glob(filepath.Join(testStorageDir, time.Now().Format("2006-01-02"), "file_*"))
+	if err != nil {
+		t.Fatalf("Failed to list saved files: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 saved file, got %v", files)
+	}
+	if ext := filepath.Ext(files[0]); ext != ".docx" {
+		t.Errorf("Expected the file to be saved with its .docx extension, got %s", files[0])
+	}
+}
+
+// TestWebhookHandlerPushesAfterSlowSave tests that a confirmation is pushed rather than replied
+// when saving took longer than a reply token stays valid
+func TestWebhookHandlerPushesAfterSlowSave(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes:     1 << 20,
+		SendConfirmation:        true,
+		ReplyTokenMaxAgeSeconds: 1,
+	})
+	mediaStore.saveDelay = 1100 * time.Millisecond
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if len(mockServer.repliesReceived) != 0 {
+		t.Errorf("Expected no reply with an expired token, got %d", len(mockServer.repliesReceived))
+	}
+	if len(mockServer.pushesReceived) != 1 {
+		t.Errorf("Expected the confirmation to be pushed, got %d pushes", len(mockServer.pushesReceived))
+	}
+}
+
+// createTextMessageWebhook creates a webhook request with a text message from a user in the given chat
+func createTextMessageWebhook(source map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"events": []map[string]interface{}{
+			{
+				"type":       "message",
+				"replyToken": "reply321",
+				"source":     source,
+				"timestamp":  time.Now().Unix() * 1000,
+				"message": map[string]interface{}{
+					"id":   "text123",
+					"type": "text",
+					"text": "hello",
+				},
+			},
+		},
+	}
+}
+
+// TestWebhookHandlerRepliesToTextMessages tests the AUTO_REPLY_NON_MEDIA reply and its group setting
+func TestWebhookHandlerRepliesToTextMessages(t *testing.T) {
+	userSource := map[string]interface{}{"type": "user", "userId": "user123"}
+	groupSource := map[string]interface{}{"type": "group", "groupId": "group123", "userId": "user123"}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		inGroups bool
+		source   map[string]interface{}
+		replies  int
+	}{
+		{"disabled", false, false, userSource, 0},
+		{"user chat", true, false, userSource, 1},
+		{"group without group replies", true, false, groupSource, 0},
+		{"group with group replies", true, true, groupSource, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+			defer cleanup()
+
+			webhookHandler.ApplyConfig(&config.Config{
+				MaxWebhookBodyBytes:       1 << 20,
+				SendConfirmation:          true,
+				AutoReplyNonMedia:         tt.enabled,
+				AutoReplyNonMediaInGroups: tt.inGroups,
+			})
+
+			if code := sendWebhook(webhookHandler, createTextMessageWebhook(tt.source)); code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+			}
+
+			if len(mockServer.repliesReceived) != tt.replies {
+				t.Fatalf("Expected %d replies, got %d", tt.replies, len(mockServer.repliesReceived))
+			}
+			if tt.replies > 0 {
+				if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, "I only save images") {
+					t.Errorf("Expected the non-media reply, got %q", text)
+				}
+			}
+			if saved := mediaStore.savedFiles(); len(saved) != 0 {
+				t.Errorf("Expected nothing to be saved, got %d files", len(saved))
+			}
+		})
+	}
+}
+
+// createFollowWebhook creates a webhook request with a follow or unfollow event from a user
+func createFollowWebhook(eventType, userID string) map[string]interface{} {
+	event := map[string]interface{}{
+		"type": eventType,
+		"source": map[string]interface{}{
+			"type":   "user",
+			"userId": userID,
+		},
+		"timestamp": time.Now().Unix() * 1000,
+	}
+	// Unfollow events have no reply token
+	if eventType == "follow" {
+		event["replyToken"] = "reply_follow"
+	}
+
+	return map[string]interface{}{
+		"events": []map[string]interface{}{event},
+	}
+}
+
+// TestWebhookHandlerWelcomesFollowers tests the welcome reply and follower counts for follow and unfollow events
+func TestWebhookHandlerWelcomesFollowers(t *testing.T) {
+	mockServer, webhookHandler, _, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		SendWelcome:         true,
+	})
+
+	for _, userID := range []string{"user1", "user2"} {
+		if code := sendWebhook(webhookHandler, createFollowWebhook("follow", userID)); code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+		}
+	}
+	if code := sendWebhook(webhookHandler, createFollowWebhook("unfollow", "user1")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	// Only the follow events are answered
+	if len(mockServer.repliesReceived) != 2 {
+		t.Fatalf("Expected 2 welcome replies, got %d", len(mockServer.repliesReceived))
+	}
+	if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, "Thanks for adding me") {
+		t.Errorf("Expected the welcome message, got %q", text)
+	}
+	if len(mockServer.pushesReceived) != 0 {
+		t.Errorf("Expected no pushes, got %d", len(mockServer.pushesReceived))
+	}
+
+	expected := handler.FollowerStats{Follows: 2, Unfollows: 1, Net: 1}
+	if stats := webhookHandler.FollowerStats(); stats != expected {
+		t.Errorf("Expected follower stats %+v, got %+v", expected, stats)
+	}
+}
+
+// TestWebhookHandlerWelcomeDisabled tests that followers are still counted without the welcome message
+func TestWebhookHandlerWelcomeDisabled(t *testing.T) {
+	mockServer, webhookHandler, _, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		SendWelcome:         false,
+	})
+
+	if code := sendWebhook(webhookHandler, createFollowWebhook("follow", "user1")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if len(mockServer.repliesReceived) != 0 {
+		t.Errorf("Expected no welcome reply, got %d", len(mockServer.repliesReceived))
+	}
+	if stats := webhookHandler.FollowerStats(); stats.Follows != 1 || stats.Net != 1 {
+		t.Errorf("Expected 1 follow to be counted, got %+v", stats)
+	}
+}
+
+// createGroupWebhook creates a webhook request with a join, leave or memberJoined event for a group
+func createGroupWebhook(eventType, groupID string) map[string]interface{} {
+	event := map[string]interface{}{
+		"type": eventType,
+		"source": map[string]interface{}{
+			"type":    "group",
+			"groupId": groupID,
+		},
+		"timestamp": time.Now().Unix() * 1000,
+	}
+	switch eventType {
+	case "join":
+		event["replyToken"] = "reply_join"
+	case "memberJoined":
+		event["replyToken"] = "reply_member"
+		event["joined"] = map[string]interface{}{
+			"members": []map[string]interface{}{{"type": "user", "userId": "user123"}},
+		}
+	}
+
+	return map[string]interface{}{
+		"events": []map[string]interface{}{event},
+	}
+}
+
+// TestWebhookHandlerGreetsGroupsOnJoin tests that groups are greeted when the bot joins,
+// not when members join, and that media from a group the bot left isn't saved
+func TestWebhookHandlerGreetsGroupsOnJoin(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		SendConfirmation:    true,
+		SendGroupGreeting:   true,
+	})
+
+	for _, eventType := range []string{"join", "memberJoined", "leave"} {
+		if code := sendWebhook(webhookHandler, createGroupWebhook(eventType, "group123")); code != http.StatusOK {
+			t.Fatalf("Expected status code %d for %s, got %d", http.StatusOK, eventType, code)
+		}
+	}
+
+	if len(mockServer.repliesReceived) != 1 {
+		t.Fatalf("Expected only the join to be answered, got %d replies", len(mockServer.repliesReceived))
+	}
+	if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, "Hello everyone") {
+		t.Errorf("Expected the group greeting, got %q", text)
+	}
+
+	// A redelivered message from the group after the bot left is ignored
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+	webhookRequest := createImageMessageWebhook("image123")
+	webhookRequest["events"].([]map[string]interface{})[0]["source"] = map[string]interface{}{
+		"type":    "group",
+		"groupId": "group123",
+		"userId":  "user123",
+	}
+	if code := sendWebhook(webhookHandler, webhookRequest); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if saved := mediaStore.savedFiles(); len(saved) != 0 {
+		t.Errorf("Expected nothing to be saved from a group the bot left, got %d files", len(saved))
+	}
+	if len(mockServer.pushesReceived) != 0 {
+		t.Errorf("Expected nothing to be pushed to a group the bot left, got %d pushes", len(mockServer.pushesReceived))
+	}
+}
+
+// TestWebhookHandlerSkipsMediaWhilePaused tests that webhooks are acknowledged but nothing is saved while paused
+func TestWebhookHandlerSkipsMediaWhilePaused(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	mediaStore.paused.Store(true)
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d while paused, got %d", http.StatusOK, code)
+	}
+	if saved := mediaStore.savedFiles(); len(saved) != 0 {
+		t.Errorf("Expected nothing to be saved while paused, got %d files", len(saved))
+	}
+	if len(mockServer.repliesReceived) != 0 {
+		t.Errorf("Expected no confirmation while paused, got %d replies", len(mockServer.repliesReceived))
+	}
+}
+
+// TestWebhookHandlerRetriesMessages tests that replies are retried after transient errors but not permanent ones
+func TestWebhookHandlerRetriesMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		requests int
+		replies  int
+	}{
+		{"server error", http.StatusInternalServerError, 2, 3, 1},
+		{"rate limited", http.StatusTooManyRequests, 1, 2, 1},
+		{"retries exhausted", http.StatusServiceUnavailable, 5, 3, 0},
+		{"permanent error", http.StatusForbidden, 1, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer, webhookHandler, _, cleanup := setupWithFakeStore(t)
+			defer cleanup()
+
+			webhookHandler.ApplyConfig(&config.Config{
+				MaxWebhookBodyBytes: 1 << 20,
+				SendConfirmation:    true,
+				MessageRetryCount:   2,
+			})
+			mockServer.failMessages = tt.failures
+			mockServer.failStatus = tt.status
+			mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+			if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+			}
+
+			if mockServer.messageRequests != tt.requests {
+				t.Errorf("Expected %d reply attempts, got %d", tt.requests, mockServer.messageRequests)
+			}
+			if len(mockServer.repliesReceived) != tt.replies {
+				t.Errorf("Expected %d replies, got %d", tt.replies, len(mockServer.repliesReceived))
+			}
+		})
+	}
+}
+
+// TestWebhookHandlerUsesMessageDate tests that media is stored under the day the message was sent
+// rather than the day it was received, e.g. for a redelivered event
+func TestWebhookHandlerUsesMessageDate(t *testing.T) {
+	// Set up the test environment
+	mockServer, webhookHandler, _, _, cleanup := setup(t)
+	defer cleanup()
+
+	mockServer.addTestContent("image123", "image/jpeg", []byte("image bytes"))
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	webhookRequest := createImageMessageWebhook("image123")
+	webhookRequest["events"].([]map[string]interface{})[0]["timestamp"] = yesterday.UnixMilli()
+
+	if code := sendWebhook(webhookHandler, webhookRequest); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	files, err := filepath.Glob(filepath.Join(testStorageDir, yesterday.Format("2006-01-02"), "image_*"))
+	if err != nil {
+		t.Fatalf("Failed to list saved files: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected the image in yesterday's folder, got %v", files)
+	}
+
+	if today, _ := filepath.Glob(filepath.Join(testStorageDir, time.Now().Format("2006-01-02"), "image_*")); len(today) != 0 {
+		t.Errorf("Expected nothing in today's folder, got %v", today)
+	}
+}
+
+// gzipBody compresses body as a proxy in front of the webhook would
+func gzipBody(t *testing.T, body []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestWebhookHandlerAcceptsGzipBodies tests that gzip-compressed webhooks are verified against the uncompressed JSON
+func TestWebhookHandlerAcceptsGzipBodies(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	mockServer.addTestContent("gzip123", "image/png", []byte("image bytes"))
+
+	body, _ := json.Marshal(createImageMessageWebhook("gzip123"))
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(gzipBody(t, body)))
+	req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	res := httptest.NewRecorder()
+	webhookHandler.HandleWebhook(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, res.Code)
+	}
+
+	saved := mediaStore.savedFiles()
+	if len(saved) != 1 || saved[0].MessageID != "gzip123" {
+		t.Fatalf("Expected the gzipped webhook's image to be saved, got %+v", saved)
+	}
+
+	// A body that expands past the size limit is refused
+	bomb := make([]byte, 2<<20)
+	req = httptest.NewRequest("POST", "/webhook", bytes.NewReader(gzipBody(t, bomb)))
+	req.Header.Set("X-Line-Signature", createSignature(testChannelSecret, bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	res = httptest.NewRecorder()
+	webhookHandler.HandleWebhook(res, req)
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d for an oversized decompressed body, got %d", http.StatusRequestEntityTooLarge, res.Code)
+	}
+}
+
+// createPostbackWebhook creates a webhook request with a postback event, such as a rich menu tap, from a user
+func createPostbackWebhook(data string) map[string]interface{} {
+	return map[string]interface{}{
+		"events": []map[string]interface{}{
+			{
+				"type":       "postback",
+				"replyToken": "reply_postback",
+				"source": map[string]interface{}{
+					"type":   "user",
+					"userId": "user123",
+				},
+				"timestamp": time.Now().Unix() * 1000,
+				"postback":  map[string]interface{}{"data": data},
+			},
+		},
+	}
+}
+
+// TestWebhookHandlerAnswersPostbacks tests that rich menu postbacks with a known action are answered and others ignored
+func TestWebhookHandlerAnswersPostbacks(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		saved    []string
+		expected string
+	}{
+		{"stats", "action=stats", []string{"image", "image", "video"}, "2 images and 1 video"},
+		{"stats with other parameters", "menu=main&action=stats", []string{"file"}, "1 file"},
+		{"stats with nothing saved", "action=stats", nil, "No files have been saved"},
+		{"help", "action=help", nil, "Send me images"},
+		{"unknown action", "action=delete", nil, ""},
+		{"no action", "menu=main", nil, ""},
+		{"malformed data", "action=%zz", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+			defer cleanup()
+
+			webhookHandler.ApplyConfig(&config.Config{MaxWebhookBodyBytes: 1 << 20})
+			for i, messageType := range tt.saved {
+				mediaStore.saved = append(mediaStore.saved, savedMedia{MessageID: fmt.Sprint(i), MessageType: messageType, Content: []byte("content")})
+			}
+
+			if code := sendWebhook(webhookHandler, createPostbackWebhook(tt.data)); code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+			}
+
+			if tt.expected == "" {
+				if len(mockServer.repliesReceived) != 0 || len(mockServer.pushesReceived) != 0 {
+					t.Errorf("Expected the postback to be ignored, got %d replies and %d pushes",
+						len(mockServer.repliesReceived), len(mockServer.pushesReceived))
+				}
+				return
+			}
+
+			if len(mockServer.repliesReceived) != 1 {
+				t.Fatalf("Expected 1 reply, got %d", len(mockServer.repliesReceived))
+			}
+			if text := mockServer.repliesReceived[0].(*linebot.TextMessage).Text; !strings.Contains(text, tt.expected) {
+				t.Errorf("Expected the reply to contain %q, got %q", tt.expected, text)
+			}
+		})
+	}
+}
+
+// TestWithReloadableSettings tests that only settings the reload can't apply are left to report as needing a restart
+func TestWithReloadableSettings(t *testing.T) {
+	current := &config.Config{WebhookRateLimit: 60, MaxFileSizeBytes: 0, AdminToken: "old"}
+	reloaded := &config.Config{WebhookRateLimit: 120, MaxFileSizeBytes: 1024, AdminToken: "new"}
+
+	applied := handler.WithReloadableSettings(current, reloaded)
+	if applied.WebhookRateLimit != 120 {
+		t.Errorf("Expected the rate limit to be applied, got %d", applied.WebhookRateLimit)
+	}
+
+	restart := config.ChangedSettings(&applied, reloaded)
+	if strings.Join(restart, ",") != "ADMIN_TOKEN,MAX_FILE_SIZE_BYTES" {
+		t.Errorf("Expected the media and admin settings to need a restart, got %v", restart)
+	}
+}
+
+// TestWebhookHandlerPersistsEvents tests that saved events can be re-signed and replayed, and old days are pruned
+func TestWebhookHandlerPersistsEvents(t *testing.T) {
+	mockServer, webhookHandler, mediaStore, cleanup := setupWithFakeStore(t)
+	defer cleanup()
+
+	eventsDir := t.TempDir()
+	webhookHandler.ApplyConfig(&config.Config{
+		MaxWebhookBodyBytes: 1 << 20,
+		PersistEvents:       true,
+		EventsDir:           eventsDir,
+		EventsRetentionDays: 7,
+	})
+
+	// An expired day and a folder that isn't a day
+	for _, dir := range []string{"2000-01-01", "notes"} {
+		if err := os.MkdirAll(filepath.Join(eventsDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create events folder: %v", err)
+		}
+	}
+
+	mockServer.addTestContent("image123", "image/png", []byte("image bytes"))
+	if code := sendWebhook(webhookHandler, createImageMessageWebhook("image123")); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+
+	if _, err := os.Stat(filepath.Join(eventsDir, "2000-01-01")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired day to be pruned, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(eventsDir, "notes")); err != nil {
+		t.Errorf("Expected folders that aren't days to be kept: %v", err)
+	}
+
+	saved, err := filepath.Glob(filepath.Join(eventsDir, utils.GetDateString(), "*.json"))
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("Expected 1 saved event, got %v (%v)", saved, err)
+	}
+	data, err := os.ReadFile(saved[0])
+	if err != nil {
+		t.Fatalf("Failed to read saved event: %v", err)
+	}
+	var event handler.PersistedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("Failed to parse saved event: %v", err)
+	}
+
+	// The re-signed body passes verification and is processed again
+	body, signature, err := event.Resign(testChannelSecret)
+	if err != nil {
+		t.Fatalf("Failed to re-sign event: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+	req.Header.Set("X-Line-Signature", signature)
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	webhookHandler.HandleWebhook(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected the replayed event to be accepted, got %d", res.Code)
+	}
+	if files := mediaStore.savedFiles(); len(files) != 2 || files[1].MessageID != "image123" {
+		t.Errorf("Expected the replayed message to be saved again, got %+v", files)
+	}
+}